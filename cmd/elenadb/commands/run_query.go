@@ -9,14 +9,15 @@ import (
 	"github.com/urfave/cli/v2"
 )
 
-func RunQuery(_ *cli.Context, dbDir string, inputQuery string) error {
-	elena, err := database.StartElenaBusiness(dbDir)
-	defer elena.RestInPeace()
+func RunQuery(_ *cli.Context, dbDir string, inputQuery string, options ...database.ElenaOption) error {
+	elena, err := database.StartElenaBusiness(dbDir, options...)
 	if err != nil {
 		return err
 	}
+	defer elena.RestInPeace()
 	parser := query.NewParser()
-	elapsed, err := repl.ExecuteAndDisplay(elena, parser, inputQuery)
+	// A single query has no session, it's a transaction of its own
+	elapsed, err := repl.ExecuteAndDisplay(elena, nil, parser, inputQuery)
 	if err != nil {
 		fmt.Printf(
 			"\n\033[31mError:\033[0m %v"+
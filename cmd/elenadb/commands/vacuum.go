@@ -0,0 +1,37 @@
+package commands
+
+import (
+	"fisi/elenadb/pkg/database"
+	"fisi/elenadb/pkg/meta"
+	"fmt"
+	"sort"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Runs "limpia tabla" on every table of the database
+func Vacuum(_ *cli.Context, dbDir string, options ...database.ElenaOption) error {
+	elena, err := database.StartElenaBusiness(dbDir, options...)
+	if err != nil {
+		return err
+	}
+	defer elena.RestInPeace()
+
+	tables := []string{}
+	for name := range elena.Catalog.TableMetadataMap {
+		if name != meta.ELENA_META_TABLE_NAME {
+			tables = append(tables, name)
+		}
+	}
+	sort.Strings(tables)
+
+	fmt.Printf("🧹 Vacuuming database '%s'\n", dbDir)
+	for _, table := range tables {
+		stats, err := elena.Vacuum(table)
+		if err != nil {
+			return err
+		}
+		fmt.Println(stats.ToString())
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"fisi/elenadb/elena/commands"
 	"fisi/elenadb/elena/repl"
 	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/database"
 	"fisi/elenadb/pkg/utils"
 
 	"github.com/urfave/cli/v2"
@@ -16,15 +17,35 @@ func main() {
 	app := &cli.App{
 		Name:            common.Name,
 		Usage:           common.Description,
-		UsageText:       fmt.Sprintf("%s <db> [query | file.sql]", common.Name),
+		UsageText:       fmt.Sprintf("%s [--pool-size <frames>] <db> [query | file.sql]", common.Name),
 		Version:         common.Version,
 		HideHelpCommand: true,
+		Flags: []cli.Flag{
+			&cli.UintFlag{
+				Name:  "pool-size",
+				Usage: "number of pages the buffer pool keeps in memory",
+				Value: common.BufferPoolSize,
+			},
+		},
 		Commands: []*cli.Command{
 			{
 				Name:  "<db>",
 				Usage: "db directory to work with",
 				// no action, just redirect to the root command
 			},
+			{
+				Name:      "vacuum",
+				Usage:     "rewrite the tables of a db without their deleted rows",
+				ArgsUsage: "<db>",
+				Action: func(ctx *cli.Context) error {
+					dbDirectory := ctx.Args().First()
+					if dbDirectory == "" {
+						return cli.ShowSubcommandHelp(ctx)
+					}
+					poolSize := database.WithBufferPoolSize(uint32(ctx.Uint("pool-size")))
+					return commands.Vacuum(ctx, dbDirectory, poolSize)
+				},
+			},
 		},
 		Action: func(ctx *cli.Context) error {
 			dbDirectory := ctx.Args().First()
@@ -39,8 +60,10 @@ func main() {
 				return fmt.Errorf("missing database name. use --create <db>")
 			}
 
+			poolSize := database.WithBufferPoolSize(uint32(ctx.Uint("pool-size")))
+
 			if toExecute == "" {
-				return repl.StartREPL(dbDirectory)
+				return repl.StartREPL(dbDirectory, poolSize)
 			}
 
 			if utils.FileExists(toExecute) {
@@ -48,7 +71,7 @@ func main() {
 			}
 
 			if toExecute != "" {
-				return commands.RunQuery(ctx, dbDirectory, toExecute)
+				return commands.RunQuery(ctx, dbDirectory, toExecute, poolSize)
 			}
 			return nil
 		},
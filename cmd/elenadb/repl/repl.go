@@ -29,7 +29,7 @@ var (
 	history_fn = filepath.Join(os.TempDir(), HistoryFile)
 )
 
-func StartREPL(dbName string) error {
+func StartREPL(dbName string, options ...database.ElenaOption) error {
 	fmt.Printf(
 		"🚄 Elena DB v"+common.Version+"\n"+
 			"   Built Date: "+common.BirthDate+"\n\n"+
@@ -40,12 +40,14 @@ func StartREPL(dbName string) error {
 		color.YellowString("ayuda"),
 	)
 
-	elena, err := database.StartElenaBusiness(dbName)
-	defer elena.RestInPeace()
-
+	elena, err := database.StartElenaBusiness(dbName, options...)
 	if err != nil {
 		return err
 	}
+	defer elena.RestInPeace()
+	// The transaction started with "empieza" is the one of this REPL
+	session := elena.NewSession()
+	defer session.Close()
 
 	if elena.IsJustCreated {
 		fmt.Println("created db", dbName)
@@ -117,7 +119,7 @@ mainLoop:
 
 			if isEnd && symbolStack.Empty() {
 				repl.AppendHistory(strings.TrimSpace(fullInput))
-				elapsed, err := ExecuteAndDisplay(elena, parser, fullInput)
+				elapsed, err := ExecuteAndDisplay(elena, session, parser, fullInput)
 				if err != nil {
 					fmt.Printf(
 						"\n\033[31mError:\033[0m %v"+
@@ -144,6 +146,7 @@ mainLoop:
 
 func ExecuteAndDisplay(
 	elena *database.ElenaDB,
+	session *database.Session,
 	parser *query.Parser,
 	fullInput string,
 ) (*time.Duration, error) {
@@ -160,7 +163,7 @@ func ExecuteAndDisplay(
 
 	// 🚆 Database query execution!
 	start := time.Now()
-	tuples, schema, bindedQuery, plan, err := elena.ExecuteThisBaby(input, isExplain)
+	tuples, schema, bindedQuery, plan, err := elena.ExecuteThisBaby(session, input, isExplain)
 	if err != nil {
 		elapsed := time.Since(start)
 		return &elapsed, err
@@ -250,6 +253,29 @@ func displayHelp() {
    Insertar un nuevo registro
    %v
 
+   Modificar los registros que cumplan una condición
+   %v
+
+   Crear o borrar un índice sobre una columna int
+   %v
+   %v
+
+   Reescribir una tabla sin los registros borrados
+   %v
+
+   Vaciar una tabla de una vez, o borrarla con sus índices
+   %v
+   %v
+
+   Agregar, quitar o renombrar columnas de una tabla
+   %v
+   %v
+   %v
+
+   Agrupar varias consultas en una transacción, que se confirma o se deshace completa
+   %v
+   %v
+
    Añade "explica" al inicio de tu consulta para ver el plan de ejecución
    %v
 
@@ -264,6 +290,17 @@ func displayHelp() {
 		Highlight("dame todo de <tabla> pe"),
 		Highlight("dame { <atributo>, ... } de <tabla> pe"),
 		Highlight("mete { <atributo>: <valor>, ... } en <tabla> pe"),
+		Highlight("cambia en <tabla> { <atributo>: <valor>, ... } si (<condición>) pe"),
+		Highlight("creame indice en <tabla> (<atributo>, ...) pe"),
+		Highlight("borra indice <tabla>.<atributo>[.<atributo>...] pe"),
+		Highlight("limpia tabla <tabla> pe"),
+		Highlight("trunca tabla <tabla> pe"),
+		Highlight("borra tabla <tabla> pe"),
+		Highlight("cambia tabla <tabla> agrega { <atributo> <tipo>?, ... } pe"),
+		Highlight("cambia tabla <tabla> quita <atributo> pe"),
+		Highlight("cambia tabla <tabla> renombra <atributo> a <nuevo> pe"),
+		Highlight("empieza pe"),
+		Highlight("confirma pe / deshaz pe"),
 		Highlight("explicame <consulta> pe"),
 		color.YellowString("limpia"),
 		color.YellowString("ayuda"),
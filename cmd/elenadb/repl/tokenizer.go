@@ -6,12 +6,14 @@ import (
 
 var identifiers = []string{
 	"dame", "de", "donde", "pe", "ordenado", "por", "asc", "desc",
-	"creame", "tabla",
+	"creame", "tabla", "indice",
 	"mete", "en", "retornando",
 	"borra",
+	"cambia", "si", "agrega", "quita", "renombra",
 	"explicame",
 	"set",
 	"limpia",
+	"trunca",
 	"ayuda",
 	"tablas",
 }
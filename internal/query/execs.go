@@ -45,11 +45,72 @@ func parseChangeFn(qb *QueryBuilder, _ *tokens.Token) error {
     return nil
 }
 
+func parseAlterFn(qb *QueryBuilder, tk *tokens.Token) error {
+    qb.qu[len(qb.qu)-1].QueryAlterInstr = AlterInstrType(tk.Data)
+    return nil
+}
+
+func parseAlterNewNameFn(qb *QueryBuilder, tk *tokens.Token) error {
+    qb.qu[len(qb.qu)-1].QueryAlterNewName = tk.Data
+    return nil
+}
+
 func parseEraseFn(qu *QueryBuilder, _ *tokens.Token) error {
     qu.PushInstr(QueryErase)
     return nil
 }
 
+func parseTruncateFn(qb *QueryBuilder, _ *tokens.Token) error {
+    qb.PushInstr(QueryTruncate)
+    return nil
+}
+
+func parseEraseTableFn(qb *QueryBuilder, _ *tokens.Token) error {
+    qb.qu[len(qb.qu)-1].QueryTableInstr = true
+    return nil
+}
+
+func parseVacuumFn(qb *QueryBuilder, _ *tokens.Token) error {
+    qb.PushInstr(QueryVacuum)
+    return nil
+}
+
+func parseBeginFn(qb *QueryBuilder, _ *tokens.Token) error {
+    qb.PushInstr(QueryBegin)
+    return nil
+}
+
+func parseCommitFn(qb *QueryBuilder, _ *tokens.Token) error {
+    qb.PushInstr(QueryCommit)
+    return nil
+}
+
+func parseRollbackFn(qb *QueryBuilder, _ *tokens.Token) error {
+    qb.PushInstr(QueryRollback)
+    return nil
+}
+
+func parseIndexFn(qb *QueryBuilder, _ *tokens.Token) error {
+    qb.qu[len(qb.qu)-1].QueryIndexInstr = true
+    return nil
+}
+
+func parseSequenceFn(qb *QueryBuilder, _ *tokens.Token) error {
+    qb.qu[len(qb.qu)-1].QuerySequenceInstr = true
+    return nil
+}
+
+// the value before the parentheses is the name of the function, siguiente is the only one
+func parseSequenceValueFn(qb *QueryBuilder, tk *tokens.Token) error {
+    fields := qb.qu[len(qb.qu)-1].Fields
+    function, ok := fields[len(fields)-1].Value.(string)
+    if !ok || function != "siguiente" {
+        return fmt.Errorf("unknown function \"%v\", expected siguiente(<secuencia>)", fields[len(fields)-1].Value)
+    }
+    fields[len(fields)-1].Value = NextValue{Sequence: tk.Data}
+    return nil
+}
+
 func parseTableNameFn(qb *QueryBuilder, tk *tokens.Token) error {
     qb.qu[len(qb.qu)-1].QueryInstrName = tk.Data
     return nil
@@ -100,6 +161,11 @@ func parseAnnotationFn(qb *QueryBuilder, tk *tokens.Token) error {
 
 func parseValueFn(qb *QueryBuilder, tk *tokens.Token) error {
     fields := qb.qu[len(qb.qu)-1].Fields
+    // nulo without quotes is NULL, the field is left without value
+    if tk.Type == tokens.TkWord && tk.Data == "nulo" {
+        fields[len(fields)-1].Value = nil
+        return nil
+    }
     fields[len(fields)-1].Value = tk.Data
     return nil
 }
@@ -160,6 +226,14 @@ func selectorPushTokenFn(qb *QueryBuilder, tk *tokens.Token) error {
     return nil
 }
 
+func selectorPushIsNullFn(qb *QueryBuilder, _ *tokens.Token) error {
+    return qb.qu[len(qb.qu)-1].Filter.Push(&tokens.Token{Type: tokens.TkBoolOp, Data: CmpIsNull})
+}
+
+func selectorPushIsNotNullFn(qb *QueryBuilder, _ *tokens.Token) error {
+    return qb.qu[len(qb.qu)-1].Filter.Push(&tokens.Token{Type: tokens.TkBoolOp, Data: CmpIsNotNull})
+}
+
 func parseBeginStepFn(qb *QueryBuilder, tk *tokens.Token) error {
     if len(qb.qu) < 1 {
         return nil
@@ -197,6 +271,9 @@ var defaultParseFnTable map[StepType]ParseFn = map[StepType]ParseFn{
     FsmRetrieve: parseRetrieveFn,
     FsmInsertStep: parseInsertFn,
     FsmDb: parseDbFn,
+    FsmIndex: parseIndexFn,
+    FsmSequence: parseSequenceFn,
+    FsmSequenceName: parseSequenceValueFn,
     FsmTableName: parseTableNameFn,
     FsmFieldKey: parseFieldKeyFn,
     FsmFieldType: parseFieldTypeFn,
@@ -211,17 +288,31 @@ var defaultParseFnTable map[StepType]ParseFn = map[StepType]ParseFn{
     FsmRetrieveAll: parseFieldKeyFn,
     FsmReturningFieldKey: parseReturningFieldKeyFn,
     FsmSelector: parseSelectorFn,
+    FsmChangeSelector: parseSelectorFn,
     FsmSelectorOpenBranch: selectorPushTokenFn,
     FsmSelectorKey: selectorPushTokenFn,
     FsmSelectorCmp: selectorPushTokenFn,
     FsmSelectorValue: selectorPushTokenFn,
     FsmSelectorNexus: selectorPushTokenFn,
     FsmSelectorCloseBranch: selectorPushTokenFn,
+    FsmSelectorIs: selectorPushIsNullFn,
+    FsmSelectorNotIs: selectorPushIsNotNullFn,
+    FsmSelectorNull: selectorPushTokenFn,
     FsmErase: parseEraseFn,
+    FsmEraseTable: parseEraseTableFn,
+    FsmTruncate: parseTruncateFn,
     FsmOrderingKey: parseOrderingKey,
     FsmOrderingDirectionAsc: parseOrderingAsc,
     FsmOrderingDirectionDesc: parseOrderingDesc,
     FsmChange: parseChangeFn,
+    FsmAlterAdd: parseAlterFn,
+    FsmAlterDrop: parseAlterFn,
+    FsmAlterRename: parseAlterFn,
+    FsmAlterNewName: parseAlterNewNameFn,
+    FsmVacuum: parseVacuumFn,
+    FsmBegin: parseBeginFn,
+    FsmCommit: parseCommitFn,
+    FsmRollback: parseRollbackFn,
     FsmOrdering: parseOrderingAsc,
 }
 
@@ -130,6 +130,56 @@ func CompareString(field string, cmp string, value string, mapper map[string]int
     }
 }
 
+// FLAG_ESTRUCTURA: three-valued logic
+// A comparison with a NULL is neither true nor false but unknown, and so are the "y" and "o"
+// that only depend on it. A filter lets a tuple pass only when it's true.
+type Truth uint8
+
+const (
+    TruthFalse Truth = iota
+    TruthUnknown
+    TruthTrue
+)
+
+func truthOf(b bool) Truth {
+    if b {
+        return TruthTrue
+    }
+    return TruthFalse
+}
+
+// "y" is true if both are, false if any is
+func (t Truth) And(other Truth) Truth {
+    return min(t, other)
+}
+
+// "o" is true if any is, false if both are
+func (t Truth) Or(other Truth) Truth {
+    return max(t, other)
+}
+
+// The "es" and "no es" comparisons, the only ones that are never unknown
+const (
+    CmpIsNull    = "es"
+    CmpIsNotNull = "no es"
+)
+
+// Solves "<field> es nulo" and "<field> no es nulo"
+func (qf *QueryFilter) CompareNull(field string, cmp string, value string, mapper map[string]interface{}) (Truth, error) {
+    if qf.Resolver(field) == valuepkg.TypeInvalid {
+        return TruthFalse, fmt.Errorf("column \"%s\" does not exist", field)
+    }
+    if value != "nulo" {
+        return TruthFalse, fmt.Errorf("expected \"nulo\" after \"%s\", got \"%s\"", cmp, value)
+    }
+
+    isNull := mapper[field] == nil
+    if cmp == CmpIsNotNull {
+        return truthOf(!isNull), nil
+    }
+    return truthOf(isNull), nil
+}
+
 func (qf *QueryFilter) CastAndCompare(field string, cmp string, value string, mapper map[string]interface{}) (bool, error) {
     switch qf.Resolver(field) {
         case valuepkg.TypeBoolean:
@@ -195,39 +245,47 @@ func (qf *QueryFilter) Push(tk *tokens.Token) error {
     return fmt.Errorf("not enough open parentheses to close")
 }
 
-func (qf *QueryFilter) execrec(mapper map[string]interface{}) (string, bool, error) {
+func (qf *QueryFilter) execrec(mapper map[string]interface{}) (string, Truth, error) {
     tk, err := qf.Out.NdPop()
     if err != nil {
-        return "", false, err
+        return "", TruthFalse, err
     }
 
     if (tk.Type == tokens.TkWord && tk.Data != "y" && tk.Data != "o") || tk.Type == tokens.TkString {
-        return tk.Data, false, nil
+        return tk.Data, TruthFalse, nil
     }
 
-    rightstr, rightbool, rightexecerr := qf.execrec(mapper)
+    rightstr, righttruth, rightexecerr := qf.execrec(mapper)
     if rightexecerr != nil {
-        return "", false, rightexecerr
+        return "", TruthFalse, rightexecerr
     }
 
-    leftstr, leftbool, leftexecerr := qf.execrec(mapper)
+    leftstr, lefttruth, leftexecerr := qf.execrec(mapper)
     if leftexecerr != nil {
-        return "", false, leftexecerr
+        return "", TruthFalse, leftexecerr
     }
 
     switch true {
     case tk.Data == "y":
-        return "", (leftbool && rightbool), nil
+        return "", lefttruth.And(righttruth), nil
     case tk.Data == "o":
-        return "", (leftbool || rightbool), nil
+        return "", lefttruth.Or(righttruth), nil
+    case tk.Data == CmpIsNull || tk.Data == CmpIsNotNull:
+        nullTruth, nullErr := qf.CompareNull(leftstr, tk.Data, rightstr, mapper)
+        return "", nullTruth, nullErr
+    }
+
+    // NULL compared with anything is unknown, even with another NULL
+    if fieldValue, ok := mapper[leftstr]; ok && fieldValue == nil {
+        return "", TruthUnknown, nil
     }
 
     cmpBool, cmpErr := qf.CastAndCompare(leftstr, tk.Data, rightstr, mapper)
     if cmpErr != nil {
-        return "", false, cmpErr
+        return "", TruthFalse, cmpErr
     }
 
-    return "", cmpBool, nil
+    return "", truthOf(cmpBool), nil
 }
 
 func (qf *QueryFilter) Load() (error) {
@@ -247,10 +305,77 @@ func (qf *QueryFilter) Load() (error) {
     return nil
 }
 
+// Whether the tuple passes the filter. mapper has the values of the tuple by column, nil for
+// the NULLs
 func (qf *QueryFilter) Exec(mapper map[string]interface{}) (bool, error) {
-    _, execbool, execerr := qf.execrec(mapper)
+    _, exectruth, execerr := qf.execrec(mapper)
     qf.Out.ResetAux()
-    return execbool, execerr
+    return exectruth == TruthTrue, execerr
+}
+
+
+// A single "<column> <cmp> <value>" comparison found in a filter
+type FilterPredicate struct {
+    Field string
+    Cmp   string
+    Value string
 }
 
+type filterNode struct {
+    tk    tokens.Token
+    left  *filterNode
+    right *filterNode
+}
 
+// Returns the comparisons that must hold for the whole filter to be true, i.e. the ones
+// joined to the root of the expression only by "y". Comparisons below an "o" are left out
+// since they don't restrict the result on their own. Used by the planner to pick indexes.
+func (qf *QueryFilter) Conjuncts() []FilterPredicate {
+    if qf.Out == nil {
+        return nil
+    }
+
+    // GetAll walks the stack from the top, so the postfix expression is reversed
+    all := qf.Out.GetAll()
+    nodes := make([]*filterNode, 0, len(all))
+
+    for i := len(all) - 1; i >= 0; i-- {
+        tk := all[i]
+        if (tk.Type == tokens.TkWord && tk.Data != "y" && tk.Data != "o") || tk.Type == tokens.TkString {
+            nodes = append(nodes, &filterNode{tk: tk})
+            continue
+        }
+
+        if len(nodes) < 2 {
+            return nil
+        }
+        right, left := nodes[len(nodes)-1], nodes[len(nodes)-2]
+        nodes = append(nodes[:len(nodes)-2], &filterNode{tk: tk, left: left, right: right})
+    }
+
+    if len(nodes) != 1 {
+        return nil
+    }
+
+    return collectConjuncts(nodes[0])
+}
+
+func collectConjuncts(node *filterNode) []FilterPredicate {
+    if node == nil || node.left == nil || node.right == nil {
+        return nil
+    }
+
+    if node.tk.Data == "y" {
+        return append(collectConjuncts(node.left), collectConjuncts(node.right)...)
+    }
+
+    if node.tk.Data == "o" || node.left.left != nil || node.right.left != nil {
+        return nil
+    }
+
+    return []FilterPredicate{{
+        Field: node.left.tk.Data,
+        Cmp:   node.tk.Data,
+        Value: node.right.tk.Data,
+    }}
+}
@@ -31,27 +31,27 @@ func TestExec(t *testing.T) {
 		{
 			query: `(id >= 5)`,
 			mapper: map[string]interface{}{
-				"id":     32,
+				"id":     int32(32),
 				"name":   "ramirez",
-				"loqsea": 6.0,
+				"loqsea": float32(6.0),
 			},
 			expect: true,
 		},
 		{
 			query: "(id >= 5 y loqsea == 6) o name <= ramirez",
 			mapper: map[string]interface{}{
-				"id":     0,
+				"id":     int32(0),
 				"name":   "pamirez",
-				"loqsea": 50.0,
+				"loqsea": float32(50.0),
 			},
 			expect: true,
 		},
 		{
 			query: "(id >= 5 y loqsea == 5) o (name == ramirez y isGerencial == true)",
 			mapper: map[string]interface{}{
-				"id":          0,
+				"id":          int32(0),
 				"name":        "hola",
-				"loqsea":      4.0,
+				"loqsea":      float32(4.0),
 				"isGerencial": true,
 			},
 			expect: false,
@@ -94,3 +94,115 @@ func TestExec(t *testing.T) {
 		t.Logf("result on %s is correct: expected %v got %v", tests[index].query, tests[index].expect, resCmp)
 	}
 }
+
+func TestConjuncts(t *testing.T) {
+	tests := []struct {
+		query  string
+		expect []query.FilterPredicate
+	}{
+		{
+			query:  "(id == 5)",
+			expect: []query.FilterPredicate{{Field: "id", Cmp: "==", Value: "5"}},
+		},
+		{
+			query: "(id >= 5 y id < 10 y name == ramirez)",
+			expect: []query.FilterPredicate{
+				{Field: "id", Cmp: ">=", Value: "5"},
+				{Field: "id", Cmp: "<", Value: "10"},
+				{Field: "name", Cmp: "==", Value: "ramirez"},
+			},
+		},
+		{
+			query:  "(id >= 5 y loqsea == 6) o name <= ramirez",
+			expect: []query.FilterPredicate{},
+		},
+		{
+			query:  "(id == 5 o id == 6) y loqsea > 1",
+			expect: []query.FilterPredicate{{Field: "loqsea", Cmp: ">", Value: "1"}},
+		},
+	}
+
+	for _, test := range tests {
+		filter := query.NewQueryFilter()
+		tks, err := tokens.Tokenize(bufio.NewReader(strings.NewReader(test.query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for {
+			tk, err := tks.Next()
+			if err != nil {
+				break
+			}
+			filter.Push(&tk)
+		}
+
+		if err := filter.Load(); err != nil {
+			t.Fatal(err)
+		}
+
+		got := filter.Conjuncts()
+		if len(got) != len(test.expect) {
+			t.Fatalf("conjuncts of %s: expected %v got %v", test.query, test.expect, got)
+		}
+		for i := range got {
+			if got[i] != test.expect[i] {
+				t.Fatalf("conjuncts of %s: expected %v got %v", test.query, test.expect, got)
+			}
+		}
+	}
+}
+
+func TestNullPredicates(t *testing.T) {
+	resolver := func(field string) value.ValueType {
+		switch field {
+		case "id":
+			return value.TypeInt32
+		case "name":
+			return value.TypeVarChar
+		default:
+			return value.TypeInvalid
+		}
+	}
+	withNull := map[string]interface{}{"id": int32(5), "name": nil}
+	withName := map[string]interface{}{"id": int32(5), "name": "ramirez"}
+
+	tests := []struct {
+		filter string
+		mapper map[string]interface{}
+		expect bool
+	}{
+		{"(name es nulo)", withNull, true},
+		{"(name es nulo)", withName, false},
+		{"(name no es nulo)", withNull, false},
+		{"(name no es nulo y id == 5)", withName, true},
+		// Comparisons with NULL are unknown, so neither they nor their opposite pass
+		{"(name == ramirez)", withNull, false},
+		{"(name != ramirez)", withNull, false},
+		// Unknown and false is false, unknown or true is true
+		{"(name == ramirez y id == 5)", withNull, false},
+		{"(name == ramirez o id == 5)", withNull, true},
+		{"(name != ramirez o name es nulo)", withNull, true},
+	}
+
+	for _, test := range tests {
+		statements, err := query.NewParser().Parse(strings.NewReader("dame todo de users donde " + test.filter + " pe"))
+		if err != nil {
+			t.Fatalf("%s: %v", test.filter, err)
+		}
+		filter := statements[0].Filter
+		filter.Resolver = resolver
+
+		got, err := filter.Exec(test.mapper)
+		if err != nil {
+			t.Fatalf("%s: %v", test.filter, err)
+		}
+		if got != test.expect {
+			t.Fatalf("result on %s with %v is wrong: expected %v got %v", test.filter, test.mapper, test.expect, got)
+		}
+	}
+
+	if _, err := query.NewParser().Parse(strings.NewReader("dame todo de users donde (name es 5) pe")); err == nil {
+		t.Fatal("expected \"es\" to only take nulo")
+	}
+}
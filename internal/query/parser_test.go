@@ -116,3 +116,223 @@ func TestOrderingBy(t *testing.T) {
 }
 
 
+
+func TestParsingCambia(t *testing.T) {
+	input := "cambia en users { nombre: \"otro nombre\", edad: 20 } si (id == 10) pe"
+
+	parser := query.NewParser()
+	results, err := parser.Parse(strings.NewReader(input))
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	result := results[0]
+	if result.QueryType != query.QueryUpdate {
+		t.Fatalf("unexpected query type: %s", result.QueryType)
+	}
+
+	assert.Equal(t, "users", result.QueryInstrName)
+	assert.Equal(t, 2, len(result.Fields))
+	assert.Equal(t, "nombre", result.Fields[0].Name)
+	assert.Equal(t, "otro nombre", result.Fields[0].Value)
+	assert.Equal(t, "edad", result.Fields[1].Name)
+	assert.Equal(t, "20", result.Fields[1].Value)
+	assert.NotNil(t, result.Filter)
+}
+
+func TestParsingIndexDDL(t *testing.T) {
+	parser := query.NewParser()
+	results, err := parser.Parse(strings.NewReader("creame indice en users (edad) pe"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	result := results[0]
+	assert.Equal(t, query.QueryCreate, result.QueryType)
+	assert.True(t, result.QueryIndexInstr)
+	assert.Equal(t, "users", result.QueryInstrName)
+	assert.Equal(t, 1, len(result.Fields))
+	assert.Equal(t, "edad", result.Fields[0].Name)
+
+	results, err = parser.Parse(strings.NewReader("borra indice users.edad pe"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	result = results[0]
+	assert.Equal(t, query.QueryErase, result.QueryType)
+	assert.True(t, result.QueryIndexInstr)
+	assert.Equal(t, "users.edad", result.QueryInstrName)
+
+	// several columns, with or without their types
+	results, err = parser.Parse(strings.NewReader("creame indice en users (codigo char(8), edad int, activo) pe"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	result = results[0]
+	assert.True(t, result.QueryIndexInstr)
+	assert.Equal(t, 3, len(result.Fields))
+	assert.Equal(t, "codigo", result.Fields[0].Name)
+	assert.Equal(t, value.TypeVarChar, result.Fields[0].Type)
+	assert.Equal(t, uint8(8), result.Fields[0].Length)
+	assert.Equal(t, "edad", result.Fields[1].Name)
+	assert.Equal(t, value.TypeInt32, result.Fields[1].Type)
+	assert.Equal(t, "activo", result.Fields[2].Name)
+	assert.Equal(t, "creame indice en users (codigo char(8), edad int, activo) pe", result.AsQueryText())
+
+	for _, bad := range []string{
+		"creame indice en users () pe",
+		"creame indice en users (edad,) pe",
+		"creame indice en users (edad int int) pe",
+		"creame indice en users (codigo char) pe",
+	} {
+		if _, err := parser.Parse(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected an error for \"%s\"", bad)
+		}
+	}
+}
+
+func TestParsingVacuum(t *testing.T) {
+	parser := query.NewParser()
+	results, err := parser.Parse(strings.NewReader("limpia tabla users pe"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	result := results[0]
+	assert.Equal(t, query.QueryVacuum, result.QueryType)
+	assert.Equal(t, "users", result.QueryInstrName)
+
+	for _, bad := range []string{
+		"limpia users pe",
+		"limpia tabla pe",
+		"limpia tabla users donde (id == 1) pe",
+	} {
+		if _, err := parser.Parse(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected an error for \"%s\"", bad)
+		}
+	}
+}
+
+func TestParsingDropAndTruncateTable(t *testing.T) {
+	parser := query.NewParser()
+	results, err := parser.Parse(strings.NewReader("borra tabla users pe trunca tabla users pe"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	assert.Equal(t, query.QueryErase, results[0].QueryType)
+	assert.True(t, results[0].QueryTableInstr)
+	assert.Equal(t, "users", results[0].QueryInstrName)
+	assert.Equal(t, query.QueryTruncate, results[1].QueryType)
+	assert.Equal(t, "users", results[1].QueryInstrName)
+
+	for _, bad := range []string{
+		"borra tabla pe",
+		"trunca users pe",
+		"trunca tabla users donde (id == 1) pe",
+	} {
+		if _, err := parser.Parse(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected an error for \"%s\"", bad)
+		}
+	}
+}
+
+func TestParsingAlterTable(t *testing.T) {
+	parser := query.NewParser()
+	results, err := parser.Parse(strings.NewReader(
+		"cambia tabla users agrega { edad int?, tutor fkey(users.id)? @cascada, apodo char(10)?, } pe " +
+			"cambia tabla users quita edad pe " +
+			"cambia tabla users renombra apodo a alias pe",
+	))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	add := results[0]
+	assert.Equal(t, query.QueryUpdate, add.QueryType)
+	assert.Equal(t, query.AlterAdd, add.QueryAlterInstr)
+	assert.Equal(t, "users", add.QueryInstrName)
+	assert.Equal(t, 3, len(add.Fields))
+	assert.Equal(t, "edad int?", add.Fields[0].AsString())
+	assert.Equal(t, "tutor fkey(users.id)? @cascada", add.Fields[1].AsString())
+	assert.Equal(t, "apodo char(10)?", add.Fields[2].AsString())
+
+	assert.Equal(t, query.AlterDrop, results[1].QueryAlterInstr)
+	assert.Equal(t, "edad", results[1].Fields[0].Name)
+
+	assert.Equal(t, query.AlterRename, results[2].QueryAlterInstr)
+	assert.Equal(t, "apodo", results[2].Fields[0].Name)
+	assert.Equal(t, "alias", results[2].QueryAlterNewName)
+
+	for _, bad := range []string{
+		"cambia tabla users pe",
+		"cambia tabla users agrega edad int pe",
+		"cambia tabla users quita pe",
+		"cambia tabla users renombra apodo pe",
+		"cambia tabla users renombra apodo a pe",
+	} {
+		if _, err := parser.Parse(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected an error for \"%s\"", bad)
+		}
+	}
+}
+
+func TestParsingTransactions(t *testing.T) {
+	parser := query.NewParser()
+	results, err := parser.Parse(strings.NewReader(
+		"empieza pe mete { name: \"elena\" } en users pe confirma pe empieza pe deshaz pe",
+	))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	assert.Equal(t, 5, len(results))
+	assert.Equal(t, query.QueryBegin, results[0].QueryType)
+	assert.Equal(t, query.QueryInsert, results[1].QueryType)
+	assert.Equal(t, query.QueryCommit, results[2].QueryType)
+	assert.Equal(t, query.QueryBegin, results[3].QueryType)
+	assert.Equal(t, query.QueryRollback, results[4].QueryType)
+
+	for _, bad := range []string{
+		"empieza",
+		"empieza users pe",
+		"confirma todo pe",
+		"deshaz de users pe",
+	} {
+		if _, err := parser.Parse(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected an error for \"%s\"", bad)
+		}
+	}
+}
+
+func TestParsingSequences(t *testing.T) {
+	parser := query.NewParser()
+	results, err := parser.Parse(strings.NewReader(
+		"creame secuencia codigos pe mete { codigo: siguiente(codigos), nombre: \"elena\" } en users pe",
+	))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, query.QueryCreate, results[0].QueryType)
+	assert.True(t, results[0].QuerySequenceInstr)
+	assert.Equal(t, "codigos", results[0].QueryInstrName)
+	assert.Equal(t, "creame secuencia codigos pe", results[0].AsQueryText())
+	assert.Equal(t, query.NextValue{Sequence: "codigos"}, results[1].Fields[0].Value)
+	assert.Equal(t, "elena", results[1].Fields[1].Value)
+
+	for _, bad := range []string{
+		"creame secuencia pe",
+		"mete { codigo: proximo(codigos) } en users pe",
+		"mete { codigo: siguiente() } en users pe",
+		"cambia en users { codigo: siguiente(codigos) } si (id == 1) pe",
+	} {
+		if _, err := parser.Parse(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected an error for \"%s\"", bad)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fisi/elenadb/pkg/catalog/column"
 	"fisi/elenadb/pkg/catalog/schema"
 	"fisi/elenadb/pkg/storage/table/value"
+	"fmt"
 	"strconv"
 	"strings"
 )
@@ -16,6 +17,11 @@ const (
 	QueryInsert   QueryInstrType = "mete"
 	QueryErase    QueryInstrType = "borra"
 	QueryUpdate   QueryInstrType = "cambia"
+	QueryVacuum   QueryInstrType = "limpia"
+	QueryTruncate QueryInstrType = "trunca"
+	QueryBegin    QueryInstrType = "empieza"
+	QueryCommit   QueryInstrType = "confirma"
+	QueryRollback QueryInstrType = "deshaz"
 )
 
 type QueryFieldAnnotation string
@@ -23,8 +29,25 @@ type QueryFieldAnnotation string
 const (
 	AnnotationId     QueryFieldAnnotation = "id"
 	AnnotationUnique QueryFieldAnnotation = "unique"
+	// only for fkey columns, deleting the referenced row deletes the rows referencing it
+	AnnotationCascade QueryFieldAnnotation = "cascada"
 )
 
+// What "cambia tabla" does to the columns of the table
+type AlterInstrType string
+
+const (
+	AlterAdd    AlterInstrType = "agrega"
+	AlterDrop   AlterInstrType = "quita"
+	AlterRename AlterInstrType = "renombra"
+)
+
+// Value of a field given as siguiente(<secuencia>). It's replaced by the next value of the
+// sequence when the statement runs
+type NextValue struct {
+	Sequence string
+}
+
 type QueryField struct {
 	Foreign     bool
 	Name        string
@@ -37,14 +60,26 @@ type QueryField struct {
 }
 
 type Query struct {
-	QueryType      QueryInstrType
-	QueryInstrName string
-	QueryDbInstr   bool
-	Fields         []QueryField
-	Filter         *QueryFilter `json:"-"`
-	Returning      []string
+	QueryType       QueryInstrType
+	QueryInstrName  string
+	QueryDbInstr    bool
+	// "creame indice" and "borra indice". When creating, QueryInstrName is the table and
+	// the indexed columns are the fields, in key order. When dropping, it's the index name
+	QueryIndexInstr bool
+	// "creame secuencia", QueryInstrName is the name of the sequence
+	QuerySequenceInstr bool
+	// "borra tabla", QueryInstrName is the table
+	QueryTableInstr bool
+	// "cambia tabla", QueryInstrName is the table. The columns added by "agrega" are the
+	// fields, "quita" and "renombra" have their column as the only field
+	QueryAlterInstr AlterInstrType
+	// "renombra", the new name of the column
+	QueryAlterNewName string
+	Fields          []QueryField
+	Filter          *QueryFilter `json:"-"`
+	Returning       []string
     OrderedBy      *string
-	IsAscending    bool
+	IsAscending     bool
 }
 
 // WARNING: This function may lose information if your query is one of: ["meta", "borra", "cambia"]
@@ -61,13 +96,15 @@ func (q *Query) GetSchema() *schema.Schema {
 
 	for _, f := range q.Fields {
 		cols = append(cols, column.Column{
-			ColumnName:  f.Name,
-			ColumnType:  f.Type,
-			StorageSize: f.Length,
-			IsUnique:    f.HasAnnotation(AnnotationUnique),
-			IsNullable:  f.Nullable,
-			IsForeign:   f.Foreign,
-			IsIdentity:  f.HasAnnotation(AnnotationId),
+			ColumnName:      f.Name,
+			ColumnType:      f.Type,
+			StorageSize:     f.Length,
+			IsUnique:        f.HasAnnotation(AnnotationUnique),
+			IsNullable:      f.Nullable,
+			IsForeign:       f.Foreign,
+			IsIdentity:      f.HasAnnotation(AnnotationId),
+			ForeignPath:     f.ForeignPath,
+			OnDeleteCascade: f.HasAnnotation(AnnotationCascade),
 		})
 	}
 	return schema.NewSchema(cols)
@@ -82,11 +119,10 @@ func (qf *QueryField) HasAnnotation(annotation QueryFieldAnnotation) bool {
 	return false
 }
 
+// A nil Value is NULL: the user wrote nulo, or left out a nullable column in "mete"
 func (qf *QueryField) AsTupleValue() *value.Value {
 	if qf.Value == nil {
-		// We assert this as nil because AsTupleValue should only be called in
-		// queries that define a value for its fields, like "mete"
-		panic("unreachable: AsTupleValue() called on nil value: " + qf.Name)
+		return qf.AsNullRepresentation()
 	}
 
 	var newValue value.Value
@@ -106,72 +142,30 @@ func (qf *QueryField) AsTupleValue() *value.Value {
 	return &newValue
 }
 
-func (qf *QueryField) AsTupleValueNillable() *value.Value {
-	var newValue value.Value
-	switch qf.Type {
-	case value.TypeInt32:
-		if qf.Value == nil {
-			newValue = *value.NewInt32Value(0)
-		} else {
-			newValue = *value.NewInt32Value(qf.Value.(int32))
-		}
-	case value.TypeFloat32:
-		if qf.Value == nil {
-			newValue = *value.NewFloat32Value(0)
-		} else {
-			newValue = *value.NewFloat32Value(qf.Value.(float32))
-		}
-	case value.TypeVarChar:
-		if qf.Value == nil {
-			newValue = *value.NewVarCharValue("", int(qf.Length))
-		} else {
-			// we strip the first and last character because they are quotes
-			newValue = *value.NewVarCharValue(qf.Value.(string), int(qf.Length))
-		}
-	case value.TypeBoolean:
-		if qf.Value == nil {
-			newValue = *value.NewBooleanValue(false)
-		} else {
-			newValue = *value.NewBooleanValue(qf.Value.(bool))
-		}
-	default:
-		panic("unreachable: unknown type")
-	}
-	return &newValue
-}
-
-// There is no concept of null for us. We just choose a reasonable default value
+// NULL of the field type, it takes no bytes in the tuple besides its bit in the null bitmap
 func (qf *QueryField) AsNullRepresentation() *value.Value {
-	var newValue value.Value
-	switch qf.Type {
-	case value.TypeInt32:
-		newValue = *value.NewInt32Value(0)
-	case value.TypeFloat32:
-		newValue = *value.NewFloat32Value(0)
-	case value.TypeVarChar:
-		newValue = *value.NewVarCharValue("", 0)
-	case value.TypeBoolean:
-		newValue = *value.NewBooleanValue(false)
-	default:
-		panic("unreachable: unknown type")
-	}
-	return &newValue
+	return value.NewNullValue(qf.Type)
 }
 
-
 func (qf *QueryField) AsString() string {
 	builder := strings.Builder{}
 	builder.WriteString(qf.Name)
 	builder.WriteString(" ")
 
-	switch qf.Type {
-	case value.TypeBoolean:
+	// the type of a foreign column is the one of the column it references, it's resolved
+	// again when the table is bound
+	switch {
+	case qf.Foreign:
+		builder.WriteString("fkey(")
+		builder.WriteString(qf.ForeignPath)
+		builder.WriteString(")")
+	case qf.Type == value.TypeBoolean:
 		builder.WriteString("bool")
-	case value.TypeInt32:
+	case qf.Type == value.TypeInt32:
 		builder.WriteString("int")
-	case value.TypeFloat32:
+	case qf.Type == value.TypeFloat32:
 		builder.WriteString("float")
-	case value.TypeVarChar:
+	case qf.Type == value.TypeVarChar:
 		builder.WriteString("char(")
 		// uint8 to string
 		conv := strconv.Itoa(int(qf.Length))
@@ -198,6 +192,23 @@ func (q *Query) AsQueryText() string {
 		panic("unreachable: AsQueryText() should be only used for 'creame' queries")
 	}
 
+	if q.QuerySequenceInstr {
+		return fmt.Sprintf("creame secuencia %s pe", q.QueryInstrName)
+	}
+
+	// the types of the columns are kept once they are bound, they are the key schema
+	if q.QueryIndexInstr {
+		columns := make([]string, 0, len(q.Fields))
+		for _, f := range q.Fields {
+			if f.Type == "" {
+				columns = append(columns, f.Name)
+			} else {
+				columns = append(columns, f.AsString())
+			}
+		}
+		return fmt.Sprintf("creame indice en %s (%s) pe", q.QueryInstrName, strings.Join(columns, ", "))
+	}
+
 	builder := strings.Builder{}
 	builder.WriteString("creame tabla ")
 	builder.WriteString(q.QueryInstrName)
@@ -210,8 +221,9 @@ func (q *Query) AsQueryText() string {
 	return builder.String()
 }
 
+// NULL is not equal to anything, not even to another NULL
 func (qf *QueryField) IsEqualToValue(val *value.Value) bool {
-	if qf.Value == nil {
+	if qf.Value == nil || val.IsNull() {
 		return false
 	}
 
@@ -51,6 +51,13 @@ const (
 
     FsmChange
     FsmChangeAt
+    FsmChangeSelector
+
+    FsmAlterAdd
+    FsmAlterDrop
+    FsmAlterRename
+    FsmAlterTo
+    FsmAlterNewName
 
     FsmInsertStep
     FsmInsertAt
@@ -62,9 +69,28 @@ const (
     FsmSelectorCmp
     FsmSelectorValue
     FsmSelectorNexus
+    FsmSelectorNot
+    FsmSelectorIs
+    FsmSelectorNotIs
+    FsmSelectorNull
 
     FsmErase
     FsmEraseFrom
+    FsmEraseTable
+
+    FsmTruncate
+
+    FsmIndex
+    FsmIndexOn
+
+    FsmSequence
+    FsmSequenceName
+
+    FsmVacuum
+
+    FsmBegin
+    FsmCommit
+    FsmRollback
 )
 
 
@@ -243,6 +269,27 @@ func defaultParseFsm() *FsmNode {
         Children: map[StepType]*FsmNode{},
     }
 
+    // "<key> es nulo" and "<key> no es nulo"
+    selectorNot := &FsmNode{
+        ExpectedString: "no",
+        Children: map[StepType]*FsmNode{},
+    }
+
+    selectorIs := &FsmNode{
+        ExpectedString: "es",
+        Children: map[StepType]*FsmNode{},
+    }
+
+    selectorNotIs := &FsmNode{
+        ExpectedString: "es",
+        Children: map[StepType]*FsmNode{},
+    }
+
+    selectorNull := &FsmNode{
+        ExpectedString: "nulo",
+        Children: map[StepType]*FsmNode{},
+    }
+
     selector.AddRule(selectorOpenBranch, FsmSelectorOpenBranch)
     selector.AddRule(selectorKey, FsmSelectorKey)
 
@@ -250,6 +297,15 @@ func defaultParseFsm() *FsmNode {
     selectorOpenBranch.AddRule(selectorKey, FsmSelectorKey)
 
     selectorKey.AddRule(selectorCmp, FsmSelectorCmp)
+    selectorKey.AddRule(selectorIs, FsmSelectorIs)
+    selectorKey.AddRule(selectorNot, FsmSelectorNot)
+
+    selectorNot.AddRule(selectorNotIs, FsmSelectorNotIs)
+    selectorIs.AddRule(selectorNull, FsmSelectorNull)
+    selectorNotIs.AddRule(selectorNull, FsmSelectorNull)
+
+    selectorNull.AddRule(selectorCloseBranch, FsmSelectorCloseBranch)
+    selectorNull.AddRule(selectorNexus, FsmSelectorNexus)
 
     selectorCmp.AddRule(selectorValue, FsmSelectorValue)
 
@@ -412,6 +468,125 @@ func defaultParseFsm() *FsmNode {
     AddRule(createTableAnnotation, FsmCreate, FsmTable, FsmTableName, FsmOpenList, FsmFieldKey, FsmFieldFkey, FsmOpenSelector, FsmFieldFkeyPath, FsmCloseSelector, FsmFieldAnnotation).
     AddRule(createTableEos, FsmCreate, FsmTable, FsmTableName, FsmOpenList, FsmFieldKey, FsmFieldFkey, FsmOpenSelector, FsmFieldFkeyPath, FsmCloseSelector, FsmEos)
 
+    // fsm creame secuencia-specific rules: creame secuencia <nombre> pe
+    beginStep.
+    AddRule(&FsmNode{
+        ExpectedString: "secuencia",
+    }, FsmCreate, FsmSequence).
+    AddRule(&FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+        },
+        ExpectedString: "",
+    }, FsmCreate, FsmSequence, FsmTableName).
+    AddRule(beginStep, FsmCreate, FsmSequence, FsmTableName, FsmBeginStep)
+
+    // fsm creame indice-specific rules
+    indexFieldKey := &FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+        },
+        ExpectedString: "",
+        Children: map[StepType]*FsmNode{},
+    }
+
+    indexFieldType := &FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+        },
+        Children: map[StepType]*FsmNode{},
+    }
+
+    indexFieldCompositeType := &FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+        },
+        Children: map[StepType]*FsmNode{},
+    }
+
+    indexTypeOpenSelector := &FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkParenOpen,
+        },
+        Children: map[StepType]*FsmNode{},
+    }
+
+    indexTypeLength := &FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+        },
+        ExpectedString: "",
+        Children: map[StepType]*FsmNode{},
+    }
+
+    indexTypeCloseSelector := &FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkParenClosed,
+        },
+        Children: map[StepType]*FsmNode{},
+    }
+
+    indexListSeparator := &FsmNode{
+        ExpectedString: ",",
+        Children: map[StepType]*FsmNode{},
+    }
+
+    indexCloseList := &FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkParenClosed,
+        },
+        Children: map[StepType]*FsmNode{},
+    }
+
+    beginStep.
+    AddRule(&FsmNode{
+        ExpectedString: "indice",
+    }, FsmCreate, FsmIndex).
+    AddRule(&FsmNode{
+        ExpectedString: "en",
+    }, FsmCreate, FsmIndex, FsmIndexOn).
+    AddRule(&FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+        },
+        ExpectedString: "",
+    }, FsmCreate, FsmIndex, FsmIndexOn, FsmTableName).
+    AddRule(&FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkParenOpen,
+        },
+    }, FsmCreate, FsmIndex, FsmIndexOn, FsmTableName, FsmOpenSelector).
+    AddRule(indexFieldKey, FsmCreate, FsmIndex, FsmIndexOn, FsmTableName, FsmOpenSelector, FsmFieldKey)
+
+    // the indexed columns may carry their type, it's how the key schema is stored in
+    // elena_meta: "creame indice en t (a int, b char(8)) pe"
+    indexFieldKey.AddRule(indexFieldType, FsmFieldType)
+    indexFieldKey.AddRule(indexFieldCompositeType, FsmFieldCompositeType)
+    indexFieldKey.AddRule(indexListSeparator, FsmListSeparator)
+    indexFieldKey.AddRule(indexCloseList, FsmCloseSelector)
+
+    indexFieldType.AddRule(indexListSeparator, FsmListSeparator)
+    indexFieldType.AddRule(indexCloseList, FsmCloseSelector)
+
+    indexFieldCompositeType.AddRule(indexTypeOpenSelector, FsmOpenSelector)
+    indexTypeOpenSelector.AddRule(indexTypeLength, FsmNumber)
+    indexTypeLength.AddRule(indexTypeCloseSelector, FsmCloseSelector)
+    indexTypeCloseSelector.AddRule(indexListSeparator, FsmListSeparator)
+    indexTypeCloseSelector.AddRule(indexCloseList, FsmCloseSelector)
+
+    indexListSeparator.AddRule(indexFieldKey, FsmFieldKey)
+    indexCloseList.AddRule(beginStep, FsmBeginStep)
+
     // fsm dame-specific rules
     retrieve := &FsmNode{
         ExpectedString: "dame",
@@ -532,6 +707,12 @@ func defaultParseFsm() *FsmNode {
         ExpectedString: "{",
     }
 
+    // "cambia" filters are introduced by "si" (although "donde" works too)
+    changeSelector := &FsmNode{
+        ExpectedString: "si",
+        Children: selector.Children,
+    }
+
     changeFieldKey := &FsmNode{
         ExpectByTypes: true,
         ExpectedTypes: []tokens.TkType{
@@ -572,7 +753,66 @@ func defaultParseFsm() *FsmNode {
     AddRule(changeSeparator, FsmChange, FsmChangeAt, FsmTableName, FsmOpenList, FsmFieldKey, FsmValueAssign, FsmFieldValue, FsmListSeparator).
     AddRule(changeFieldKey, FsmChange, FsmChangeAt, FsmTableName, FsmOpenList, FsmFieldKey, FsmValueAssign, FsmFieldValue, FsmListSeparator, FsmFieldKey).
     AddRule(changeCloseList, FsmChange, FsmChangeAt, FsmTableName, FsmOpenList, FsmFieldKey, FsmValueAssign, FsmFieldValue, FsmCloseList).
-    AddRule(selector, FsmChange, FsmChangeAt, FsmTableName, FsmOpenList, FsmFieldKey, FsmValueAssign, FsmFieldValue, FsmCloseList, FsmSelector)
+    AddRule(selector, FsmChange, FsmChangeAt, FsmTableName, FsmOpenList, FsmFieldKey, FsmValueAssign, FsmFieldValue, FsmCloseList, FsmSelector).
+    AddRule(changeSelector, FsmChange, FsmChangeAt, FsmTableName, FsmOpenList, FsmFieldKey, FsmValueAssign, FsmFieldValue, FsmCloseList, FsmChangeSelector)
+
+    // fsm cambia tabla-specific rules: the columns of "agrega" are written like the ones of
+    // "creame tabla", so they share its nodes
+    alterColumn := &FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+        },
+        ExpectedString: "",
+    }
+
+    beginStep.
+    AddRule(&FsmNode{
+        ExpectedString: "tabla",
+    }, FsmChange, FsmTable).
+    AddRule(&FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+        },
+        ExpectedString: "",
+    }, FsmChange, FsmTable, FsmTableName).
+    // cambia tabla <tabla> agrega { <columna> <tipo>, ... } pe
+    AddRule(&FsmNode{
+        ExpectedString: "agrega",
+    }, FsmChange, FsmTable, FsmTableName, FsmAlterAdd).
+    AddRule(&FsmNode{
+        ExpectedString: "{",
+    }, FsmChange, FsmTable, FsmTableName, FsmAlterAdd, FsmOpenList).
+    AddRule(createTableFieldKey, FsmChange, FsmTable, FsmTableName, FsmAlterAdd, FsmOpenList, FsmFieldKey).
+    // cambia tabla <tabla> quita <columna> pe
+    AddRule(&FsmNode{
+        ExpectedString: "quita",
+    }, FsmChange, FsmTable, FsmTableName, FsmAlterDrop).
+    AddRule(alterColumn, FsmChange, FsmTable, FsmTableName, FsmAlterDrop, FsmFieldKey).
+    AddRule(beginStep, FsmChange, FsmTable, FsmTableName, FsmAlterDrop, FsmFieldKey, FsmBeginStep).
+    // cambia tabla <tabla> renombra <columna> a <nuevo nombre> pe
+    AddRule(&FsmNode{
+        ExpectedString: "renombra",
+    }, FsmChange, FsmTable, FsmTableName, FsmAlterRename).
+    AddRule(&FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+        },
+        ExpectedString: "",
+    }, FsmChange, FsmTable, FsmTableName, FsmAlterRename, FsmFieldKey).
+    AddRule(&FsmNode{
+        ExpectedString: "a",
+    }, FsmChange, FsmTable, FsmTableName, FsmAlterRename, FsmFieldKey, FsmAlterTo).
+    AddRule(&FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+        },
+        ExpectedString: "",
+    }, FsmChange, FsmTable, FsmTableName, FsmAlterRename, FsmFieldKey, FsmAlterTo, FsmAlterNewName).
+    AddRule(beginStep, FsmChange, FsmTable, FsmTableName, FsmAlterRename, FsmFieldKey, FsmAlterTo, FsmAlterNewName, FsmBeginStep)
 
     // fsm borra-specific rules
     erase := &FsmNode{
@@ -598,7 +838,80 @@ func defaultParseFsm() *FsmNode {
     AddRule(erase, FsmErase).
     AddRule(eraseFrom, FsmErase, FsmEraseFrom).
     AddRule(eraseTableName, FsmErase, FsmEraseFrom, FsmTableName).
-    AddRule(selector, FsmErase, FsmEraseFrom, FsmTableName, FsmSelector)
+    AddRule(selector, FsmErase, FsmEraseFrom, FsmTableName, FsmSelector).
+    // borra indice <tabla.columna> pe
+    AddRule(&FsmNode{
+        ExpectedString: "indice",
+    }, FsmErase, FsmIndex).
+    AddRule(&FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+        },
+        ExpectedString: "",
+    }, FsmErase, FsmIndex, FsmTableName).
+    AddRule(beginStep, FsmErase, FsmIndex, FsmTableName, FsmBeginStep).
+    // borra tabla <tabla> pe
+    AddRule(&FsmNode{
+        ExpectedString: "tabla",
+    }, FsmErase, FsmEraseTable).
+    AddRule(&FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+        },
+        ExpectedString: "",
+    }, FsmErase, FsmEraseTable, FsmTableName).
+    AddRule(beginStep, FsmErase, FsmEraseTable, FsmTableName, FsmBeginStep)
+
+    // fsm trunca-specific rules: trunca tabla <tabla> pe
+    beginStep.
+    AddRule(&FsmNode{
+        ExpectedString: "trunca",
+    }, FsmTruncate).
+    AddRule(&FsmNode{
+        ExpectedString: "tabla",
+    }, FsmTruncate, FsmTable).
+    AddRule(&FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+        },
+        ExpectedString: "",
+    }, FsmTruncate, FsmTable, FsmTableName).
+    AddRule(beginStep, FsmTruncate, FsmTable, FsmTableName, FsmBeginStep)
+
+    // fsm limpia-specific rules: limpia tabla <tabla> pe
+    beginStep.
+    AddRule(&FsmNode{
+        ExpectedString: "limpia",
+    }, FsmVacuum).
+    AddRule(&FsmNode{
+        ExpectedString: "tabla",
+    }, FsmVacuum, FsmTable).
+    AddRule(&FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+        },
+        ExpectedString: "",
+    }, FsmVacuum, FsmTable, FsmTableName).
+    AddRule(beginStep, FsmVacuum, FsmTable, FsmTableName, FsmBeginStep)
+
+    // fsm transaction-specific rules: empieza pe, confirma pe, deshaz pe
+    beginStep.
+    AddRule(&FsmNode{
+        ExpectedString: "empieza",
+    }, FsmBegin).
+    AddRule(beginStep, FsmBegin, FsmBeginStep).
+    AddRule(&FsmNode{
+        ExpectedString: "confirma",
+    }, FsmCommit).
+    AddRule(beginStep, FsmCommit, FsmBeginStep).
+    AddRule(&FsmNode{
+        ExpectedString: "deshaz",
+    }, FsmRollback).
+    AddRule(beginStep, FsmRollback, FsmBeginStep)
 
     // fsm mete-specific rules
     insertFieldKey := &FsmNode{
@@ -623,6 +936,47 @@ func defaultParseFsm() *FsmNode {
         ExpectedString: "}",
     }
 
+    insertFieldValue := &FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+            tokens.TkString,
+        },
+        ExpectedString: "",
+        Children: map[StepType]*FsmNode{},
+    }
+
+    // siguiente(<secuencia>): the value is read as a word, and the parentheses after it
+    // make it a call. It's followed by the same steps as any other value
+    insertCallOpen := &FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkParenOpen,
+        },
+        Children: map[StepType]*FsmNode{},
+    }
+
+    insertSequenceName := &FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkWord,
+        },
+        ExpectedString: "",
+        Children: map[StepType]*FsmNode{},
+    }
+
+    insertCallClose := &FsmNode{
+        ExpectByTypes: true,
+        ExpectedTypes: []tokens.TkType{
+            tokens.TkParenClosed,
+        },
+        Children: insertFieldValue.Children,
+    }
+
+    insertFieldValue.AddRule(insertCallOpen, FsmOpenSelector)
+    insertCallOpen.AddRule(insertSequenceName, FsmSequenceName)
+    insertSequenceName.AddRule(insertCallClose, FsmCloseSelector)
+
     beginStep.
     AddRule(&FsmNode{
         ExpectedString: "mete",
@@ -634,14 +988,7 @@ func defaultParseFsm() *FsmNode {
     AddRule(&FsmNode{
         ExpectedString: ":",
     }, FsmInsertStep, FsmOpenList, FsmFieldKey, FsmValueAssign).
-    AddRule(&FsmNode{
-        ExpectByTypes: true,
-        ExpectedTypes: []tokens.TkType{
-            tokens.TkWord,
-            tokens.TkString,
-        },
-        ExpectedString: "",
-    }, FsmInsertStep, FsmOpenList, FsmFieldKey, FsmValueAssign, FsmFieldValue).
+    AddRule(insertFieldValue, FsmInsertStep, FsmOpenList, FsmFieldKey, FsmValueAssign, FsmFieldValue).
     AddRule(&FsmNode{
         ExpectedString: ",",
     }, FsmInsertStep, FsmOpenList, FsmFieldKey, FsmValueAssign, FsmFieldValue, FsmListSeparator).
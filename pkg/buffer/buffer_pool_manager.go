@@ -3,6 +3,7 @@ package buffer
 import (
 	"fisi/elenadb/pkg/catalog"
 	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/recovery"
 	storage_disk "fisi/elenadb/pkg/storage/disk"
 	"fisi/elenadb/pkg/storage/page"
 	"fisi/elenadb/pkg/utils"
@@ -14,13 +15,25 @@ import (
 type BufferPoolManager struct {
 	poolSize      uint32
 	diskScheduler *storage_disk.DiskScheduler
-	pageTable     map[common.FrameID_t]*page.Page // relaciones GRACIAS!!!!!!!!!!!!!!!!!!!!!!!
-	replacer      LRUKReplacer
-	latch         sync.RWMutex
-	nextPageID    *atomic.Int32
-	dbName        string
-	freeList      []common.FrameID_t
-	Log           *common.Logger
+	// Write-ahead log. A page is only written once the log is on disk up to its LSN
+	logManager *recovery.LogManager
+	// The page cached in each frame, nil if the frame is free
+	frames []*page.Page
+	// Frame of each page that is in memory, so finding a page doesn't depend on the pool size
+	pageTable map[common.PageID_t]common.FrameID_t // relaciones GRACIAS!!!!!!!!!!!!!!!!!!!!!!!
+	// High-water mark of each file: how many pages it has, so the next one can be allocated
+	// without looking at the file
+	pageCounts map[common.FileID_t]common.APageID_t
+	// How many of those pages are on disk, as stored in the header page (see page_counts.go)
+	diskPageCounts map[common.FileID_t]common.APageID_t
+	replacer       LRUKReplacer
+	latch          sync.RWMutex
+	// Signaled (with latch) whenever a page is no longer pinned, see DiscardFilePages
+	unpinned   *sync.Cond
+	nextPageID *atomic.Int32
+	dbName     string
+	freeList   []common.FrameID_t
+	Log        *common.Logger
 }
 
 func NewBufferPoolManager(dbName string, poolSize uint32, k int, ctlg *catalog.Catalog) *BufferPoolManager {
@@ -31,29 +44,37 @@ func NewBufferPoolManager(dbName string, poolSize uint32, k int, ctlg *catalog.C
 
 	scheduler := storage_disk.NewScheduler(diskManager, ctlg)
 	freeList := make([]common.FrameID_t, poolSize)
-	pageTable := make(map[common.FrameID_t]*page.Page)
 	var nextPageID atomic.Int32
 	nextPageID.Store(-1)
 
 	for i := uint32(0); i < poolSize; i++ {
 		freeList[i] = common.FrameID_t(i)
-		pageTable[common.FrameID_t(i)] = nil
 	}
 
 	// TODO: @damaris how many threads should we use?
 	scheduler.StartWorkerThread()
 
-	return &BufferPoolManager{
-		poolSize:      poolSize,
-		pageTable:     pageTable,
-		diskScheduler: scheduler,
-		replacer:      *NewLRUK(poolSize, k),
-		nextPageID:    &nextPageID,
-		freeList:      freeList,
-		dbName:        dbName,
-		latch:         sync.RWMutex{},
-		Log:           common.NewLogger('💾'),
+	bpm := &BufferPoolManager{
+		poolSize:       poolSize,
+		frames:         make([]*page.Page, poolSize),
+		pageTable:      make(map[common.PageID_t]common.FrameID_t, poolSize),
+		pageCounts:     make(map[common.FileID_t]common.APageID_t),
+		diskPageCounts: make(map[common.FileID_t]common.APageID_t),
+		diskScheduler:  scheduler,
+		logManager:     recovery.NewLogManager(diskManager),
+		replacer:       *NewLRUK(poolSize, k),
+		nextPageID:     &nextPageID,
+		freeList:       freeList,
+		dbName:         dbName,
+		latch:          sync.RWMutex{},
+		Log:            common.NewLogger('💾'),
 	}
+	bpm.unpinned = sync.NewCond(&bpm.latch)
+	return bpm
+}
+
+func (bp *BufferPoolManager) LogManager() *recovery.LogManager {
+	return bp.logManager
 }
 
 /**
@@ -81,64 +102,32 @@ func (bp *BufferPoolManager) FetchPage(pageId common.PageID_t) *page.Page {
 	return bp.fetchPageUnlocked(pageId)
 }
 
+// Fetches the last page of the file, nil if the file has no pages yet
 func (bp *BufferPoolManager) FetchLastPage(fileId common.FileID_t) *page.Page {
 	bp.latch.Lock()
 	defer bp.latch.Unlock()
 
-	filename := bp.diskScheduler.Catalog.FilenameFromFileId(fileId)
-	size, err := storage_disk.GetFileSize(filepath.Join(bp.dbName, *filename))
-	if err != nil {
-		panic(err)
-	}
-
-	emptyFile := false
-	isInMemory := false
-	if size == 0 {
-		emptyFile = true
-	}
-
-	apidOffset := common.APageID_t(utils.Max(size/common.ElenaPageSize-1, 0))
-	bp.Log.Boot("fetch last page for file '%d' (size=%d, apidOffset=%d)", fileId, size, apidOffset)
-
-	// apidOffset is the last page based on disk, but we need to check our frames to see if there's
-	// a higher apid in memory
-
-	for _, page := range bp.pageTable {
-		if page == nil {
-			continue
-		}
-
-		if fileId == page.PageId.GetFileId() {
-			if page.PageId.GetActualPageId() >= apidOffset {
-				isInMemory = true
-				bp.Log.Boot("last page for file_id '%d' is in memory %s", fileId, page.PageId.ToString())
-				apidOffset = page.PageId.GetActualPageId()
-			}
-		}
-	}
-
-	if apidOffset == 0 && emptyFile && !isInMemory {
+	count := bp.pageCountUnlocked(fileId)
+	if count == 0 {
 		return nil
 	}
-	bp.Log.Boot("Returning last page for file_id=%d %d", fileId, apidOffset)
+	bp.Log.Debug("fetch last page for file '%d' (pages=%d)", fileId, count)
 
-	pageId := common.NewPageIdFromParts(fileId, common.APageID_t(apidOffset))
+	pageId := common.NewPageIdFromParts(fileId, count-1)
 	return bp.fetchPageUnlocked(pageId)
 }
 
 func (bp *BufferPoolManager) fetchPageUnlocked(pageId common.PageID_t) *page.Page {
 	// First search for page_id in the buffer pool
-	for frameId, page := range bp.pageTable {
-		if page == nil {
-			continue
-		}
-
-		if page.PageId == pageId {
-			// if found, returneas la page pues, but you pin it
-			page.PinCount.Add(1)
-			bp.Log.Debug("fetch page %s from frame '%d' (pins=%d)", pageId.ToString(), frameId, page.PinCount.Load())
-			return page
-		}
+	if frameId, ok := bp.pageTable[pageId]; ok {
+		page := bp.frames[frameId]
+		// if found, returneas la page pues, but you pin it
+		page.PinCount.Add(1)
+		// the page may have been unpinned before, it can't be evicted while pinned again
+		bp.replacer.TriggerAccess(frameId)
+		bp.replacer.SetEvictable(frameId, false)
+		bp.Log.Debug("fetch page %s from frame '%d' (pins=%d)", pageId.ToString(), frameId, page.PinCount.Load())
+		return page
 	}
 
 	frameId := common.InvalidFrameID
@@ -154,12 +143,9 @@ func (bp *BufferPoolManager) fetchPageUnlocked(pageId common.PageID_t) *page.Pag
 		}
 		bp.Log.Debug("evicted frame '%d'", frameId)
 		// eviction can happen
-		if !bp.DeletePage(bp.pageTable[frameId].PageId) {
+		if !bp.DeletePage(bp.frames[frameId].PageId) {
 			// panic("(2) DeletePage shouldn't have returned false since we just evicted that page")
 		}
-	} else {
-		// there's a free frame to use!!11!!1!
-		frameId = bp.freeList[0]
 	}
 
 	data := make([]byte, common.ElenaPageSize)
@@ -179,10 +165,11 @@ func (bp *BufferPoolManager) fetchPageUnlocked(pageId common.PageID_t) *page.Pag
 		return nil
 	}
 
+	// an evicted frame goes back to the free list, so there's a free frame to use!!11!!1!
+	frameId = bp.takeFreeFrame()
 	newPage := page.NewPageWithData(pageId, data, 1)
 	bp.Log.Debug("cache page %s to frame '%d'", pageId.ToString(), frameId)
-	bp.pageTable[frameId] = newPage
-	bp.removeFromFreeList(frameId)
+	bp.setFrame(frameId, newPage)
 
 	// Una vez que hallamos creado la página, marcamos ese frame
 	// como not evictable
@@ -197,45 +184,38 @@ func (bp *BufferPoolManager) fetchPageUnlocked(pageId common.PageID_t) *page.Pag
  * @return the id of the allocated page
  */
 func (bp *BufferPoolManager) AllocatePage(fileId common.FileID_t) common.PageID_t {
-	// In order to know what's the next apid (actual page id) to allocate for this fileId
-	// we need to visit our frames, since there may be pages that are in memory but not
-	filename := bp.diskScheduler.Catalog.FilenameFromFileId(fileId)
-
-	maxActualPageId := common.APageID_t(0)
-	foundOnBuffer := false
+	// The next actual page id is right after the high-water mark of the file. Pages count as
+	// allocated even if they are still in memory only
+	nextActualPageId := bp.pageCountUnlocked(fileId)
+	bp.pageCounts[fileId] = nextActualPageId + 1
+	return common.NewPageIdFromParts(fileId, nextActualPageId)
+}
 
-	for _, page := range bp.pageTable {
-		if page == nil {
-			continue
-		}
+// Number of pages the file has, including the ones that are still in memory only
+func (bp *BufferPoolManager) PageCount(fileId common.FileID_t) common.APageID_t {
+	bp.latch.Lock()
+	defer bp.latch.Unlock()
+	return bp.pageCountUnlocked(fileId)
+}
 
-		if fileId == page.PageId.GetFileId() {
-			foundOnBuffer = true
-			if page.PageId.GetActualPageId() > maxActualPageId {
-				maxActualPageId = page.PageId.GetActualPageId()
-			}
-		}
+// The page count of each file is kept in memory. A file is only looked up on disk the first
+// time it's used, unless its count was read from the header page on boot (see LoadPageCounts)
+func (bp *BufferPoolManager) pageCountUnlocked(fileId common.FileID_t) common.APageID_t {
+	if count, ok := bp.pageCounts[fileId]; ok {
+		return count
 	}
 
+	filename := bp.diskScheduler.Catalog.FilenameFromFileId(fileId)
 	size, err := storage_disk.GetFileSize(filepath.Join(bp.dbName, *filename))
 	if err != nil {
 		panic(err)
 	}
-
-	var nextActualPageId common.APageID_t
-	if !foundOnBuffer {
-		// IF this file doesn't have pages on memory we choose the next actual page id
-		// based on its size
-		nextActualPageId = common.APageID_t(size / common.ElenaPageSize)
-	} else {
-		// IF this file has pages on memory we choose the next actual page id
-		nextActualPageId = utils.Max(maxActualPageId+1, common.APageID_t(size/common.ElenaPageSize))
-	}
-
-	pageId := common.NewPageIdFromParts(fileId, nextActualPageId)
-
-	// add one to the next page id
-	return pageId
+	count := common.APageID_t(utils.Max(size/common.ElenaPageSize, 0))
+	bp.Log.Boot("file '%d' has %d pages (size=%d)", fileId, count, size)
+	bp.pageCounts[fileId] = count
+	bp.diskPageCounts[fileId] = count
+	bp.storePageCountsUnlocked()
+	return count
 }
 
 /**
@@ -270,17 +250,15 @@ func (bp *BufferPoolManager) newPageUnlocked(fileId common.FileID_t) *page.Page
 		// eviction can happen
 		// check if page is dirrrty (POP ANTHEM BY CRHISTINA AGUILERA!!) so we write it to disk
 		// NOTE: debugger halts here
-		if !bp.DeletePage(bp.pageTable[frameId].PageId) {
+		if !bp.DeletePage(bp.frames[frameId].PageId) {
 			// panic("(1) DeletePage shouldn't have returned false since we just evicted that page")
 		}
-	} else {
-		// there's a free frame to use!!11!!1!
-		frameId = bp.freeList[0]
 	}
+	// the evicted frame went back to the free list, so there's a free frame to use!!11!!1!
+	frameId = bp.takeFreeFrame()
 
 	newPage := page.NewPage(bp.AllocatePage(fileId), 1)
-	bp.pageTable[frameId] = newPage
-	bp.removeFromFreeList(frameId)
+	bp.setFrame(frameId, newPage)
 	// Una vez que hallamos creado la página, marcamos ese frame como not evictable
 
 	// Remember to "Pin" the frame by calling replacer.SetEvictable(frame_id, false)
@@ -311,27 +289,15 @@ func (bp *BufferPoolManager) NewPage(fileId common.FileID_t) *page.Page {
  * @return false if the page exists but could not be deleted, true if the page didn't exist or deletion succeeded
  */
 func (bp *BufferPoolManager) DeletePage(pageId common.PageID_t) bool {
-	frameIdToDelete := common.InvalidFrameID
-
-	for frameId, page := range bp.pageTable {
-		if page == nil {
-			continue
-		}
-
-		if page.PageId == pageId {
-			frameIdToDelete = frameId
-			if page.PinCount.Load() > 0 {
-				return false
-			}
-			break
-		}
-	}
-
-	if frameIdToDelete == common.InvalidFrameID {
+	frameIdToDelete, ok := bp.pageTable[pageId]
+	if !ok {
 		return true
 	}
 
-	page := bp.pageTable[frameIdToDelete]
+	page := bp.frames[frameIdToDelete]
+	if page.PinCount.Load() > 0 {
+		return false
+	}
 	if page.IsDirty {
 		// write to disk
 		bp.flushPageNoLock(pageId)
@@ -339,13 +305,51 @@ func (bp *BufferPoolManager) DeletePage(pageId common.PageID_t) bool {
 
 	// stop tracking the frame in the replacer
 	bp.replacer.Remove(frameIdToDelete)
-	// add the frame back to the free list
-	bp.freeList = append(bp.freeList, frameIdToDelete)
+	// add the frame back to the free list, the frame must not be found by its old page id
+	bp.freeFrame(frameIdToDelete)
 	// reset the page's memory and metadata
 	page.ResetMemory()
 	return true
 }
 
+// Drops every page of the given file from the buffer pool without writing them back. Used
+// when the file itself is about to be deleted or replaced. Pinned pages are waited for, whoever
+// pinned them may still read them: the frames can't be given to other pages meanwhile.
+func (bp *BufferPoolManager) DiscardFilePages(fileId common.FileID_t) {
+	bp.latch.Lock()
+	defer bp.latch.Unlock()
+
+	for bp.hasPinnedPagesUnlocked(fileId) {
+		bp.Log.Debug("waiting for the pages of file '%d' to be unpinned", fileId)
+		bp.unpinned.Wait()
+	}
+
+	for frameId, page := range bp.frames {
+		if page == nil || page.PageId.GetFileId() != fileId {
+			continue
+		}
+
+		bp.replacer.Remove(common.FrameID_t(frameId))
+		bp.freeFrame(common.FrameID_t(frameId))
+		page.ResetMemory()
+	}
+	// The file may have other pages once replaced, it's looked up on disk again
+	delete(bp.pageCounts, fileId)
+	if _, ok := bp.diskPageCounts[fileId]; ok {
+		delete(bp.diskPageCounts, fileId)
+		bp.storePageCountsUnlocked()
+	}
+}
+
+func (bp *BufferPoolManager) hasPinnedPagesUnlocked(fileId common.FileID_t) bool {
+	for _, page := range bp.frames {
+		if page != nil && page.PageId.GetFileId() == fileId && page.PinCount.Load() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 /**
  * TODO(P1): Add implementation
  *
@@ -365,27 +369,24 @@ func (bp *BufferPoolManager) UnpinPage(pageId common.PageID_t, isDirty bool) boo
 	bp.latch.Lock()
 	defer bp.latch.Unlock()
 
-	for frameId, page := range bp.pageTable {
-		if page == nil {
-			continue
-		}
-
-		if page.PageId == pageId {
-			if !page.IsDirty {
-				page.IsDirty = isDirty
-			}
-			if page.PinCount.Load() <= 0 {
-				return false
-			}
-			if page.PinCount.Add(-1) == 0 {
-				bp.replacer.SetEvictable(frameId, true)
-			}
-			bp.Log.Debug("unpin page %s in frame '%d' (is_dirty=%t, pins=%d)", pageId.ToString(), frameId, page.IsDirty, page.PinCount.Load())
-			return true
-		}
+	frameId, ok := bp.pageTable[pageId]
+	if !ok {
+		return false
 	}
 
-	return false
+	page := bp.frames[frameId]
+	if !page.IsDirty {
+		page.IsDirty = isDirty
+	}
+	if page.PinCount.Load() <= 0 {
+		return false
+	}
+	if page.PinCount.Add(-1) == 0 {
+		bp.replacer.SetEvictable(frameId, true)
+		bp.unpinned.Broadcast()
+	}
+	bp.Log.Debug("unpin page %s in frame '%d' (is_dirty=%t, pins=%d)", pageId.ToString(), frameId, page.IsDirty, page.PinCount.Load())
+	return true
 }
 
 /**
@@ -401,81 +402,116 @@ func (bp *BufferPoolManager) UnpinPage(pageId common.PageID_t, isDirty bool) boo
  */
 func (bp *BufferPoolManager) FlushPage(pageId common.PageID_t) bool {
 	bp.latch.Lock()
-	defer bp.latch.Unlock()
-	return bp.flushPageNoLock(pageId)
+	if _, ok := bp.pageTable[pageId]; !ok {
+		bp.latch.Unlock()
+		return false
+	}
+	page := bp.fetchPageUnlocked(pageId)
+	bp.latch.Unlock()
+
+	bp.writePinnedPage(page)
+	bp.UnpinPage(pageId, false)
+	return true
 }
 
-// Same as FlushPage but without the lock
+// Writes a page that is about to be evicted, if it's dirty. Nobody has it pinned, so nobody has
+// its latch either (guards release it before unpinning): the read latch is taken right away.
 func (bp *BufferPoolManager) flushPageNoLock(pageId common.PageID_t) bool {
-	for _, page := range bp.pageTable {
-		if page == nil {
-			continue
-		}
-
-		if page.PageId == pageId {
-			if !page.IsDirty {
-				return true
-			}
-			cb := make(chan bool)
-			bp.diskScheduler.Schedule(&storage_disk.DiskRequest{
-				IsWrite:  true,
-				PageID:   pageId,
-				Data:     page.Data,
-				Callback: cb,
-			})
-			res := <-cb
-			if !res {
-				panic("unexpected I/O error")
-			}
-			page.IsDirty = false
-			return true
-		}
+	frameId, ok := bp.pageTable[pageId]
+	if !ok {
+		return false
 	}
 
-	return false
+	page := bp.frames[frameId]
+	page.Latch.RLock()
+	defer page.Latch.RUnlock()
+	if !page.IsDirty {
+		return true
+	}
+	bp.writePageUnlocked(page)
+	page.IsDirty = false
+	return true
 }
 
-// Schedules a write for each dirty page in the buffer pool.
-// FUTURE NOTE: You may need to first adquire each page's latch before writing to disk
+// Writes every dirty page in the buffer pool. Pinned pages may be changing, see writePinnedPage
 func (bp *BufferPoolManager) FlushEntirePool() {
-	bp.latch.Lock()
-	defer bp.latch.Unlock()
 	bp.Log.Info("Flushing entire pool to disk...")
 
-	for _, page := range bp.pageTable {
-		if page == nil {
-			continue
+	bp.latch.Lock()
+	dirty := []*page.Page{}
+	for _, page := range bp.frames {
+		if page != nil && page.IsDirty {
+			dirty = append(dirty, bp.fetchPageUnlocked(page.PageId))
 		}
+	}
+	bp.latch.Unlock()
 
-		if page.IsDirty {
-			bp.Log.Debug("flushing page %s to disk", page.PageId.ToString())
-			cb := make(chan bool)
-			bp.diskScheduler.Schedule(&storage_disk.DiskRequest{
-				IsWrite:  true,
-				PageID:   page.PageId,
-				Data:     page.Data,
-				Callback: cb,
-			})
-			res := <-cb
-			if !res {
-				panic("unexpected I/O error")
-			}
-			page.IsDirty = false
-		}
+	for _, page := range dirty {
+		bp.Log.Debug("flushing page %s to disk", page.PageId.ToString())
+		bp.writePinnedPage(page)
+		bp.UnpinPage(page.PageId, false)
 	}
 }
 
-func (bp *BufferPoolManager) removeFromFreeList(frameId common.FrameID_t) {
-	newFreeList := make([]common.FrameID_t, 0, len(bp.freeList))
+// Writes a page the caller has pinned, if it's dirty. Whoever else has it pinned may be in the
+// middle of a change, so its read latch is waited for first: the page is written whole and
+// with all its changes in the log. Page latches are taken before bp.latch, so the caller must
+// not hold it.
+func (bp *BufferPoolManager) writePinnedPage(page *page.Page) {
+	page.Latch.RLock()
+	defer page.Latch.RUnlock()
 
-	for _, id := range bp.freeList {
-		if id == frameId {
-			continue
-		}
-		newFreeList = append(newFreeList, id)
+	bp.latch.Lock()
+	defer bp.latch.Unlock()
+	if !page.IsDirty {
+		return
+	}
+	bp.writePageUnlocked(page)
+	page.IsDirty = false
+}
+
+// Writes the page, which must be read latched, once the log is on disk up to its LSN
+func (bp *BufferPoolManager) writePageUnlocked(page *page.Page) {
+	bp.flushLogFor(page)
+	bp.growFileFor(page.PageId)
+	cb := make(chan bool)
+	bp.diskScheduler.Schedule(&storage_disk.DiskRequest{
+		IsWrite:  true,
+		PageID:   page.PageId,
+		Data:     page.Data,
+		Callback: cb,
+	})
+	if !<-cb {
+		panic("unexpected I/O error")
+	}
+}
+
+// WAL before data: the changes of a page are logged before the page is written, so they can
+// be undone if they belong to a transaction that never committed
+func (bp *BufferPoolManager) flushLogFor(page *page.Page) {
+	if err := bp.logManager.Flush(page.LSN); err != nil {
+		panic("unable to write the log: " + err.Error())
 	}
+}
+
+// Takes the first frame of the free list. The caller must check that there's one
+func (bp *BufferPoolManager) takeFreeFrame() common.FrameID_t {
+	frameId := bp.freeList[0]
+	bp.freeList = bp.freeList[1:]
+	return frameId
+}
+
+// Caches the page in the (already taken) frame
+func (bp *BufferPoolManager) setFrame(frameId common.FrameID_t, page *page.Page) {
+	bp.frames[frameId] = page
+	bp.pageTable[page.PageId] = frameId
+}
 
-	bp.freeList = newFreeList
+// Empties the frame and adds it back to the free list
+func (bp *BufferPoolManager) freeFrame(frameId common.FrameID_t) {
+	delete(bp.pageTable, bp.frames[frameId].PageId)
+	bp.frames[frameId] = nil
+	bp.freeList = append(bp.freeList, frameId)
 }
 
 // Iterates over our frames to see if the page exists. If not, tries to create fetch it from disk
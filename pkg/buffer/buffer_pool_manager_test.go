@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -151,3 +152,116 @@ func TestBufferPoolManagerTestSampleTest(t *testing.T) {
 	// Shutdown the disk manager and remove the temporary file we created.
 	// disk_manager.ShutDown()
 }
+
+func TestDiscardFilePagesWaitsForPins(t *testing.T) {
+	db_dir := "db.elena/"
+	common.GloablDbDir = db_dir
+
+	os.MkdirAll(db_dir, os.ModePerm)
+	os.Create(db_dir + "elena_meta.table")
+	defer os.RemoveAll(db_dir)
+
+	bpm := buffer.NewBufferPoolManager(db_dir, 3, 2, catalog.EmptyCatalog())
+	catalogFileId := common.FileID_t(0)
+
+	guard := bpm.NewPageWrite(catalogFileId)
+	copy(guard.DataMut(), []byte("Hello"))
+	pageId := guard.PageId()
+	guard.Drop()
+
+	// Scenario: a page that is still being read keeps its frame until it's unpinned
+	reader := bpm.FetchPageRead(pageId)
+	p := reader.Page()
+	discarded := make(chan bool)
+	go func() {
+		bpm.DiscardFilePages(catalogFileId)
+		close(discarded)
+	}()
+
+	select {
+	case <-discarded:
+		t.Fatal("the pages were discarded while pinned")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, "Hello", string(reader.Data()[:5]))
+	reader.Drop()
+	<-discarded
+
+	// Scenario: the discarded frame is reset, and its page is not written back
+	assert.Equal(t, int32(0), p.PinCount.Load())
+	assert.False(t, p.IsDirty)
+	assert.Equal(t, make([]byte, 5), p.Data[:5])
+	assert.Equal(t, common.APageID_t(0), bpm.PageCount(catalogFileId))
+}
+
+func TestPageCountsAreStoredAsFilesGrow(t *testing.T) {
+	db_dir := "db.elena/"
+	common.GloablDbDir = db_dir
+
+	os.MkdirAll(db_dir, os.ModePerm)
+	os.Create(db_dir + "elena_meta.table")
+	defer os.RemoveAll(db_dir)
+
+	bpm := buffer.NewBufferPoolManager(db_dir, 3, 2, catalog.EmptyCatalog())
+	catalogFileId := common.FileID_t(0)
+
+	// Scenario: the header page follows the pages written, without a shutdown
+	for i := 0; i < 5; i++ {
+		guard := bpm.NewPageWrite(catalogFileId)
+		copy(guard.DataMut(), []byte("Hello"))
+		guard.Drop()
+	}
+	bpm.FlushEntirePool()
+
+	restarted := buffer.NewBufferPoolManager(db_dir, 3, 2, catalog.EmptyCatalog())
+	assert.Nil(t, restarted.LoadPageCounts())
+	// The file isn't looked up, the count comes from the header page
+	os.Remove(db_dir + "elena_meta.table")
+	assert.Equal(t, common.APageID_t(5), restarted.PageCount(catalogFileId))
+
+	// Scenario: a file replaced as a whole is looked up on disk again
+	restarted.DiscardFilePages(catalogFileId)
+	os.Create(db_dir + "elena_meta.table")
+	restarted = buffer.NewBufferPoolManager(db_dir, 3, 2, catalog.EmptyCatalog())
+	assert.Nil(t, restarted.LoadPageCounts())
+	assert.Equal(t, common.APageID_t(0), restarted.PageCount(catalogFileId))
+}
+
+func TestFlushWaitsForTheWriteLatch(t *testing.T) {
+	db_dir := "db.elena/"
+	common.GloablDbDir = db_dir
+
+	os.MkdirAll(db_dir, os.ModePerm)
+	os.Create(db_dir + "elena_meta.table")
+	defer os.RemoveAll(db_dir)
+
+	bpm := buffer.NewBufferPoolManager(db_dir, 3, 2, catalog.EmptyCatalog())
+	catalogFileId := common.FileID_t(0)
+
+	guard := bpm.NewPageWrite(catalogFileId)
+	copy(guard.DataMut(), []byte("Hello"))
+	pageId := guard.PageId()
+	guard.Drop()
+
+	// Scenario: a page in the middle of a change is written once the change is done
+	writer := bpm.FetchPageWrite(pageId)
+	copy(writer.DataMut(), []byte("Wo"))
+	flushed := make(chan bool)
+	go func() {
+		bpm.FlushEntirePool()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		t.Fatal("the page was written while write latched")
+	case <-time.After(50 * time.Millisecond):
+	}
+	copy(writer.DataMut()[2:], []byte("rld"))
+	writer.Drop()
+	<-flushed
+
+	data, err := os.ReadFile(db_dir + "elena_meta.table")
+	assert.Nil(t, err)
+	assert.Equal(t, "World", string(data[:5]))
+}
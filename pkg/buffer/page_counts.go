@@ -0,0 +1,105 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/meta"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The header page of the database, "elena.pages", has how many pages each file has on disk:
+// [number of entries (2 bytes)] and then one [file id (2 bytes)][count (2 bytes)] entry per
+// file. It's written (and synced) before a page that makes its file grow is written, so it's
+// never behind the files, not even after a crash, and the boot takes the counts from it
+// instead of looking at the files.
+//
+// A file without an entry (a database written before the header page, or a file replaced as a
+// whole, see DiscardFilePages) is looked up on disk the first time it's used, and its entry is
+// added then. The counts are not in elena_meta, so its rows keep the layout they always had.
+
+const pageCountEntrySize = 4
+const maxPageCountEntries = (common.ElenaPageSize - 2) / pageCountEntrySize
+
+// Reads the header page, on boot. The pages of each file are allocated after the ones on disk
+func (bp *BufferPoolManager) LoadPageCounts() error {
+	bp.latch.Lock()
+	defer bp.latch.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(bp.dbName, meta.ELENA_PAGES_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) != common.ElenaPageSize {
+		return fmt.Errorf("\"%s\" has %d bytes, expected a page of %d", meta.ELENA_PAGES_FILE, len(data), common.ElenaPageSize)
+	}
+	entries := int(binary.LittleEndian.Uint16(data))
+	if entries > maxPageCountEntries {
+		return fmt.Errorf("\"%s\" has %d entries, at most %d fit", meta.ELENA_PAGES_FILE, entries, maxPageCountEntries)
+	}
+
+	for i, offset := 0, 2; i < entries; i, offset = i+1, offset+pageCountEntrySize {
+		fileId := common.FileID_t(binary.LittleEndian.Uint16(data[offset:]))
+		count := common.APageID_t(binary.LittleEndian.Uint16(data[offset+2:]))
+		bp.diskPageCounts[fileId] = count
+		bp.pageCounts[fileId] = count
+	}
+	return nil
+}
+
+// Called before the page is written: if the file grows, the header page has to say so first
+func (bp *BufferPoolManager) growFileFor(pageId common.PageID_t) {
+	fileId, aPageId := common.ParsePageID(pageId)
+	// A file without an entry yet is looked up on disk, it may be bigger than this page
+	bp.pageCountUnlocked(fileId)
+	if aPageId < bp.diskPageCounts[fileId] {
+		return
+	}
+	bp.diskPageCounts[fileId] = aPageId + 1
+	bp.storePageCountsUnlocked()
+}
+
+// Writes the header page next to the old one and renames it over it, so a crash never leaves
+// half of it. Files that don't fit in the page are left out, they are looked up on disk on boot.
+func (bp *BufferPoolManager) storePageCountsUnlocked() {
+	data := make([]byte, common.ElenaPageSize)
+	entries := 0
+	for fileId, count := range bp.diskPageCounts {
+		if entries == maxPageCountEntries {
+			break
+		}
+		offset := 2 + entries*pageCountEntrySize
+		binary.LittleEndian.PutUint16(data[offset:], uint16(fileId))
+		binary.LittleEndian.PutUint16(data[offset+2:], uint16(count))
+		entries++
+	}
+	binary.LittleEndian.PutUint16(data, uint16(entries))
+
+	path := filepath.Join(bp.dbName, meta.ELENA_PAGES_FILE)
+	if err := writeSynced(path+".tmp", data); err != nil {
+		panic("unable to write the page counts: " + err.Error())
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		panic("unable to write the page counts: " + err.Error())
+	}
+}
+
+func writeSynced(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,202 @@
+package buffer
+
+import (
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/storage/page"
+)
+
+// Page guards pin a page on creation and unpin it exactly once on Drop(), so callers don't have
+// to remember which dirty flag to pass to UnpinPage (or whether they already did). The usual
+// pattern is:
+//
+//	guard := bp.FetchPageRead(pageId)
+//	if guard == nil { ... }
+//	defer guard.Drop()
+//
+// Dropping a guard twice is harmless, the second call does nothing. A guard must not be used
+// after it's dropped.
+
+// BasicPageGuard keeps a page pinned but doesn't hold its latch. It's meant for callers that
+// want the page to stay in memory between accesses, and take the latch with UpgradeRead or
+// UpgradeWrite when they actually read or write it.
+type BasicPageGuard struct {
+	bpm   *BufferPoolManager
+	page  *page.Page
+	dirty bool
+}
+
+// ReadPageGuard keeps a page pinned with its latch held in read mode
+type ReadPageGuard struct {
+	guard BasicPageGuard
+}
+
+// WritePageGuard keeps a page pinned with its latch held in write mode. Writes through DataMut
+// or MarkDirty make Drop() unpin the page as dirty.
+type WritePageGuard struct {
+	guard BasicPageGuard
+}
+
+// Pins the page without latching it. Returns nil if the page can't be fetched.
+func (bp *BufferPoolManager) FetchPageBasic(pageId common.PageID_t) *BasicPageGuard {
+	p := bp.FetchPage(pageId)
+	if p == nil {
+		return nil
+	}
+	return &BasicPageGuard{bpm: bp, page: p}
+}
+
+// Pins the page and waits for its read latch. Returns nil if the page can't be fetched.
+func (bp *BufferPoolManager) FetchPageRead(pageId common.PageID_t) *ReadPageGuard {
+	guard := bp.FetchPageBasic(pageId)
+	if guard == nil {
+		return nil
+	}
+	return guard.UpgradeRead()
+}
+
+// Pins the page and waits for its write latch. Returns nil if the page can't be fetched.
+func (bp *BufferPoolManager) FetchPageWrite(pageId common.PageID_t) *WritePageGuard {
+	guard := bp.FetchPageBasic(pageId)
+	if guard == nil {
+		return nil
+	}
+	return guard.UpgradeWrite()
+}
+
+// Same as FetchLastPage, but the page comes write latched. Returns nil if the file is empty.
+func (bp *BufferPoolManager) FetchLastPageWrite(fileId common.FileID_t) *WritePageGuard {
+	p := bp.FetchLastPage(fileId)
+	if p == nil {
+		return nil
+	}
+	return (&BasicPageGuard{bpm: bp, page: p}).UpgradeWrite()
+}
+
+// Same as NewPage, but the page comes write latched. Returns nil if there are no frames left.
+// The new page is already dirty: its id is only taken once it reaches the disk, so it has to be
+// written back even if nothing is stored in it.
+func (bp *BufferPoolManager) NewPageWrite(fileId common.FileID_t) *WritePageGuard {
+	p := bp.NewPage(fileId)
+	if p == nil {
+		return nil
+	}
+	guard := (&BasicPageGuard{bpm: bp, page: p}).UpgradeWrite()
+	guard.MarkDirty()
+	return guard
+}
+
+// ======== BasicPageGuard ========
+
+func (g *BasicPageGuard) PageId() common.PageID_t {
+	return g.page.PageId
+}
+
+// Waits for the read latch. The pin moves to the returned guard, this one is left empty.
+func (g *BasicPageGuard) UpgradeRead() *ReadPageGuard {
+	g.page.Latch.RLock()
+	return &ReadPageGuard{guard: g.take()}
+}
+
+// Waits for the write latch. The pin moves to the returned guard, this one is left empty.
+func (g *BasicPageGuard) UpgradeWrite() *WritePageGuard {
+	g.page.Latch.Lock()
+	return &WritePageGuard{guard: g.take()}
+}
+
+// Takes the read latch only if it's free. If it isn't, returns false and this guard keeps the
+// pin, so it still has to be dropped.
+func (g *BasicPageGuard) TryUpgradeRead() (*ReadPageGuard, bool) {
+	if !g.page.Latch.TryRLock() {
+		return nil, false
+	}
+	return &ReadPageGuard{guard: g.take()}, true
+}
+
+// Takes the write latch only if it's free. If it isn't, returns false and this guard keeps the
+// pin, so it still has to be dropped.
+func (g *BasicPageGuard) TryUpgradeWrite() (*WritePageGuard, bool) {
+	if !g.page.Latch.TryLock() {
+		return nil, false
+	}
+	return &WritePageGuard{guard: g.take()}, true
+}
+
+// Unpins the page, only the first time it's called
+func (g *BasicPageGuard) Drop() {
+	if g.page == nil {
+		return
+	}
+	g.bpm.UnpinPage(g.page.PageId, g.dirty)
+	g.page = nil
+}
+
+// take moves the pin to a new guard and leaves this one empty
+func (g *BasicPageGuard) take() BasicPageGuard {
+	moved := *g
+	g.page = nil
+	return moved
+}
+
+// ======== ReadPageGuard ========
+
+func (g *ReadPageGuard) PageId() common.PageID_t {
+	return g.guard.page.PageId
+}
+
+// The latched page. It must not be modified through a read guard.
+func (g *ReadPageGuard) Page() *page.Page {
+	return g.guard.page
+}
+
+func (g *ReadPageGuard) Data() []byte {
+	return g.guard.page.Data
+}
+
+// Releases the read latch and unpins the page, only the first time it's called
+func (g *ReadPageGuard) Drop() {
+	if g.guard.page == nil {
+		return
+	}
+	g.guard.page.Latch.RUnlock()
+	g.guard.Drop()
+}
+
+// ======== WritePageGuard ========
+
+func (g *WritePageGuard) PageId() common.PageID_t {
+	return g.guard.page.PageId
+}
+
+// The latched page. Whoever modifies it through here has to call MarkDirty.
+func (g *WritePageGuard) Page() *page.Page {
+	return g.guard.page
+}
+
+func (g *WritePageGuard) Data() []byte {
+	return g.guard.page.Data
+}
+
+// The page data, for writing. The page is unpinned as dirty.
+func (g *WritePageGuard) DataMut() []byte {
+	g.guard.dirty = true
+	return g.guard.page.Data
+}
+
+// Makes Drop() unpin the page as dirty
+func (g *WritePageGuard) MarkDirty() {
+	g.guard.dirty = true
+}
+
+func (g *WritePageGuard) IsDirty() bool {
+	return g.guard.dirty
+}
+
+// Releases the write latch and unpins the page, only the first time it's called. The latch is
+// released first, an unpinned page can be evicted and nobody may hold its latch by then.
+func (g *WritePageGuard) Drop() {
+	if g.guard.page == nil {
+		return
+	}
+	g.guard.page.Latch.Unlock()
+	g.guard.Drop()
+}
@@ -0,0 +1,116 @@
+package buffer_test
+
+import (
+	"fisi/elenadb/pkg/buffer"
+	"fisi/elenadb/pkg/catalog"
+	"fisi/elenadb/pkg/common"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageGuardsUnpinOnce(t *testing.T) {
+	db_dir := "db.elena/"
+	common.GloablDbDir = db_dir
+
+	os.MkdirAll(db_dir, os.ModePerm)
+	os.Create(db_dir + "elena_meta.table")
+	defer os.RemoveAll(db_dir)
+
+	bpm := buffer.NewBufferPoolManager(db_dir, 3, 2, catalog.EmptyCatalog())
+	catalogFileId := common.FileID_t(0)
+
+	// Scenario: a new page guard is write latched and pinned once
+	guard := bpm.NewPageWrite(catalogFileId)
+	assert.NotNil(t, guard)
+	pageId := guard.PageId()
+	p := guard.Page()
+	assert.Equal(t, int32(1), p.PinCount.Load())
+	copy(guard.DataMut(), []byte("Hello"))
+
+	// Scenario: dropping it twice unpins it only once
+	guard.Drop()
+	guard.Drop()
+	assert.Equal(t, int32(0), p.PinCount.Load())
+	assert.True(t, p.IsDirty)
+
+	// Scenario: several readers can hold the page at the same time
+	reader1 := bpm.FetchPageRead(pageId)
+	reader2 := bpm.FetchPageRead(pageId)
+	assert.NotNil(t, reader1)
+	assert.NotNil(t, reader2)
+	assert.Equal(t, "Hello", string(reader1.Data()[:5]))
+	assert.Equal(t, int32(2), p.PinCount.Load())
+
+	// Scenario: a writer can't latch the page while it's being read
+	pinned := bpm.FetchPageBasic(pageId)
+	_, ok := pinned.TryUpgradeWrite()
+	assert.False(t, ok)
+	assert.Equal(t, int32(3), p.PinCount.Load())
+	pinned.Drop()
+
+	reader1.Drop()
+	reader1.Drop()
+	assert.Equal(t, int32(1), p.PinCount.Load())
+	reader2.Drop()
+	assert.Equal(t, int32(0), p.PinCount.Load())
+
+	// Scenario: once the readers are gone the writer gets the latch, and the upgraded guard
+	// is the only one holding the pin
+	pinned = bpm.FetchPageBasic(pageId)
+	writer, ok := pinned.TryUpgradeWrite()
+	assert.True(t, ok)
+	pinned.Drop()
+	assert.Equal(t, int32(1), p.PinCount.Load())
+	writer.Drop()
+	assert.Equal(t, int32(0), p.PinCount.Load())
+}
+
+func TestWritePageGuardTracksDirtiness(t *testing.T) {
+	db_dir := "db.elena/"
+	common.GloablDbDir = db_dir
+
+	os.MkdirAll(db_dir, os.ModePerm)
+	os.Create(db_dir + "elena_meta.table")
+	defer os.RemoveAll(db_dir)
+
+	bpm := buffer.NewBufferPoolManager(db_dir, 3, 2, catalog.EmptyCatalog())
+	catalogFileId := common.FileID_t(0)
+
+	guard := bpm.NewPageWrite(catalogFileId)
+	pageId := guard.PageId()
+	p := guard.Page()
+	guard.Drop()
+	assert.True(t, bpm.FlushPage(pageId))
+	assert.False(t, p.IsDirty)
+
+	// Scenario: a write guard that only reads leaves the page clean
+	guard = bpm.FetchPageWrite(pageId)
+	assert.Equal(t, byte(0), guard.Data()[0])
+	guard.Drop()
+	assert.False(t, p.IsDirty)
+
+	// Scenario: writing through the guard unpins the page as dirty
+	guard = bpm.FetchPageWrite(pageId)
+	guard.DataMut()[0] = 42
+	guard.Drop()
+	assert.True(t, p.IsDirty)
+
+	// Scenario: the write reaches the disk when the page is evicted. Filling the pool with
+	// three new pages forces it out
+	others := []*buffer.WritePageGuard{}
+	for i := 0; i < 3; i++ {
+		other := bpm.NewPageWrite(catalogFileId)
+		assert.NotNil(t, other)
+		others = append(others, other)
+	}
+	for _, other := range others {
+		other.Drop()
+	}
+
+	reader := bpm.FetchPageRead(pageId)
+	assert.NotNil(t, reader)
+	assert.Equal(t, byte(42), reader.Data()[0])
+	reader.Drop()
+}
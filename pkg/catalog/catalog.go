@@ -18,6 +18,7 @@ import (
 	"fisi/elenadb/pkg/common"
 	"fisi/elenadb/pkg/meta"
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -47,6 +48,8 @@ type IndexMetadata struct {
 	FileID    common.FileID_t
 	Root      common.PageID_t
 	SqlCreate string
+	// The indexed columns, in key order. It comes from the typed column list of SqlCreate
+	KeySchema schema.Schema
 }
 
 func NewIndexInfo(
@@ -63,20 +66,33 @@ func NewIndexInfo(
 	}
 }
 
+/* Metadata about a Sequence */
+type SequenceMetadata struct {
+	Name string
+	// Row of the sequence in elena_meta, sequences have no file
+	FileID common.FileID_t
+	// Next value to hand out. It's stored in elena_meta (as root) before it's handed out
+	Next      int32
+	SqlCreate string
+}
+
 type Catalog struct {
 	// Casos de uso:
 	// file_id -> filename
 	// table_name -> TableMetadata
 	// index_name -> IndexMetadata
-	TableMetadataMap map[string]*TableMetadata
-	IndexMetadataMap map[string]*IndexMetadata
+	// sequence_name -> SequenceMetadata
+	TableMetadataMap    map[string]*TableMetadata
+	IndexMetadataMap    map[string]*IndexMetadata
+	SequenceMetadataMap map[string]*SequenceMetadata
 }
 
 // un catalog skeleton, vacío no más
 func EmptyCatalog() *Catalog {
 	return &Catalog{
-		TableMetadataMap: make(map[string]*TableMetadata),
-		IndexMetadataMap: make(map[string]*IndexMetadata),
+		TableMetadataMap:    make(map[string]*TableMetadata),
+		IndexMetadataMap:    make(map[string]*IndexMetadata),
+		SequenceMetadataMap: make(map[string]*SequenceMetadata),
 	}
 }
 
@@ -86,8 +102,9 @@ func FillCatalog(
 	indexMetadataMap map[string]*IndexMetadata,
 ) *Catalog {
 	return &Catalog{
-		TableMetadataMap: tableMetadataMap,
-		IndexMetadataMap: indexMetadataMap,
+		TableMetadataMap:    tableMetadataMap,
+		IndexMetadataMap:    indexMetadataMap,
+		SequenceMetadataMap: make(map[string]*SequenceMetadata),
 	}
 }
 
@@ -95,6 +112,38 @@ func (c *Catalog) IndexMetadata(table string) *IndexMetadata {
 	return c.IndexMetadataMap[table]
 }
 
+// Indexes are named after the table and the columns they index: "<table>.<column>", or
+// "<table>.<column1>.<column2>" when the key has several columns. Names can't have dots (see
+// CheckName), so two indexes never get the same name.
+func IndexName(table string, columns []string) string {
+	return fmt.Sprintf("%s.%s", table, strings.Join(columns, "."))
+}
+
+// Tables and columns can't have a "." in their names: it separates the table from the column in
+// "<table>.<column>", and the columns of an index in its name
+func CheckName(name string) error {
+	if strings.Contains(name, ".") {
+		return fmt.Errorf("name \"%s\" can't have a \".\"", name)
+	}
+	return nil
+}
+
+func (im *IndexMetadata) TableName() string {
+	return im.Name[:strings.Index(im.Name, ".")]
+}
+
+// Returns all the indexes defined on the given table
+func (c *Catalog) GetTableIndexes(table string) []*IndexMetadata {
+	indexes := make([]*IndexMetadata, 0)
+	for name, index := range c.IndexMetadataMap {
+		if strings.HasPrefix(name, table+".") {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Name < indexes[j].Name })
+	return indexes
+}
+
 func (c *Catalog) FilenameFromFileId(fileId common.FileID_t) *string {
 	if fileId == 0 {
 		__ := meta.ELENA_META_TABLE_FILE
@@ -124,6 +173,14 @@ func (c *Catalog) RegisterIndexMetadata(index string, metadata *IndexMetadata) {
 	c.IndexMetadataMap[index] = metadata
 }
 
+func (c *Catalog) DeleteIndexMetadata(index string) {
+	delete(c.IndexMetadataMap, index)
+}
+
+func (c *Catalog) DeleteTableMetadata(table string) {
+	delete(c.TableMetadataMap, table)
+}
+
 func (c *Catalog) GetTableMetadata(table string) *TableMetadata {
 	if table == meta.ELENA_META_TABLE_NAME {
 		return &TableMetadata{
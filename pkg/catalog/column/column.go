@@ -10,17 +10,23 @@ type Column struct {
 	IsNullable  bool
 	IsForeign   bool
 	IsIdentity  bool
+	// "table.column" a foreign column references, and whether deleting the referenced row
+	// deletes the rows that reference it (@cascada) instead of being rejected
+	ForeignPath     string
+	OnDeleteCascade bool
 }
 
 func CopyColumn(c Column) Column {
 	return Column{
-		ColumnType:  c.ColumnType,
-		ColumnName:  c.ColumnName,
-		StorageSize: c.StorageSize,
-		IsUnique:    c.IsUnique,
-		IsNullable:  c.IsNullable,
-		IsForeign:   c.IsForeign,
-		IsIdentity:  c.IsIdentity,
+		ColumnType:      c.ColumnType,
+		ColumnName:      c.ColumnName,
+		StorageSize:     c.StorageSize,
+		IsUnique:        c.IsUnique,
+		IsNullable:      c.IsNullable,
+		IsForeign:       c.IsForeign,
+		IsIdentity:      c.IsIdentity,
+		ForeignPath:     c.ForeignPath,
+		OnDeleteCascade: c.OnDeleteCascade,
 	}
 }
 
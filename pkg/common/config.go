@@ -43,7 +43,7 @@ const (
 	InvalidLSN     = LSN_t(-1)
 	HeaderPageID   = 0
 	ElenaPageSize  = 4096
-	BufferPoolSize = 10
+	BufferPoolSize = 10 // default number of frames, see database.WithBufferPoolSize
 	LogBufferSize  = (BufferPoolSize + 1) * ElenaPageSize
 	BucketSize     = 50
 	LRUKReplacerK  = 10
@@ -55,6 +55,7 @@ type PageID_t uint32 // PageId = FileID + APageID
 type FileID_t uint16
 type APageID_t uint16 // "Actual" Page ID
 type TxnID_t int64
+type Timestamp_t int64 // commit timestamps of the transactions, see concurrency.VersionStore
 type LSN_t int32
 type SlotOffset_t uint16
 type SlotNumber_t uint16 // Slot number is slot index
@@ -0,0 +1,481 @@
+package concurrency
+
+import (
+	"fisi/elenadb/pkg/common"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+type LockMode uint8
+
+const (
+	LockIntentionShared LockMode = iota
+	LockIntentionExclusive
+	LockShared
+	LockSharedIntentionExclusive
+	LockExclusive
+)
+
+func (m LockMode) ToString() string {
+	switch m {
+	case LockIntentionShared:
+		return "IS"
+	case LockIntentionExclusive:
+		return "IX"
+	case LockShared:
+		return "S"
+	case LockSharedIntentionExclusive:
+		return "SIX"
+	case LockExclusive:
+		return "X"
+	default:
+		return "INVALID"
+	}
+}
+
+// Which modes can be held together by different transactions, indexed by LockMode
+var lockCompatibility = [5][5]bool{
+	//                   IS     IX     S      SIX    X
+	/* IS  */ {true, true, true, true, false},
+	/* IX  */ {true, true, false, false, false},
+	/* S   */ {true, false, true, false, false},
+	/* SIX */ {true, false, false, false, false},
+	/* X   */ {false, false, false, false, false},
+}
+
+func (m LockMode) IsCompatibleWith(other LockMode) bool {
+	return lockCompatibility[m][other]
+}
+
+// Whether holding m already allows everything other does
+func (m LockMode) Covers(other LockMode) bool {
+	switch m {
+	case LockExclusive:
+		return true
+	case LockSharedIntentionExclusive:
+		return other != LockExclusive
+	case LockShared, LockIntentionExclusive:
+		return other == m || other == LockIntentionShared
+	default:
+		return other == m
+	}
+}
+
+// The weakest mode that covers both, what a lock is upgraded to
+func combineLockModes(held LockMode, wanted LockMode) LockMode {
+	if held.Covers(wanted) {
+		return held
+	}
+	if wanted.Covers(held) {
+		return wanted
+	}
+	// S and IX
+	return LockSharedIntentionExclusive
+}
+
+type lockRequest struct {
+	txn     *Transaction
+	mode    LockMode
+	granted bool
+}
+
+// Requests on a table or a row, the granted ones first and then the waiting ones in the
+// order they came. Waiters are woken up by cond whenever a request leaves the queue.
+type lockRequestQueue struct {
+	requests []*lockRequest
+	cond     *sync.Cond
+	// Transaction waiting to upgrade its lock, only one can at a time
+	upgrading common.TxnID_t
+}
+
+func (q *lockRequestQueue) find(txn *Transaction) (int, *lockRequest) {
+	for i, request := range q.requests {
+		if request.txn == txn {
+			return i, request
+		}
+	}
+	return -1, nil
+}
+
+func (q *lockRequestQueue) remove(txn *Transaction) {
+	if i, _ := q.find(txn); i >= 0 {
+		q.requests = slices.Delete(q.requests, i, i+1)
+	}
+}
+
+// A request is granted once it's compatible with every request ahead of it, granted or not,
+// so the waiters are served in order and a stream of readers can't starve a writer
+func (q *lockRequestQueue) isGrantable(request *lockRequest) bool {
+	for _, ahead := range q.requests {
+		if ahead == request {
+			return true
+		}
+		if !ahead.mode.IsCompatibleWith(request.mode) {
+			return false
+		}
+	}
+	return false
+}
+
+// LockManager hands out table and row (RID) locks to transactions under strict two-phase
+// locking: locks are taken as the statements need them and all of them are released together
+// when the transaction commits or aborts (see TransactionManager).
+//
+// Rows are locked in S or X mode and take the intention lock (IS or IX) on their table first,
+// so a table lock in S or X mode waits for the rows to be released. A transaction waiting
+// for a lock held by another one that is waiting (maybe not directly) for it is a deadlock:
+// a background detector looks for them every common.CycleDetectionInterval and aborts the
+// youngest transaction of the cycle, whose lock request fails with TransactionAbortedError.
+type LockManager struct {
+	// Guards the queues and the locks of the transactions, and it's the lock of the conds
+	latch      sync.Mutex
+	tableLocks map[common.FileID_t]*lockRequestQueue
+	rowLocks   map[common.RID]*lockRequestQueue
+	// Queue each transaction is waiting on, to wake it up if it's aborted
+	waitingOn map[common.TxnID_t]*lockRequestQueue
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+func NewLockManager() *LockManager {
+	return &LockManager{
+		tableLocks: make(map[common.FileID_t]*lockRequestQueue),
+		rowLocks:   make(map[common.RID]*lockRequestQueue),
+		waitingOn:  make(map[common.TxnID_t]*lockRequestQueue),
+	}
+}
+
+// Locks a table, waiting until the lock is granted. A transaction that already holds a
+// weaker lock on it gets it upgraded.
+func (lm *LockManager) LockTable(txn *Transaction, mode LockMode, fileId common.FileID_t) error {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	return lm.lockTable(txn, mode, fileId)
+}
+
+func (lm *LockManager) lockTable(txn *Transaction, mode LockMode, fileId common.FileID_t) error {
+	if held, ok := txn.tableLocks[fileId]; ok && held.Covers(mode) {
+		return nil
+	}
+	queue, ok := lm.tableLocks[fileId]
+	if !ok {
+		queue = lm.newQueue()
+		lm.tableLocks[fileId] = queue
+	}
+	granted, err := lm.acquire(txn, queue, mode)
+	if err != nil {
+		if len(queue.requests) == 0 {
+			delete(lm.tableLocks, fileId)
+		}
+		return err
+	}
+	txn.tableLocks[fileId] = granted
+	return nil
+}
+
+// Locks a row in S or X mode, waiting until the lock is granted. The intention lock on the
+// table is taken first, unless the transaction holds a table lock that covers the row already.
+func (lm *LockManager) LockRow(txn *Transaction, mode LockMode, rid common.RID) error {
+	if mode != LockShared && mode != LockExclusive {
+		return fmt.Errorf("rows can't be locked in %s mode, only in S or X", mode.ToString())
+	}
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+
+	fileId := rid.PageID.GetFileId()
+	if held, ok := txn.tableLocks[fileId]; ok && held.Covers(mode) {
+		return nil
+	}
+	if held, ok := txn.rowLocks[rid]; ok && held.Covers(mode) {
+		return nil
+	}
+
+	intention := LockIntentionShared
+	if mode == LockExclusive {
+		intention = LockIntentionExclusive
+	}
+	if err := lm.lockTable(txn, intention, fileId); err != nil {
+		return err
+	}
+
+	queue, ok := lm.rowLocks[rid]
+	if !ok {
+		queue = lm.newQueue()
+		lm.rowLocks[rid] = queue
+	}
+	granted, err := lm.acquire(txn, queue, mode)
+	if err != nil {
+		if len(queue.requests) == 0 {
+			delete(lm.rowLocks, rid)
+		}
+		return err
+	}
+	txn.rowLocks[rid] = granted
+	return nil
+}
+
+// Releases every lock of the transaction. Strict 2PL: it's only called when the transaction
+// is done.
+func (lm *LockManager) ReleaseLocks(txn *Transaction) {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+
+	// Rows first, the table locks are their intention locks
+	for rid := range txn.rowLocks {
+		if queue, ok := lm.rowLocks[rid]; ok {
+			lm.release(txn, queue)
+			if len(queue.requests) == 0 {
+				delete(lm.rowLocks, rid)
+			}
+		}
+	}
+	for fileId := range txn.tableLocks {
+		if queue, ok := lm.tableLocks[fileId]; ok {
+			lm.release(txn, queue)
+			if len(queue.requests) == 0 {
+				delete(lm.tableLocks, fileId)
+			}
+		}
+	}
+	txn.rowLocks = make(map[common.RID]LockMode)
+	txn.tableLocks = make(map[common.FileID_t]LockMode)
+}
+
+func (lm *LockManager) newQueue() *lockRequestQueue {
+	return &lockRequestQueue{
+		requests:  []*lockRequest{},
+		cond:      sync.NewCond(&lm.latch),
+		upgrading: common.InvalidTxnID,
+	}
+}
+
+// Queues the request of the transaction and waits until it's granted (or the transaction
+// is aborted). Returns the mode it holds now. Called with the latch held.
+func (lm *LockManager) acquire(txn *Transaction, queue *lockRequestQueue, mode LockMode) (LockMode, error) {
+	if err := lm.checkCanLock(txn); err != nil {
+		return 0, err
+	}
+
+	i, request := queue.find(txn)
+	upgrade := request != nil
+	heldMode := mode
+	if upgrade {
+		if queue.upgrading != common.InvalidTxnID {
+			// Both would wait for the other to let its lock go
+			txn.SetState(TransactionAborted)
+			return 0, TransactionAbortedError{
+				TxnId:  txn.GetTxnId(),
+				Reason: fmt.Sprintf("transaction %d is upgrading the same lock", queue.upgrading),
+			}
+		}
+		// The upgrade goes before the other waiters, right after the granted requests
+		heldMode = request.mode
+		queue.requests = slices.Delete(queue.requests, i, i+1)
+		request.mode = combineLockModes(heldMode, mode)
+		request.granted = false
+		at := 0
+		for at < len(queue.requests) && queue.requests[at].granted {
+			at++
+		}
+		queue.requests = slices.Insert(queue.requests, at, request)
+		queue.upgrading = txn.GetTxnId()
+	} else {
+		request = &lockRequest{txn: txn, mode: mode}
+		queue.requests = append(queue.requests, request)
+	}
+
+	for !queue.isGrantable(request) {
+		lm.waitingOn[txn.GetTxnId()] = queue
+		queue.cond.Wait()
+		delete(lm.waitingOn, txn.GetTxnId())
+
+		if txn.GetState() == TransactionAborted {
+			if upgrade {
+				// It keeps the lock it had, until the abort releases it
+				request.mode = heldMode
+				request.granted = true
+				queue.upgrading = common.InvalidTxnID
+			} else {
+				queue.remove(txn)
+			}
+			queue.cond.Broadcast()
+			return 0, TransactionAbortedError{TxnId: txn.GetTxnId(), Reason: "deadlock"}
+		}
+	}
+
+	request.granted = true
+	if upgrade {
+		queue.upgrading = common.InvalidTxnID
+	}
+	return request.mode, nil
+}
+
+func (lm *LockManager) checkCanLock(txn *Transaction) error {
+	switch state := txn.GetState(); state {
+	case TransactionRunning:
+		return nil
+	case TransactionAborted:
+		return TransactionAbortedError{TxnId: txn.GetTxnId(), Reason: "it was aborted before"}
+	default:
+		return fmt.Errorf("transaction %d is %s, it can't take locks", txn.GetTxnId(), state.ToString())
+	}
+}
+
+func (lm *LockManager) release(txn *Transaction, queue *lockRequestQueue) {
+	queue.remove(txn)
+	queue.cond.Broadcast()
+}
+
+// ================ deadlocks ================
+
+// Starts looking for deadlocks in the background, every common.CycleDetectionInterval
+func (lm *LockManager) StartDeadlockDetection() {
+	lm.stop = make(chan struct{})
+	lm.stopped = make(chan struct{})
+	ticker := time.NewTicker(common.CycleDetectionInterval)
+	go func() {
+		defer close(lm.stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lm.stop:
+				return
+			case <-ticker.C:
+				lm.breakDeadlocks()
+			}
+		}
+	}()
+}
+
+func (lm *LockManager) StopDeadlockDetection() {
+	if lm.stop == nil {
+		return
+	}
+	close(lm.stop)
+	<-lm.stopped
+	lm.stop = nil
+}
+
+// Aborts transactions until the waits-for graph has no cycles left. The victim of a cycle is
+// its youngest transaction (the highest id), the one that has done the least work.
+func (lm *LockManager) breakDeadlocks() {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+
+	for {
+		graph := lm.waitsForGraph()
+		cycle := graph.findCycle()
+		if cycle == nil {
+			return
+		}
+		victim := cycle[0]
+		for _, txn := range cycle[1:] {
+			if txn.GetTxnId() > victim.GetTxnId() {
+				victim = txn
+			}
+		}
+		victim.SetState(TransactionAborted)
+		// Only waiting transactions are in a cycle, it wakes up and leaves the queue
+		lm.waitingOn[victim.GetTxnId()].cond.Broadcast()
+	}
+}
+
+// FLAG_ESTRUCTURA: grafo dirigido (waits-for graph)
+type waitsForGraph struct {
+	txns  map[common.TxnID_t]*Transaction
+	edges map[common.TxnID_t][]common.TxnID_t
+}
+
+// A waiting transaction waits for every request ahead of its own that it's not compatible
+// with. Aborted transactions don't wait anymore, they are leaving their queue.
+func (lm *LockManager) waitsForGraph() *waitsForGraph {
+	graph := &waitsForGraph{
+		txns:  make(map[common.TxnID_t]*Transaction),
+		edges: make(map[common.TxnID_t][]common.TxnID_t),
+	}
+	addQueue := func(queue *lockRequestQueue) {
+		for i, request := range queue.requests {
+			if request.granted || request.txn.GetState() == TransactionAborted {
+				continue
+			}
+			waiter := request.txn.GetTxnId()
+			graph.txns[waiter] = request.txn
+			for _, ahead := range queue.requests[:i] {
+				if !ahead.mode.IsCompatibleWith(request.mode) {
+					graph.txns[ahead.txn.GetTxnId()] = ahead.txn
+					graph.edges[waiter] = append(graph.edges[waiter], ahead.txn.GetTxnId())
+				}
+			}
+		}
+	}
+	for _, queue := range lm.tableLocks {
+		addQueue(queue)
+	}
+	for _, queue := range lm.rowLocks {
+		addQueue(queue)
+	}
+	return graph
+}
+
+// FLAG_ALGORITMO: DFS para encontrar ciclos
+// Returns the transactions of a cycle, or nil if there's none. The transactions and their
+// edges are walked in id order, so the same graph always gives the same cycle.
+func (g *waitsForGraph) findCycle() []*Transaction {
+	ids := make([]common.TxnID_t, 0, len(g.txns))
+	for id := range g.txns {
+		ids = append(ids, id)
+		slices.Sort(g.edges[id])
+	}
+	slices.Sort(ids)
+
+	visited := make(map[common.TxnID_t]bool)
+	onPath := make(map[common.TxnID_t]bool)
+	path := []common.TxnID_t{}
+
+	var visit func(id common.TxnID_t) []*Transaction
+	visit = func(id common.TxnID_t) []*Transaction {
+		visited[id] = true
+		onPath[id] = true
+		path = append(path, id)
+		for _, next := range g.edges[id] {
+			if onPath[next] {
+				// The cycle is the part of the path from next to here
+				cycle := []*Transaction{}
+				for _, inCycle := range path[slices.Index(path, next):] {
+					cycle = append(cycle, g.txns[inCycle])
+				}
+				return cycle
+			}
+			if !visited[next] {
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		onPath[id] = false
+		path = path[:len(path)-1]
+		return nil
+	}
+
+	for _, id := range ids {
+		if !visited[id] {
+			if cycle := visit(id); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// TransactionAbortedError is returned by a lock request of a transaction that was aborted,
+// i.e. to break a deadlock. The transaction has to be rolled back.
+type TransactionAbortedError struct {
+	TxnId  common.TxnID_t
+	Reason string
+}
+
+func (e TransactionAbortedError) Error() string {
+	return fmt.Sprintf("transaction %d was aborted: %s", e.TxnId, e.Reason)
+}
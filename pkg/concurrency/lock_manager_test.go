@@ -0,0 +1,217 @@
+package concurrency_test
+
+import (
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/concurrency"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLockManager(t *testing.T) *concurrency.LockManager {
+	interval := common.CycleDetectionInterval
+	common.CycleDetectionInterval = 10 * time.Millisecond
+	lm := concurrency.NewLockManager()
+	lm.StartDeadlockDetection()
+	t.Cleanup(func() {
+		lm.StopDeadlockDetection()
+		common.CycleDetectionInterval = interval
+	})
+	return lm
+}
+
+func rid(fileId common.FileID_t, slot uint32) common.RID {
+	return *common.NewRID(common.NewPageIdFromParts(fileId, 0), slot)
+}
+
+// Asks for a lock in the background, the result comes through the channel once it's granted
+func lockAsync(lock func() error) chan error {
+	result := make(chan error, 1)
+	go func() { result <- lock() }()
+	return result
+}
+
+func assertWaiting(t *testing.T, result chan error) {
+	t.Helper()
+	select {
+	case err := <-result:
+		t.Fatalf("expected the lock to wait, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func assertGranted(t *testing.T, result chan error) {
+	t.Helper()
+	select {
+	case err := <-result:
+		assert.Nil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the lock to be granted")
+	}
+}
+
+func assertAborted(t *testing.T, txn *concurrency.Transaction, result chan error) {
+	t.Helper()
+	select {
+	case err := <-result:
+		assert.IsType(t, concurrency.TransactionAbortedError{}, err)
+		assert.Equal(t, concurrency.TransactionAborted, txn.GetState())
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the deadlock to be broken")
+	}
+}
+
+func TestLockModes(t *testing.T) {
+	lm := newLockManager(t)
+	first := concurrency.NewTransaction(common.TXNStartID + 1)
+	second := concurrency.NewTransaction(common.TXNStartID + 2)
+
+	// Readers share the row, and the rows take the intention lock on their table
+	assert.Nil(t, lm.LockRow(first, concurrency.LockShared, rid(1, 0)))
+	assert.Nil(t, lm.LockRow(second, concurrency.LockShared, rid(1, 0)))
+	mode, _ := first.GetTableLockMode(1)
+	assert.Equal(t, concurrency.LockIntentionShared, mode)
+
+	// A writer waits for the readers
+	assert.NotNil(t, lm.LockRow(first, concurrency.LockIntentionShared, rid(1, 0)))
+	writer := lockAsync(func() error { return lm.LockRow(second, concurrency.LockExclusive, rid(1, 0)) })
+	assertWaiting(t, writer)
+	lm.ReleaseLocks(first)
+	assertGranted(t, writer)
+	mode, _ = second.GetRowLockMode(rid(1, 0))
+	assert.Equal(t, concurrency.LockExclusive, mode)
+	mode, _ = second.GetTableLockMode(1)
+	assert.Equal(t, concurrency.LockIntentionExclusive, mode)
+
+	// Reading the whole table waits for the rows being written
+	reader := lockAsync(func() error { return lm.LockTable(first, concurrency.LockShared, 1) })
+	assertWaiting(t, reader)
+	lm.ReleaseLocks(second)
+	assertGranted(t, reader)
+
+	// A table lock covers its rows, and S plus IX is SIX
+	assert.Nil(t, lm.LockRow(first, concurrency.LockShared, rid(1, 1)))
+	_, ok := first.GetRowLockMode(rid(1, 1))
+	assert.False(t, ok)
+	assert.Nil(t, lm.LockRow(first, concurrency.LockExclusive, rid(1, 1)))
+	mode, _ = first.GetTableLockMode(1)
+	assert.Equal(t, concurrency.LockSharedIntentionExclusive, mode)
+
+	// Done transactions can't lock anything
+	first.SetState(concurrency.TransactionCommitted)
+	assert.NotNil(t, lm.LockTable(first, concurrency.LockShared, 2))
+}
+
+func TestLockUpgradeGoesFirst(t *testing.T) {
+	lm := newLockManager(t)
+	first := concurrency.NewTransaction(common.TXNStartID + 1)
+	second := concurrency.NewTransaction(common.TXNStartID + 2)
+	third := concurrency.NewTransaction(common.TXNStartID + 3)
+
+	assert.Nil(t, lm.LockRow(first, concurrency.LockShared, rid(1, 0)))
+	assert.Nil(t, lm.LockRow(second, concurrency.LockShared, rid(1, 0)))
+	waiting := lockAsync(func() error { return lm.LockRow(third, concurrency.LockExclusive, rid(1, 0)) })
+	assertWaiting(t, waiting)
+
+	// The upgrade doesn't queue behind the third one
+	upgrade := lockAsync(func() error { return lm.LockRow(first, concurrency.LockExclusive, rid(1, 0)) })
+	assertWaiting(t, upgrade)
+	lm.ReleaseLocks(second)
+	assertGranted(t, upgrade)
+	assertWaiting(t, waiting)
+	lm.ReleaseLocks(first)
+	assertGranted(t, waiting)
+}
+
+func TestDeadlockBetweenTwoTransactions(t *testing.T) {
+	lm := newLockManager(t)
+	older := concurrency.NewTransaction(common.TXNStartID + 1)
+	younger := concurrency.NewTransaction(common.TXNStartID + 2)
+
+	assert.Nil(t, lm.LockRow(older, concurrency.LockExclusive, rid(1, 0)))
+	assert.Nil(t, lm.LockRow(younger, concurrency.LockExclusive, rid(1, 1)))
+	olderWaits := lockAsync(func() error { return lm.LockRow(older, concurrency.LockExclusive, rid(1, 1)) })
+	assertWaiting(t, olderWaits)
+
+	// The younger one is the victim, the older one goes on once its locks are released
+	youngerWaits := lockAsync(func() error { return lm.LockRow(younger, concurrency.LockShared, rid(1, 0)) })
+	assertAborted(t, younger, youngerWaits)
+	assertWaiting(t, olderWaits)
+	lm.ReleaseLocks(younger)
+	assertGranted(t, olderWaits)
+	assert.Equal(t, concurrency.TransactionRunning, older.GetState())
+
+	// An aborted transaction can't take more locks
+	assert.IsType(t, concurrency.TransactionAbortedError{}, lm.LockTable(younger, concurrency.LockShared, 2))
+}
+
+func TestDeadlockBetweenThreeTransactions(t *testing.T) {
+	lm := newLockManager(t)
+	txns := []*concurrency.Transaction{
+		concurrency.NewTransaction(common.TXNStartID + 1),
+		concurrency.NewTransaction(common.TXNStartID + 2),
+		concurrency.NewTransaction(common.TXNStartID + 3),
+	}
+	for i, txn := range txns {
+		assert.Nil(t, lm.LockTable(txn, concurrency.LockExclusive, common.FileID_t(i+1)))
+	}
+
+	// 3 -> 1 -> 2 -> 3, closed by the oldest one
+	third := lockAsync(func() error { return lm.LockTable(txns[2], concurrency.LockShared, 1) })
+	assertWaiting(t, third)
+	second := lockAsync(func() error { return lm.LockTable(txns[1], concurrency.LockShared, 3) })
+	assertWaiting(t, second)
+	first := lockAsync(func() error { return lm.LockTable(txns[0], concurrency.LockIntentionShared, 2) })
+
+	assertAborted(t, txns[2], third)
+	lm.ReleaseLocks(txns[2])
+	assertGranted(t, second)
+	assertWaiting(t, first)
+	lm.ReleaseLocks(txns[1])
+	assertGranted(t, first)
+}
+
+func TestDeadlockUpgradingTheSameLock(t *testing.T) {
+	lm := newLockManager(t)
+	first := concurrency.NewTransaction(common.TXNStartID + 1)
+	second := concurrency.NewTransaction(common.TXNStartID + 2)
+
+	assert.Nil(t, lm.LockTable(first, concurrency.LockShared, 1))
+	assert.Nil(t, lm.LockTable(second, concurrency.LockShared, 1))
+	upgrade := lockAsync(func() error { return lm.LockTable(first, concurrency.LockExclusive, 1) })
+	assertWaiting(t, upgrade)
+
+	// Both would wait for each other, the second upgrade is not even queued
+	err := lm.LockTable(second, concurrency.LockIntentionExclusive, 1)
+	assert.IsType(t, concurrency.TransactionAbortedError{}, err)
+	assert.Equal(t, concurrency.TransactionAborted, second.GetState())
+	mode, _ := second.GetTableLockMode(1)
+	assert.Equal(t, concurrency.LockShared, mode)
+
+	lm.ReleaseLocks(second)
+	assertGranted(t, upgrade)
+	mode, _ = first.GetTableLockMode(1)
+	assert.Equal(t, concurrency.LockExclusive, mode)
+}
+
+func TestAbortReleasesTheLocksOfTheVictim(t *testing.T) {
+	lm := newLockManager(t)
+	tm := concurrency.NewTransactionManager(newLogManager(t), lm, nil)
+	older, younger := tm.Begin(), tm.Begin()
+
+	assert.Nil(t, lm.LockRow(older, concurrency.LockExclusive, rid(1, 0)))
+	assert.Nil(t, lm.LockRow(younger, concurrency.LockExclusive, rid(1, 1)))
+	olderWaits := lockAsync(func() error { return lm.LockRow(older, concurrency.LockExclusive, rid(1, 1)) })
+	assertWaiting(t, olderWaits)
+	youngerWaits := lockAsync(func() error { return lm.LockRow(younger, concurrency.LockExclusive, rid(1, 0)) })
+	assertAborted(t, younger, youngerWaits)
+
+	// The victim can't commit, it has to be rolled back
+	assert.NotNil(t, tm.Commit(younger))
+	assert.Nil(t, tm.Abort(younger))
+	assertGranted(t, olderWaits)
+	assert.Nil(t, tm.Commit(older))
+	_, ok := older.GetRowLockMode(rid(1, 1))
+	assert.False(t, ok)
+}
@@ -0,0 +1,121 @@
+package concurrency
+
+import (
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/recovery"
+	"sync"
+)
+
+type TransactionState uint8
+
+const (
+	TransactionRunning TransactionState = iota
+	TransactionCommitted
+	TransactionAborted
+)
+
+func (s TransactionState) ToString() string {
+	switch s {
+	case TransactionRunning:
+		return "RUNNING"
+	case TransactionCommitted:
+		return "COMMITTED"
+	case TransactionAborted:
+		return "ABORTED"
+	default:
+		return "INVALID"
+	}
+}
+
+// Transaction groups the changes that are committed (or undone) together. Every record it
+// writes to the log points to the previous one, so its changes can be walked back from the
+// last one.
+type Transaction struct {
+	txnId common.TxnID_t
+	// The deadlock detector aborts transactions from its own goroutine
+	stateLatch sync.Mutex
+	state      TransactionState
+	// Last record of the transaction in the log, InvalidLSN if it didn't log anything yet
+	prevLSN common.LSN_t
+	// The transaction sees what was committed until readTs (see VersionStore). commitTs is
+	// 0 until it commits
+	readTs   common.Timestamp_t
+	commitTs common.Timestamp_t
+	// Records of the changes that have to be undone if the transaction aborts, oldest first.
+	// Kept in memory so a rollback doesn't have to read the log back.
+	writeSet []*recovery.LogRecord
+	// Locks held by the transaction, written only by the LockManager (under its latch)
+	tableLocks map[common.FileID_t]LockMode
+	rowLocks   map[common.RID]LockMode
+}
+
+func NewTransaction(txnId common.TxnID_t) *Transaction {
+	return &Transaction{
+		txnId:      txnId,
+		state:      TransactionRunning,
+		prevLSN:    common.InvalidLSN,
+		writeSet:   []*recovery.LogRecord{},
+		tableLocks: make(map[common.FileID_t]LockMode),
+		rowLocks:   make(map[common.RID]LockMode),
+	}
+}
+
+func (txn *Transaction) GetTxnId() common.TxnID_t {
+	return txn.txnId
+}
+
+func (txn *Transaction) GetState() TransactionState {
+	txn.stateLatch.Lock()
+	defer txn.stateLatch.Unlock()
+	return txn.state
+}
+
+func (txn *Transaction) SetState(state TransactionState) {
+	txn.stateLatch.Lock()
+	defer txn.stateLatch.Unlock()
+	txn.state = state
+}
+
+func (txn *Transaction) GetReadTs() common.Timestamp_t {
+	return txn.readTs
+}
+
+func (txn *Transaction) GetCommitTs() common.Timestamp_t {
+	return txn.commitTs
+}
+
+// Timestamp of the versions the transaction writes while it runs, its id
+func (txn *Transaction) getTempTs() common.Timestamp_t {
+	return common.Timestamp_t(txn.txnId)
+}
+
+func (txn *Transaction) GetPrevLSN() common.LSN_t {
+	return txn.prevLSN
+}
+
+func (txn *Transaction) SetPrevLSN(lsn common.LSN_t) {
+	txn.prevLSN = lsn
+}
+
+// Remembers a change of the transaction, only the undoable ones are kept
+func (txn *Transaction) AppendWriteRecord(record *recovery.LogRecord) {
+	if record.IsUndoable() {
+		txn.writeSet = append(txn.writeSet, record)
+	}
+}
+
+func (txn *Transaction) GetWriteSet() []*recovery.LogRecord {
+	return txn.writeSet
+}
+
+// Mode of the lock the transaction holds on a table, if any
+func (txn *Transaction) GetTableLockMode(fileId common.FileID_t) (LockMode, bool) {
+	mode, ok := txn.tableLocks[fileId]
+	return mode, ok
+}
+
+// Mode of the lock the transaction holds on a row, if any
+func (txn *Transaction) GetRowLockMode(rid common.RID) (LockMode, bool) {
+	mode, ok := txn.rowLocks[rid]
+	return mode, ok
+}
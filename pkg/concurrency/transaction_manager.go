@@ -0,0 +1,171 @@
+package concurrency
+
+import (
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/recovery"
+	"fmt"
+	"sync"
+)
+
+// Undoes one change of a transaction that is being rolled back. It must log the undo as a
+// compensation in the same transaction.
+type UndoFunc func(txn *Transaction, record *recovery.LogRecord) error
+
+// TransactionManager hands out transactions and finishes them. A commit is durable once
+// Commit returns: its record is flushed to the log. Abort undoes the changes of the
+// transaction newest first, with the UndoFunc the database gave it, since only the database
+// knows about the heaps and indexes behind the records. Both release the locks of the
+// transaction once it's done, never before (strict 2PL).
+//
+// It also keeps the versions of the rows the transactions write (see VersionStore): a
+// transaction gets its snapshot when it begins, and its versions are visible to the ones that
+// begin after it commits.
+type TransactionManager struct {
+	latch       sync.Mutex
+	nextTxnId   common.TxnID_t
+	running     map[common.TxnID_t]*Transaction
+	logManager  *recovery.LogManager
+	lockManager *LockManager
+	versions    *VersionStore
+	undo        UndoFunc
+}
+
+func NewTransactionManager(logManager *recovery.LogManager, lockManager *LockManager, undo UndoFunc) *TransactionManager {
+	return &TransactionManager{
+		nextTxnId:   common.TXNStartID,
+		running:     make(map[common.TxnID_t]*Transaction),
+		logManager:  logManager,
+		lockManager: lockManager,
+		versions:    NewVersionStore(),
+		undo:        undo,
+	}
+}
+
+func (tm *TransactionManager) Begin() *Transaction {
+	tm.latch.Lock()
+	defer tm.latch.Unlock()
+
+	tm.nextTxnId++
+	txn := NewTransaction(tm.nextTxnId)
+	tm.versions.begin(txn)
+	tm.running[txn.GetTxnId()] = txn
+	return txn
+}
+
+func (tm *TransactionManager) GetVersionStore() *VersionStore {
+	return tm.versions
+}
+
+// Logs the commit of the transaction and waits for it to be on disk. Transactions that
+// didn't change anything have nothing to log.
+func (tm *TransactionManager) Commit(txn *Transaction) error {
+	if txn.GetState() != TransactionRunning {
+		return fmt.Errorf("transaction %d is %s, it can't commit", txn.GetTxnId(), txn.GetState().ToString())
+	}
+	if txn.GetPrevLSN() != common.InvalidLSN {
+		lsn, err := tm.logManager.AppendLogRecord(
+			recovery.NewTxnLogRecord(txn.GetTxnId(), txn.GetPrevLSN(), recovery.LogCommit),
+		)
+		if err != nil {
+			return err
+		}
+		txn.SetPrevLSN(lsn)
+		if err := tm.logManager.Flush(lsn); err != nil {
+			return err
+		}
+	}
+	tm.versions.commit(txn)
+	tm.finish(txn, TransactionCommitted)
+	return nil
+}
+
+// Undoes every change of the transaction and logs its end. The abort record is not flushed:
+// if it's lost, recovery sees the transaction as unfinished and its compensations say there's
+// nothing left to undo. A transaction the lock manager aborted (it's ABORTED already) still
+// has to be rolled back with Abort.
+func (tm *TransactionManager) Abort(txn *Transaction) error {
+	if !tm.isRunning(txn) {
+		return fmt.Errorf("transaction %d is %s, it can't abort", txn.GetTxnId(), txn.GetState().ToString())
+	}
+	writeSet := txn.GetWriteSet()
+	for i := len(writeSet) - 1; i >= 0; i-- {
+		if err := tm.undo(txn, writeSet[i]); err != nil {
+			return err
+		}
+		// Undone changes are never undone again, even if the abort fails later
+		txn.writeSet = writeSet[:i]
+	}
+
+	if txn.GetPrevLSN() != common.InvalidLSN {
+		lsn, err := tm.logManager.AppendLogRecord(
+			recovery.NewTxnLogRecord(txn.GetTxnId(), txn.GetPrevLSN(), recovery.LogAbort),
+		)
+		if err != nil {
+			return err
+		}
+		txn.SetPrevLSN(lsn)
+	}
+	tm.versions.abort(txn)
+	tm.finish(txn, TransactionAborted)
+	return nil
+}
+
+func (tm *TransactionManager) isRunning(txn *Transaction) bool {
+	tm.latch.Lock()
+	defer tm.latch.Unlock()
+	_, ok := tm.running[txn.GetTxnId()]
+	return ok
+}
+
+func (tm *TransactionManager) finish(txn *Transaction, state TransactionState) {
+	tm.latch.Lock()
+	txn.SetState(state)
+	delete(tm.running, txn.GetTxnId())
+	tm.latch.Unlock()
+	tm.lockManager.ReleaseLocks(txn)
+	tm.GarbageCollect()
+}
+
+// Runs fn while txn (nil for none) is the only running transaction, and keeps new ones from
+// beginning until it returns. Fails without running fn if others are running, or if txn
+// already changed something.
+//
+// A checkpoint runs this way: it writes every dirty page and empties the log, so the changes
+// of a transaction that is still running would be on disk with nothing left to undo them.
+func (tm *TransactionManager) RunAlone(txn *Transaction, fn func() error) error {
+	tm.latch.Lock()
+	defer tm.latch.Unlock()
+
+	others := 0
+	for id := range tm.running {
+		if txn == nil || id != txn.GetTxnId() {
+			others++
+		}
+	}
+	if others > 0 {
+		return fmt.Errorf("%d other transaction(s) are running, try again once they end", others)
+	}
+	if txn != nil && txn.GetPrevLSN() != common.InvalidLSN {
+		return fmt.Errorf("transaction %d already changed rows, the statement needs a transaction of its own", txn.GetTxnId())
+	}
+	return fn()
+}
+
+// Oldest read timestamp of the running transactions, the versions committed before it are
+// only needed if they are the newest ones
+func (tm *TransactionManager) GetWatermark() common.Timestamp_t {
+	tm.latch.Lock()
+	defer tm.latch.Unlock()
+
+	// Taken with the latch, so no transaction can begin with an older snapshot meanwhile
+	watermark := tm.versions.GetLastCommitTs()
+	for _, txn := range tm.running {
+		watermark = min(watermark, txn.GetReadTs())
+	}
+	return watermark
+}
+
+// Drops the versions no running transaction can see
+func (tm *TransactionManager) GarbageCollect() {
+	tm.versions.GarbageCollect(tm.GetWatermark())
+}
@@ -0,0 +1,75 @@
+package concurrency_test
+
+import (
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/concurrency"
+	"fisi/elenadb/pkg/recovery"
+	storage_disk "fisi/elenadb/pkg/storage/disk"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLogManager(t *testing.T) *recovery.LogManager {
+	dir := t.TempDir()
+	common.GloablDbDir = dir
+	dm, err := storage_disk.NewDiskManager(dir)
+	assert.Nil(t, err)
+	t.Cleanup(dm.ShutDown)
+	return recovery.NewLogManager(dm)
+}
+
+// Logs a change of the transaction, like the database does
+func logChange(t *testing.T, lm *recovery.LogManager, txn *concurrency.Transaction, slot common.SlotNumber_t) {
+	record := recovery.NewTxnLogRecord(txn.GetTxnId(), txn.GetPrevLSN(), recovery.LogInsert)
+	record.PageID = common.NewPageIdFromParts(1, 0)
+	record.Slot = slot
+	lsn, err := lm.AppendLogRecord(record)
+	assert.Nil(t, err)
+	txn.SetPrevLSN(lsn)
+	txn.AppendWriteRecord(record)
+}
+
+func TestTransactionManagerCommit(t *testing.T) {
+	lm := newLogManager(t)
+	tm := concurrency.NewTransactionManager(lm, concurrency.NewLockManager(), nil)
+
+	first, second := tm.Begin(), tm.Begin()
+	assert.NotEqual(t, first.GetTxnId(), second.GetTxnId())
+	assert.Equal(t, concurrency.TransactionRunning, first.GetState())
+
+	// A commit is on disk when it returns
+	logChange(t, lm, first, 0)
+	assert.Nil(t, tm.Commit(first))
+	assert.Equal(t, concurrency.TransactionCommitted, first.GetState())
+	assert.Equal(t, first.GetPrevLSN(), lm.PersistentLSN())
+	assert.NotNil(t, tm.Commit(first))
+
+	// Nothing to log for a transaction that didn't change anything
+	persistent := lm.PersistentLSN()
+	assert.Nil(t, tm.Commit(second))
+	assert.Equal(t, persistent, lm.PersistentLSN())
+}
+
+func TestTransactionManagerAbort(t *testing.T) {
+	lm := newLogManager(t)
+	undone := []common.SlotNumber_t{}
+	tm := concurrency.NewTransactionManager(lm, concurrency.NewLockManager(), func(txn *concurrency.Transaction, record *recovery.LogRecord) error {
+		undone = append(undone, record.Slot)
+		return nil
+	})
+
+	txn := tm.Begin()
+	for slot := common.SlotNumber_t(0); slot < 3; slot++ {
+		logChange(t, lm, txn, slot)
+	}
+	assert.Nil(t, tm.Abort(txn))
+	assert.Equal(t, []common.SlotNumber_t{2, 1, 0}, undone)
+	assert.Equal(t, concurrency.TransactionAborted, txn.GetState())
+	assert.NotNil(t, tm.Abort(txn))
+
+	assert.Nil(t, lm.Flush(txn.GetPrevLSN()))
+	records, err := lm.ReadLogRecords()
+	assert.Nil(t, err)
+	assert.Equal(t, recovery.LogAbort, records[len(records)-1].Type)
+}
@@ -0,0 +1,235 @@
+package concurrency
+
+import (
+	"cmp"
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/storage/table/tuple"
+	"slices"
+	"sync"
+)
+
+// A version of a row that is not in the heap anymore
+type TupleVersion struct {
+	Meta tuple.TupleMeta
+	// Raw tuple, nil if there was no row
+	Data []byte
+}
+
+// What a row was before the last transactions that changed it
+type versionChain struct {
+	// Who wrote what the heap has now
+	head tuple.TupleMeta
+	// Versions the heap had before, newest first
+	undo []TupleVersion
+}
+
+// VersionStore keeps the old versions of the rows so readers can see a snapshot of the tables
+// without locking them (MVCC). The heap always has the newest version of a row, even if its
+// transaction didn't commit yet, and the versions it replaced are kept here in memory, with
+// the commit timestamp of the transaction that wrote each of them.
+//
+// A transaction sees the rows as they were committed when it began (its read timestamp),
+// plus its own changes. Rows without versions here are seen by everybody as they are in the
+// heap. Versions no running transaction can see anymore are garbage collected when a
+// transaction ends.
+type VersionStore struct {
+	latch        sync.Mutex
+	lastCommitTs common.Timestamp_t
+	chains       map[common.RID]*versionChain
+	// Rows changed by each running transaction, to stamp (or drop) their versions when it ends
+	written map[common.TxnID_t][]common.RID
+	// Number of calls to Write, see GetWriteCount
+	writes uint64
+}
+
+func NewVersionStore() *VersionStore {
+	return &VersionStore{
+		lastCommitTs: 0,
+		chains:       make(map[common.RID]*versionChain),
+		written:      make(map[common.TxnID_t][]common.RID),
+	}
+}
+
+func (vs *VersionStore) GetLastCommitTs() common.Timestamp_t {
+	vs.latch.Lock()
+	defer vs.latch.Unlock()
+	return vs.lastCommitTs
+}
+
+// Number of changes written so far. Rows only get versions when they are written, so while it
+// stays the same TableVersions has no new rows.
+func (vs *VersionStore) GetWriteCount() uint64 {
+	vs.latch.Lock()
+	defer vs.latch.Unlock()
+	return vs.writes
+}
+
+// Remembers what a row was before the transaction changes it. before is the raw tuple the
+// heap has in that slot, nil if it has none, and deleted says if the change removes the row.
+// The page of the row must be write latched until the change is in the heap, so no reader
+// sees the change without its version.
+func (vs *VersionStore) Write(txn *Transaction, rid common.RID, before []byte, deleted bool) {
+	vs.latch.Lock()
+	defer vs.latch.Unlock()
+
+	vs.writes++
+	ts := txn.getTempTs()
+	chain, ok := vs.chains[rid]
+	if !ok {
+		// Committed before anybody running began
+		chain = &versionChain{head: tuple.TupleMeta{Timestamp: 0, IsDeleted: before == nil}}
+		vs.chains[rid] = chain
+	}
+	if chain.head.Timestamp == ts {
+		// The version from before the transaction is kept already
+		chain.head.IsDeleted = deleted
+		return
+	}
+	previous := TupleVersion{
+		Meta: tuple.TupleMeta{Timestamp: chain.head.Timestamp, IsDeleted: before == nil},
+		Data: before,
+	}
+	chain.undo = slices.Insert(chain.undo, 0, previous)
+	chain.head = tuple.TupleMeta{Timestamp: ts, IsDeleted: deleted}
+	vs.written[txn.GetTxnId()] = append(vs.written[txn.GetTxnId()], rid)
+}
+
+// Returns the version of the row the transaction sees, nil if it sees no row. heap is what
+// the heap has in the slot now (nil if nothing), read while the page is latched.
+func (vs *VersionStore) Visible(txn *Transaction, rid common.RID, heap []byte) []byte {
+	vs.latch.Lock()
+	defer vs.latch.Unlock()
+	return vs.visible(txn, rid, heap)
+}
+
+// Visible for every slot of a page, heap has the raw tuples of the page by slot
+func (vs *VersionStore) VisibleRows(txn *Transaction, pageId common.PageID_t, heap [][]byte) [][]byte {
+	vs.latch.Lock()
+	defer vs.latch.Unlock()
+
+	rows := make([][]byte, len(heap))
+	for slot := range heap {
+		rows[slot] = vs.visible(txn, *common.NewRID(pageId, uint32(slot)), heap[slot])
+	}
+	return rows
+}
+
+func (vs *VersionStore) visible(txn *Transaction, rid common.RID, heap []byte) []byte {
+	chain, ok := vs.chains[rid]
+	if !ok || txn == nil || vs.canSee(txn, &chain.head) {
+		return heap
+	}
+	for _, version := range chain.undo {
+		if vs.canSee(txn, &version.Meta) {
+			return version.Data
+		}
+	}
+	// The row didn't exist yet
+	return nil
+}
+
+func (vs *VersionStore) canSee(txn *Transaction, meta *tuple.TupleMeta) bool {
+	if meta.IsUncommitted() {
+		return meta.Timestamp == txn.getTempTs()
+	}
+	return meta.Timestamp <= txn.GetReadTs()
+}
+
+// Rows of a table with versions, the ones that may look different to each transaction
+func (vs *VersionStore) TableVersions(fileId common.FileID_t) []common.RID {
+	vs.latch.Lock()
+	defer vs.latch.Unlock()
+
+	rids := []common.RID{}
+	for rid := range vs.chains {
+		if rid.PageID.GetFileId() == fileId {
+			rids = append(rids, rid)
+		}
+	}
+	slices.SortFunc(rids, func(a, b common.RID) int {
+		return cmp.Compare(a.Get(), b.Get())
+	})
+	return rids
+}
+
+// Number of rows with versions
+func (vs *VersionStore) Len() int {
+	vs.latch.Lock()
+	defer vs.latch.Unlock()
+	return len(vs.chains)
+}
+
+// The transaction sees what was committed until now
+func (vs *VersionStore) begin(txn *Transaction) {
+	vs.latch.Lock()
+	defer vs.latch.Unlock()
+	txn.readTs = vs.lastCommitTs
+}
+
+// Gives the transaction its commit timestamp, and stamps it on the versions it wrote so the
+// transactions that begin after it can see them
+func (vs *VersionStore) commit(txn *Transaction) {
+	vs.latch.Lock()
+	defer vs.latch.Unlock()
+
+	vs.lastCommitTs++
+	txn.commitTs = vs.lastCommitTs
+	for _, rid := range vs.written[txn.GetTxnId()] {
+		chain := vs.chains[rid]
+		if chain.head.Timestamp == txn.getTempTs() {
+			chain.head.Timestamp = txn.commitTs
+			continue
+		}
+		for i := range chain.undo {
+			if chain.undo[i].Meta.Timestamp == txn.getTempTs() {
+				chain.undo[i].Meta.Timestamp = txn.commitTs
+			}
+		}
+	}
+	delete(vs.written, txn.GetTxnId())
+}
+
+// Drops the versions of a transaction that was rolled back, its changes are not in the heap
+// anymore
+func (vs *VersionStore) abort(txn *Transaction) {
+	vs.latch.Lock()
+	defer vs.latch.Unlock()
+
+	for _, rid := range vs.written[txn.GetTxnId()] {
+		chain := vs.chains[rid]
+		if chain.head.Timestamp == txn.getTempTs() {
+			chain.head = chain.undo[0].Meta
+			chain.undo = chain.undo[1:]
+		} else {
+			chain.undo = slices.DeleteFunc(chain.undo, func(version TupleVersion) bool {
+				return version.Meta.Timestamp == txn.getTempTs()
+			})
+		}
+		if len(chain.undo) == 0 && chain.head.Timestamp == 0 {
+			delete(vs.chains, rid)
+		}
+	}
+	delete(vs.written, txn.GetTxnId())
+}
+
+// FLAG_ALGORITMO: garbage collection de versiones
+// Drops the versions that no transaction can see anymore. watermark is the oldest read
+// timestamp of the running transactions: a row only needs its newest version committed at
+// or before it, and the ones after. Rows whose heap version is that one don't need any.
+func (vs *VersionStore) GarbageCollect(watermark common.Timestamp_t) {
+	vs.latch.Lock()
+	defer vs.latch.Unlock()
+
+	for rid, chain := range vs.chains {
+		if !chain.head.IsUncommitted() && chain.head.Timestamp <= watermark {
+			delete(vs.chains, rid)
+			continue
+		}
+		for i, version := range chain.undo {
+			if !version.Meta.IsUncommitted() && version.Meta.Timestamp <= watermark {
+				chain.undo = chain.undo[:i+1]
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package concurrency_test
+
+import (
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/concurrency"
+	"fisi/elenadb/pkg/recovery"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotVisibility(t *testing.T) {
+	tm := concurrency.NewTransactionManager(newLogManager(t), concurrency.NewLockManager(), nil)
+	vs := tm.GetVersionStore()
+	row := rid(1, 0)
+	elena, eduardo := []byte("elena"), []byte("eduardo")
+
+	// Rows nobody changed are seen as they are in the heap
+	before := tm.Begin()
+	assert.Equal(t, elena, vs.Visible(before, row, elena))
+
+	writer := tm.Begin()
+	vs.Write(writer, row, elena, false)
+	vs.Write(writer, row, eduardo, false)
+	assert.Equal(t, eduardo, vs.Visible(writer, row, eduardo))
+	assert.Equal(t, elena, vs.Visible(before, row, eduardo))
+
+	// Committed, but after the snapshot of before
+	assert.Nil(t, tm.Commit(writer))
+	after := tm.Begin()
+	assert.Equal(t, elena, vs.Visible(before, row, eduardo))
+	assert.Equal(t, eduardo, vs.Visible(after, row, eduardo))
+
+	// A deleted row is still there for the ones that began before the delete
+	deleter := tm.Begin()
+	vs.Write(deleter, row, eduardo, true)
+	assert.Nil(t, vs.Visible(deleter, row, nil))
+	assert.Equal(t, eduardo, vs.Visible(after, row, nil))
+	assert.Nil(t, tm.Commit(deleter))
+	assert.Equal(t, eduardo, vs.Visible(after, row, nil))
+	assert.Equal(t, elena, vs.Visible(before, row, nil))
+
+	// A row inserted after the snapshot is not in it
+	inserter := tm.Begin()
+	vs.Write(inserter, rid(1, 1), nil, false)
+	assert.Nil(t, tm.Commit(inserter))
+	assert.Nil(t, vs.Visible(after, rid(1, 1), elena))
+	assert.Equal(t, []common.RID{rid(1, 0), rid(1, 1)}, vs.TableVersions(1))
+	assert.Empty(t, vs.TableVersions(2))
+}
+
+func TestAbortedVersionsAreDropped(t *testing.T) {
+	tm := concurrency.NewTransactionManager(newLogManager(t), concurrency.NewLockManager(), func(*concurrency.Transaction, *recovery.LogRecord) error {
+		return nil
+	})
+	vs := tm.GetVersionStore()
+	row := rid(1, 0)
+
+	reader := tm.Begin()
+	writer := tm.Begin()
+	vs.Write(writer, row, []byte("elena"), true)
+	assert.Nil(t, vs.Visible(writer, row, nil))
+	assert.Nil(t, tm.Abort(writer))
+
+	// The heap has the row back, and nobody needs a version of it
+	assert.Equal(t, []byte("elena"), vs.Visible(reader, row, []byte("elena")))
+	assert.Equal(t, 0, vs.Len())
+}
+
+func TestVersionGarbageCollection(t *testing.T) {
+	tm := concurrency.NewTransactionManager(newLogManager(t), concurrency.NewLockManager(), nil)
+	vs := tm.GetVersionStore()
+	row := rid(1, 0)
+
+	// Versions are kept while a transaction that may need them runs
+	reader := tm.Begin()
+	for i := 0; i < 3; i++ {
+		writer := tm.Begin()
+		vs.Write(writer, row, []byte{byte(i)}, false)
+		assert.Nil(t, tm.Commit(writer))
+	}
+	assert.Equal(t, common.Timestamp_t(3), vs.GetLastCommitTs())
+	assert.Equal(t, reader.GetReadTs(), tm.GetWatermark())
+	assert.Equal(t, 1, vs.Len())
+	assert.Equal(t, []byte{0}, vs.Visible(reader, row, []byte{3}))
+
+	// The newest version is in the heap, so nobody needs the old ones
+	assert.Nil(t, tm.Commit(reader))
+	assert.Equal(t, vs.GetLastCommitTs(), tm.GetWatermark())
+	assert.Equal(t, 0, vs.Len())
+}
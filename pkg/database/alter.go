@@ -0,0 +1,578 @@
+package database
+
+import (
+	"fisi/elenadb/internal/query"
+	"fisi/elenadb/pkg/catalog"
+	"fisi/elenadb/pkg/concurrency"
+	"fisi/elenadb/pkg/meta"
+	"fisi/elenadb/pkg/storage/table/tuple"
+	"fisi/elenadb/pkg/storage/table/value"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// "cambia tabla" changes the columns of a table that may already have rows. The sql of the
+// table in elena_meta stays a "creame tabla" with the columns it has now, so the catalog built
+// from it on boot is the same one the statement leaves.
+//   - "agrega" adds nullable columns after the others, NULL in the rows already stored
+//   - "quita" removes a column and the indexes on it. @id columns and columns referenced by a
+//     fkey column can't be removed
+//   - "renombra" changes the name of a column, and follows it in its indexes, its identity
+//     sequence and the fkey columns that reference it
+//
+// "agrega" and "quita" change how the rows are stored, so the heap is copied as in "limpia
+// tabla", converting the rows on the way, and its indexes are rebuilt. The new sql is stored
+// together with PENDING_HEAP_ROOT before the copy is renamed over the heap, and cleared once
+// the indexes follow it: if Elena dies in between, the boot finishes the rewrite (see
+// finishHeapRewrites).
+//
+// "renombra" changes several rows of elena_meta, each one in a transaction of its own. The
+// statement is stored in elena_meta first, as a PENDING_ALTER_TYPE row, and removed once
+// every row was changed: if Elena dies in between, the boot runs it again (see
+// finishColumnRenames).
+
+// Root of the elena_meta row of a table whose new heap is still in "<table>.table.vacuum",
+// or whose indexes don't follow it yet. Tables have no root, it's always 0 otherwise
+const PENDING_HEAP_ROOT = 1
+
+// Type of the elena_meta rows of the "cambia tabla" that didn't finish, only "renombra" stores
+// them. Their name is the table and their sql the statement
+const PENDING_ALTER_TYPE = "alter"
+
+// Runs a bound "cambia tabla" on its table
+func (db *ElenaDB) AlterTable(txn *concurrency.Transaction, alter *query.Query) error {
+	switch alter.QueryAlterInstr {
+	case query.AlterAdd:
+		return db.addColumns(txn, alter)
+	case query.AlterDrop:
+		return db.dropColumn(txn, alter)
+	case query.AlterRename:
+		return db.renameColumn(alter)
+	default:
+		return fmt.Errorf("unknown \"cambia tabla\" action \"%s\"", alter.QueryAlterInstr)
+	}
+}
+
+// Checks the columns the statement adds, removes or renames, and that the new sql of the table
+// fits in elena_meta
+func (db *ElenaDB) bindAlterTable(tableMetadata *catalog.TableMetadata, alter *query.Query) error {
+	switch alter.QueryAlterInstr {
+	case query.AlterAdd:
+		columnsSet := make(map[string]bool)
+		for _, col := range tableMetadata.Schema.GetColumns() {
+			columnsSet[col.ColumnName] = true
+		}
+		for idx := range alter.Fields {
+			field := &alter.Fields[idx]
+			if columnsSet[field.Name] {
+				return fmt.Errorf("Column \"%s\" is duplicated", field.Name)
+			}
+			if err := catalog.CheckName(field.Name); err != nil {
+				return err
+			}
+			// The rows already stored get NULL, and @id and @unique columns are not nullable
+			if !field.Nullable {
+				return fmt.Errorf("Column \"%s\" is added to the rows already stored, it must be nullable", field.Name)
+			}
+			if field.HasAnnotation(query.AnnotationId) || field.HasAnnotation(query.AnnotationUnique) {
+				return fmt.Errorf("Column \"%s\" is nullable, it cannot be @id nor @unique", field.Name)
+			}
+			if field.HasAnnotation(query.AnnotationCascade) && !field.Foreign {
+				return fmt.Errorf("Column \"%s\" is @cascada but it's not a fkey", field.Name)
+			}
+			if field.Foreign {
+				referenced, refIdx, err := db.referencedColumn(field.ForeignPath)
+				if err != nil {
+					return err
+				}
+				field.Type = referenced.Schema.GetColumn(refIdx).ColumnType
+				field.Length = referenced.Schema.GetColumn(refIdx).StorageSize
+			}
+			columnsSet[field.Name] = true
+		}
+
+	case query.AlterDrop:
+		colIdx, err := alteredColumn(tableMetadata, alter)
+		if err != nil {
+			return err
+		}
+		col := tableMetadata.Schema.GetColumn(colIdx)
+		if col.IsIdentity {
+			return fmt.Errorf("column \"%s\" is @id and cannot be removed", col.ColumnName)
+		}
+		for _, reference := range db.referencesTo(tableMetadata) {
+			if reference.referenced == colIdx {
+				return fmt.Errorf(
+					"column \"%s\" is referenced by \"%s.%s\"",
+					col.ColumnName, reference.table.Name,
+					reference.table.Schema.GetColumn(reference.column).ColumnName,
+				)
+			}
+		}
+
+	case query.AlterRename:
+		colIdx, err := alteredColumn(tableMetadata, alter)
+		if err != nil {
+			return err
+		}
+		newName := alter.QueryAlterNewName
+		if newName == meta.ELENA_RID_GHOST_COLUMN_NAME {
+			return fmt.Errorf("\"%s\" is the name of a ghost column", newName)
+		}
+		if err := catalog.CheckName(newName); err != nil {
+			return err
+		}
+		for _, col := range tableMetadata.Schema.GetColumns() {
+			if col.ColumnName == newName {
+				return fmt.Errorf("Column \"%s\" is duplicated", newName)
+			}
+		}
+		if tableMetadata.Schema.GetColumn(colIdx).IsIdentity {
+			sequence := identitySequenceName(tableMetadata.Name, newName)
+			if db.Catalog.SequenceMetadataMap[sequence] != nil {
+				return fmt.Errorf("sequence \"%s\" already exists", sequence)
+			}
+		}
+	}
+
+	_, err := alteredTableFields(tableMetadata, alter)
+	return err
+}
+
+// Index of the column "quita" and "renombra" work on
+func alteredColumn(tableMetadata *catalog.TableMetadata, alter *query.Query) (int, error) {
+	name := alter.Fields[0].Name
+	if idx := columnIndex(tableMetadata, name); idx >= 0 {
+		return idx, nil
+	}
+	return 0, ColumnNotFoundError{name, tableMetadata.Name}
+}
+
+// Index of the column in the table, -1 if it has none with that name
+func columnIndex(tableMetadata *catalog.TableMetadata, name string) int {
+	for idx, col := range tableMetadata.Schema.GetColumns() {
+		if col.ColumnName == name {
+			return idx
+		}
+	}
+	return -1
+}
+
+// Columns of the "creame tabla" the table has once the statement is done
+func alteredTableFields(tableMetadata *catalog.TableMetadata, alter *query.Query) ([]query.QueryField, error) {
+	fields, err := parseTableFields(tableMetadata.SqlCreate)
+	if err != nil {
+		return nil, err
+	}
+
+	switch alter.QueryAlterInstr {
+	case query.AlterAdd:
+		fields = append(fields, alter.Fields...)
+	case query.AlterDrop:
+		altered := make([]query.QueryField, 0, len(fields))
+		for _, field := range fields {
+			if field.Name != alter.Fields[0].Name {
+				altered = append(altered, field)
+			}
+		}
+		fields = altered
+	case query.AlterRename:
+		oldPath := fmt.Sprintf("%s.%s", tableMetadata.Name, alter.Fields[0].Name)
+		for idx := range fields {
+			if fields[idx].Name == alter.Fields[0].Name {
+				fields[idx].Name = alter.QueryAlterNewName
+			}
+			// a fkey column can reference a column of its own table
+			if fields[idx].Foreign && fields[idx].ForeignPath == oldPath {
+				fields[idx].ForeignPath = fmt.Sprintf("%s.%s", tableMetadata.Name, alter.QueryAlterNewName)
+			}
+		}
+	}
+
+	if sql := tableSql(tableMetadata.Name, fields); len(sql) > int(meta.ElenaMetaSchema.GetColumn(4).StorageSize) {
+		return nil, fmt.Errorf("the sql of table \"%s\" would be too long: %s", tableMetadata.Name, sql)
+	}
+	return fields, nil
+}
+
+// Parses the columns of a "creame tabla", the types of its fkey columns are not resolved
+func parseTableFields(sql string) ([]query.QueryField, error) {
+	parsed, err := query.NewParser().Parse(strings.NewReader(sql))
+	if err != nil {
+		return nil, err
+	}
+	return parsed[0].Fields, nil
+}
+
+func tableSql(table string, fields []query.QueryField) string {
+	createQuery := &query.Query{
+		QueryType:      query.QueryCreate,
+		QueryInstrName: table,
+		Fields:         fields,
+	}
+	return createQuery.AsQueryText()
+}
+
+// Stores the sql of the table in elena_meta, along with root, and takes its schema from it.
+// The types of the fkey columns have to be resolved again afterwards
+func (db *ElenaDB) storeTableSql(tableMetadata *catalog.TableMetadata, fields []query.QueryField, root int) error {
+	sql := tableSql(tableMetadata.Name, fields)
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil,
+		fmt.Sprintf(
+			"cambia en %s { sql: \"%s\", root: %d } si (file_id == %d) pe",
+			meta.ELENA_META_TABLE_NAME, sql, root, tableMetadata.FileID,
+		), false)
+	if err != nil {
+		return err
+	}
+	for result := range tuples {
+		if result.IsError() {
+			return result.Error
+		}
+	}
+
+	parsed, err := query.NewParser().Parse(strings.NewReader(sql))
+	if err != nil {
+		return err
+	}
+	tableMetadata.SqlCreate = sql
+	tableMetadata.Schema = *parsed[0].GetSchema()
+	return nil
+}
+
+// Copies the heap with its rows converted, and puts the copy in place along with the new sql.
+// The indexes on columns the table doesn't have anymore are dropped, and the others are
+// rebuilt against the new RIDs
+func (db *ElenaDB) rewriteTable(tableMetadata *catalog.TableMetadata, fields []query.QueryField, convert func(*tuple.Tuple) *tuple.Tuple) error {
+	if _, err := db.copyHeap(tableMetadata, convert); err != nil {
+		return err
+	}
+	if err := db.storeTableSql(tableMetadata, fields, PENDING_HEAP_ROOT); err != nil {
+		os.Remove(db.newHeapPath(tableMetadata.Name))
+		return err
+	}
+	if err := db.resolveForeignColumns(); err != nil {
+		return err
+	}
+	if err := db.replaceHeap(tableMetadata); err != nil {
+		return err
+	}
+	if err := db.dropStaleIndexes(tableMetadata); err != nil {
+		return err
+	}
+	for _, indexMetadata := range db.Catalog.GetTableIndexes(tableMetadata.Name) {
+		if err := db.rebuildIndex(tableMetadata, indexMetadata); err != nil {
+			return err
+		}
+	}
+	return db.clearPendingHeap(tableMetadata)
+}
+
+// Drops the indexes of the table on columns it doesn't have anymore
+func (db *ElenaDB) dropStaleIndexes(tableMetadata *catalog.TableMetadata) error {
+	for _, indexMetadata := range db.Catalog.GetTableIndexes(tableMetadata.Name) {
+		for _, keyCol := range indexMetadata.KeySchema.GetColumns() {
+			if columnIndex(tableMetadata, keyCol.ColumnName) < 0 {
+				if err := db.dropIndex(indexMetadata.Name); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (db *ElenaDB) clearPendingHeap(tableMetadata *catalog.TableMetadata) error {
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil,
+		fmt.Sprintf(
+			"cambia en %s { root: 0 } si (file_id == %d) pe",
+			meta.ELENA_META_TABLE_NAME, tableMetadata.FileID,
+		), false)
+	if err != nil {
+		return err
+	}
+	for result := range tuples {
+		if result.IsError() {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+func (db *ElenaDB) addColumns(txn *concurrency.Transaction, alter *query.Query) error {
+	tableMetadata, err := db.wholeTableStatement(txn, alter.QueryInstrName)
+	if err != nil {
+		return err
+	}
+	fields, err := alteredTableFields(tableMetadata, alter)
+	if err != nil {
+		return err
+	}
+
+	return db.rewriteTable(tableMetadata, fields, func(t *tuple.Tuple) *tuple.Tuple {
+		values := append([]value.Value{}, t.Values...)
+		for _, field := range alter.Fields {
+			values = append(values, *value.NewNullValue(field.Type))
+		}
+		return tuple.NewFromValues(values)
+	})
+}
+
+func (db *ElenaDB) dropColumn(txn *concurrency.Transaction, alter *query.Query) error {
+	tableMetadata, err := db.wholeTableStatement(txn, alter.QueryInstrName)
+	if err != nil {
+		return err
+	}
+	colIdx, err := alteredColumn(tableMetadata, alter)
+	if err != nil {
+		return err
+	}
+	fields, err := alteredTableFields(tableMetadata, alter)
+	if err != nil {
+		return err
+	}
+
+	// The indexes on the column are dropped once the new heap is in place
+	return db.rewriteTable(tableMetadata, fields, func(t *tuple.Tuple) *tuple.Tuple {
+		values := make([]value.Value, 0, len(t.Values)-1)
+		values = append(values, t.Values[:colIdx]...)
+		values = append(values, t.Values[colIdx+1:]...)
+		return tuple.NewFromValues(values)
+	})
+}
+
+// The rows are stored the same way, only the sql of the table, the ones of the tables that
+// reference the column, and the indexes and the sequence named after it change
+func (db *ElenaDB) renameColumn(alter *query.Query) error {
+	tableMetadata := db.Catalog.GetTableMetadata(alter.QueryInstrName)
+	if tableMetadata == nil || tableMetadata.Name == meta.ELENA_META_TABLE_NAME {
+		return TableDoesNotExistError{table: alter.QueryInstrName}
+	}
+	if _, err := alteredColumn(tableMetadata, alter); err != nil {
+		return err
+	}
+
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil,
+		fmt.Sprintf(
+			"mete { type: \"%s\", name: \"%s\", root: 0, sql: \"%s\" } en %s retornando { file_id } pe",
+			PENDING_ALTER_TYPE, tableMetadata.Name, renameSql(alter), meta.ELENA_META_TABLE_NAME,
+		), false)
+	if err != nil {
+		return err
+	}
+	result := <-tuples
+	if result == nil {
+		return fmt.Errorf("unable to store the rename of \"%s.%s\"", tableMetadata.Name, alter.Fields[0].Name)
+	}
+	if result.IsError() {
+		return result.Error
+	}
+	fileId := result.Value.Values[0].AsInt32()
+
+	if err := db.applyRename(tableMetadata, alter); err != nil {
+		return err
+	}
+	return db.clearPendingRename(fileId)
+}
+
+func renameSql(alter *query.Query) string {
+	return fmt.Sprintf(
+		"cambia tabla %s renombra %s a %s pe",
+		alter.QueryInstrName, alter.Fields[0].Name, alter.QueryAlterNewName,
+	)
+}
+
+// Changes the rows of elena_meta that name the column. Each step checks if it was done
+// already, the boot runs them again when Elena died halfway
+func (db *ElenaDB) applyRename(tableMetadata *catalog.TableMetadata, alter *query.Query) error {
+	oldName := alter.Fields[0].Name
+	newName := alter.QueryAlterNewName
+
+	// The column may have the new name already
+	colIdx := columnIndex(tableMetadata, oldName)
+	if colIdx < 0 {
+		colIdx = columnIndex(tableMetadata, newName)
+	}
+	if colIdx < 0 {
+		return ColumnNotFoundError{oldName, tableMetadata.Name}
+	}
+	if tableMetadata.Schema.GetColumn(colIdx).IsIdentity {
+		if sequence := db.Catalog.SequenceMetadataMap[identitySequenceName(tableMetadata.Name, oldName)]; sequence != nil {
+			if err := db.renameSequence(sequence, identitySequenceName(tableMetadata.Name, newName)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The paths of the fkey columns stop resolving once the column has another name. The ones
+	// of the table itself change along with it
+	oldPath := fmt.Sprintf("%s.%s", tableMetadata.Name, oldName)
+	for _, referencing := range db.Catalog.TableMetadataMap {
+		if referencing == tableMetadata || referencing.Name == meta.ELENA_META_TABLE_NAME {
+			continue
+		}
+		referencingFields, err := parseTableFields(referencing.SqlCreate)
+		if err != nil {
+			return err
+		}
+		changed := false
+		for idx := range referencingFields {
+			if referencingFields[idx].Foreign && referencingFields[idx].ForeignPath == oldPath {
+				referencingFields[idx].ForeignPath = fmt.Sprintf("%s.%s", tableMetadata.Name, newName)
+				changed = true
+			}
+		}
+		if changed {
+			if err := db.storeTableSql(referencing, referencingFields, 0); err != nil {
+				return err
+			}
+		}
+	}
+	fields, err := alteredTableFields(tableMetadata, alter)
+	if err != nil {
+		return err
+	}
+	if err := db.storeTableSql(tableMetadata, fields, 0); err != nil {
+		return err
+	}
+	if err := db.resolveForeignColumns(); err != nil {
+		return err
+	}
+
+	// The indexes are named after their columns: the one with the new name is created before
+	// the old one is dropped
+	for _, indexMetadata := range db.Catalog.GetTableIndexes(tableMetadata.Name) {
+		if !indexHasColumn(indexMetadata, oldName) {
+			continue
+		}
+		parsed, err := query.NewParser().Parse(strings.NewReader(indexMetadata.SqlCreate))
+		if err != nil {
+			return err
+		}
+		columnNames := []string{}
+		for idx := range parsed[0].Fields {
+			if parsed[0].Fields[idx].Name == oldName {
+				parsed[0].Fields[idx].Name = newName
+			}
+			columnNames = append(columnNames, parsed[0].Fields[idx].Name)
+		}
+		if db.Catalog.IndexMetadataMap[catalog.IndexName(tableMetadata.Name, columnNames)] == nil {
+			renamed, err := db.createIndex(tableMetadata.Name, parsed[0].GetSchema(), parsed[0].AsQueryText())
+			if err != nil {
+				return err
+			}
+			if err := db.buildIndex(tableMetadata, renamed); err != nil {
+				return err
+			}
+		}
+		if err := db.dropIndex(indexMetadata.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *ElenaDB) clearPendingRename(fileId int32) error {
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil,
+		fmt.Sprintf(
+			"borra de %s donde (file_id == %d) pe",
+			meta.ELENA_META_TABLE_NAME, fileId,
+		), false)
+	if err != nil {
+		return err
+	}
+	for result := range tuples {
+		if result.IsError() {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+func indexHasColumn(indexMetadata *catalog.IndexMetadata, name string) bool {
+	for _, keyCol := range indexMetadata.KeySchema.GetColumns() {
+		if keyCol.ColumnName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Puts in place the heaps a "cambia tabla" left in "<table>.table.vacuum", if Elena died after
+// storing the new sql of their tables. Returns whether it did, the indexes of those tables
+// have to be rebuilt
+func (db *ElenaDB) finishHeapRewrites() (bool, error) {
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil,
+		fmt.Sprintf(
+			"dame { file_id, name } de %s donde (type == \"table\" y root == %d) pe",
+			meta.ELENA_META_TABLE_NAME, PENDING_HEAP_ROOT,
+		), false)
+	if err != nil {
+		return false, err
+	}
+	pending := []*catalog.TableMetadata{}
+	for result := range tuples {
+		if result.IsError() {
+			return false, result.Error
+		}
+		if tableMetadata := db.Catalog.GetTableMetadata(result.Value.Values[1].AsVarchar()); tableMetadata != nil {
+			pending = append(pending, tableMetadata)
+		}
+	}
+
+	for _, tableMetadata := range pending {
+		db.log.Boot("finishing the rewrite of table '%s'", tableMetadata.Name)
+		if _, err := os.Stat(db.newHeapPath(tableMetadata.Name)); err == nil {
+			if err := db.replaceHeap(tableMetadata); err != nil {
+				return false, err
+			}
+		}
+		if err := db.dropStaleIndexes(tableMetadata); err != nil {
+			return false, err
+		}
+		if err := db.clearPendingHeap(tableMetadata); err != nil {
+			return false, err
+		}
+	}
+	return len(pending) > 0, nil
+}
+
+// Runs again the "renombra" Elena died in the middle of. Returns whether there were any, the
+// indexes they created may be half built. The fkey columns of the catalog are not resolved
+// yet: their paths may name the column the old way
+func (db *ElenaDB) finishColumnRenames() (bool, error) {
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil,
+		fmt.Sprintf(
+			"dame { file_id, sql } de %s donde (type == \"%s\") pe",
+			meta.ELENA_META_TABLE_NAME, PENDING_ALTER_TYPE,
+		), false)
+	if err != nil {
+		return false, err
+	}
+	pending := map[int32]string{}
+	for result := range tuples {
+		if result.IsError() {
+			return false, result.Error
+		}
+		pending[result.Value.Values[0].AsInt32()] = result.Value.Values[1].AsVarchar()
+	}
+
+	for fileId, sql := range pending {
+		db.log.Boot("finishing '%s'", sql)
+		parsed, err := query.NewParser().Parse(strings.NewReader(sql))
+		if err != nil {
+			return false, err
+		}
+		if tableMetadata := db.Catalog.GetTableMetadata(parsed[0].QueryInstrName); tableMetadata != nil {
+			if err := db.applyRename(tableMetadata, &parsed[0]); err != nil {
+				return false, err
+			}
+		}
+		if err := db.clearPendingRename(fileId); err != nil {
+			return false, err
+		}
+	}
+	return len(pending) > 0, nil
+}
@@ -16,9 +16,12 @@ import (
 	"fisi/elenadb/internal/query"
 	"fisi/elenadb/pkg/buffer"
 	"fisi/elenadb/pkg/catalog"
+	"fisi/elenadb/pkg/catalog/column"
 	"fisi/elenadb/pkg/catalog/schema"
 	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/concurrency"
 	"fisi/elenadb/pkg/meta"
+	storage "fisi/elenadb/pkg/storage/index"
 	"fisi/elenadb/pkg/storage/table/tuple"
 	"fisi/elenadb/pkg/storage/table/value"
 	"fisi/elenadb/pkg/utils"
@@ -26,6 +29,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 )
 
@@ -37,27 +41,66 @@ type ElenaDB struct {
 	// Whether this instance created the database for the first time
 	IsJustCreated bool
 	Catalog       *catalog.Catalog
+	// B+ trees of the indexes loaded in memory, by index name ("<table>.<column>")
+	indexes map[string]*storage.BPTree
+	// Free-space maps of the tables written since the boot, by file id
+	freeSpaceMaps  map[common.FileID_t]*FreeSpaceMap
+	freeSpaceLatch sync.Mutex
+	// Taken while a sequence hands out a value, see nextValue
+	sequenceLatch sync.Mutex
 	log           *common.Logger
 	NextQueryID   atomic.Uint32
+	txnManager    *concurrency.TransactionManager
+	lockManager   *concurrency.LockManager
+	// Sessions not closed yet, their open transactions are rolled back by RestInPeace
+	sessions      map[*Session]struct{}
+	sessionsLatch sync.Mutex
+}
+
+// Optional settings of StartElenaBusiness
+type ElenaOption func(*elenaOptions)
+
+type elenaOptions struct {
+	bufferPoolSize uint32
+}
+
+// Number of frames (pages) the buffer pool keeps in memory. Defaults to common.BufferPoolSize
+func WithBufferPoolSize(frames uint32) ElenaOption {
+	return func(opts *elenaOptions) {
+		opts.bufferPoolSize = frames
+	}
 }
 
 // Creates the Elena Instance. Should be called only once per process.
 // Long live to ELENA! WE LOVE ELENA! 🚄!!
-func StartElenaBusiness(dbPath string) (*ElenaDB, error) {
+func StartElenaBusiness(dbPath string, options ...ElenaOption) (*ElenaDB, error) {
+	opts := elenaOptions{bufferPoolSize: common.BufferPoolSize}
+	for _, option := range options {
+		option(&opts)
+	}
+	if opts.bufferPoolSize == 0 {
+		return nil, fmt.Errorf("the buffer pool needs at least one frame")
+	}
+
 	dbPath = utils.WithTrailingSlash(dbPath)
 	common.GloablDbDir = dbPath
 	common.DebugEnabled.Store(false)
 
 	ctlg := catalog.EmptyCatalog()
-	bpm := buffer.NewBufferPoolManager(dbPath, common.BufferPoolSize, common.LRUKReplacerK, ctlg)
+	bpm := buffer.NewBufferPoolManager(dbPath, opts.bufferPoolSize, common.LRUKReplacerK, ctlg)
 
 	elena := &ElenaDB{
 		DbPath:        dbPath,
 		bufferPool:    bpm,
 		IsJustCreated: false,
 		Catalog:       ctlg,
+		indexes:       make(map[string]*storage.BPTree),
 		log:           common.NewLogger('🚄'),
+		freeSpaceMaps: make(map[common.FileID_t]*FreeSpaceMap),
+		sessions:      make(map[*Session]struct{}),
 	}
+	elena.lockManager = concurrency.NewLockManager()
+	elena.txnManager = concurrency.NewTransactionManager(bpm.LogManager(), elena.lockManager, elena.rollbackRecord)
 	elena.log.Boot("\n🌫  ElenaDB just started")
 
 	err := elena.CreateDatabaseIfNotExists()
@@ -65,6 +108,18 @@ func StartElenaBusiness(dbPath string) (*ElenaDB, error) {
 		return nil, err
 	}
 
+	// The header page is never behind the files, recovery only adds pages after those
+	err = bpm.LoadPageCounts()
+	if err != nil {
+		return nil, err
+	}
+
+	// If Elena died, the tables are left as they were after the last commit
+	recovered, err := elena.recover()
+	if err != nil {
+		return nil, fmt.Errorf("unable to recover the database: %s", err.Error())
+	}
+
 	err = elena.CreateMetaTableIfNotExists()
 	if err != nil {
 		return nil, err
@@ -75,6 +130,32 @@ func StartElenaBusiness(dbPath string) (*ElenaDB, error) {
 		return nil, err
 	}
 
+	// A "cambia tabla" may have died before putting the new heap of its table in place
+	rewritten, err := elena.finishHeapRewrites()
+	if err != nil {
+		return nil, err
+	}
+	// or in the middle of renaming a column
+	renamed, err := elena.finishColumnRenames()
+	if err != nil {
+		return nil, err
+	}
+	err = elena.resolveForeignColumns()
+	if err != nil {
+		return nil, err
+	}
+
+	err = elena.loadIndexes(recovered || rewritten || renamed)
+	if err != nil {
+		return nil, err
+	}
+
+	if recovered {
+		if err := elena.checkpoint(nil); err != nil {
+			return nil, err
+		}
+	}
+	elena.lockManager.StartDeadlockDetection()
 	return elena, nil
 }
 
@@ -83,8 +164,9 @@ func (elena *ElenaDB) PopulateCatalog() error {
 	elena.log.Boot("populating catalog")
 	tableMetadataMap := make(map[string]*catalog.TableMetadata)
 	indexMetadataMap := make(map[string]*catalog.IndexMetadata)
+	sequenceMetadataMap := make(map[string]*catalog.SequenceMetadata)
 
-	tuples, _, _, _, err := elena.ExecuteThisBaby("dame todo de elena_meta pe", false)
+	tuples, _, _, _, err := elena.ExecuteThisBaby(nil, "dame todo de elena_meta pe", false)
 	if err != nil {
 		return err
 	}
@@ -109,17 +191,56 @@ func (elena *ElenaDB) PopulateCatalog() error {
 				Schema:    *tableSchema[0].GetSchema(),
 			}
 		} else if fileType == "index" {
+			parser := query.NewParser()
+			indexQuery, err := parser.Parse(strings.NewReader(sql))
+			if err != nil {
+				return err
+			}
 			indexMetadataMap[name] = &catalog.IndexMetadata{
 				Name:      name,
 				FileID:    common.FileID_t(fileId),
 				Root:      common.PageID_t(root),
 				SqlCreate: sql,
+				KeySchema: *indexQuery[0].GetSchema(),
+			}
+		} else if fileType == SEQUENCE_FILE_TYPE {
+			// Sequences have no file, root is the next value to hand out
+			sequenceMetadataMap[name] = &catalog.SequenceMetadata{
+				Name:      name,
+				FileID:    common.FileID_t(fileId),
+				Next:      root,
+				SqlCreate: sql,
 			}
 		}
 	}
 
 	elena.Catalog.TableMetadataMap = tableMetadataMap
 	elena.Catalog.IndexMetadataMap = indexMetadataMap
+	elena.Catalog.SequenceMetadataMap = sequenceMetadataMap
+	return nil
+}
+
+// The trees are already on disk, we just need their roots and key schemas to open them. After
+// a recovery they are rebuilt instead: changes to the indexes are not logged, so they may be
+// missing entries or have half-written pages.
+func (elena *ElenaDB) loadIndexes(rebuild bool) error {
+	for name, indexMetadata := range elena.Catalog.IndexMetadataMap {
+		if rebuild {
+			elena.log.Boot("rebuilding index '%s'", name)
+			tableMetadata := elena.Catalog.GetTableMetadata(indexMetadata.TableName())
+			if err := elena.rebuildIndex(tableMetadata, indexMetadata); err != nil {
+				return fmt.Errorf("unable to rebuild index \"%s\": %s", name, err.Error())
+			}
+			continue
+		}
+
+		elena.log.Boot("loading index '%s' (root=%s)", name, indexMetadata.Root.ToString())
+		tree, err := storage.OpenBPTree(elena.bufferPool, indexMetadata.FileID, indexMetadata.Root, &indexMetadata.KeySchema)
+		if err != nil {
+			return fmt.Errorf("unable to open index \"%s\": %s", name, err.Error())
+		}
+		elena.indexes[name] = tree
+	}
 	return nil
 }
 
@@ -132,14 +253,15 @@ func (tr *TupleResult) IsError() bool {
 	return tr.Error != nil
 }
 
-// Executes a SQL query. The steps are as follows:
+// Executes a SQL query in the transaction open in session, if any. Without a session (nil)
+// the query is a transaction of its own. The steps are as follows:
 // - (sqlPipeline) Parse the query
 // - (sqlPipeline) Analize/bind the query
 // - (sqlPipeline) Optimize the query
 // - Make a plan based on the query
 // - Optimize the plan
 // - Execute the plan, fetching the tuples one by one
-func (db *ElenaDB) ExecuteThisBaby(input string, isExplain bool) (chan *TupleResult, *schema.Schema, *query.Query, PlanNode, error) {
+func (db *ElenaDB) ExecuteThisBaby(session *Session, input string, isExplain bool) (chan *TupleResult, *schema.Schema, *query.Query, PlanNode, error) {
 	if CheckForEspecialQueries(input) {
 		return nil, nil, nil, nil, nil
 	}
@@ -161,14 +283,26 @@ func (db *ElenaDB) ExecuteThisBaby(input string, isExplain bool) (chan *TupleRes
 	}
 	nodePlan = OptimizeQueryPlan(nodePlan)
 
+	txn, implicit, err := db.statementTransaction(session, parsedQuery)
+	if err != nil {
+		db.log.Error("query(%d): %s", queryId, err.Error())
+		return nil, nil, nil, nil, err
+	}
+	setTransaction(nodePlan, txn)
+	if txnPlan, ok := nodePlan.(*TransactionPlanNode); ok {
+		txnPlan.Session = session
+	}
+
 	count := 0
 	tuples := make(chan *TupleResult)
 	if !isExplain {
 		go func() {
+			failed := false
 			for {
 				tuple, err := nodePlan.Next() // executor
 				if err != nil {
 					tuples <- &TupleResult{Value: nil, Error: err}
+					failed = true
 					break
 				}
 				if tuple == nil {
@@ -177,10 +311,19 @@ func (db *ElenaDB) ExecuteThisBaby(input string, isExplain bool) (chan *TupleRes
 				count++
 				tuples <- &TupleResult{Value: tuple, Error: nil}
 			}
+			if err := db.finishStatement(session, txn, implicit, failed); err != nil {
+				tuples <- &TupleResult{Value: nil, Error: err}
+			}
 			db.log.Info("query(%d): -> %d tuples", queryId, count)
 			close(tuples)
 		}()
 	} else {
+		if implicit {
+			if err := db.txnManager.Commit(txn); err != nil {
+				db.log.Error("query(%d): %s", queryId, err.Error())
+				return nil, nil, nil, nil, err
+			}
+		}
 		close(tuples)
 	}
 	return tuples, nodePlan.Schema(), parsedQuery, nodePlan, nil
@@ -219,7 +362,7 @@ func (db *ElenaDB) CreateMetaTableIfNotExists() error {
 	}
 
 	db.log.Boot("creating meta table 'elena_meta.table'")
-	result, _, _, _, err := db.ExecuteThisBaby(meta.ELENA_META_CREATE_SQL, false)
+	result, _, _, _, err := db.ExecuteThisBaby(nil, meta.ELENA_META_CREATE_SQL, false)
 	if err != nil {
 		return err
 	}
@@ -337,29 +480,17 @@ func (db *ElenaDB) sqlPipeline(input string) (*query.Query, error) {
 					if col.IsIdentity {
 						return nil, fmt.Errorf("column \"%s\" is @id and cannot be inserted", col.ColumnName)
 					}
-					// Parser parses all values as string, so we need to resolve them to their respective types
-					resolvedValue, err := resolveAnyValueFromType(col.ColumnType, field.Value)
+					var resolvedField *query.QueryField
+					var err error
+					if _, ok := field.Value.(query.NextValue); ok {
+						resolvedField, err = db.bindNextValue(tableMetaData.Name, col, field)
+					} else {
+						resolvedField, err = bindFieldToColumn(tableMetaData.Name, col, field)
+					}
 					if err != nil {
 						return nil, err
 					}
-
-					if col.ColumnType == value.TypeVarChar && len(field.Value.(string)) > int(col.StorageSize) {
-						return nil, fmt.Errorf(
-							"column \"%s\" is char(%d), but \"%s\" has length %d",
-							col.ColumnName, col.StorageSize, field.Value, len(field.Value.(string)),
-						)
-					}
-
-					resolvedFields = append(resolvedFields, query.QueryField{
-						Foreign:     col.IsForeign,
-						Name:        fmt.Sprintf("%s.%s", tableMetaData.Name, col.ColumnName),
-						Type:        col.ColumnType,
-						Length:      uint8(col.StorageSize),
-						Value:       resolvedValue,
-						ForeignPath: "",
-						Nullable:    col.IsNullable,
-						Annotations: []string{},
-					})
+					resolvedFields = append(resolvedFields, *resolvedField)
 					exists = true
 				}
 			}
@@ -408,19 +539,167 @@ func (db *ElenaDB) sqlPipeline(input string) (*query.Query, error) {
 		parsedQuery.Returning = revisedReturning
 	}
 
+	// cambia tabla
+	if parsedQuery.QueryType == query.QueryUpdate && parsedQuery.QueryAlterInstr != "" {
+		tableMetaData := db.Catalog.GetTableMetadata(parsedQuery.QueryInstrName)
+		if tableMetaData == nil || tableMetaData.Name == meta.ELENA_META_TABLE_NAME {
+			return nil, TableDoesNotExistError{table: parsedQuery.QueryInstrName}
+		}
+		if err := db.bindAlterTable(tableMetaData, parsedQuery); err != nil {
+			return nil, err
+		}
+		return parsedQuery, nil
+	}
+
+	// cambia
+	if parsedQuery.QueryType == query.QueryUpdate {
+		tableMetaData := db.Catalog.GetTableMetadata(parsedQuery.QueryInstrName)
+		if tableMetaData == nil {
+			return nil, TableDoesNotExistError{table: parsedQuery.QueryInstrName}
+		}
+
+		// Unlike "mete", "cambia" only carries the columns that are being assigned, so we
+		// keep the user's order and just check that each one exists and gets a valid value
+		assignedFields := make(map[string]bool)
+		resolvedFields := make([]query.QueryField, 0, len(parsedQuery.Fields))
+
+		for _, field := range parsedQuery.Fields {
+			if assignedFields[field.Name] {
+				return nil, fmt.Errorf("Column \"%s\" is assigned more than once", field.Name)
+			}
+			assignedFields[field.Name] = true
+
+			exists := false
+			for _, col := range tableMetaData.Schema.GetColumns() {
+				if field.Name != col.ColumnName {
+					continue
+				}
+				if col.IsIdentity {
+					return nil, fmt.Errorf("column \"%s\" is @id and cannot be changed", col.ColumnName)
+				}
+				resolvedField, err := bindFieldToColumn(tableMetaData.Name, col, field)
+				if err != nil {
+					return nil, err
+				}
+				resolvedFields = append(resolvedFields, *resolvedField)
+				exists = true
+				break
+			}
+			if !exists {
+				return nil, ColumnNotFoundError{field.Name, tableMetaData.Name}
+			}
+		}
+		parsedQuery.Fields = resolvedFields
+	}
+
+	// creame indice
+	if parsedQuery.QueryType == query.QueryCreate && parsedQuery.QueryIndexInstr {
+		tableMetaData := db.Catalog.GetTableMetadata(parsedQuery.QueryInstrName)
+		if tableMetaData == nil || tableMetaData.Name == meta.ELENA_META_TABLE_NAME {
+			return nil, TableDoesNotExistError{table: parsedQuery.QueryInstrName}
+		}
+
+		// The types of the table columns are copied to the query, so the sql stored in
+		// elena_meta has the whole key schema
+		columnNames := make([]string, 0, len(parsedQuery.Fields))
+		for idx := range parsedQuery.Fields {
+			field := &parsedQuery.Fields[idx]
+			for _, name := range columnNames {
+				if name == field.Name {
+					return nil, fmt.Errorf("Column \"%s\" is duplicated", field.Name)
+				}
+			}
+
+			exists := false
+			for _, col := range tableMetaData.Schema.GetColumns() {
+				if col.ColumnName != field.Name {
+					continue
+				}
+				if field.Type != "" && (field.Type != col.ColumnType || field.Length != col.StorageSize) {
+					return nil, fmt.Errorf("column \"%s\" is not of type %s", field.Name, field.AsString())
+				}
+				field.Type = col.ColumnType
+				field.Length = col.StorageSize
+				exists = true
+			}
+			if !exists {
+				return nil, ColumnNotFoundError{field.Name, tableMetaData.Name}
+			}
+			columnNames = append(columnNames, field.Name)
+		}
+		if _, err := storage.NewKeyComparator(parsedQuery.GetSchema()); err != nil {
+			return nil, err
+		}
+
+		indexName := catalog.IndexName(tableMetaData.Name, columnNames)
+		if db.Catalog.IndexMetadataMap[indexName] != nil {
+			return nil, fmt.Errorf("index \"%s\" already exists", indexName)
+		}
+		return parsedQuery, nil
+	}
+
+	// borra indice
+	if parsedQuery.QueryType == query.QueryErase && parsedQuery.QueryIndexInstr {
+		if db.Catalog.IndexMetadataMap[parsedQuery.QueryInstrName] == nil {
+			return nil, fmt.Errorf("index \"%s\" does not exist", parsedQuery.QueryInstrName)
+		}
+		return parsedQuery, nil
+	}
+
+	// limpia tabla
+	if parsedQuery.QueryType == query.QueryVacuum {
+		tableMetaData := db.Catalog.GetTableMetadata(parsedQuery.QueryInstrName)
+		if tableMetaData == nil || tableMetaData.Name == meta.ELENA_META_TABLE_NAME {
+			return nil, TableDoesNotExistError{table: parsedQuery.QueryInstrName}
+		}
+		return parsedQuery, nil
+	}
+
+	// borra tabla, trunca tabla
+	if parsedQuery.QueryType == query.QueryTruncate || (parsedQuery.QueryType == query.QueryErase && parsedQuery.QueryTableInstr) {
+		tableMetaData := db.Catalog.GetTableMetadata(parsedQuery.QueryInstrName)
+		if tableMetaData == nil || tableMetaData.Name == meta.ELENA_META_TABLE_NAME {
+			return nil, TableDoesNotExistError{table: parsedQuery.QueryInstrName}
+		}
+		if err := db.checkNotReferencedTable(tableMetaData); err != nil {
+			return nil, err
+		}
+		return parsedQuery, nil
+	}
+
+	// creame secuencia
+	if parsedQuery.QueryType == query.QueryCreate && parsedQuery.QuerySequenceInstr {
+		name := parsedQuery.QueryInstrName
+		if db.Catalog.SequenceMetadataMap[name] != nil || db.Catalog.GetTableMetadata(name) != nil || db.Catalog.IndexMetadataMap[name] != nil {
+			return nil, fmt.Errorf("name \"%s\" is already in use", name)
+		}
+		return parsedQuery, nil
+	}
+
 	// creame
 	if parsedQuery.QueryType == query.QueryCreate {
+		if err := catalog.CheckName(parsedQuery.QueryInstrName); err != nil {
+			return nil, err
+		}
 		columnsSet := make(map[string]bool)
 
 		identityCols := 0
-		for _, field := range parsedQuery.Fields {
+		for idx := range parsedQuery.Fields {
+			field := &parsedQuery.Fields[idx]
 			if columnsSet[field.Name] {
 				return nil, fmt.Errorf("Column \"%s\" is duplicated", field.Name)
 			}
+			if err := catalog.CheckName(field.Name); err != nil {
+				return nil, err
+			}
 			if field.HasAnnotation(query.AnnotationId) {
 				if field.Nullable {
 					return nil, fmt.Errorf("Column \"%s\" is @id and cannot be nullable", field.Name)
 				}
+				sequence := identitySequenceName(parsedQuery.QueryInstrName, field.Name)
+				if db.Catalog.SequenceMetadataMap[sequence] != nil {
+					return nil, fmt.Errorf("sequence \"%s\" already exists", sequence)
+				}
 				identityCols++
 			}
 			if field.HasAnnotation(query.AnnotationUnique) {
@@ -428,6 +707,21 @@ func (db *ElenaDB) sqlPipeline(input string) (*query.Query, error) {
 					return nil, fmt.Errorf("Column \"%s\" is @unique and cannot be nullable", field.Name)
 				}
 			}
+			if field.HasAnnotation(query.AnnotationCascade) && !field.Foreign {
+				return nil, fmt.Errorf("Column \"%s\" is @cascada but it's not a fkey", field.Name)
+			}
+			// The foreign columns take the type of the column they reference
+			if field.Foreign {
+				if field.HasAnnotation(query.AnnotationId) {
+					return nil, fmt.Errorf("Column \"%s\" is a fkey and cannot be @id", field.Name)
+				}
+				referenced, refIdx, err := db.referencedColumn(field.ForeignPath)
+				if err != nil {
+					return nil, err
+				}
+				field.Type = referenced.Schema.GetColumn(refIdx).ColumnType
+				field.Length = referenced.Schema.GetColumn(refIdx).StorageSize
+			}
 			columnsSet[field.Name] = true
 		}
 		if identityCols != 1 {
@@ -440,6 +734,43 @@ func (db *ElenaDB) sqlPipeline(input string) (*query.Query, error) {
 	return parsedQuery, nil
 }
 
+// Type-checks a value given by the user against the column it is assigned to, and
+// returns the field resolved to the column's type and storage size.
+func bindFieldToColumn(tableName string, col column.Column, field query.QueryField) (*query.QueryField, error) {
+	if field.Value == nil && !col.IsNullable {
+		return nil, fmt.Errorf("column \"%s\" is not nullable", col.ColumnName)
+	}
+
+	// Parser parses all values as string, so we need to resolve them to their respective
+	// types. NULL (nil) stays nil
+	var resolvedValue any
+	if field.Value != nil {
+		var err error
+		resolvedValue, err = resolveAnyValueFromType(col.ColumnType, field.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if col.ColumnType == value.TypeVarChar && field.Value != nil && len(field.Value.(string)) > int(col.StorageSize) {
+		return nil, fmt.Errorf(
+			"column \"%s\" is char(%d), but \"%s\" has length %d",
+			col.ColumnName, col.StorageSize, field.Value, len(field.Value.(string)),
+		)
+	}
+
+	return &query.QueryField{
+		Foreign:     col.IsForeign,
+		Name:        fmt.Sprintf("%s.%s", tableName, col.ColumnName),
+		Type:        col.ColumnType,
+		Length:      uint8(col.StorageSize),
+		Value:       resolvedValue,
+		ForeignPath: "",
+		Nullable:    col.IsNullable,
+		Annotations: []string{},
+	}, nil
+}
+
 // The parser parses all values as string, so we need to resolve them to their
 // respective types.
 // TODO: Test if this works
@@ -464,7 +795,7 @@ func resolveAnyValueFromType(vType value.ValueType, val any) (any, error) {
 		if err != nil {
 			return nil, InvalidValueForTypeError{vvalType: vType, val: val.(string)}
 		}
-		return v, nil
+		return float32(v), nil
 	default:
 		return nil, fmt.Errorf("Unknown value type: %s", vType)
 	}
@@ -497,5 +828,21 @@ func (e ColumnNotFoundError) Error() string {
 }
 
 func (e *ElenaDB) RestInPeace() {
-	e.bufferPool.FlushEntirePool() // clueless
+	// A transaction left open is lost, like if Elena had died
+	e.sessionsLatch.Lock()
+	sessions := make([]*Session, 0, len(e.sessions))
+	for session := range e.sessions {
+		sessions = append(sessions, session)
+	}
+	e.sessionsLatch.Unlock()
+	for _, session := range sessions {
+		if err := session.Close(); err != nil {
+			e.log.Error("unable to roll back the open transaction: %s", err.Error())
+		}
+	}
+	// Nothing is left to recover from: the pages are on disk and the log is emptied
+	if err := e.checkpoint(nil); err != nil {
+		e.log.Error("unable to checkpoint: %s", err.Error())
+	}
+	e.lockManager.StopDeadlockDetection()
 }
@@ -0,0 +1,825 @@
+package database
+
+import (
+	"fisi/elenadb/pkg/meta"
+	"fisi/elenadb/pkg/storage/page"
+	"fisi/elenadb/pkg/storage/table/tuple"
+	"fisi/elenadb/pkg/storage/table/value"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBufferPoolSizeOption(t *testing.T) {
+	if _, err := StartElenaBusiness(t.TempDir(), WithBufferPoolSize(0)); err == nil {
+		t.Fatal("expected an empty buffer pool to be rejected")
+	}
+
+	// Pages are evicted all the time with the smallest pool the B+ tree can work with
+	db, err := StartElenaBusiness(t.TempDir(), WithBufferPoolSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla notas { id int @id, curso char(200), } pe")
+	for i := 0; i < 100; i++ {
+		execAll(t, db, fmt.Sprintf("mete { curso: \"curso %d\" } en notas pe", i))
+	}
+	if n := execAll(t, db, "dame todo de notas pe"); n != 100 {
+		t.Fatalf("expected 100 rows, got %d", n)
+	}
+	if n := execAll(t, db, "dame todo de notas donde (id >= 40 y id < 60) pe"); n != 20 {
+		t.Fatalf("expected 20 rows through the index, got %d", n)
+	}
+}
+
+// Full table scans of ~130 pages. With 10 frames every page is read from disk on each scan,
+// with 10,000 frames the whole table stays in memory.
+func BenchmarkSeqScan(b *testing.B) {
+	const rows = 2000
+
+	for _, frames := range []uint32{10, 10_000} {
+		b.Run(fmt.Sprintf("frames=%d", frames), func(b *testing.B) {
+			db, err := StartElenaBusiness(b.TempDir(), WithBufferPoolSize(frames))
+			if err != nil {
+				b.Fatal(err)
+			}
+			execAll(b, db, "creame tabla alumnos { id int @id, nombre char(255), } pe")
+			for i := 0; i < rows; i++ {
+				execAll(b, db, fmt.Sprintf("mete { nombre: \"%0200d\" } en alumnos pe", i))
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if n := execAll(b, db, "dame todo de alumnos pe"); n != rows {
+					b.Fatalf("expected %d rows, got %d", rows, n)
+				}
+			}
+			b.ReportMetric(float64(rows*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+func TestPageCountsSurviveRestarts(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla notas { id int @id, curso char(200), } pe")
+	insertNotas := func(db *ElenaDB, from, to int) {
+		for i := from; i < to; i++ {
+			execAll(t, db, fmt.Sprintf("mete { curso: \"curso %d\" } en notas pe", i))
+		}
+	}
+	insertNotas(db, 0, 100)
+	fileId := db.Catalog.GetTableMetadata("notas").FileID
+	pages := db.bufferPool.PageCount(fileId)
+	db.RestInPeace()
+	pagesFile := filepath.Join(dir, meta.ELENA_PAGES_FILE)
+	if _, err := os.Stat(pagesFile); err != nil {
+		t.Fatalf("expected the header page with the page counts: %v", err)
+	}
+
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := db.bufferPool.PageCount(fileId); count != pages {
+		t.Fatalf("expected %d pages on boot, got %d", pages, count)
+	}
+
+	// Without a clean shutdown the header page has the pages that made it to disk, and
+	// recovery adds the ones that only the log has
+	insertNotas(db, 100, 200)
+	pages = db.bufferPool.PageCount(fileId)
+
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := db.bufferPool.PageCount(fileId); count != pages {
+		t.Fatalf("expected %d pages after a crash, got %d", pages, count)
+	}
+	if _, err := os.Stat(pagesFile); err != nil {
+		t.Fatalf("expected the header page to stay after the boot: %v", err)
+	}
+	insertNotas(db, 200, 250)
+	if n := execAll(t, db, "dame todo de notas pe"); n != 250 {
+		t.Fatalf("expected 250 rows, got %d", n)
+	}
+}
+
+// elena_meta keeps the five columns it always had, so a database written before the page counts
+// were stored can still be opened
+func TestOpensAFiveColumnCatalog(t *testing.T) {
+	dir := t.TempDir()
+	writePage := func(name string, lastInsertedId int32, rows ...[]value.Value) {
+		heap := page.NewSelfContainedSlottedPage()
+		for _, values := range rows {
+			if _, err := heap.AppendTuple(tuple.NewFromValues(values)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		heap.SetLastInsertedId(lastInsertedId)
+		if err := os.WriteFile(filepath.Join(dir, name), heap.AsRawPageData(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sql := "creame tabla notas { id int @id, curso char(20), } pe"
+	writePage(meta.ELENA_META_TABLE_FILE, 1, []value.Value{
+		*value.NewInt32Value(1),
+		*value.NewVarCharValue("table", 5),
+		*value.NewVarCharValue("notas", 255),
+		*value.NewInt32Value(0),
+		*value.NewVarCharValue(sql, 255),
+	})
+	writePage("notas.table", 2,
+		[]value.Value{*value.NewInt32Value(1), *value.NewVarCharValue("algebra", 20)},
+		[]value.Value{*value.NewInt32Value(2), *value.NewVarCharValue("fisica", 20)},
+	)
+
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableMetadata := db.Catalog.GetTableMetadata("notas")
+	if tableMetadata == nil || tableMetadata.SqlCreate != sql {
+		t.Fatalf("expected table notas in the catalog, got %v", tableMetadata)
+	}
+	if n := execAll(t, db, "dame todo de notas donde (curso == \"fisica\") pe"); n != 1 {
+		t.Fatalf("expected the row stored before, got %d rows", n)
+	}
+	if count := db.bufferPool.PageCount(tableMetadata.FileID); count != 1 {
+		t.Fatalf("expected the page count to be looked up on disk, got %d", count)
+	}
+}
+
+func TestInsertsUseTheFreeSpaceMap(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla alumnos { id int @id, nombre char(250), } pe")
+	fileId := db.Catalog.GetTableMetadata("alumnos").FileID
+
+	// Long names leave a gap at the end of every page that a long name doesn't fit in
+	for i := 0; i < 60; i++ {
+		execAll(t, db, fmt.Sprintf("mete { nombre: \"%0250d\" } en alumnos pe", i))
+	}
+	pages := db.bufferPool.PageCount(fileId)
+	if pages < 3 {
+		t.Fatalf("expected the table to take several pages, got %d", pages)
+	}
+
+	// Short names go to those gaps instead of a new page, and still get the next identities
+	for i := 0; i < 20; i++ {
+		execAll(t, db, fmt.Sprintf("mete { nombre: \"corto %d\" } en alumnos pe", i))
+	}
+	if count := db.bufferPool.PageCount(fileId); count != pages {
+		t.Fatalf("expected the short names to fit in the %d pages, the table has %d", pages, count)
+	}
+	if n := execAll(t, db, "dame todo de alumnos donde (id >= 60 y id < 80) pe"); n != 20 {
+		t.Fatalf("expected 20 short names with new identities, got %d", n)
+	}
+
+	// Deleting tells the map how many bytes the page has now
+	fsm := db.freeSpaceMap(fileId)
+	before := fsm.free[0]
+	execAll(t, db, "borra de alumnos donde (id == 0) pe")
+	if fsm.free[0] <= before {
+		t.Fatalf("expected page 0 to have more than %d free bytes after the delete, got %d", before, fsm.free[0])
+	}
+
+	// After a restart the map is built from the page headers, and identities keep counting
+	db.RestInPeace()
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		execAll(t, db, fmt.Sprintf("mete { nombre: \"otro %d\" } en alumnos pe", i))
+	}
+	if count := db.bufferPool.PageCount(fileId); count != pages {
+		t.Fatalf("expected the table to keep %d pages after the restart, it has %d", pages, count)
+	}
+	if n := execAll(t, db, "dame todo de alumnos donde (id >= 80) pe"); n != 10 {
+		t.Fatalf("expected 10 rows with identities from 80, got %d", n)
+	}
+	if n := execAll(t, db, "dame todo de alumnos pe"); n != 89 {
+		t.Fatalf("expected 89 rows, got %d", n)
+	}
+}
+
+func TestDeletedSpaceIsReused(t *testing.T) {
+	db, err := StartElenaBusiness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla alumnos { id int @id, nombre char(250), } pe")
+	fileId := db.Catalog.GetTableMetadata("alumnos").FileID
+	for i := 0; i < 60; i++ {
+		execAll(t, db, fmt.Sprintf("mete { nombre: \"%0250d\" } en alumnos pe", i))
+	}
+	pages := db.bufferPool.PageCount(fileId)
+
+	// The rows deleted from the first pages make room for the same number of new ones, the
+	// pages are compacted as the new rows need the bytes
+	for _, from := range []int{0, 20, 60} {
+		deleted := execAll(t, db, fmt.Sprintf("borra de alumnos donde (id >= %d y id < %d) pe", from, from+20))
+		if deleted != 20 {
+			t.Fatalf("expected 20 rows deleted from id %d, got %d", from, deleted)
+		}
+		for i := 0; i < deleted; i++ {
+			execAll(t, db, fmt.Sprintf("mete { nombre: \"%0250d\" } en alumnos pe", i))
+		}
+	}
+	if count := db.bufferPool.PageCount(fileId); count != pages {
+		t.Fatalf("expected the table to keep %d pages, it has %d", pages, count)
+	}
+	if n := execAll(t, db, "dame todo de alumnos pe"); n != 60 {
+		t.Fatalf("expected 60 rows, got %d", n)
+	}
+	assertNoDrift(t, db, "alumnos.id")
+}
+
+func TestVacuumRewritesTheHeap(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla alumnos { id int @id, nombre char(250), } pe")
+	execAll(t, db, "creame indice en alumnos (nombre) pe")
+	fileId := db.Catalog.GetTableMetadata("alumnos").FileID
+	for i := 0; i < 90; i++ {
+		execAll(t, db, fmt.Sprintf("mete { nombre: \"%0250d\" } en alumnos pe", i))
+	}
+	pages := db.bufferPool.PageCount(fileId)
+	if deleted := execAll(t, db, "borra de alumnos donde (id > 10 y id <= 70) pe"); deleted != 60 {
+		t.Fatalf("expected 60 rows deleted, got %d", deleted)
+	}
+
+	execAll(t, db, "limpia tabla alumnos pe")
+	if count := db.bufferPool.PageCount(fileId); count >= pages {
+		t.Fatalf("expected the table to shrink from %d pages, it has %d", pages, count)
+	}
+	if n := execAll(t, db, "dame todo de alumnos pe"); n != 30 {
+		t.Fatalf("expected 30 rows, got %d", n)
+	}
+	assertNoDrift(t, db, "alumnos.id")
+	assertNoDrift(t, db, "alumnos.nombre")
+
+	// The identity goes on from where it was, and the new heap is the one used after a restart
+	execAll(t, db, "mete { nombre: \"nuevo\" } en alumnos pe")
+	if n := execAll(t, db, "dame todo de alumnos donde (id == 90) pe"); n != 1 {
+		t.Fatalf("expected the next id to be 90, got %d rows with it", n)
+	}
+	db.RestInPeace()
+
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := execAll(t, db, "dame todo de alumnos pe"); n != 31 {
+		t.Fatalf("expected 31 rows after a restart, got %d", n)
+	}
+	if n := execAll(t, db, "dame todo de alumnos donde (nombre == \"nuevo\") pe"); n != 1 {
+		t.Fatalf("expected to find the new row by nombre, got %d rows", n)
+	}
+	assertNoDrift(t, db, "alumnos.id")
+	assertNoDrift(t, db, "alumnos.nombre")
+
+	// Only existing tables can be vacuumed, and elena_meta is not one of them
+	for _, table := range []string{"elena_meta", "profesores"} {
+		if _, _, _, _, err := db.ExecuteThisBaby(nil, fmt.Sprintf("limpia tabla %s pe", table), false); err == nil {
+			t.Fatalf("expected vacuuming %s to fail", table)
+		}
+	}
+}
+
+func TestNullValues(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla alumnos { id int @id, nombre char(20), tutor int?, nota float?, } pe")
+	execAll(t, db, "creame indice en alumnos (tutor) pe")
+	for i := 0; i < 10; i++ {
+		if i%3 == 0 {
+			execAll(t, db, fmt.Sprintf("mete { nombre: \"alumno %d\" } en alumnos pe", i))
+		} else {
+			execAll(t, db, fmt.Sprintf("mete { nombre: \"alumno %d\", tutor: %d, nota: nulo } en alumnos pe", i, i%2))
+		}
+	}
+	if _, _, _, _, err := db.ExecuteThisBaby(nil, "mete { nombre: nulo } en alumnos pe", false); err == nil {
+		t.Fatal("expected nulo to be rejected in a column that is not nullable")
+	}
+
+	counts := map[string]int{
+		"dame todo de alumnos donde (tutor es nulo) pe":                4,
+		"dame todo de alumnos donde (tutor no es nulo) pe":             6,
+		"dame todo de alumnos donde (nota es nulo) pe":                 10,
+		"dame todo de alumnos donde (tutor == 0) pe":                   3,
+		"dame todo de alumnos donde (tutor != 0) pe":                   3,
+		"dame todo de alumnos donde (tutor < 1) pe":                    3,
+		"dame todo de alumnos donde (tutor == 0 o tutor es nulo) pe":   7,
+		"dame todo de alumnos donde (tutor != 0 y nombre != \"x\") pe": 3,
+		"dame todo de alumnos donde (tutor es nulo y id >= 3) pe":      3,
+		"dame todo de alumnos donde (nota != 1 o tutor no es nulo) pe": 6,
+	}
+	assertCounts := func() {
+		t.Helper()
+		for input, expected := range counts {
+			if n := execAll(t, db, input); n != expected {
+				t.Fatalf("%s: expected %d rows, got %d", input, expected, n)
+			}
+		}
+	}
+	assertCounts()
+	assertNoDrift(t, db, "alumnos.tutor")
+
+	// NULLs are printed as nulo, and go first when ordering through the index
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil, "dame todo de alumnos ordenado por tutor pe", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for result := range tuples {
+		if result.IsError() {
+			t.Fatal(result.Error)
+		}
+		got = append(got, result.Value.Values[2].FormatAsString())
+	}
+	expected := []string{"nulo", "nulo", "nulo", "nulo", "0", "0", "0", "1", "1", "1"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected tutors %v, got %v", expected, got)
+	}
+
+	// NULLs can be set and unset, and they are still there after a restart
+	execAll(t, db, "cambia en alumnos { tutor: nulo } si (id == 1) pe")
+	execAll(t, db, "cambia en alumnos { tutor: 5, nota: 20 } si (id == 0) pe")
+	// One tutor changed from 1 to NULL and another one from NULL to 5, so only nota changes
+	counts["dame todo de alumnos donde (nota es nulo) pe"] = 9
+	assertCounts()
+	assertNoDrift(t, db, "alumnos.tutor")
+	db.RestInPeace()
+
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCounts()
+}
+
+func TestForeignKeys(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla cursos { id int @id, codigo char(6) @unique, } pe")
+	execAll(t, db, "creame tabla notas { id int @id, curso fkey(cursos.id) @cascada, nota int, } pe")
+	execAll(t, db, "creame tabla matriculas { id int @id, curso fkey(cursos.codigo)?, } pe")
+	execErr(t, db, "creame tabla malas { id int @id, curso fkey(cursos.nada), } pe")
+	execErr(t, db, "creame tabla malas { id int @id, curso int @cascada, } pe")
+
+	for i := 0; i < 3; i++ {
+		execAll(t, db, fmt.Sprintf("mete { codigo: \"C%d\" } en cursos pe", i))
+	}
+	for i := 0; i < 9; i++ {
+		execAll(t, db, fmt.Sprintf("mete { curso: %d, nota: %d } en notas pe", i%3, i))
+	}
+	execAll(t, db, "mete { curso: \"C1\" } en matriculas pe")
+	execAll(t, db, "mete { curso: nulo } en matriculas pe")
+
+	// Only rows of courses that exist
+	execErr(t, db, "mete { curso: 7, nota: 10 } en notas pe")
+	execErr(t, db, "mete { curso: \"C9\" } en matriculas pe")
+	execErr(t, db, "cambia en notas { curso: 7 } si (id == 0) pe")
+	execAll(t, db, "cambia en notas { curso: 2 } si (id == 0) pe")
+
+	// C1 is still referenced by a matricula, which doesn't cascade
+	execErr(t, db, "borra de cursos donde (id == 1) pe")
+	execErr(t, db, "cambia en cursos { codigo: \"C7\" } si (id == 1) pe")
+	execAll(t, db, "cambia en cursos { codigo: \"C8\" } si (id == 0) pe")
+
+	// The notas of a course go away with it
+	if n := execAll(t, db, "borra de cursos donde (id == 2) pe"); n != 1 {
+		t.Fatalf("expected 1 course deleted, got %d", n)
+	}
+	if n := execAll(t, db, "dame todo de notas pe"); n != 5 {
+		t.Fatalf("expected 5 notas left, got %d", n)
+	}
+	assertNoDrift(t, db, "notas.id")
+
+	// The referenced column is stored with the table, its type comes back with the catalog
+	db.RestInPeace()
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execErr(t, db, "mete { curso: 2, nota: 10 } en notas pe")
+	execAll(t, db, "borra de matriculas donde (curso == \"C1\") pe")
+	execAll(t, db, "borra de cursos donde (id == 1) pe")
+	if n := execAll(t, db, "dame todo de notas pe"); n != 2 {
+		t.Fatalf("expected 2 notas left, got %d", n)
+	}
+}
+
+func TestSequences(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla alumnos { id int @id, codigo int, nombre char(20), } pe")
+	execAll(t, db, "creame secuencia codigos pe")
+	execErr(t, db, "creame secuencia alumnos pe")
+	execErr(t, db, "creame secuencia alumnos_id_seq pe")
+	execErr(t, db, "mete { codigo: siguiente(otra), nombre: \"x\" } en alumnos pe")
+	execErr(t, db, "mete { codigo: 1, nombre: siguiente(codigos) } en alumnos pe")
+
+	for i := 0; i < 3; i++ {
+		execAll(t, db, "mete { codigo: siguiente(codigos), nombre: \"alumno\" } en alumnos pe")
+	}
+	// Deleted and rolled back ids are not handed out again
+	execAll(t, db, "borra de alumnos donde (id == 2) pe")
+	session := db.NewSession()
+	execIn(t, db, session, "empieza pe")
+	execErrIn(t, db, session, "creame secuencia otra pe")
+	execIn(t, db, session, "mete { codigo: siguiente(codigos), nombre: \"deshecho\" } en alumnos pe")
+	execIn(t, db, session, "deshaz pe")
+	execAll(t, db, "mete { codigo: siguiente(codigos), nombre: \"alumno\" } en alumnos pe")
+	if n := execAll(t, db, "dame todo de alumnos donde (id == 4 y codigo == 4) pe"); n != 1 {
+		t.Fatalf("expected the row with id 4 and codigo 4, got %d rows", n)
+	}
+
+	// Elena dies without a shutdown, the sequences go on from the values stored in elena_meta
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "mete { codigo: siguiente(codigos), nombre: \"alumno\" } en alumnos pe")
+	if n := execAll(t, db, "dame todo de alumnos donde (id == 5 y codigo == 5) pe"); n != 1 {
+		t.Fatalf("expected the row with id 5 and codigo 5, got %d rows", n)
+	}
+	if n := execAll(t, db, "dame todo de alumnos pe"); n != 4 {
+		t.Fatalf("expected 4 rows, got %d", n)
+	}
+}
+
+func TestDropAndTruncateTable(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla cursos { id int @id, nombre char(20), } pe")
+	execAll(t, db, "creame tabla alumnos { id int @id, nombre char(20), curso fkey(cursos.id)?, } pe")
+	execAll(t, db, "creame indice en alumnos (nombre) pe")
+	execAll(t, db, "mete { nombre: \"fisica\" } en cursos pe")
+	for i := 0; i < 20; i++ {
+		execAll(t, db, fmt.Sprintf("mete { nombre: \"alumno %d\", curso: 0 } en alumnos pe", i))
+	}
+
+	// cursos is referenced by alumnos, and neither runs inside a transaction
+	execErr(t, db, "borra tabla cursos pe")
+	execErr(t, db, "trunca tabla cursos pe")
+	execErr(t, db, "borra tabla elena_meta pe")
+	execErr(t, db, "trunca tabla profesores pe")
+	session := db.NewSession()
+	execIn(t, db, session, "empieza pe")
+	execErrIn(t, db, session, "trunca tabla alumnos pe")
+	execIn(t, db, session, "deshaz pe")
+	execIn(t, db, session, "empieza pe")
+	execErrIn(t, db, session, "borra tabla alumnos pe")
+	execIn(t, db, session, "deshaz pe")
+
+	// The rows go away at once and the ids start from 0 again
+	execAll(t, db, "trunca tabla alumnos pe")
+	if n := execAll(t, db, "dame todo de alumnos pe"); n != 0 {
+		t.Fatalf("expected no rows after truncating, got %d", n)
+	}
+	execAll(t, db, "mete { nombre: \"nuevo\", curso: 0 } en alumnos pe")
+	if n := execAll(t, db, "dame todo de alumnos donde (id == 0 y nombre == \"nuevo\") pe"); n != 1 {
+		t.Fatalf("expected the new row to get id 0, got %d rows", n)
+	}
+	assertNoDrift(t, db, "alumnos.id")
+	assertNoDrift(t, db, "alumnos.nombre")
+
+	// Elena dies without a shutdown, the truncated table stays as it was left
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := execAll(t, db, "dame todo de alumnos pe"); n != 1 {
+		t.Fatalf("expected 1 row after a restart, got %d", n)
+	}
+	assertNoDrift(t, db, "alumnos.nombre")
+
+	// Once alumnos is gone, cursos can go too
+	execAll(t, db, "borra tabla alumnos pe")
+	execAll(t, db, "borra tabla cursos pe")
+	for _, file := range []string{"alumnos.table", "alumnos.nombre.index", "alumnos.id.index", "cursos.table"} {
+		if _, err := os.Stat(dir + "/" + file); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed", file)
+		}
+	}
+	if db.Catalog.GetTableMetadata("alumnos") != nil || db.Catalog.SequenceMetadataMap["alumnos_id_seq"] != nil {
+		t.Fatal("expected alumnos to be gone from the catalog")
+	}
+	execErr(t, db, "dame todo de alumnos pe")
+
+	// The name can be used again, and nothing of the old table comes back with a restart
+	execAll(t, db, "creame tabla alumnos { id int @id, apellido char(20), } pe")
+	execAll(t, db, "mete { apellido: \"perez\" } en alumnos pe")
+	db.RestInPeace()
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := execAll(t, db, "dame todo de alumnos donde (id == 0 y apellido == \"perez\") pe"); n != 1 {
+		t.Fatalf("expected the row of the new alumnos, got %d rows", n)
+	}
+	if db.Catalog.GetTableMetadata("cursos") != nil {
+		t.Fatal("expected cursos to stay dropped after a restart")
+	}
+}
+
+func TestAlterTable(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla cursos { id int @id, nombre char(20), } pe")
+	execAll(t, db, "creame tabla alumnos { id int @id, nombre char(20), curso fkey(cursos.id)?, } pe")
+	execAll(t, db, "creame indice en alumnos (nombre) pe")
+	execAll(t, db, "mete { nombre: \"fisica\" } en cursos pe")
+	for i := 0; i < 30; i++ {
+		execAll(t, db, fmt.Sprintf("mete { nombre: \"alumno %d\", curso: 0 } en alumnos pe", i))
+	}
+
+	execErr(t, db, "cambia tabla alumnos agrega { nota int, } pe")
+	execErr(t, db, "cambia tabla alumnos agrega { nota int? @unique, } pe")
+	execErr(t, db, "cambia tabla alumnos agrega { nombre char(5)?, } pe")
+	execErr(t, db, "cambia tabla alumnos quita id pe")
+	execErr(t, db, "cambia tabla alumnos quita nada pe")
+	execErr(t, db, "cambia tabla cursos quita id pe")
+	execErr(t, db, "cambia tabla alumnos renombra nombre a curso pe")
+	execErr(t, db, "cambia tabla elena_meta agrega { otra int?, } pe")
+	session := db.NewSession()
+	execIn(t, db, session, "empieza pe")
+	execErrIn(t, db, session, "cambia tabla alumnos quita nombre pe")
+	execIn(t, db, session, "deshaz pe")
+
+	// The rows already stored get NULL in the new columns
+	execAll(t, db, "cambia tabla alumnos agrega { nota int?, tutor fkey(alumnos.id)?, } pe")
+	if n := execAll(t, db, "dame todo de alumnos donde (nota es nulo y tutor es nulo) pe"); n != 30 {
+		t.Fatalf("expected 30 rows without nota, got %d", n)
+	}
+	if n := execAll(t, db, "cambia en alumnos { nota: 15, tutor: 0 } si (id < 10) pe"); n != 10 {
+		t.Fatalf("expected 10 rows changed, got %d", n)
+	}
+	execErr(t, db, "cambia en alumnos { tutor: 99 } si (id == 20) pe")
+	assertNoDrift(t, db, "alumnos.id")
+	assertNoDrift(t, db, "alumnos.nombre")
+
+	// The index on nombre goes away with it
+	execAll(t, db, "cambia tabla alumnos quita nombre pe")
+	if db.Catalog.IndexMetadataMap["alumnos.nombre"] != nil {
+		t.Fatal("expected the index on nombre to be dropped")
+	}
+	execErr(t, db, "dame { nombre } de alumnos pe")
+	if n := execAll(t, db, "dame todo de alumnos donde (nota == 15) pe"); n != 10 {
+		t.Fatalf("expected 10 rows with nota, got %d", n)
+	}
+	assertNoDrift(t, db, "alumnos.id")
+
+	// The fkey columns, the index and the sequence of cursos.id follow it
+	execAll(t, db, "cambia tabla cursos renombra id a codigo pe")
+	execAll(t, db, "cambia tabla alumnos renombra nota a calificacion pe")
+	execAll(t, db, "mete { nombre: \"quimica\" } en cursos pe")
+	if n := execAll(t, db, "dame todo de cursos donde (codigo == 1) pe"); n != 1 {
+		t.Fatalf("expected the new course to get codigo 1, got %d rows", n)
+	}
+	execAll(t, db, "mete { curso: 1, calificacion: 20 } en alumnos pe")
+	execErr(t, db, "mete { curso: 5 } en alumnos pe")
+	assertNoDrift(t, db, "cursos.codigo")
+
+	// Everything is back from elena_meta after a shutdown, and after a crash
+	sql := "creame tabla alumnos { id int @id, curso fkey(cursos.codigo)?, calificacion int?, tutor fkey(alumnos.id)?, } pe"
+	for _, shutdown := range []bool{true, false} {
+		if shutdown {
+			db.RestInPeace()
+		}
+		db, err = StartElenaBusiness(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := db.Catalog.GetTableMetadata("alumnos").SqlCreate; got != sql {
+			t.Fatalf("expected the sql of alumnos to be %s, got %s", sql, got)
+		}
+		if n := execAll(t, db, "dame todo de alumnos donde (calificacion >= 15) pe"); n != 11 {
+			t.Fatalf("expected 11 rows with calificacion, got %d", n)
+		}
+		if n := execAll(t, db, "dame todo de cursos donde (codigo == 1) pe"); n != 1 {
+			t.Fatalf("expected the course with codigo 1, got %d rows", n)
+		}
+		assertNoDrift(t, db, "alumnos.id")
+		assertNoDrift(t, db, "cursos.codigo")
+	}
+}
+
+func TestAlterTableFinishesTheRewriteOnBoot(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla alumnos { id int @id, nombre char(20), nota int, } pe")
+	execAll(t, db, "creame indice en alumnos (nombre) pe")
+	execAll(t, db, "creame indice en alumnos (nota) pe")
+	for i := 0; i < 10; i++ {
+		execAll(t, db, fmt.Sprintf("mete { nombre: \"alumno %d\", nota: %d } en alumnos pe", i, i+10))
+	}
+
+	// Elena dies once the new sql is stored, before the new heap is renamed over the old one
+	// and before the indexes follow it
+	alter, err := db.sqlPipeline("cambia tabla alumnos quita nombre pe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableMetadata, err := db.wholeTableStatement(nil, "alumnos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := alteredTableFields(tableMetadata, alter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.copyHeap(tableMetadata, func(heapTuple *tuple.Tuple) *tuple.Tuple {
+		return tuple.NewFromValues([]value.Value{heapTuple.Values[0], heapTuple.Values[2]})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.storeTableSql(tableMetadata, fields, PENDING_HEAP_ROOT); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := execAll(t, db, "dame todo de alumnos donde (nota >= 15) pe"); n != 5 {
+		t.Fatalf("expected 5 rows with nota >= 15, got %d", n)
+	}
+	execErr(t, db, "dame { nombre } de alumnos pe")
+	if db.Catalog.IndexMetadataMap["alumnos.nombre"] != nil {
+		t.Fatal("expected the index on nombre to be dropped")
+	}
+	assertNoDrift(t, db, "alumnos.id")
+	assertNoDrift(t, db, "alumnos.nota")
+}
+
+func TestRenameColumnFinishesOnBoot(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla cursos { id int @id, nombre char(20), } pe")
+	execAll(t, db, "creame tabla alumnos { id int @id, curso fkey(cursos.id), } pe")
+	execAll(t, db, "creame indice en cursos (id, nombre) pe")
+	for i := 0; i < 5; i++ {
+		execAll(t, db, fmt.Sprintf("mete { nombre: \"curso %d\" } en cursos pe", i))
+		execAll(t, db, fmt.Sprintf("mete { curso: %d } en alumnos pe", i))
+	}
+
+	// Elena dies once the sequence and the fkey column of alumnos have the new name, before
+	// the sql of cursos and its indexes do
+	alter, err := db.sqlPipeline("cambia tabla cursos renombra id a codigo pe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, fmt.Sprintf(
+		"mete { type: \"%s\", name: \"cursos\", root: 0, sql: \"%s\" } en %s pe",
+		PENDING_ALTER_TYPE, renameSql(alter), meta.ELENA_META_TABLE_NAME,
+	))
+	if err := db.renameSequence(db.Catalog.SequenceMetadataMap["cursos_id_seq"], "cursos_codigo_seq"); err != nil {
+		t.Fatal(err)
+	}
+	alumnos := db.Catalog.GetTableMetadata("alumnos")
+	fields, err := parseTableFields(alumnos.SqlCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields[1].ForeignPath = "cursos.codigo"
+	if err := db.storeTableSql(alumnos, fields, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql := "creame tabla cursos { codigo int @id, nombre char(20), } pe"
+	if got := db.Catalog.GetTableMetadata("cursos").SqlCreate; got != sql {
+		t.Fatalf("expected the sql of cursos to be %s, got %s", sql, got)
+	}
+	if db.Catalog.IndexMetadataMap["cursos.id"] != nil || db.Catalog.IndexMetadataMap["cursos.id.nombre"] != nil {
+		t.Fatal("expected the indexes named after id to be dropped")
+	}
+	execAll(t, db, "mete { nombre: \"curso 5\" } en cursos pe")
+	if n := execAll(t, db, "dame todo de cursos donde (codigo == 5) pe"); n != 1 {
+		t.Fatalf("expected the new course to get codigo 5, got %d rows", n)
+	}
+	execAll(t, db, "mete { curso: 5 } en alumnos pe")
+	execErr(t, db, "mete { curso: 9 } en alumnos pe")
+	if n := execAll(t, db, fmt.Sprintf("dame todo de %s donde (type == \"%s\") pe", meta.ELENA_META_TABLE_NAME, PENDING_ALTER_TYPE)); n != 0 {
+		t.Fatalf("expected the rename to be finished, %d are pending", n)
+	}
+	assertNoDrift(t, db, "cursos.codigo")
+	assertNoDrift(t, db, "cursos.codigo.nombre")
+}
+
+// RID of the only row matched by the filter, as the ghost column shows it
+func rowRid(t *testing.T, db *ElenaDB, table string, filter string) string {
+	t.Helper()
+	input := fmt.Sprintf("dame { rid } de %s donde %s pe", table, filter)
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil, input, false)
+	if err != nil {
+		t.Fatalf("%s: %v", input, err)
+	}
+	rids := []string{}
+	for result := range tuples {
+		if result.IsError() {
+			t.Fatalf("%s: %v", input, result.Error)
+		}
+		rids = append(rids, result.Value.Values[0].AsVarchar())
+	}
+	if len(rids) != 1 {
+		t.Fatalf("%s: expected 1 row, got %d", input, len(rids))
+	}
+	return rids[0]
+}
+
+func TestUpdate(t *testing.T) {
+	db, err := StartElenaBusiness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla alumnos { id int @id, codigo char(12) @unique, nombre char(200), } pe")
+	for i := 0; i < 100; i++ {
+		execAll(t, db, fmt.Sprintf("mete { codigo: \"c%d\", nombre: \"%0100d\" } en alumnos pe", i, i))
+	}
+
+	// A value of the same size is written over the old one, in its slot
+	rid := rowRid(t, db, "alumnos", "(id == 10)")
+	if n := execAll(t, db, fmt.Sprintf("cambia en alumnos { nombre: \"%0100d\" } si (id == 10) pe", 1000)); n != 1 {
+		t.Fatalf("expected 1 row updated, got %d", n)
+	}
+	if newRid := rowRid(t, db, "alumnos", fmt.Sprintf("(nombre == \"%0100d\")", 1000)); newRid != rid {
+		t.Fatalf("expected the row to stay at %s, it moved to %s", rid, newRid)
+	}
+
+	// The first page is full, so the grown row is moved to another one
+	rid = rowRid(t, db, "alumnos", "(id == 0)")
+	if n := execAll(t, db, fmt.Sprintf("cambia en alumnos { nombre: \"%0200d\" } si (id == 0) pe", 0)); n != 1 {
+		t.Fatalf("expected 1 row updated, got %d", n)
+	}
+	newRid := rowRid(t, db, "alumnos", fmt.Sprintf("(nombre == \"%0200d\")", 0))
+	if newRid == rid {
+		t.Fatalf("expected the grown row to be moved from %s", rid)
+	}
+	if newRid != rowRid(t, db, "alumnos", "(id == 0)") {
+		t.Fatal("expected the index to point to the moved row")
+	}
+	if n := execAll(t, db, "dame todo de alumnos pe"); n != 100 {
+		t.Fatalf("expected 100 rows, got %d", n)
+	}
+	assertNoDrift(t, db, "alumnos.id")
+
+	// @unique columns can't end up with a repeated value
+	for _, input := range []string{
+		"cambia en alumnos { codigo: \"c5\" } si (id == 6) pe",
+		"cambia en alumnos { codigo: \"nuevo\" } si (id >= 6 y id < 8) pe",
+	} {
+		if err := execErr(t, db, input); !strings.Contains(err.Error(), "@unique") {
+			t.Fatalf("%s: expected a @unique error, got %v", input, err)
+		}
+	}
+	if n := execAll(t, db, "dame todo de alumnos donde (codigo == \"c6\") pe"); n != 1 {
+		t.Fatalf("expected the rejected update to leave the row as it was, got %d rows", n)
+	}
+	execAll(t, db, "cambia en alumnos { codigo: \"c6\" } si (id == 6) pe")
+	execAll(t, db, "cambia en alumnos { codigo: \"nuevo\" } si (id == 6) pe")
+	if n := execAll(t, db, "dame todo de alumnos donde (codigo == \"nuevo\") pe"); n != 1 {
+		t.Fatalf("expected the unique value to be updated, got %d rows", n)
+	}
+}
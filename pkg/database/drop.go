@@ -0,0 +1,134 @@
+package database
+
+import (
+	"fisi/elenadb/pkg/catalog"
+	"fisi/elenadb/pkg/concurrency"
+	"fisi/elenadb/pkg/meta"
+	"fmt"
+	"os"
+)
+
+// "borra tabla" and "trunca tabla" work on the whole file of the table instead of its rows, so
+// they are not logged and can't be rolled back: like "limpia tabla" and "cambia tabla", they
+// run once the log is emptied, which only happens while theirs is the only transaction running.
+// A table referenced by a fkey column of another table can't be dropped nor truncated, its rows
+// would be left referencing nothing.
+
+// Removes the table: its indexes, its identity sequences, its elena_meta row, its pages in the
+// buffer pool, its catalog entry and its file. If Elena dies halfway, the elena_meta rows that
+// were deleted stay deleted and the files left behind are just not used anymore.
+func (db *ElenaDB) DropTable(txn *concurrency.Transaction, table string) error {
+	tableMetadata, err := db.wholeTableStatement(txn, table)
+	if err != nil {
+		return err
+	}
+	if err := db.checkNotReferencedTable(tableMetadata); err != nil {
+		return err
+	}
+
+	for _, indexMetadata := range db.Catalog.GetTableIndexes(table) {
+		if err := db.dropIndex(indexMetadata.Name); err != nil {
+			return err
+		}
+	}
+	for _, sequenceMetadata := range db.identitySequences(tableMetadata) {
+		if err := db.dropSequence(sequenceMetadata); err != nil {
+			return err
+		}
+	}
+
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil,
+		fmt.Sprintf(
+			"borra de %s donde (file_id == %d) pe",
+			meta.ELENA_META_TABLE_NAME, tableMetadata.FileID,
+		), false)
+	if err != nil {
+		return err
+	}
+	for result := range tuples {
+		if result.IsError() {
+			return result.Error
+		}
+	}
+
+	// The file is going away, so there is no point in flushing its pages
+	db.discardHeapPages(tableMetadata)
+	db.Catalog.DeleteTableMetadata(table)
+
+	return os.Remove(db.DbPath + table + ".table")
+}
+
+// Empties the table at once, leaving it as it was just after "creame": its file without pages,
+// its indexes without keys and its identity sequences starting from 0 again.
+func (db *ElenaDB) Truncate(txn *concurrency.Transaction, table string) error {
+	tableMetadata, err := db.wholeTableStatement(txn, table)
+	if err != nil {
+		return err
+	}
+	if err := db.checkNotReferencedTable(tableMetadata); err != nil {
+		return err
+	}
+
+	db.discardHeapPages(tableMetadata)
+	file, err := os.Create(db.DbPath + table + ".table")
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	for _, indexMetadata := range db.Catalog.GetTableIndexes(table) {
+		if err := db.rebuildIndex(tableMetadata, indexMetadata); err != nil {
+			return err
+		}
+	}
+	for _, sequenceMetadata := range db.identitySequences(tableMetadata) {
+		if err := db.resetSequence(sequenceMetadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks no running transaction sees old versions of the rows of the table, and empties the log
+// so it has no changes to its file. txn is the transaction of the statement, the only one that
+// may be running
+func (db *ElenaDB) wholeTableStatement(txn *concurrency.Transaction, table string) (*catalog.TableMetadata, error) {
+	tableMetadata := db.Catalog.GetTableMetadata(table)
+	if tableMetadata == nil || table == meta.ELENA_META_TABLE_NAME {
+		return nil, TableDoesNotExistError{table: table}
+	}
+
+	db.txnManager.GarbageCollect()
+	if len(db.txnManager.GetVersionStore().TableVersions(tableMetadata.FileID)) > 0 {
+		return nil, fmt.Errorf("running transactions still see old versions of the rows of \"%s\", try again once they end", table)
+	}
+
+	// Redo would write the logged changes to the old pages over the new file
+	if err := db.checkpoint(txn); err != nil {
+		return nil, err
+	}
+	return tableMetadata, nil
+}
+
+// Makes sure no other table has a fkey column referencing tableMetadata
+func (db *ElenaDB) checkNotReferencedTable(tableMetadata *catalog.TableMetadata) error {
+	for _, reference := range db.referencesTo(tableMetadata) {
+		if reference.table == tableMetadata {
+			continue
+		}
+		return fmt.Errorf(
+			"table \"%s\" is referenced by \"%s.%s\"",
+			tableMetadata.Name, reference.table.Name,
+			reference.table.Schema.GetColumn(reference.column).ColumnName,
+		)
+	}
+	return nil
+}
+
+// Forgets the pages of the heap kept in the buffer pool and its free-space map
+func (db *ElenaDB) discardHeapPages(tableMetadata *catalog.TableMetadata) {
+	db.bufferPool.DiscardFilePages(tableMetadata.FileID)
+	db.freeSpaceLatch.Lock()
+	delete(db.freeSpaceMaps, tableMetadata.FileID)
+	db.freeSpaceLatch.Unlock()
+}
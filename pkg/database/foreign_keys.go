@@ -0,0 +1,244 @@
+package database
+
+import (
+	"fisi/elenadb/internal/query"
+	"fisi/elenadb/pkg/catalog"
+	"fisi/elenadb/pkg/catalog/schema"
+	"fisi/elenadb/pkg/concurrency"
+	"fisi/elenadb/pkg/storage/table/value"
+	"fmt"
+	"strings"
+)
+
+// A fkey(table.column) column takes the type of the column it references, which must be @id or
+// @unique, and its values must be in that column. NULLs reference nothing.
+//   - "mete" and "cambia" check that the referenced rows exist
+//   - "borra" of a referenced row is rejected, or deletes the rows that reference it too if the
+//     foreign column is @cascada
+//   - "cambia" of a referenced column is rejected while it has rows referencing it
+//
+// The rows are looked up with a SeqScan that reads the newest rows and locks the table in S
+// mode, so nobody can delete the referenced row (or insert a referencing one) until the
+// transaction ends. It never runs with a page latched.
+
+// A foreign column of table, referencing the column referenced of another table
+type foreignReference struct {
+	table      *catalog.TableMetadata
+	column     int
+	referenced int
+	cascade    bool
+}
+
+// Resolves the "table.column" of a foreign column to the referenced table and the index of the
+// referenced column
+func (db *ElenaDB) referencedColumn(path string) (*catalog.TableMetadata, int, error) {
+	tableColumn := strings.Split(path, ".")
+	if len(tableColumn) != 2 {
+		return nil, 0, fmt.Errorf("fkey(%s) must reference a column as table.column", path)
+	}
+	tableMetadata := db.Catalog.TableMetadataMap[tableColumn[0]]
+	if tableMetadata == nil {
+		return nil, 0, TableDoesNotExistError{table: tableColumn[0]}
+	}
+	for idx, col := range tableMetadata.Schema.GetColumns() {
+		if col.ColumnName != tableColumn[1] {
+			continue
+		}
+		if !col.IsIdentity && !col.IsUnique {
+			return nil, 0, fmt.Errorf("fkey(%s) must reference an @id or @unique column", path)
+		}
+		return tableMetadata, idx, nil
+	}
+	return nil, 0, ColumnNotFoundError{tableColumn[1], tableColumn[0]}
+}
+
+// Copies the type of the referenced columns to the foreign columns of the tables in the
+// catalog. The sql of a table only has the fkey(table.column) of them
+func (db *ElenaDB) resolveForeignColumns() error {
+	for _, tableMetadata := range db.Catalog.TableMetadataMap {
+		columns := tableMetadata.Schema.GetColumns()
+		for idx := range columns {
+			if !columns[idx].IsForeign {
+				continue
+			}
+			referenced, refIdx, err := db.referencedColumn(columns[idx].ForeignPath)
+			if err != nil {
+				return err
+			}
+			columns[idx].ColumnType = referenced.Schema.GetColumn(refIdx).ColumnType
+			columns[idx].StorageSize = referenced.Schema.GetColumn(refIdx).StorageSize
+		}
+	}
+	return nil
+}
+
+// Foreign columns of every table (tableMetadata included) that reference a column of tableMetadata
+func (db *ElenaDB) referencesTo(tableMetadata *catalog.TableMetadata) []foreignReference {
+	references := []foreignReference{}
+	for _, child := range db.Catalog.TableMetadataMap {
+		for idx, col := range child.Schema.GetColumns() {
+			if !col.IsForeign {
+				continue
+			}
+			referenced, refIdx, err := db.referencedColumn(col.ForeignPath)
+			if err != nil || referenced != tableMetadata {
+				continue
+			}
+			references = append(references, foreignReference{
+				table:      child,
+				column:     idx,
+				referenced: refIdx,
+				cascade:    col.OnDeleteCascade,
+			})
+		}
+	}
+	return references
+}
+
+// Tells if a row of tableMetadata has val in the column colIdx
+func (db *ElenaDB) rowWithValueExists(txn *concurrency.Transaction, tableMetadata *catalog.TableMetadata, colIdx int, val *value.Value) (bool, error) {
+	scan := &SeqScanPlanNode{
+		PlanNodeBase: PlanNodeBase{
+			Type:     PlanNodeTypeSeqScan,
+			Children: nil,
+			Database: db,
+			Txn:      txn,
+		},
+		TableMetadata: tableMetadata,
+		Cursor:        NewPagesCursorFromParts(tableMetadata.FileID, 0, 0),
+		CurrentPage:   nil,
+	}
+	for {
+		scannedTuple, err := scan.Next()
+		if err != nil {
+			return false, err
+		}
+		if scannedTuple == nil {
+			return false, nil
+		}
+		if value.Compare(&scannedTuple.Values[colIdx], val) == 0 {
+			return true, nil
+		}
+	}
+}
+
+// Makes sure the rows referenced by the foreign columns in columns exist, values being the
+// values of a row of tableMetadata (in the order of its columns)
+func (db *ElenaDB) checkReferencedRows(txn *concurrency.Transaction, tableMetadata *catalog.TableMetadata, values []value.Value, columns []int) error {
+	for _, idx := range columns {
+		col := tableMetadata.Schema.GetColumn(idx)
+		if !col.IsForeign || values[idx].IsNull() {
+			continue
+		}
+		referenced, refIdx, err := db.referencedColumn(col.ForeignPath)
+		if err != nil {
+			return err
+		}
+		exists, err := db.rowWithValueExists(txn, referenced, refIdx, &values[idx])
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf(
+				"fkey column \"%s\" references %s, but there is no row with \"%s\"",
+				col.ColumnName, col.ForeignPath, values[idx].FormatAsString(),
+			)
+		}
+	}
+	return nil
+}
+
+// Makes sure no row references the row of tableMetadata with values, in the referenced columns
+// in columns. Used before changing them
+func (db *ElenaDB) checkNotReferenced(txn *concurrency.Transaction, tableMetadata *catalog.TableMetadata, values []value.Value, columns []int) error {
+	for _, reference := range db.referencesTo(tableMetadata) {
+		for _, idx := range columns {
+			if reference.referenced != idx {
+				continue
+			}
+			if err := db.restrictReference(txn, tableMetadata, reference, &values[idx]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Deletes the rows that reference the row of tableMetadata with values through a @cascada
+// column, or fails if another column references it. Runs before the row itself is deleted
+func (db *ElenaDB) deleteReferencingRows(txn *concurrency.Transaction, tableMetadata *catalog.TableMetadata, values []value.Value) error {
+	for _, reference := range db.referencesTo(tableMetadata) {
+		referencedValue := &values[reference.referenced]
+		if !reference.cascade {
+			if err := db.restrictReference(txn, tableMetadata, reference, referencedValue); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// It's a "borra" like any other, so it cascades on its own to the tables that
+		// reference the child
+		column := reference.table.Schema.GetColumn(reference.column).ColumnName
+		literal := referencedValue.FormatAsString()
+		if referencedValue.Type == value.TypeVarChar {
+			literal = fmt.Sprintf("\"%s\"", literal)
+		}
+		input := fmt.Sprintf("borra de %s donde (%s == %s) pe", reference.table.Name, column, literal)
+		if err := db.runInTransaction(txn, input); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *ElenaDB) restrictReference(txn *concurrency.Transaction, tableMetadata *catalog.TableMetadata, reference foreignReference, val *value.Value) error {
+	exists, err := db.rowWithValueExists(txn, reference.table, reference.column, val)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf(
+			"row of \"%s\" with \"%s\" is referenced by \"%s.%s\"",
+			tableMetadata.Name, val.FormatAsString(),
+			reference.table.Name, reference.table.Schema.GetColumn(reference.column).ColumnName,
+		)
+	}
+	return nil
+}
+
+// Runs a statement as part of txn, in the middle of the one that is running
+func (db *ElenaDB) runInTransaction(txn *concurrency.Transaction, input string) error {
+	parsedQuery, err := db.sqlPipeline(input)
+	if err != nil {
+		return err
+	}
+	nodePlan, err := MakeQueryPlan(parsedQuery, db)
+	if err != nil {
+		return err
+	}
+	nodePlan = OptimizeQueryPlan(nodePlan)
+	setTransaction(nodePlan, txn)
+
+	for {
+		t, err := nodePlan.Next()
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			return nil
+		}
+	}
+}
+
+// Indexes of the columns of tableMetadata assigned by fields
+func assignedColumns(tableMetadata *catalog.TableMetadata, fields []query.QueryField) []int {
+	columns := []int{}
+	for _, field := range fields {
+		for idx, col := range tableMetadata.Schema.GetColumns() {
+			if schema.ExtractColumnName(field.Name) == col.ColumnName {
+				columns = append(columns, idx)
+			}
+		}
+	}
+	return columns
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/storage/page"
+	"sync"
+)
+
+// FreeSpaceMap remembers roughly how many bytes are free in each page of a table heap, so an
+// insert can go to an earlier page with room (i.e. after a "borra") instead of always growing
+// the file. It's only a hint: whoever uses a page checks its header under the page latch, and
+// tells the map when it was wrong.
+//
+// The map lives in memory. It's built from the page headers the first time the table is
+// written after a boot (see ElenaDB.freeSpaceMap).
+type FreeSpaceMap struct {
+	latch sync.Mutex
+	// free bytes of each page, by actual page id
+	free []uint16
+}
+
+func NewFreeSpaceMap() *FreeSpaceMap {
+	return &FreeSpaceMap{}
+}
+
+// Records the free bytes of a page
+func (fsm *FreeSpaceMap) Update(pageId common.APageID_t, free uint16) {
+	fsm.latch.Lock()
+	defer fsm.latch.Unlock()
+
+	for int(pageId) >= len(fsm.free) {
+		fsm.free = append(fsm.free, 0)
+	}
+	fsm.free[pageId] = free
+}
+
+// Returns the first page that should have room for a tuple of the given size (and its slot).
+// False if there's none.
+func (fsm *FreeSpaceMap) FindPage(tupleSize uint16) (common.APageID_t, bool) {
+	fsm.latch.Lock()
+	defer fsm.latch.Unlock()
+
+	for pageId, free := range fsm.free {
+		if int(free) >= int(tupleSize)+page.SLOT_SIZE {
+			return common.APageID_t(pageId), true
+		}
+	}
+	return 0, false
+}
+
+// Returns the free-space map of a table, reading the header of every page of the table the
+// first time. The caller must not hold any page of the table.
+func (db *ElenaDB) freeSpaceMap(fileId common.FileID_t) *FreeSpaceMap {
+	db.freeSpaceLatch.Lock()
+	defer db.freeSpaceLatch.Unlock()
+
+	if fsm, ok := db.freeSpaceMaps[fileId]; ok {
+		return fsm
+	}
+
+	fsm := NewFreeSpaceMap()
+	pageCount := db.bufferPool.PageCount(fileId)
+	for aPageId := common.APageID_t(0); aPageId < pageCount; aPageId++ {
+		guard := db.bufferPool.FetchPageRead(common.NewPageIdFromParts(fileId, aPageId))
+		if guard == nil {
+			continue
+		}
+		fsm.Update(aPageId, page.NewSlottedPageFromRawPage(guard.Page()).FreeBytes())
+		guard.Drop()
+	}
+	db.freeSpaceMaps[fileId] = fsm
+	return fsm
+}
+
+// Tells the free-space map of the table how many bytes are free in a page that just changed.
+// Does nothing if the map wasn't built yet, it will read the page when it is. The page must
+// be released before, the map may be reading it.
+func (db *ElenaDB) updateFreeSpace(pageId common.PageID_t, free uint16) {
+	db.freeSpaceLatch.Lock()
+	fsm, ok := db.freeSpaceMaps[pageId.GetFileId()]
+	db.freeSpaceLatch.Unlock()
+
+	if ok {
+		fsm.Update(pageId.GetActualPageId(), free)
+	}
+}
@@ -0,0 +1,381 @@
+package database
+
+import (
+	"fisi/elenadb/pkg/catalog"
+	"fisi/elenadb/pkg/catalog/schema"
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/meta"
+	storage "fisi/elenadb/pkg/storage/index"
+	"fisi/elenadb/pkg/storage/table/value"
+	"fmt"
+	"os"
+)
+
+// Creates the index on the keySchema columns of the table: registers it in elena_meta, creates
+// its file and builds an empty B+ tree on it. The tree is kept in memory so plan nodes can use
+// it. The sql must have the typed column list, it's what tells the key schema on the next boot.
+func (db *ElenaDB) createIndex(table string, keySchema *schema.Schema, sql string) (*catalog.IndexMetadata, error) {
+	columnNames := make([]string, 0, keySchema.GetColumnCount())
+	for _, col := range keySchema.GetColumns() {
+		columnNames = append(columnNames, col.ColumnName)
+	}
+	name := catalog.IndexName(table, columnNames)
+
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil,
+		fmt.Sprintf(
+			"mete { type: \"index\", name: \"%s\", root: 0, sql: \"%s\" } en %s retornando { file_id } pe",
+			name, sql, meta.ELENA_META_TABLE_NAME,
+		), false)
+	if err != nil {
+		return nil, err
+	}
+	result := <-tuples
+	if result == nil {
+		return nil, fmt.Errorf("unable to register index \"%s\"", name)
+	}
+	if result.IsError() {
+		return nil, result.Error
+	}
+	fileId := common.FileID_t(result.Value.Values[0].AsInt32())
+
+	file, err := os.Create(db.DbPath + name + ".index")
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	// The buffer pool needs the catalog to know the index filename before allocating pages
+	indexMetadata := &catalog.IndexMetadata{
+		Name:      name,
+		FileID:    fileId,
+		Root:      common.InvalidPageID,
+		SqlCreate: sql,
+		KeySchema: *keySchema,
+	}
+	db.Catalog.RegisterIndexMetadata(name, indexMetadata)
+
+	tree, err := storage.NewBPTree(db.bufferPool, fileId, &indexMetadata.KeySchema)
+	if err != nil {
+		return nil, err
+	}
+	db.indexes[name] = tree
+
+	if err := db.persistIndexRoot(indexMetadata); err != nil {
+		return nil, err
+	}
+	return indexMetadata, nil
+}
+
+// Fills the index with the tuples already stored in the table, then stores the resulting
+// root. Meant for indexes created on tables that already have rows.
+func (db *ElenaDB) buildIndex(tableMetadata *catalog.TableMetadata, indexMetadata *catalog.IndexMetadata) error {
+	tree := db.indexTree(indexMetadata.Name)
+	if tree == nil {
+		return fmt.Errorf("index \"%s\" is not loaded", indexMetadata.Name)
+	}
+
+	scan := &SeqScanPlanNode{
+		PlanNodeBase: PlanNodeBase{
+			Type:     PlanNodeTypeSeqScan,
+			Children: nil,
+			Database: db,
+		},
+		TableMetadata: tableMetadata,
+		Cursor:        NewPagesCursorFromParts(tableMetadata.FileID, 0, 0),
+		CurrentPage:   nil,
+	}
+	ridIdx := tableMetadata.Schema.GetColumnCount() // the ghost column goes last
+	for {
+		heapTuple, err := scan.Next()
+		if err != nil {
+			return err
+		}
+		if heapTuple == nil {
+			break
+		}
+		key, ok := indexKey(tableMetadata, indexMetadata, heapTuple.Values)
+		if !ok {
+			continue
+		}
+		pageId, slot, err := parseRidGhostValue(heapTuple.Values[ridIdx].AsVarchar())
+		if err != nil {
+			return err
+		}
+		tree.Insert(key, uint64(common.NewRID(pageId, uint32(slot)).Get()))
+	}
+
+	return db.persistIndexRoot(indexMetadata)
+}
+
+// Stores the current root of the index tree in elena_meta and in the catalog. The catalog
+// only takes it once elena_meta has it, so a failed write is tried again on the next sync
+func (db *ElenaDB) persistIndexRoot(indexMetadata *catalog.IndexMetadata) error {
+	tree := db.indexTree(indexMetadata.Name)
+	if tree == nil {
+		return fmt.Errorf("index \"%s\" is not loaded", indexMetadata.Name)
+	}
+	root := tree.Root()
+
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil,
+		fmt.Sprintf(
+			"cambia en %s { root: %d } si (file_id == %d) pe",
+			meta.ELENA_META_TABLE_NAME, root, indexMetadata.FileID,
+		), false)
+	if err != nil {
+		return fmt.Errorf("unable to store the root of index %s: %s", indexMetadata.Name, err.Error())
+	}
+	updated := 0
+	for result := range tuples {
+		if result.IsError() {
+			err = result.Error
+		}
+		updated++
+	}
+	if err == nil && updated != 1 {
+		err = fmt.Errorf("%d rows of %s have file_id %d", updated, meta.ELENA_META_TABLE_NAME, indexMetadata.FileID)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to store the root of index %s: %s", indexMetadata.Name, err.Error())
+	}
+	indexMetadata.Root = root
+	return nil
+}
+
+// Splits can move the root of the tree, elena_meta has to follow it or the index couldn't be
+// opened on the next boot
+func (db *ElenaDB) syncIndexRoot(indexMetadata *catalog.IndexMetadata) error {
+	tree := db.indexTree(indexMetadata.Name)
+	if tree == nil || tree.Root() == indexMetadata.Root {
+		return nil
+	}
+	return db.persistIndexRoot(indexMetadata)
+}
+
+// Removes the index: its elena_meta row, its pages in the buffer pool, its catalog entry
+// and its file. The table itself is not touched.
+func (db *ElenaDB) dropIndex(name string) error {
+	indexMetadata := db.Catalog.IndexMetadataMap[name]
+	if indexMetadata == nil {
+		return fmt.Errorf("index \"%s\" does not exist", name)
+	}
+
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil,
+		fmt.Sprintf(
+			"borra de %s donde (file_id == %d) pe",
+			meta.ELENA_META_TABLE_NAME, indexMetadata.FileID,
+		), false)
+	if err != nil {
+		return err
+	}
+	for result := range tuples {
+		if result.IsError() {
+			return result.Error
+		}
+	}
+
+	// The file is going away, so there is no point in flushing its pages
+	db.bufferPool.DiscardFilePages(indexMetadata.FileID)
+	db.Catalog.DeleteIndexMetadata(name)
+	delete(db.indexes, name)
+
+	return os.Remove(db.DbPath + name + ".index")
+}
+
+// Returns the in-memory B+ tree of an index, or nil if it isn't loaded
+func (db *ElenaDB) indexTree(name string) *storage.BPTree {
+	return db.indexes[name]
+}
+
+// Returns the key the tuple values have on the given index, its columns in key order.
+// It's false if the table no longer has one of them.
+func indexKey(tableMetadata *catalog.TableMetadata, index *catalog.IndexMetadata, values []value.Value) (storage.IndexKey, bool) {
+	key := make(storage.IndexKey, 0, index.KeySchema.GetColumnCount())
+	for _, keyCol := range index.KeySchema.GetColumns() {
+		found := false
+		for idx, col := range tableMetadata.Schema.GetColumns() {
+			if col.ColumnName == keyCol.ColumnName && values[idx].Type == keyCol.ColumnType {
+				key = append(key, values[idx])
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return key, true
+}
+
+// Adds the tuple values (stored at rid) to every loaded index of the table. Callers do it
+// after the heap write succeeded to keep both in sync. The trees can't fail, but storing a
+// root they moved can: the entry is added to every index anyway, so rolling the statement
+// back removes it from all of them, and the first error is returned.
+func (db *ElenaDB) insertIntoIndexes(tableMetadata *catalog.TableMetadata, values []value.Value, rid *common.RID) error {
+	var err error
+	for _, index := range db.Catalog.GetTableIndexes(tableMetadata.Name) {
+		tree := db.indexTree(index.Name)
+		if tree == nil {
+			continue
+		}
+		if key, ok := indexKey(tableMetadata, index, values); ok {
+			tree.Insert(key, uint64(rid.Get()))
+			if syncErr := db.syncIndexRoot(index); err == nil {
+				err = syncErr
+			}
+		}
+	}
+	return err
+}
+
+// Removes the tuple values (stored at rid) from every loaded index of the table. Same as
+// insertIntoIndexes, it should be called once the heap write succeeded.
+func (db *ElenaDB) deleteFromIndexes(tableMetadata *catalog.TableMetadata, values []value.Value, rid *common.RID) error {
+	var err error
+	for _, index := range db.Catalog.GetTableIndexes(tableMetadata.Name) {
+		tree := db.indexTree(index.Name)
+		if tree == nil {
+			continue
+		}
+		key, ok := indexKey(tableMetadata, index, values)
+		if !ok {
+			continue
+		}
+		if !tree.Delete(key, uint64(rid.Get())) {
+			// Nothing to undo here, the index just didn't have it. CheckIndex will report it
+			db.log.Warn("index %s has no entry for key %s at %s", index.Name, key.ToString(), rid.ToString())
+		}
+		if syncErr := db.syncIndexRoot(index); err == nil {
+			err = syncErr
+		}
+	}
+	return err
+}
+
+// ========== consistency checker ==========
+
+// A key and the RID it points to
+type IndexEntry struct {
+	Key storage.IndexKey
+	Rid common.RID
+}
+
+// Keys are slices, so entries can't be map keys by themselves. The raw bytes of the key
+// values tell them apart.
+func (e *IndexEntry) id() string {
+	return fmt.Sprintf("%v@%d", e.Key, e.Rid.Get())
+}
+
+// Differences found between an index and the table heap
+type IndexDrift struct {
+	Index string
+	// Heap tuples the index doesn't know about
+	Missing []IndexEntry
+	// Index entries pointing to deleted tuples, or to tuples with another key
+	Stale []IndexEntry
+}
+
+func (d *IndexDrift) HasDrift() bool {
+	return len(d.Missing) > 0 || len(d.Stale) > 0
+}
+
+func (d *IndexDrift) ToString() string {
+	return fmt.Sprintf("index %s: %d missing, %d stale entries", d.Index, len(d.Missing), len(d.Stale))
+}
+
+// Rebuilds the entries of the index from the table heap and compares them against the
+// ones stored in the B+ tree. If repair is true, the tree is patched so it matches the heap.
+func (db *ElenaDB) CheckIndex(name string, repair bool) (*IndexDrift, error) {
+	indexMetadata := db.Catalog.IndexMetadataMap[name]
+	if indexMetadata == nil {
+		return nil, fmt.Errorf("index \"%s\" does not exist", name)
+	}
+	tree := db.indexTree(name)
+	if tree == nil {
+		return nil, fmt.Errorf("index \"%s\" is not loaded", name)
+	}
+	tableName := indexMetadata.TableName()
+	tableMetadata := db.Catalog.GetTableMetadata(tableName)
+	if tableMetadata == nil {
+		return nil, TableDoesNotExistError{table: tableName}
+	}
+
+	expected := make(map[string][]IndexEntry)
+	scan := &SeqScanPlanNode{
+		PlanNodeBase: PlanNodeBase{
+			Type:     PlanNodeTypeSeqScan,
+			Children: nil,
+			Database: db,
+		},
+		TableMetadata: tableMetadata,
+		Cursor:        NewPagesCursorFromParts(tableMetadata.FileID, 0, 0),
+		CurrentPage:   nil,
+	}
+	ridIdx := tableMetadata.Schema.GetColumnCount() // the ghost column goes last
+	for {
+		heapTuple, err := scan.Next()
+		if err != nil {
+			return nil, err
+		}
+		if heapTuple == nil {
+			break
+		}
+		key, ok := indexKey(tableMetadata, indexMetadata, heapTuple.Values)
+		if !ok {
+			continue
+		}
+		pageId, slot, err := parseRidGhostValue(heapTuple.Values[ridIdx].AsVarchar())
+		if err != nil {
+			return nil, err
+		}
+		entry := IndexEntry{Key: key, Rid: *common.NewRID(pageId, uint32(slot))}
+		expected[entry.id()] = append(expected[entry.id()], entry)
+	}
+
+	drift := &IndexDrift{Index: name}
+	keys, rids := tree.RangeSearch(storage.IndexKey{}, storage.IndexKey{})
+	for i := range keys {
+		entry := IndexEntry{Key: keys[i], Rid: *common.NewRIDFromInt64(int64(rids[i]))}
+		if matches := expected[entry.id()]; len(matches) > 0 {
+			expected[entry.id()] = matches[1:]
+		} else {
+			drift.Stale = append(drift.Stale, entry)
+		}
+	}
+	for _, entries := range expected {
+		drift.Missing = append(drift.Missing, entries...)
+	}
+
+	if repair {
+		for _, entry := range drift.Stale {
+			tree.Delete(entry.Key, uint64(entry.Rid.Get()))
+		}
+		for _, entry := range drift.Missing {
+			tree.Insert(entry.Key, uint64(entry.Rid.Get()))
+		}
+		if err := db.syncIndexRoot(indexMetadata); err != nil {
+			return nil, err
+		}
+	}
+
+	if drift.HasDrift() {
+		db.log.Warn("%s", drift.ToString())
+	}
+	return drift, nil
+}
+
+// Empties the index and fills it again from the table heap
+func (db *ElenaDB) rebuildIndex(tableMetadata *catalog.TableMetadata, indexMetadata *catalog.IndexMetadata) error {
+	db.bufferPool.DiscardFilePages(indexMetadata.FileID)
+	file, err := os.Create(db.DbPath + indexMetadata.Name + ".index")
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	tree, err := storage.NewBPTree(db.bufferPool, indexMetadata.FileID, &indexMetadata.KeySchema)
+	if err != nil {
+		return err
+	}
+	db.indexes[indexMetadata.Name] = tree
+	return db.buildIndex(tableMetadata, indexMetadata)
+}
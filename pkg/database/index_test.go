@@ -0,0 +1,481 @@
+package database
+
+import (
+	"fisi/elenadb/pkg/meta"
+	storage "fisi/elenadb/pkg/storage/index"
+	"fisi/elenadb/pkg/storage/table/value"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func execAll(t testing.TB, db *ElenaDB, input string) int {
+	t.Helper()
+	return execIn(t, db, nil, input)
+}
+
+// Runs a statement with session, in the transaction it has open
+func execIn(t testing.TB, db *ElenaDB, session *Session, input string) int {
+	t.Helper()
+	tuples, _, _, _, err := db.ExecuteThisBaby(session, input, false)
+	if err != nil {
+		t.Fatalf("%s: %v", input, err)
+	}
+	count := 0
+	for result := range tuples {
+		if result.IsError() {
+			t.Fatalf("%s: %v", input, result.Error)
+		}
+		count++
+	}
+	return count
+}
+
+func assertNoDrift(t *testing.T, db *ElenaDB, index string) {
+	t.Helper()
+	drift, err := db.CheckIndex(index, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift.HasDrift() {
+		t.Fatalf("unexpected drift: %s (missing=%v, stale=%v)", drift.ToString(), drift.Missing, drift.Stale)
+	}
+}
+
+func TestIndexesFollowTableMutations(t *testing.T) {
+	db, err := StartElenaBusiness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	execAll(t, db, "creame tabla users { id int @id, name char(20), } pe")
+	for i := 0; i < 300; i++ {
+		execAll(t, db, fmt.Sprintf("mete { name: \"u%d\" } en users pe", i))
+	}
+	assertNoDrift(t, db, "users.id")
+
+	if n := execAll(t, db, "dame todo de users donde (id >= 100 y id < 110) pe"); n != 10 {
+		t.Fatalf("expected 10 rows through the index, got %d", n)
+	}
+
+	execAll(t, db, "borra de users donde (id >= 100 y id < 150) pe")
+	assertNoDrift(t, db, "users.id")
+	if n := execAll(t, db, "dame todo de users donde (id >= 100 y id < 110) pe"); n != 0 {
+		t.Fatalf("expected deleted rows to be gone from the index, got %d", n)
+	}
+
+	// Growing the tuple moves it to another RID
+	execAll(t, db, "cambia en users { name: \"un nombre largo\" } si (id < 20) pe")
+	assertNoDrift(t, db, "users.id")
+	if n := execAll(t, db, "dame todo de users donde (id == 5 y name == \"un nombre largo\") pe"); n != 1 {
+		t.Fatalf("expected the relocated row to be found through the index, got %d", n)
+	}
+}
+
+func TestSelectPlannerPicksIndexScans(t *testing.T) {
+	db, err := StartElenaBusiness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	execAll(t, db, "creame tabla users { id int @id, edad int, } pe")
+	for i := 0; i < 200; i++ {
+		execAll(t, db, fmt.Sprintf("mete { edad: %d } en users pe", i%30))
+	}
+
+	// Only comparisons joined by "y" on an indexed column can narrow the scan
+	queries := map[string]struct {
+		node string
+		rows int
+	}{
+		"dame todo de users donde (id == 42) pe":             {"IndexScanPlanNode", 1},
+		"dame todo de users donde (id >= 100 y id < 150) pe": {"IndexScanPlanNode", 50},
+		"dame todo de users donde (id < 100 y edad == 3) pe": {"IndexScanPlanNode", 4},
+		"dame todo de users donde (edad == 3) pe":            {"SeqScanPlanNode", 7},
+		"dame todo de users donde (id == 5 o id == 6) pe":    {"SeqScanPlanNode", 2},
+		"dame todo de users pe":                              {"SeqScanPlanNode", 200},
+	}
+	for q, expected := range queries {
+		_, _, _, plan, err := db.ExecuteThisBaby(nil, q, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(plan.ToString(), expected.node) {
+			t.Fatalf("%s: expected a %s, got:\n%s", q, expected.node, plan.ToString())
+		}
+		if n := execAll(t, db, q); n != expected.rows {
+			t.Fatalf("%s: expected %d rows, got %d", q, expected.rows, n)
+		}
+	}
+}
+
+func TestCheckIndexReportsAndRepairsDrift(t *testing.T) {
+	db, err := StartElenaBusiness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	execAll(t, db, "creame tabla users { id int @id, name char(20), } pe")
+	for i := 0; i < 50; i++ {
+		execAll(t, db, fmt.Sprintf("mete { name: \"u%d\" } en users pe", i))
+	}
+
+	tree := db.indexTree("users.id")
+	key := func(id int32) storage.IndexKey {
+		return storage.IndexKey{*value.NewInt32Value(id)}
+	}
+	rid, found := tree.Search(key(7))
+	if !found {
+		t.Fatal("key 7 should be indexed")
+	}
+	tree.Delete(key(7), rid)
+	tree.Insert(key(1000), rid)
+
+	drift, err := db.CheckIndex("users.id", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift.Missing) != 1 || drift.Missing[0].Key[0].AsInt32() != 7 {
+		t.Fatalf("expected key 7 to be reported as missing, got %v", drift.Missing)
+	}
+	if len(drift.Stale) != 1 || drift.Stale[0].Key[0].AsInt32() != 1000 {
+		t.Fatalf("expected key 1000 to be reported as stale, got %v", drift.Stale)
+	}
+
+	assertNoDrift(t, db, "users.id")
+
+	if _, err := db.CheckIndex("users.name", false); err == nil {
+		t.Fatal("expected an error for an index that doesn't exist")
+	}
+}
+
+func TestCreateAndDropIndex(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	execAll(t, db, "creame tabla users { id int @id, edad int, name char(20), } pe")
+	// Not ascending and with repeated keys, so the leaves split out of order
+	for i := 0; i < 600; i++ {
+		execAll(t, db, fmt.Sprintf("mete { edad: %d, name: \"u%d\" } en users pe", (i*37)%50, i))
+	}
+
+	execAll(t, db, "creame indice en users (edad) pe")
+	assertNoDrift(t, db, "users.edad")
+
+	if _, _, _, _, err := db.ExecuteThisBaby(nil, "creame indice en users (edad) pe", false); err == nil {
+		t.Fatal("expected an error when creating the same index twice")
+	}
+	if _, _, _, _, err := db.ExecuteThisBaby(nil, "creame indice en users (apellido) pe", false); err == nil {
+		t.Fatal("expected an error when indexing a missing column")
+	}
+	if _, _, _, _, err := db.ExecuteThisBaby(nil, "creame indice en users (edad float) pe", false); err == nil {
+		t.Fatal("expected an error when the column type doesn't match the table")
+	}
+
+	_, _, _, plan, err := db.ExecuteThisBaby(nil, "dame todo de users donde (edad == 7) pe", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(plan.ToString(), "IndexScanPlanNode") {
+		t.Fatalf("expected the new index to be used, got:\n%s", plan.ToString())
+	}
+	if n := execAll(t, db, "dame todo de users donde (edad == 7) pe"); n != 12 {
+		t.Fatalf("expected 12 rows with edad 7, got %d", n)
+	}
+
+	// New rows go to the index too
+	execAll(t, db, "mete { edad: 7, name: \"otro\" } en users pe")
+	assertNoDrift(t, db, "users.edad")
+
+	execAll(t, db, "borra indice users.edad pe")
+	if db.Catalog.IndexMetadataMap["users.edad"] != nil {
+		t.Fatal("index should be gone from the catalog")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "users.edad.index")); !os.IsNotExist(err) {
+		t.Fatalf("index file should be removed, got %v", err)
+	}
+	if n := execAll(t, db, "dame todo de elena_meta donde (name == \"users.edad\") pe"); n != 0 {
+		t.Fatalf("index should be gone from elena_meta, got %d rows", n)
+	}
+	if n := execAll(t, db, "dame todo de users donde (edad == 7) pe"); n != 13 {
+		t.Fatalf("expected 13 rows with edad 7 after dropping the index, got %d", n)
+	}
+	if _, _, _, _, err := db.ExecuteThisBaby(nil, "borra indice users.edad pe", false); err == nil {
+		t.Fatal("expected an error when dropping a missing index")
+	}
+}
+
+func TestIndexesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	execAll(t, db, "creame tabla users { id int @id, edad int, } pe")
+	// Enough rows to split the root a few times
+	for i := 0; i < 600; i++ {
+		execAll(t, db, fmt.Sprintf("mete { edad: %d } en users pe", i%40))
+	}
+	execAll(t, db, "creame indice en users (edad) pe")
+	roots := map[string]string{}
+	for _, name := range []string{"users.id", "users.edad"} {
+		tree := db.indexTree(name)
+		if tree.RootPageID != db.Catalog.IndexMetadataMap[name].Root {
+			t.Fatalf("catalog root of %s is behind the tree", name)
+		}
+		roots[name] = tree.RootPageID.ToString()
+	}
+	db.RestInPeace()
+
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, root := range roots {
+		tree := db.indexTree(name)
+		if tree == nil {
+			t.Fatalf("index %s was not loaded on boot", name)
+		}
+		if tree.RootPageID.ToString() != root {
+			t.Fatalf("index %s was opened at %s, expected %s", name, tree.RootPageID.ToString(), root)
+		}
+		assertNoDrift(t, db, name)
+	}
+
+	if n := execAll(t, db, "dame todo de users donde (id >= 100 y id < 110) pe"); n != 10 {
+		t.Fatalf("expected 10 rows through the reopened index, got %d", n)
+	}
+	if n := execAll(t, db, "dame todo de users donde (edad == 3) pe"); n != 15 {
+		t.Fatalf("expected 15 rows with edad 3, got %d", n)
+	}
+
+	// The reopened trees keep working
+	execAll(t, db, "mete { edad: 3 } en users pe")
+	execAll(t, db, "borra de users donde (id < 50) pe")
+	assertNoDrift(t, db, "users.id")
+	assertNoDrift(t, db, "users.edad")
+
+	// Emptying the table collapses the trees, the new roots must be stored too
+	execAll(t, db, "borra de users donde (id >= 0) pe")
+	db.RestInPeace()
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range roots {
+		assertNoDrift(t, db, name)
+	}
+	if n := execAll(t, db, "dame todo de users donde (edad == 3) pe"); n != 0 {
+		t.Fatalf("expected an empty table, got %d rows", n)
+	}
+}
+
+// A root that can't be stored fails the statement that moved it, which is rolled back
+func TestFailedRootWriteFailsTheStatement(t *testing.T) {
+	db, err := StartElenaBusiness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.RestInPeace)
+	execAll(t, db, "creame tabla users { id int @id, edad int, } pe")
+	execAll(t, db, "creame indice en users (edad) pe")
+	execAll(t, db, fmt.Sprintf(
+		"borra de %s donde (file_id == %d) pe",
+		meta.ELENA_META_TABLE_NAME, db.Catalog.IndexMetadataMap["users.edad"].FileID,
+	))
+
+	inserted := 0
+	for ; inserted < 2000; inserted++ {
+		if err := execResult(db, fmt.Sprintf("mete { edad: %d } en users pe", inserted)); err != nil {
+			break
+		}
+	}
+	if inserted == 2000 {
+		t.Fatal("expected the insert that moved the root to fail")
+	}
+	if n := execAll(t, db, "dame todo de users pe"); n != inserted {
+		t.Fatalf("expected the failed insert to be rolled back, %d rows for %d inserts", n, inserted)
+	}
+	assertNoDrift(t, db, "users.id")
+	assertNoDrift(t, db, "users.edad")
+}
+
+func TestCharAndCompositeIndexes(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	execAll(t, db, "creame tabla estudiantes { id int @id, codigo char(8), promedio float, activo bool, } pe")
+	for i := 0; i < 400; i++ {
+		execAll(t, db, fmt.Sprintf(
+			"mete { codigo: \"%08d\", promedio: %d.5, activo: %v } en estudiantes pe",
+			20200000+(i*7)%400, i%20, i%3 == 0,
+		))
+	}
+
+	execAll(t, db, "creame indice en estudiantes (codigo) pe")
+	execAll(t, db, "creame indice en estudiantes (activo, promedio) pe")
+	for _, name := range []string{"estudiantes.codigo", "estudiantes.activo.promedio"} {
+		assertNoDrift(t, db, name)
+	}
+
+	queries := map[string]int{
+		"dame todo de estudiantes donde (codigo == \"20200042\") pe":                             1,
+		"dame todo de estudiantes donde (codigo >= \"20200100\" y codigo < \"20200150\") pe":     50,
+		"dame todo de estudiantes donde (activo == true) pe":                                     134,
+		"dame todo de estudiantes donde (activo == true y promedio == 3.5) pe":                   7,
+		"dame todo de estudiantes donde (activo == false y promedio > 10 y promedio <= 12.5) pe": 40,
+	}
+	check := func() {
+		t.Helper()
+		for q, expected := range queries {
+			_, _, _, plan, err := db.ExecuteThisBaby(nil, q, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(plan.ToString(), "IndexScanPlanNode") {
+				t.Fatalf("%s: expected an index scan, got:\n%s", q, plan.ToString())
+			}
+			if n := execAll(t, db, q); n != expected {
+				t.Fatalf("%s: expected %d rows, got %d", q, expected, n)
+			}
+		}
+	}
+	check()
+
+	// The key schema is stored with the index and comes back on boot
+	db.RestInPeace()
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := db.Catalog.IndexMetadataMap["estudiantes.activo.promedio"]
+	if index == nil {
+		t.Fatal("index estudiantes.activo.promedio was not loaded on boot")
+	}
+	if index.SqlCreate != "creame indice en estudiantes (activo bool, promedio float) pe" {
+		t.Fatalf("unexpected sql for the index: %s", index.SqlCreate)
+	}
+	if index.KeySchema.GetColumnCount() != 2 || index.KeySchema.GetColumn(1).ColumnType != value.TypeFloat32 {
+		t.Fatalf("unexpected key schema: %v", index.KeySchema.GetColumns())
+	}
+	check()
+
+	execAll(t, db, "borra de estudiantes donde (promedio < 5) pe")
+	for _, name := range []string{"estudiantes.codigo", "estudiantes.activo.promedio"} {
+		assertNoDrift(t, db, name)
+	}
+	if n := execAll(t, db, "dame todo de estudiantes donde (activo == true y promedio == 3.5) pe"); n != 0 {
+		t.Fatalf("expected the deleted rows to be gone, got %d", n)
+	}
+}
+
+func TestIndexNamesDontCollide(t *testing.T) {
+	db, err := StartElenaBusiness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	execAll(t, db, "creame tabla t { id int @id, a int, b int, a_b int, } pe")
+	for i := 0; i < 50; i++ {
+		execAll(t, db, fmt.Sprintf("mete { a: %d, b: %d, a_b: %d } en t pe", i%5, i%7, i))
+	}
+	execAll(t, db, "creame indice en t (a_b) pe")
+	execAll(t, db, "creame indice en t (a, b) pe")
+	for _, name := range []string{"t.a_b", "t.a.b"} {
+		if db.Catalog.IndexMetadataMap[name] == nil {
+			t.Fatalf("expected index %s to exist", name)
+		}
+		assertNoDrift(t, db, name)
+	}
+	execAll(t, db, "borra indice t.a.b pe")
+	assertNoDrift(t, db, "t.a_b")
+
+	// Dots are what keeps the names apart
+	for _, input := range []string{
+		"creame tabla u { id int @id, a.b int, } pe",
+		"creame tabla u.v { id int @id, } pe",
+		"cambia tabla t agrega { c.d int?, } pe",
+		"cambia tabla t renombra a a c.d pe",
+	} {
+		if _, _, _, _, err := db.ExecuteThisBaby(nil, input, false); err == nil {
+			t.Fatalf("%s: expected names with dots to be rejected", input)
+		}
+	}
+}
+
+func TestOrderedByIndex(t *testing.T) {
+	db, err := StartElenaBusiness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	execAll(t, db, "creame tabla notas { id int @id, codigo char(8), nota int, } pe")
+	for i := 0; i < 300; i++ {
+		execAll(t, db, fmt.Sprintf("mete { codigo: \"%08d\", nota: %d } en notas pe", (i*37)%300, i%21))
+	}
+	execAll(t, db, "creame indice en notas (codigo) pe")
+
+	// Sorting by an indexed column walks the index instead of sorting the tuples, both
+	// for a whole table and for the range the filter picked
+	queries := map[string][2]string{
+		"dame todo de notas ordenado por codigo pe":                                                        {"00000000", "00000299"},
+		"dame todo de notas ordenado por codigo desc pe":                                                   {"00000299", "00000000"},
+		"dame todo de notas ordenado por codigo donde (codigo >= \"00000100\" y codigo < \"00000200\") pe": {"00000100", "00000199"},
+		"dame todo de notas ordenado por id desc pe":                                                       {"", ""},
+	}
+	for q, bounds := range queries {
+		_, _, _, plan, err := db.ExecuteThisBaby(nil, q, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(plan.ToString(), "IndexScanPlanNode") || strings.Contains(plan.ToString(), "SortPlanNode") {
+			t.Fatalf("%s: expected an index scan without sorting, got:\n%s", q, plan.ToString())
+		}
+
+		tuples, _, _, _, err := db.ExecuteThisBaby(nil, q, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		col := 1
+		if bounds[0] == "" {
+			col = 0
+		}
+		var got []value.Value
+		for result := range tuples {
+			if result.IsError() {
+				t.Fatalf("%s: %v", q, result.Error)
+			}
+			got = append(got, result.Value.GetValue(col))
+		}
+		if len(got) == 0 {
+			t.Fatalf("%s: no rows", q)
+		}
+		for i := 1; i < len(got); i++ {
+			cmp := value.Compare(&got[i-1], &got[i])
+			if (strings.Contains(q, "desc") && cmp < 0) || (!strings.Contains(q, "desc") && cmp > 0) {
+				t.Fatalf("%s: %s came before %s", q, got[i-1].FormatAsString(), got[i].FormatAsString())
+			}
+		}
+		if bounds[0] != "" && (got[0].AsVarchar() != bounds[0] || got[len(got)-1].AsVarchar() != bounds[1]) {
+			t.Fatalf("%s: expected %s..%s, got %s..%s", q, bounds[0], bounds[1], got[0].FormatAsString(), got[len(got)-1].FormatAsString())
+		}
+	}
+
+	// Without an index on the column the tuples are still sorted
+	_, _, _, plan, err := db.ExecuteThisBaby(nil, "dame todo de notas ordenado por nota pe", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(plan.ToString(), "SortPlanNode") {
+		t.Fatalf("expected a sort, got:\n%s", plan.ToString())
+	}
+}
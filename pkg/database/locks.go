@@ -0,0 +1,43 @@
+package database
+
+import (
+	"fisi/elenadb/pkg/catalog"
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/concurrency"
+	"fisi/elenadb/pkg/meta"
+)
+
+// The plan nodes of the statements that write lock what they read or write in the
+// transaction of the statement, and the locks are held until it ends (see
+// concurrency.LockManager). "dame" reads the snapshot of the transaction instead, so readers
+// never wait for writers nor writers for readers (see snapshot.go).
+//   - SeqScan locks the table in S mode, or in IS mode when it reads the snapshot
+//   - IndexScan locks the table in IS mode
+//   - "mete", "borra" and "cambia" lock the rows they write in X mode
+//   - "creame indice" locks the table in S mode
+//   - "limpia tabla", "trunca tabla", "borra tabla", "cambia tabla" and "borra indice" lock
+//     the table in X mode
+//
+// The IS lock of the readers only conflicts with X: the statements that replace the files of a
+// table (or of its indexes) wait for the scans that are still reading them, and the scans that
+// begin meanwhile wait for them.
+//
+// A node never waits for a lock while it holds a page latch: the detector can only break the
+// cycles it sees, and latches are not in the waits-for graph.
+//
+// elena_meta is never locked. Its statements run in transactions of their own, some in the
+// middle of another statement (see statementTransaction), which would wait forever for the
+// transaction that is running them.
+func (db *ElenaDB) lockTable(txn *concurrency.Transaction, tableMetadata *catalog.TableMetadata, mode concurrency.LockMode) error {
+	if txn == nil || tableMetadata.Name == meta.ELENA_META_TABLE_NAME {
+		return nil
+	}
+	return db.lockManager.LockTable(txn, mode, tableMetadata.FileID)
+}
+
+func (db *ElenaDB) lockRow(txn *concurrency.Transaction, tableMetadata *catalog.TableMetadata, mode concurrency.LockMode, rid common.RID) error {
+	if txn == nil || tableMetadata.Name == meta.ELENA_META_TABLE_NAME {
+		return nil
+	}
+	return db.lockManager.LockRow(txn, mode, rid)
+}
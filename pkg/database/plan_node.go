@@ -1,19 +1,25 @@
 package database
 
 import (
+	"bytes"
 	"container/heap"
 	"fisi/elenadb/internal/query"
+	"fisi/elenadb/pkg/buffer"
 	"fisi/elenadb/pkg/catalog"
 	"fisi/elenadb/pkg/catalog/column"
 	"fisi/elenadb/pkg/catalog/schema"
 	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/concurrency"
 	"fisi/elenadb/pkg/meta"
+	"fisi/elenadb/pkg/recovery"
+	storage "fisi/elenadb/pkg/storage/index"
 	"fisi/elenadb/pkg/storage/page"
 	"fisi/elenadb/pkg/storage/table/tuple"
 	"fisi/elenadb/pkg/storage/table/value"
 	"fmt"
 	"os"
-	"strconv"
+	"slices"
+	"sort"
 	"strings"
 )
 
@@ -39,6 +45,8 @@ const (
 	PlanNodeTypeSort      PlanNodeType = "Sort"
 	PlanNodeTypeLimit     PlanNodeType = "Limit"
 	PlanNodeTypeGroupBy   PlanNodeType = "TopN"
+	PlanNodeTypeVacuum    PlanNodeType = "Vacuum"
+	PlanNodeTypeTxn       PlanNodeType = "Transaction"
 )
 
 // FLAG_ESTRUCTURA: tree (PlanNode y sus implementaciones(SeqScanPlanNode, FilterPlanNode, etc.))
@@ -46,12 +54,12 @@ type PlanNodeBase struct {
 	Type     PlanNodeType
 	Children []PlanNode
 	Database *ElenaDB
+	// Transaction of the statement (see setTransaction)
+	Txn *concurrency.Transaction
 }
 
-type IndexScanPlanNode struct {
-	PlanNodeBase
-	Table string
-	Index string
+func (b *PlanNodeBase) base() *PlanNodeBase {
+	return b
 }
 
 // =========== "dame" ===========
@@ -62,7 +70,15 @@ type SeqScanPlanNode struct {
 	Query         *query.Query
 	TableMetadata *catalog.TableMetadata
 	Cursor        *PagesCursor
-	CurrentPage   *page.Page
+	// Copy of the page being scanned. The page is only latched while it's copied, so the
+	// nodes above can write to it (i.e. "borra") between calls
+	CurrentPage *page.Page
+	// Reads the snapshot of the transaction instead of the newest rows, with only an IS lock
+	// on the table. Only "dame" does, the statements that write change the newest rows (see
+	// locks.go)
+	Snapshot bool
+	// Rows of CurrentPage the snapshot has, by slot (nil if it has none)
+	VisibleRows [][]byte
 }
 
 // FLAG_ALGORITMO: recorrido secuencial?? greedy??
@@ -70,43 +86,62 @@ type SeqScanPlanNode struct {
 func (plan *SeqScanPlanNode) Next() (*tuple.Tuple, error) {
 	for {
 		if plan.CurrentPage == nil || plan.CurrentPage.PageId != plan.Cursor.PageId {
-			plan.CurrentPage = plan.Database.bufferPool.FetchPage(plan.Cursor.PageId)
+			plan.CurrentPage = nil
+			mode := concurrency.LockShared
+			if plan.Snapshot {
+				mode = concurrency.LockIntentionShared
+			}
+			if err := plan.Database.lockTable(plan.Txn, plan.TableMetadata, mode); err != nil {
+				return nil, err
+			}
+			guard := plan.Database.bufferPool.FetchPageRead(plan.Cursor.PageId)
+			if guard == nil {
+				return nil, nil
+			}
+			plan.CurrentPage = page.NewPageWithData(guard.PageId(), bytes.Clone(guard.Data()), 0)
+			if plan.Snapshot {
+				// Writers change the page and its versions with the page latched
+				plan.VisibleRows = plan.Database.visibleRows(plan.Txn, plan.CurrentPage)
+			}
+			guard.Drop()
 		}
 
-		if plan.CurrentPage == nil {
-			plan.Database.bufferPool.UnpinPage(plan.Cursor.PageId, false)
-			return nil, nil
-		}
 		slottedPage := page.NewSlottedPageFromRawPage(plan.CurrentPage)
 		for i := plan.Cursor.SlotNum; uint16(i) < slottedPage.GetNSlots(); i++ {
-			t := slottedPage.ReadTuple(&plan.TableMetadata.Schema, i)
+			var t *tuple.Tuple
+			if plan.Snapshot {
+				if raw := plan.VisibleRows[i]; raw != nil {
+					t = tuple.NewFromRawData(&plan.TableMetadata.Schema, bytes.NewReader(raw))
+				}
+			} else {
+				t = slottedPage.ReadTuple(&plan.TableMetadata.Schema, i)
+			}
 			plan.Cursor.NextSlot()
 			if t == nil {
-				// deleted tuple
+				// deleted tuple, or not in the snapshot
 				continue
 			}
 			// SeqScan allows us to have the RID column in the format (file_id,page_id,slot)
-			t.Values = append(
-				t.Values,
-				*value.NewVarCharValue(
-					fmt.Sprintf(
-						"(%d,%d,%d)",
-						plan.TableMetadata.FileID, plan.Cursor.PageId.GetActualPageId(), i,
-					), meta.ELENA_RID_GHOST_COLUMN_LEN,
-				),
-			)
+			t.Values = append(t.Values, *newRidGhostValue(plan.Cursor.PageId, i))
 			return t, nil
 		}
 
 		// We finished scanning the page, let's move to the next one
-		plan.Database.bufferPool.UnpinPage(plan.Cursor.PageId, false)
 		plan.Cursor.NextPage()
 	}
 }
 
 func (s *SeqScanPlanNode) Schema() *schema.Schema {
-	copiedSchema := s.TableMetadata.Schema
-	// We append the hidden RID column here (See meta.go)
+	return schemaWithRidGhostColumn(&s.TableMetadata.Schema)
+}
+
+func (s *SeqScanPlanNode) ToString() string {
+	return fmt.Sprintf("SeqScanPlanNode { table=%s } | (\n    %s \n    )\n", s.TableMetadata.Name, formatScanFields(&s.TableMetadata.Schema))
+}
+
+// Scans append the hidden RID column to the table schema (See meta.go)
+func schemaWithRidGhostColumn(tableSchema *schema.Schema) *schema.Schema {
+	copiedSchema := *tableSchema
 	copiedSchema.AppendColumn(column.Column{
 		ColumnName:  meta.ELENA_RID_GHOST_COLUMN_NAME,
 		ColumnType:  value.TypeVarChar,
@@ -115,9 +150,17 @@ func (s *SeqScanPlanNode) Schema() *schema.Schema {
 	return &copiedSchema
 }
 
-func (s *SeqScanPlanNode) ToString() string {
+// Scans allow us to have the RID column in the format (file_id,page_id,slot)
+func newRidGhostValue(pageId common.PageID_t, slot common.SlotNumber_t) *value.Value {
+	return value.NewVarCharValue(
+		fmt.Sprintf("(%d,%d,%d)", pageId.GetFileId(), pageId.GetActualPageId(), slot),
+		meta.ELENA_RID_GHOST_COLUMN_LEN,
+	)
+}
+
+func formatScanFields(tableSchema *schema.Schema) string {
 	formattedFields := strings.Builder{}
-	fields := s.TableMetadata.Schema.GetColumns()
+	fields := tableSchema.GetColumns()
 	numFields := len(fields)
 
 	for i, f := range fields {
@@ -130,8 +173,238 @@ func (s *SeqScanPlanNode) ToString() string {
 			formattedFields.WriteString(",\n")
 		}
 	}
+	return formattedFields.String()
+}
+
+// =========== index scan ===========
+
+// Walks a key range of a B+ tree index and fetches the matching tuples from the table heap,
+// one at a time and in index order. The FilterPlanNode on top still checks the whole
+// predicate, since the range only covers the comparisons on the indexed columns.
+type IndexScanPlanNode struct {
+	PlanNodeBase
+	Table         string
+	Index         string
+	Query         *query.Query
+	TableMetadata *catalog.TableMetadata
+	Tree          *storage.BPTree
+	// Inclusive range of keys to look up. Equality lookups have LowKey == HighKey. Both may
+	// be prefixes of the index key, an empty one leaves that side of the range open
+	LowKey  storage.IndexKey
+	HighKey storage.IndexKey
+	// Walks the range from HighKey down to LowKey, for "ordenado por <columna> desc"
+	Descending bool
+	// nil once the walk is out of the range
+	Iterator *storage.IndexIterator
+	Fetched  bool
+
+	// Rows with versions, left out of the walk, and the ones of them still to be returned,
+	// sorted by the key they have in the snapshot
+	versioned     map[common.RID]bool
+	versionedRows []*indexScanMatch
+	versionWrites uint64
+	// Next row of the walk, read ahead to merge the versioned rows before it
+	peeked *indexScanMatch
+	// Rows returned so far and the key of the last one
+	seen    map[common.RID]bool
+	lastKey storage.IndexKey
+}
+
+type indexScanMatch struct {
+	rid   common.RID
+	key   storage.IndexKey
+	tuple *tuple.Tuple
+}
+
+// The scan reads the snapshot of the transaction, so it only locks the table in IS mode. The
+// index only has the keys the rows have now, though: a row deleted or changed since the
+// snapshot was taken is missing from it, or it's under another key. Those rows have versions,
+// so the walk skips them and they are merged into it by the key they have in the snapshot.
+// Rows other transactions change while the scan runs get versions too, they are picked up
+// before the walk goes past them.
+func (plan *IndexScanPlanNode) Next() (*tuple.Tuple, error) {
+	if !plan.Fetched {
+		plan.Fetched = true
+		if err := plan.Database.lockTable(plan.Txn, plan.TableMetadata, concurrency.LockIntentionShared); err != nil {
+			return nil, err
+		}
+		plan.versioned = make(map[common.RID]bool)
+		plan.seen = make(map[common.RID]bool)
+		if err := plan.readVersions(); err != nil {
+			return nil, err
+		}
+
+		// Equality lookups are ranges too, non-unique indexes may repeat the key
+		plan.Iterator = storage.NewIndexIterator(plan.Tree)
+		if plan.Descending {
+			plan.Iterator.SeekAfter(plan.HighKey)
+		} else {
+			plan.Iterator.Seek(plan.LowKey)
+		}
+	}
+
+	for {
+		if plan.peeked == nil && plan.Iterator != nil {
+			match, err := plan.nextFromIndex()
+			if err != nil {
+				return nil, err
+			}
+			plan.peeked = match
+		}
+		// Read after the walk moved, so a row whose entry it didn't find had its version
+		// written already
+		if plan.Database.txnManager.GetVersionStore().GetWriteCount() != plan.versionWrites {
+			if err := plan.readVersions(); err != nil {
+				plan.closeIterator()
+				return nil, err
+			}
+		}
+
+		var match *indexScanMatch
+		if len(plan.versionedRows) > 0 && (plan.peeked == nil || plan.before(plan.versionedRows[0].key, plan.peeked.key)) {
+			match = plan.versionedRows[0]
+			plan.versionedRows = plan.versionedRows[1:]
+		} else if plan.peeked != nil {
+			match, plan.peeked = plan.peeked, nil
+		} else {
+			return nil, nil
+		}
+		if plan.seen[match.rid] {
+			continue
+		}
+		plan.seen[match.rid] = true
+		plan.lastKey = match.key
+		match.tuple.Values = append(match.tuple.Values, *newRidGhostValue(match.rid.PageID, common.SlotNumber_t(match.rid.SlotNum)))
+		return match.tuple, nil
+	}
+}
+
+// Whether the scan returns key a before key b
+func (plan *IndexScanPlanNode) before(a, b storage.IndexKey) bool {
+	if plan.Descending {
+		return plan.Tree.Compare(a, b) > 0
+	}
+	return plan.Tree.Compare(a, b) < 0
+}
+
+// Next row of the walk without versions, nil once it's out of the range
+func (plan *IndexScanPlanNode) nextFromIndex() (*indexScanMatch, error) {
+	for {
+		var key storage.IndexKey
+		var rawRid uint64
+		var ok bool
+		if plan.Descending {
+			key, rawRid, ok = plan.Iterator.Prev()
+			ok = ok && plan.Tree.Compare(key, plan.LowKey) >= 0
+		} else {
+			key, rawRid, ok = plan.Iterator.Next()
+			ok = ok && plan.Tree.Compare(key, plan.HighKey) <= 0
+		}
+		if !ok {
+			// Out of the range (or of the index), the leaf is not needed anymore
+			plan.closeIterator()
+			return nil, nil
+		}
+
+		rid := *common.NewRIDFromInt64(int64(rawRid))
+		if plan.versioned[rid] || plan.seen[rid] {
+			// non-unique indexes may have the row under more than one key
+			continue
+		}
+		match, err := plan.fetchVisible(rid)
+		if err != nil {
+			plan.closeIterator()
+			return nil, err
+		}
+		if match != nil {
+			return match, nil
+		}
+	}
+}
+
+// Takes the rows that got versions since the last time out of the walk, and keeps the ones the
+// snapshot sees in the range and the scan didn't go past yet
+func (plan *IndexScanPlanNode) readVersions() error {
+	store := plan.Database.txnManager.GetVersionStore()
+	plan.versionWrites = store.GetWriteCount()
+	for _, rid := range store.TableVersions(plan.TableMetadata.FileID) {
+		if plan.versioned[rid] {
+			continue
+		}
+		plan.versioned[rid] = true
+		if plan.seen[rid] || (plan.peeked != nil && plan.peeked.rid == rid) {
+			continue
+		}
+
+		match, err := plan.fetchVisible(rid)
+		if err != nil {
+			return err
+		}
+		if match == nil || (plan.lastKey != nil && plan.before(match.key, plan.lastKey)) {
+			continue
+		}
+		// After the rows with the same key, which keep the order of their RIDs
+		idx := sort.Search(len(plan.versionedRows), func(i int) bool {
+			return plan.before(match.key, plan.versionedRows[i].key)
+		})
+		plan.versionedRows = slices.Insert(plan.versionedRows, idx, match)
+	}
+	return nil
+}
+
+// The row the snapshot of the transaction sees in the slot, if it has one in the range
+func (plan *IndexScanPlanNode) fetchVisible(rid common.RID) (*indexScanMatch, error) {
+	guard := plan.Database.bufferPool.FetchPageRead(rid.PageID)
+	if guard == nil {
+		return nil, fmt.Errorf("index %s points to a missing page %s", plan.Index, rid.PageID.ToString())
+	}
+	heap := page.NewSlottedPageFromRawPage(guard.Page()).RawTuple(common.SlotNumber_t(rid.SlotNum))
+	raw := plan.Database.txnManager.GetVersionStore().Visible(plan.Txn, rid, heap)
+	guard.Drop()
+	if raw == nil {
+		// deleted tuple, or not in the snapshot
+		return nil, nil
+	}
 
-	return fmt.Sprintf("SeqScanPlanNode { table=%s } | (\n    %s \n    )\n", s.TableMetadata.Name, formattedFields.String())
+	t := tuple.NewFromRawData(&plan.TableMetadata.Schema, bytes.NewReader(raw))
+	key, ok := indexKey(plan.TableMetadata, plan.Database.Catalog.IndexMetadataMap[plan.Index], t.Values)
+	if !ok || plan.Tree.Compare(key, plan.LowKey) < 0 || plan.Tree.Compare(key, plan.HighKey) > 0 {
+		return nil, nil
+	}
+	return &indexScanMatch{rid: rid, key: key, tuple: t}, nil
+}
+
+func (plan *IndexScanPlanNode) closeIterator() {
+	if plan.Iterator != nil {
+		plan.Iterator.Close()
+		plan.Iterator = nil
+	}
+}
+
+func (plan *IndexScanPlanNode) Schema() *schema.Schema {
+	return schemaWithRidGhostColumn(&plan.TableMetadata.Schema)
+}
+
+func (plan *IndexScanPlanNode) ToString() string {
+	formatKey := func(key storage.IndexKey, unbounded string) string {
+		if len(key) == 0 {
+			return unbounded
+		}
+		return key.ToString()
+	}
+
+	lookup := fmt.Sprintf("key=%s", plan.LowKey.ToString())
+	if len(plan.LowKey) == 0 || plan.LowKey.ToString() != plan.HighKey.ToString() {
+		lookup = fmt.Sprintf("range=[%s, %s]", formatKey(plan.LowKey, "-inf"), formatKey(plan.HighKey, "+inf"))
+	}
+	if plan.Descending {
+		lookup += ", desc"
+	}
+
+	return fmt.Sprintf(
+		"IndexScanPlanNode { table=%s, index=%s, %s } | (\n    %s \n    )\n",
+		plan.Table, plan.Index, lookup, formatScanFields(&plan.TableMetadata.Schema),
+	)
 }
 
 // ========== ordenado por ==========
@@ -146,6 +419,14 @@ type TuplesHeap struct {
 
 func (h *TuplesHeap) Len() int { return len(h.tuples) }
 func (h *TuplesHeap) Less(i, j int) bool {
+	a, b := &h.tuples[i].Values[h.byColIdx], &h.tuples[j].Values[h.byColIdx]
+	if a.IsNull() || b.IsNull() {
+		// NULLs go first, like in the indexes
+		if h.asc {
+			return value.Compare(a, b) < 0
+		}
+		return value.Compare(a, b) > 0
+	}
 	switch h.colType {
 	case value.TypeInt32:
 		if h.asc {
@@ -278,6 +559,10 @@ func (plan *FilterPlanNode) Next() (*tuple.Tuple, error) {
 
 			valuesMap := make(map[string]interface{})
 			for idx, col := range child.Schema().GetColumns() {
+				if tupleToFilter.Values[idx].IsNull() {
+					valuesMap[col.ColumnName] = nil
+					continue
+				}
 				switch tupleToFilter.Values[idx].Type {
 				case value.TypeInt32:
 					valuesMap[col.ColumnName] = tupleToFilter.Values[idx].AsInt32()
@@ -415,7 +700,7 @@ func (plan *CreamePlanNode) Next() (*tuple.Tuple, error) {
 	queryText := plan.Query.AsQueryText()
 
 	// This is the metadata of the table
-	tuples, _, _, _, err := plan.Database.ExecuteThisBaby(
+	tuples, _, _, _, err := plan.Database.ExecuteThisBaby(nil,
 		fmt.Sprintf(
 			"mete { type: \"table\", name: \"%s\", root: 0, sql: \"%s\" } en %s retornando { file_id } pe",
 			plan.Table, queryText, meta.ELENA_META_TABLE_NAME,
@@ -436,20 +721,23 @@ func (plan *CreamePlanNode) Next() (*tuple.Tuple, error) {
 		FileID:    common.FileID_t(fileId),
 		SqlCreate: queryText,
 	})
-	plan.Database.Catalog.RegisterIndexMetadata(fmt.Sprintf("%s.id", plan.Table), &catalog.IndexMetadata{
-		Name:      plan.Table,
-		Root:      common.NewPageIdFromParts(common.FileID_t(fileId), common.APageID_t(0)),
-		FileID:    common.FileID_t(fileId),
-		SqlCreate: queryText,
-	})
 
-	// bptree := storage.NewBPTree(plan.Database.bufferPool, common.FileID_t(fileId))
+	// Identity columns are indexed by default, so lookups by id don't need a full scan, and
+	// they get a sequence to hand out the ids
 	if plan.Table != meta.ELENA_META_TABLE_NAME {
-		plan.Database.ExecuteThisBaby(
-			fmt.Sprintf(
-				"mete { type: \"index\", name: \"%s.id\", root: 0, sql: \"%s\" } en %s retornando { file_id } pe",
-				plan.Table, "", meta.ELENA_META_TABLE_NAME,
-			), false)
+		for _, col := range plan.Query.GetSchema().GetColumns() {
+			if col.IsIdentity {
+				if _, err := plan.Database.createSequence(identitySequenceName(plan.Table, col.ColumnName)); err != nil {
+					return nil, err
+				}
+				keyColumn := query.QueryField{Name: col.ColumnName, Type: col.ColumnType, Length: col.StorageSize}
+				keySchema := schema.NewSchema([]column.Column{column.NewSizedColumn(col.ColumnType, col.ColumnName, col.StorageSize)})
+				sql := fmt.Sprintf("creame indice en %s (%s) pe", plan.Table, keyColumn.AsString())
+				if _, err := plan.Database.createIndex(plan.Table, keySchema, sql); err != nil {
+					return nil, err
+				}
+			}
+		}
 	}
 
 	plan.Created = true
@@ -498,6 +786,11 @@ func (plan *MetePlanNode) Next() (*tuple.Tuple, error) {
 		return nil, nil
 	}
 
+	// siguiente(<secuencia>) is handed out first, the @unique columns are checked with it
+	if err := plan.Database.resolveNextValues(plan.Query.Fields); err != nil {
+		return nil, err
+	}
+
 	if plan.NeedsScan {
 		canBeInserted := true
 		repeatedColumn := ""
@@ -532,63 +825,75 @@ func (plan *MetePlanNode) Next() (*tuple.Tuple, error) {
 		}
 	}
 
-	nextId := int32(0)
-
-	fileId := plan.TableMetadata.FileID
-	// Calculates the tuple size from the query fields
-	tupleSize := uint16(0)
-	for idx, _ := range plan.TableMetadata.Schema.GetColumns() {
-		tupleSize += plan.Query.Fields[idx].AsTupleValueNillable().SizeOnDisk()
+	// The referenced rows are looked up before any page is latched
+	if err := plan.Database.checkReferencedRows(
+		plan.Txn, plan.TableMetadata, plan.tupleValues(0), assignedColumns(plan.TableMetadata, plan.Query.Fields),
+	); err != nil {
+		return nil, err
 	}
 
-	// FIXME: adquire lock!!!
-	pageToWrite := plan.Database.bufferPool.FetchLastPage(fileId)
-	var slottedPage *page.SlottedPage
-	if pageToWrite == nil {
-		// file is empty. this page is zeroed
-		pageToWrite = plan.Database.bufferPool.NewPage(fileId)
-		slottedPage = page.NewEmptySlottedPage(pageToWrite)
-	} else {
-		// file exists and it's a slotted page so we parse it
-		slottedPage = page.NewSlottedPageFromRawPage(pageToWrite)
-		nextId = int32(slottedPage.Header.LastInsertedId) + 1
-		if !slottedPage.HasSpaceForThisTupleSize(tupleSize) {
-			// We need to create a new page
-			plan.Database.bufferPool.UnpinPage(pageToWrite.PageId, false)
-			pageToWrite = plan.Database.bufferPool.NewPage(fileId)
-			slottedPage = page.NewEmptySlottedPage(pageToWrite)
-		}
+	// The identity is handed out by the sequence of the table, before any page is latched
+	nextId, err := plan.nextIdentity()
+	if err != nil {
+		return nil, err
 	}
 
-	// We need to create a tuple, so we iterate over the query fields
+	fileId := plan.TableMetadata.FileID
+	// Calculates the tuple size from the query fields, the identity is as wide whatever it is
+	tupleSize := tuple.NewFromValues(plan.tupleValues(0)).Size
 
-	// ASSERT: at this point, binder should have resolved the query to match the table schema
-	values := make([]value.Value, 0, len(plan.Query.Fields))
+	if err := plan.Database.lockTable(plan.Txn, plan.TableMetadata, concurrency.LockIntentionExclusive); err != nil {
+		return nil, err
+	}
+	// The free-space map may read the whole table the first time, before any page is latched
+	fsm := plan.Database.freeSpaceMap(fileId)
+
+	// elena_meta has no sequence, its last page holds the last file id handed out. So it stays
+	// latched until the tuple is in, even if the tuple goes to an earlier page
+	var last *buffer.WritePageGuard
+	if plan.TableMetadata.Name == meta.ELENA_META_TABLE_NAME {
+		last = plan.Database.bufferPool.FetchLastPageWrite(fileId)
+		if last != nil {
+			nextId = page.NewSlottedPageFromRawPage(last.Page()).Header.LastInsertedId + 1
+		}
+	}
 
-	for idx, col := range plan.TableMetadata.Schema.GetColumns() {
-		// Identity columns need to be populated first (they are autoincremental)
-		if col.IsIdentity {
-			// We assume the last slot contains the last id
-			values = append(values, *value.NewInt32Value(nextId))
-		} else if col.IsNullable && *&plan.Query.Fields[idx].Value == nil {
-			values = append(values, *plan.Query.Fields[idx].AsNullRepresentation())
-		} else {
-			// Otherwise, we just append the value
-			values = append(values, *plan.Query.Fields[idx].AsTupleValue())
+	guard, slottedPage, err := plan.Database.pageWithSpaceFor(plan.Txn, fsm, fileId, tupleSize, last)
+	if err != nil {
+		if last != nil {
+			last.Drop()
 		}
+		return nil, err
 	}
 
-	tupleToInsert := tuple.NewFromValues(values)
+	tupleToInsert := tuple.NewFromValues(plan.tupleValues(nextId))
 
-	err := slottedPage.AppendTuple(tupleToInsert)
-	slottedPage.SetLastInsertedId(nextId)
+	before := bytes.Clone(guard.Data())
+	slot, err := slottedPage.AppendTuple(tupleToInsert)
+	rid := common.NewRID(guard.PageId(), uint32(slot))
+	if err == nil {
+		err = plan.logInsert(guard, before, last, slot, nextId, tupleToInsert)
+	}
 
+	free := slottedPage.FreeBytes()
+	guard.Drop()
+	if last != nil {
+		last.Drop()
+	}
 	if err != nil {
 		return nil, err
 	}
+	plan.Database.updateFreeSpace(rid.PageID, free)
 
-	// Write the page back to disk
-	plan.Database.bufferPool.UnpinPage(pageToWrite.PageId, true)
+	if err := plan.Database.insertIntoIndexes(plan.TableMetadata, tupleToInsert.Values, rid); err != nil {
+		return nil, err
+	}
+
+	// Nobody else can see the new row until the transaction ends. The lock can't be taken
+	// before, the RID is only known once the page is latched
+	if err := plan.Database.lockRow(plan.Txn, plan.TableMetadata, concurrency.LockExclusive, *rid); err != nil {
+		return nil, err
+	}
 
 	// plan.Database.bufferPool.FlushPage(pageToWrite.PageId) // FIXME: don't flush
 	plan.Inserted = true
@@ -612,6 +917,60 @@ func (plan *MetePlanNode) Next() (*tuple.Tuple, error) {
 	return tuple.NewFromValues(mappedValues), nil
 }
 
+// Next value of the sequence of the @id column. elena_meta has none, see sequences.go
+func (plan *MetePlanNode) nextIdentity() (int32, error) {
+	if plan.TableMetadata.Name == meta.ELENA_META_TABLE_NAME {
+		return 0, nil
+	}
+	for _, col := range plan.TableMetadata.Schema.GetColumns() {
+		if col.IsIdentity {
+			return plan.Database.nextValue(identitySequenceName(plan.TableMetadata.Name, col.ColumnName))
+		}
+	}
+	return 0, nil
+}
+
+// Values of the tuple to insert, in the order of the table columns, with nextId as identity
+func (plan *MetePlanNode) tupleValues(nextId int32) []value.Value {
+	// ASSERT: at this point, binder should have resolved the query to match the table schema
+	values := make([]value.Value, 0, len(plan.Query.Fields))
+	for idx, col := range plan.TableMetadata.Schema.GetColumns() {
+		if col.IsIdentity {
+			values = append(values, *value.NewInt32Value(nextId))
+		} else {
+			// Nullable columns the user left out are NULL
+			values = append(values, *plan.Query.Fields[idx].AsTupleValue())
+		}
+	}
+	return values
+}
+
+// Logs the insert. In elena_meta it also hands out the file id: it goes to the last page of
+// the heap, in the same record if the tuple went there too.
+func (plan *MetePlanNode) logInsert(
+	guard *buffer.WritePageGuard,
+	before []byte,
+	last *buffer.WritePageGuard,
+	slot common.SlotNumber_t,
+	nextId int32,
+	tupleToInsert *tuple.Tuple,
+) error {
+	if plan.TableMetadata.Name != meta.ELENA_META_TABLE_NAME {
+		return plan.Database.logPageChange(plan.Txn, recovery.LogInsert, guard, before, slot, tupleToInsert.AsRawData())
+	}
+	if last == nil || last.PageId() <= guard.PageId() {
+		page.NewSlottedPageFromRawPage(guard.Page()).SetLastInsertedId(nextId)
+		return plan.Database.logPageChange(plan.Txn, recovery.LogInsert, guard, before, slot, tupleToInsert.AsRawData())
+	}
+
+	if err := plan.Database.logPageChange(plan.Txn, recovery.LogInsert, guard, before, slot, tupleToInsert.AsRawData()); err != nil {
+		return err
+	}
+	lastBefore := bytes.Clone(last.Data())
+	page.NewSlottedPageFromRawPage(last.Page()).SetLastInsertedId(nextId)
+	return plan.Database.logPageChange(plan.Txn, recovery.LogIdentity, last, lastBefore, 0, nil)
+}
+
 func (plan *MetePlanNode) Schema() *schema.Schema {
 	schm := schema.EmptySchema()
 
@@ -669,27 +1028,43 @@ func (plan *DeletePlanNode) Next() (*tuple.Tuple, error) {
 	// search for the RID column to get the page_id and slot to delete
 	for idx, col := range child.Schema().GetColumns() {
 		if col.ColumnName == meta.ELENA_RID_GHOST_COLUMN_NAME {
-			rid := tupleToDelete.Values[idx].AsVarchar()
-			// RID is in the format "(file_id,actual_page_id,slot)"
-			ridParts := strings.Split(rid[1:len(rid)-1], ",")
-			if len(ridParts) != 3 {
-				return nil, fmt.Errorf("invalid RID format: %s", rid)
+			pageId, tupleSlot, err := parseRidGhostValue(tupleToDelete.Values[idx].AsVarchar())
+			if err != nil {
+				return nil, err
+			}
+			rid := common.NewRID(pageId, uint32(tupleSlot))
+			if err := plan.Database.lockRow(plan.Txn, plan.TableMetadata, concurrency.LockExclusive, *rid); err != nil {
+				return nil, err
+			}
+			// The rows referencing this one go first, before the page is latched
+			if err := plan.Database.deleteReferencingRows(plan.Txn, plan.TableMetadata, tupleToDelete.Values); err != nil {
+				return nil, err
 			}
-			fileId, _ := strconv.Atoi(ridParts[0])
-			aPageId, _ := strconv.Atoi(ridParts[1])
-			tupleSlot, _ := strconv.Atoi(ridParts[2])
 
-			pageId := common.NewPageIdFromParts(common.FileID_t(fileId), common.APageID_t(aPageId))
+			guard := plan.Database.bufferPool.FetchPageWrite(pageId)
+			if guard == nil {
+				return nil, fmt.Errorf("page %s not found", pageId.ToString())
+			}
 
-			rawPage := plan.Database.bufferPool.FetchPage(pageId)
-			if rawPage == nil {
-				return nil, fmt.Errorf("page %s not found", pageId)
+			slottedPage := page.NewSlottedPageFromRawPage(guard.Page())
+			before := bytes.Clone(guard.Data())
+			deleted := slottedPage.RawTuple(tupleSlot)
+			if !slottedPage.DeleteTuple(tupleSlot) {
+				guard.Drop()
+				return nil, fmt.Errorf("slot %d of page %s does not exist", tupleSlot, pageId.ToString())
+			}
+			if err := plan.Database.logPageChange(plan.Txn, recovery.LogDelete, guard, before, tupleSlot, deleted); err != nil {
+				guard.Drop()
+				return nil, err
 			}
+			free := slottedPage.FreeBytes()
+			guard.Drop()
+			plan.Database.updateFreeSpace(pageId, free)
 
-			slottedPage := page.NewSlottedPageFromRawPage(rawPage)
-			slottedPage.DeleteTuple(common.SlotNumber_t(tupleSlot))
-			plan.Database.bufferPool.UnpinPage(pageId, true)
-			plan.Database.bufferPool.FlushPage(pageId) // FIXME: don't flush
+			// The heap is done, so now the indexes can forget about this tuple
+			if err := plan.Database.deleteFromIndexes(plan.TableMetadata, tupleToDelete.Values, rid); err != nil {
+				return nil, err
+			}
 
 			return tupleToDelete, nil
 		}
@@ -705,11 +1080,528 @@ func (plan *DeletePlanNode) ToString() string {
 	return "DeletePlanNode(" + plan.TableMetadata.Name + ")"
 }
 
+// ======== "cambia" ========
+
+// Rewrites the tuples that match the filter. Children[0] is a Filter over a SeqScan that
+// yields the tuples (with their RID ghost column), and Children[1], if present, is a
+// SeqScan used to check @unique columns before anything is written.
+type UpdatePlanNode struct {
+	PlanNodeBase
+	Query         *query.Query
+	TableMetadata *catalog.TableMetadata
+	NeedsScan     bool
+	// Tuples matched by the filter. They are all collected before touching the heap,
+	// otherwise tuples relocated to the last page would be scanned (and updated) again
+	TuplesToUpdate []*tuple.Tuple
+	Collected      bool
+}
+
+func (plan *UpdatePlanNode) Next() (*tuple.Tuple, error) {
+	if !plan.Collected {
+		for {
+			matchedTuple, err := plan.Children[0].Next()
+			if err != nil {
+				return nil, err
+			}
+			if matchedTuple == nil {
+				break
+			}
+			plan.TuplesToUpdate = append(plan.TuplesToUpdate, matchedTuple)
+		}
+		plan.Collected = true
+
+		if plan.NeedsScan {
+			if err := plan.checkUniqueColumns(); err != nil {
+				return nil, err
+			}
+			plan.NeedsScan = false
+		}
+	}
+
+	if len(plan.TuplesToUpdate) == 0 {
+		return nil, nil
+	}
+	tupleToUpdate := plan.TuplesToUpdate[0]
+	plan.TuplesToUpdate = plan.TuplesToUpdate[1:]
+
+	ridIdx := plan.TableMetadata.Schema.GetColumnCount() // the ghost column goes last
+	pageId, slot, err := parseRidGhostValue(tupleToUpdate.Values[ridIdx].AsVarchar())
+	if err != nil {
+		return nil, err
+	}
+
+	// Start from the old values (without the RID) and overwrite the assigned columns
+	values := make([]value.Value, ridIdx)
+	copy(values, tupleToUpdate.Values[:ridIdx])
+	for _, field := range plan.Query.Fields {
+		for idx, col := range plan.TableMetadata.Schema.GetColumns() {
+			if schema.ExtractColumnName(field.Name) == col.ColumnName {
+				values[idx] = *field.AsTupleValue()
+				break
+			}
+		}
+	}
+	updatedTuple := tuple.NewFromValues(values)
+
+	oldRid := common.NewRID(pageId, uint32(slot))
+	if err := plan.Database.lockRow(plan.Txn, plan.TableMetadata, concurrency.LockExclusive, *oldRid); err != nil {
+		return nil, err
+	}
+	if err := plan.checkForeignKeys(tupleToUpdate.Values, values); err != nil {
+		return nil, err
+	}
+
+	guard := plan.Database.bufferPool.FetchPageWrite(pageId)
+	if guard == nil {
+		return nil, fmt.Errorf("page %s not found", pageId.ToString())
+	}
+	slottedPage := page.NewSlottedPageFromRawPage(guard.Page())
+
+	before := bytes.Clone(guard.Data())
+	oldTuple := slottedPage.RawTuple(slot)
+	err = slottedPage.UpdateTuple(slot, updatedTuple)
+	if err == nil {
+		if err := plan.Database.logPageChange(plan.Txn, recovery.LogUpdate, guard, before, slot, oldTuple); err != nil {
+			guard.Drop()
+			return nil, err
+		}
+		free := slottedPage.FreeBytes()
+		guard.Drop()
+		plan.Database.updateFreeSpace(pageId, free)
+		if err := plan.Database.deleteFromIndexes(plan.TableMetadata, tupleToUpdate.Values, oldRid); err != nil {
+			return nil, err
+		}
+		if err := plan.Database.insertIntoIndexes(plan.TableMetadata, updatedTuple.Values, oldRid); err != nil {
+			return nil, err
+		}
+		return updatedTuple, nil
+	}
+	// The tuple may be moved to this same page, so it's released before appending
+	guard.Drop()
+	if !page.IsNoSpaceLeft(err) {
+		return nil, err
+	}
+
+	// The tuple grew past its slot, so we move it to a page with room. We append it first so
+	// that a failed append leaves the old tuple (and its index entries) untouched
+	newPageId, newSlot, err := plan.Database.appendTupleToHeap(plan.Txn, plan.TableMetadata.FileID, updatedTuple)
+	if err != nil {
+		return nil, err
+	}
+	newRid := common.NewRID(newPageId, uint32(newSlot))
+	if err := plan.Database.lockRow(plan.Txn, plan.TableMetadata, concurrency.LockExclusive, *newRid); err != nil {
+		return nil, err
+	}
+	guard = plan.Database.bufferPool.FetchPageWrite(pageId)
+	if guard == nil {
+		return nil, fmt.Errorf("page %s not found", pageId.ToString())
+	}
+	slottedPage = page.NewSlottedPageFromRawPage(guard.Page())
+	before = bytes.Clone(guard.Data())
+	oldTuple = slottedPage.RawTuple(slot)
+	slottedPage.DeleteTuple(slot)
+	if err := plan.Database.logPageChange(plan.Txn, recovery.LogDelete, guard, before, slot, oldTuple); err != nil {
+		guard.Drop()
+		return nil, err
+	}
+	free := slottedPage.FreeBytes()
+	guard.Drop()
+	plan.Database.updateFreeSpace(pageId, free)
+
+	if err := plan.Database.deleteFromIndexes(plan.TableMetadata, tupleToUpdate.Values, oldRid); err != nil {
+		return nil, err
+	}
+	if err := plan.Database.insertIntoIndexes(plan.TableMetadata, updatedTuple.Values, newRid); err != nil {
+		return nil, err
+	}
+	return updatedTuple, nil
+}
+
+// Makes sure that no @unique column ends up with a repeated value after the update
+func (plan *UpdatePlanNode) checkUniqueColumns() error {
+	uniqueFields := make(map[int]*query.QueryField)
+	for i := range plan.Query.Fields {
+		field := &plan.Query.Fields[i]
+		for idx, col := range plan.TableMetadata.Schema.GetColumns() {
+			if col.IsUnique && schema.ExtractColumnName(field.Name) == col.ColumnName {
+				uniqueFields[idx] = field
+				break
+			}
+		}
+	}
+
+	if len(uniqueFields) == 0 || len(plan.TuplesToUpdate) == 0 {
+		return nil
+	}
+
+	if len(plan.TuplesToUpdate) > 1 {
+		for idx := range uniqueFields {
+			return fmt.Errorf(
+				"@unique column \"%s\" can't be set to the same value in %d rows",
+				plan.TableMetadata.Schema.GetColumn(idx).ColumnName, len(plan.TuplesToUpdate),
+			)
+		}
+	}
+
+	ridIdx := plan.TableMetadata.Schema.GetColumnCount()
+	updatedRid := plan.TuplesToUpdate[0].Values[ridIdx].AsVarchar()
+
+	for {
+		scannedTuple, err := plan.Children[1].Next()
+		if err != nil {
+			return err
+		}
+		if scannedTuple == nil {
+			return nil
+		}
+		if scannedTuple.Values[ridIdx].AsVarchar() == updatedRid {
+			// the row being updated can keep its own value
+			continue
+		}
+		for idx, field := range uniqueFields {
+			if field.IsEqualToValue(&scannedTuple.Values[idx]) {
+				return fmt.Errorf(
+					"@unique column \"%s\" has a repeated value \"%s\"",
+					plan.TableMetadata.Schema.GetColumn(idx).ColumnName, scannedTuple.Values[idx].FormatAsString(),
+				)
+			}
+		}
+	}
+}
+
+// The new values of the foreign columns must be referenced rows, and the referenced columns
+// that change can't have rows referencing their old values. Runs before the page is latched
+func (plan *UpdatePlanNode) checkForeignKeys(oldValues []value.Value, newValues []value.Value) error {
+	assigned := assignedColumns(plan.TableMetadata, plan.Query.Fields)
+	if err := plan.Database.checkReferencedRows(plan.Txn, plan.TableMetadata, newValues, assigned); err != nil {
+		return err
+	}
+
+	changed := []int{}
+	for _, idx := range assigned {
+		if value.Compare(&oldValues[idx], &newValues[idx]) != 0 {
+			changed = append(changed, idx)
+		}
+	}
+	return plan.Database.checkNotReferenced(plan.Txn, plan.TableMetadata, oldValues, changed)
+}
+
+func (plan *UpdatePlanNode) Schema() *schema.Schema {
+	return schema.EmptySchema()
+}
+
+func (plan *UpdatePlanNode) ToString() string {
+	formattedFields := strings.Builder{}
+	fields := plan.Query.Fields
+	numFields := len(fields)
+
+	for i, f := range fields {
+		formattedFields.WriteString("    ")
+		formattedFields.WriteString(f.Name)
+		formattedFields.WriteString(":")
+		formattedFields.WriteString(strings.ToUpper(f.Type.AsString()))
+
+		if i < numFields-1 {
+			formattedFields.WriteString(",\n")
+		}
+	}
+
+	return fmt.Sprintf(
+		"UpdatePlanNode { table=%s } | (\n%s\n)\n    %s",
+		plan.TableMetadata.Name, formattedFields.String(), plan.Children[0].ToString(),
+	)
+}
+
+// =========== "creame indice" ===========
+
+type CreateIndexPlanNode struct {
+	PlanNodeBase
+	Query         *query.Query
+	TableMetadata *catalog.TableMetadata
+	Created       bool
+}
+
+func (plan *CreateIndexPlanNode) Next() (*tuple.Tuple, error) {
+	if plan.Created {
+		return nil, nil
+	}
+	plan.Created = true
+
+	// The index is built from the rows as they are, they can't change until it's done
+	if err := plan.Database.lockTable(plan.Txn, plan.TableMetadata, concurrency.LockShared); err != nil {
+		return nil, err
+	}
+	indexMetadata, err := plan.Database.createIndex(plan.TableMetadata.Name, plan.Query.GetSchema(), plan.Query.AsQueryText())
+	if err != nil {
+		return nil, err
+	}
+	if err := plan.Database.buildIndex(plan.TableMetadata, indexMetadata); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (plan *CreateIndexPlanNode) Schema() *schema.Schema {
+	return schema.EmptySchema()
+}
+
+func (plan *CreateIndexPlanNode) ToString() string {
+	columns := make([]string, 0, len(plan.Query.Fields))
+	for _, field := range plan.Query.Fields {
+		columns = append(columns, field.Name)
+	}
+	return fmt.Sprintf("CreateIndexPlanNode { table=%s, columns=(%s) }\n", plan.TableMetadata.Name, strings.Join(columns, ", "))
+}
+
+// =========== "creame secuencia" ===========
+
+type CreateSequencePlanNode struct {
+	PlanNodeBase
+	Sequence string
+	Created  bool
+}
+
+func (plan *CreateSequencePlanNode) Next() (*tuple.Tuple, error) {
+	if plan.Created {
+		return nil, nil
+	}
+	plan.Created = true
+
+	if _, err := plan.Database.createSequence(plan.Sequence); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (plan *CreateSequencePlanNode) Schema() *schema.Schema {
+	return schema.EmptySchema()
+}
+
+func (plan *CreateSequencePlanNode) ToString() string {
+	return fmt.Sprintf("CreateSequencePlanNode { sequence=%s }\n", plan.Sequence)
+}
+
+// =========== "borra indice" ===========
+
+type DropIndexPlanNode struct {
+	PlanNodeBase
+	Index   string
+	Dropped bool
+}
+
+func (plan *DropIndexPlanNode) Next() (*tuple.Tuple, error) {
+	if plan.Dropped {
+		return nil, nil
+	}
+	plan.Dropped = true
+
+	// The file goes away, nobody can be scanning it
+	if indexMetadata := plan.Database.Catalog.IndexMetadataMap[plan.Index]; indexMetadata != nil {
+		tableMetadata := plan.Database.Catalog.GetTableMetadata(indexMetadata.TableName())
+		if err := plan.Database.lockTable(plan.Txn, tableMetadata, concurrency.LockExclusive); err != nil {
+			return nil, err
+		}
+	}
+	if err := plan.Database.dropIndex(plan.Index); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (plan *DropIndexPlanNode) Schema() *schema.Schema {
+	return schema.EmptySchema()
+}
+
+func (plan *DropIndexPlanNode) ToString() string {
+	return fmt.Sprintf("DropIndexPlanNode { index=%s }\n", plan.Index)
+}
+
+// =========== "borra tabla" ===========
+
+type DropTablePlanNode struct {
+	PlanNodeBase
+	Table   string
+	Dropped bool
+}
+
+func (plan *DropTablePlanNode) Next() (*tuple.Tuple, error) {
+	if plan.Dropped {
+		return nil, nil
+	}
+	plan.Dropped = true
+
+	// The file goes away, nobody else can be using it
+	if tableMetadata := plan.Database.Catalog.GetTableMetadata(plan.Table); tableMetadata != nil {
+		if err := plan.Database.lockTable(plan.Txn, tableMetadata, concurrency.LockExclusive); err != nil {
+			return nil, err
+		}
+	}
+	if err := plan.Database.DropTable(plan.Txn, plan.Table); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (plan *DropTablePlanNode) Schema() *schema.Schema {
+	return schema.EmptySchema()
+}
+
+func (plan *DropTablePlanNode) ToString() string {
+	return fmt.Sprintf("DropTablePlanNode { table=%s }\n", plan.Table)
+}
+
+// =========== "trunca tabla" ===========
+
+type TruncatePlanNode struct {
+	PlanNodeBase
+	Table     string
+	Truncated bool
+}
+
+func (plan *TruncatePlanNode) Next() (*tuple.Tuple, error) {
+	if plan.Truncated {
+		return nil, nil
+	}
+	plan.Truncated = true
+
+	// The heap is emptied, nobody else can be using it
+	if tableMetadata := plan.Database.Catalog.GetTableMetadata(plan.Table); tableMetadata != nil {
+		if err := plan.Database.lockTable(plan.Txn, tableMetadata, concurrency.LockExclusive); err != nil {
+			return nil, err
+		}
+	}
+	if err := plan.Database.Truncate(plan.Txn, plan.Table); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (plan *TruncatePlanNode) Schema() *schema.Schema {
+	return schema.EmptySchema()
+}
+
+func (plan *TruncatePlanNode) ToString() string {
+	return fmt.Sprintf("TruncatePlanNode { table=%s }\n", plan.Table)
+}
+
+// =========== "cambia tabla" ===========
+
+type AlterTablePlanNode struct {
+	PlanNodeBase
+	Query   *query.Query
+	Altered bool
+}
+
+func (plan *AlterTablePlanNode) Next() (*tuple.Tuple, error) {
+	if plan.Altered {
+		return nil, nil
+	}
+	plan.Altered = true
+
+	// The rows change how they are stored, nobody else can be using them
+	if tableMetadata := plan.Database.Catalog.GetTableMetadata(plan.Query.QueryInstrName); tableMetadata != nil {
+		if err := plan.Database.lockTable(plan.Txn, tableMetadata, concurrency.LockExclusive); err != nil {
+			return nil, err
+		}
+	}
+	if err := plan.Database.AlterTable(plan.Txn, plan.Query); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (plan *AlterTablePlanNode) Schema() *schema.Schema {
+	return schema.EmptySchema()
+}
+
+func (plan *AlterTablePlanNode) ToString() string {
+	return fmt.Sprintf("AlterTablePlanNode { table=%s, action=%s }\n", plan.Query.QueryInstrName, plan.Query.QueryAlterInstr)
+}
+
+// =========== "limpia tabla" ===========
+
+type VacuumPlanNode struct {
+	PlanNodeBase
+	Table    string
+	Vacuumed bool
+}
+
+func (plan *VacuumPlanNode) Next() (*tuple.Tuple, error) {
+	if plan.Vacuumed {
+		return nil, nil
+	}
+	plan.Vacuumed = true
+
+	// The heap is replaced, nobody else can be using it
+	if tableMetadata := plan.Database.Catalog.GetTableMetadata(plan.Table); tableMetadata != nil {
+		if err := plan.Database.lockTable(plan.Txn, tableMetadata, concurrency.LockExclusive); err != nil {
+			return nil, err
+		}
+	}
+	stats, err := plan.Database.vacuum(plan.Txn, plan.Table)
+	if err != nil {
+		return nil, err
+	}
+	plan.Database.log.Info("vacuumed %s", stats.ToString())
+	return nil, nil
+}
+
+func (plan *VacuumPlanNode) Schema() *schema.Schema {
+	return schema.EmptySchema()
+}
+
+func (plan *VacuumPlanNode) ToString() string {
+	return fmt.Sprintf("VacuumPlanNode { table=%s }\n", plan.Table)
+}
+
+// =========== "empieza", "confirma", "deshaz" ===========
+
+type TransactionPlanNode struct {
+	PlanNodeBase
+	Action query.QueryInstrType
+	// Session whose transaction is started or ended, set by ExecuteThisBaby
+	Session *Session
+	Done    bool
+}
+
+func (plan *TransactionPlanNode) Next() (*tuple.Tuple, error) {
+	if plan.Done {
+		return nil, nil
+	}
+	plan.Done = true
+
+	switch plan.Action {
+	case query.QueryBegin:
+		return nil, plan.Session.beginTransaction()
+	case query.QueryCommit:
+		return nil, plan.Session.commitTransaction()
+	default:
+		return nil, plan.Session.rollbackTransaction()
+	}
+}
+
+func (plan *TransactionPlanNode) Schema() *schema.Schema {
+	return schema.EmptySchema()
+}
+
+func (plan *TransactionPlanNode) ToString() string {
+	return fmt.Sprintf("TransactionPlanNode { action=%s }\n", plan.Action)
+}
+
 // Static assertions for PlanNodeBase implementors.
 var _ PlanNode = (*SeqScanPlanNode)(nil)
+var _ PlanNode = (*IndexScanPlanNode)(nil)
 var _ PlanNode = (*CreamePlanNode)(nil)
 var _ PlanNode = (*MetePlanNode)(nil)
 var _ PlanNode = (*ProjectionPlanNode)(nil)
 var _ PlanNode = (*DeletePlanNode)(nil)
 var _ PlanNode = (*FilterPlanNode)(nil)
 var _ PlanNode = (*SortPlanNode)(nil)
+var _ PlanNode = (*UpdatePlanNode)(nil)
+var _ PlanNode = (*CreateIndexPlanNode)(nil)
+var _ PlanNode = (*DropIndexPlanNode)(nil)
+var _ PlanNode = (*DropTablePlanNode)(nil)
+var _ PlanNode = (*TruncatePlanNode)(nil)
+var _ PlanNode = (*AlterTablePlanNode)(nil)
+var _ PlanNode = (*VacuumPlanNode)(nil)
+var _ PlanNode = (*TransactionPlanNode)(nil)
@@ -2,7 +2,11 @@ package database
 
 import (
 	"fisi/elenadb/internal/query"
+	"fisi/elenadb/pkg/catalog"
+	"fisi/elenadb/pkg/catalog/column"
+	"fisi/elenadb/pkg/catalog/schema"
 	"fisi/elenadb/pkg/meta"
+	storage "fisi/elenadb/pkg/storage/index"
 	"fisi/elenadb/pkg/storage/table/value"
 	"fmt"
 )
@@ -10,9 +14,6 @@ import (
 func SelectPlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
 	tableMetadata := db.Catalog.GetTableMetadata(query.QueryInstrName)
 
-	// TODO: query for available indexes
-	// index := db.Catalog.IndexMetadata(query.QueryInstrName)
-
 	if tableMetadata == nil {
 		return nil, TableDoesNotExistError{table: query.QueryInstrName}
 	}
@@ -20,16 +21,35 @@ func SelectPlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
 	var selectPlan PlanNode
 
 	// FLAG_ ESTRUCTURA: tree
-	selectPlan = &SeqScanPlanNode{
-		PlanNodeBase: PlanNodeBase{
-			Type:     PlanNodeTypeSeqScan,
-			Children: nil,
-			Database: db,
-		},
-		Query:         query,
-		TableMetadata: tableMetadata,
-		Cursor:        NewPagesCursorFromParts(tableMetadata.FileID, 0, 0),
-		CurrentPage:   nil,
+	indexScan := IndexScanPlanBuilder(query, tableMetadata, db)
+
+	// "ordenado por" an indexed column reads the index in order instead of sorting the tuples
+	sortedByIndex := false
+	if query.OrderedBy != nil {
+		if indexScan == nil {
+			indexScan = OrderedIndexScanPlanBuilder(query, tableMetadata, db)
+		}
+		if indexScan != nil && indexScan.Tree.KeySchema().GetColumn(0).ColumnName == *query.OrderedBy {
+			indexScan.Descending = !query.IsAscending
+			sortedByIndex = true
+		}
+	}
+
+	if indexScan != nil {
+		selectPlan = indexScan
+	} else {
+		selectPlan = &SeqScanPlanNode{
+			PlanNodeBase: PlanNodeBase{
+				Type:     PlanNodeTypeSeqScan,
+				Children: nil,
+				Database: db,
+			},
+			Query:         query,
+			TableMetadata: tableMetadata,
+			Cursor:        NewPagesCursorFromParts(tableMetadata.FileID, 0, 0),
+			CurrentPage:   nil,
+			Snapshot:      true,
+		}
 	}
 
 	if query.Filter != nil {
@@ -58,7 +78,7 @@ func SelectPlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
 	}
 
 	// FLAG_ALGORITMO: heap sort
-	if query.OrderedBy != nil {
+	if query.OrderedBy != nil && !sortedByIndex {
 		sortedColIdx := -1
 		for idx, col := range tableMetadata.Schema.GetColumns() {
 			if col.ColumnName == *query.OrderedBy {
@@ -101,6 +121,124 @@ func SelectPlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
 		TableMetadata:   tableMetadata,
 	}, nil
 }
+
+// Returns an IndexScanPlanNode if some loaded index can answer part of the filter, or nil
+// if the table has to be scanned sequentially. Only the comparisons joined by "y" are used:
+// equalities on the first key columns narrow the prefix of the key, and the comparisons on
+// the column after them bound the range. The filter on top takes care of the rest.
+func IndexScanPlanBuilder(query *query.Query, tableMetadata *catalog.TableMetadata, db *ElenaDB) *IndexScanPlanNode {
+	if query.Filter == nil {
+		return nil
+	}
+	conjuncts := query.Filter.Conjuncts()
+
+	for _, index := range db.Catalog.GetTableIndexes(tableMetadata.Name) {
+		tree := db.indexTree(index.Name)
+		if tree == nil {
+			continue
+		}
+
+		lowKey, highKey := storage.IndexKey{}, storage.IndexKey{}
+		for _, col := range index.KeySchema.GetColumns() {
+			low, high := keyColumnBounds(col, conjuncts)
+			if low != nil {
+				lowKey = append(lowKey, *low)
+			}
+			if high != nil {
+				highKey = append(highKey, *high)
+			}
+			// Only an equality lets the next column narrow the range
+			if low == nil || high == nil || value.Compare(low, high) != 0 {
+				break
+			}
+		}
+
+		if len(lowKey) > 0 || len(highKey) > 0 {
+			return newIndexScanPlanNode(query, tableMetadata, index, tree, lowKey, highKey, db)
+		}
+	}
+
+	return nil
+}
+
+// Returns an IndexScanPlanNode over a whole index led by the "ordenado por" column, so the
+// tuples come already sorted. nil if there is no such index.
+func OrderedIndexScanPlanBuilder(query *query.Query, tableMetadata *catalog.TableMetadata, db *ElenaDB) *IndexScanPlanNode {
+	for _, index := range db.Catalog.GetTableIndexes(tableMetadata.Name) {
+		tree := db.indexTree(index.Name)
+		if tree == nil || index.KeySchema.GetColumn(0).ColumnName != *query.OrderedBy {
+			continue
+		}
+		return newIndexScanPlanNode(query, tableMetadata, index, tree, storage.IndexKey{}, storage.IndexKey{}, db)
+	}
+	return nil
+}
+
+func newIndexScanPlanNode(
+	query *query.Query,
+	tableMetadata *catalog.TableMetadata,
+	index *catalog.IndexMetadata,
+	tree *storage.BPTree,
+	lowKey storage.IndexKey,
+	highKey storage.IndexKey,
+	db *ElenaDB,
+) *IndexScanPlanNode {
+	return &IndexScanPlanNode{
+		PlanNodeBase: PlanNodeBase{
+			Type:     PlanNodeTypeIndexScan,
+			Children: nil,
+			Database: db,
+		},
+		Table:         tableMetadata.Name,
+		Index:         index.Name,
+		Query:         query,
+		TableMetadata: tableMetadata,
+		Tree:          tree,
+		LowKey:        lowKey,
+		HighKey:       highKey,
+		Descending:    false,
+		Iterator:      nil,
+		Fetched:       false,
+	}
+}
+
+// Returns the tightest inclusive bounds the comparisons give to the key column, nil when a
+// side isn't bounded. Strict comparisons are taken as inclusive, the filter drops the extra
+// tuples. Values that don't fit the column type are ignored.
+func keyColumnBounds(col column.Column, conjuncts []query.FilterPredicate) (*value.Value, *value.Value) {
+	var low, high *value.Value
+	for _, predicate := range conjuncts {
+		if predicate.Field != col.ColumnName {
+			continue
+		}
+		resolved, err := resolveAnyValueFromType(col.ColumnType, predicate.Value)
+		if err != nil {
+			continue
+		}
+		field := query.QueryField{Type: col.ColumnType, Length: col.StorageSize, Value: resolved}
+		bound := field.AsTupleValue()
+
+		switch predicate.Cmp {
+		case "==":
+			if low == nil || value.Compare(bound, low) > 0 {
+				low = bound
+			}
+			if high == nil || value.Compare(bound, high) < 0 {
+				high = bound
+			}
+		case ">=", ">":
+			if low == nil || value.Compare(bound, low) > 0 {
+				low = bound
+			}
+		case "<=", "<":
+			if high == nil || value.Compare(bound, high) < 0 {
+				high = bound
+			}
+		}
+	}
+	return low, high
+}
+
 func InsertPlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
 	tableMetadata := db.Catalog.GetTableMetadata(query.QueryInstrName)
 	if tableMetadata == nil {
@@ -155,7 +293,87 @@ func InsertPlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
 
 }
 func UpdatePlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
-	return nil, NonImplementedPlanError{planName: "cambia"}
+	tableMetadata := db.Catalog.GetTableMetadata(query.QueryInstrName)
+	if tableMetadata == nil {
+		return nil, TableDoesNotExistError{table: query.QueryInstrName}
+	}
+
+	if query.Filter == nil {
+		return nil, fmt.Errorf("\"cambia\" query must have a filter like: cambia en <table> { ... } si (...) pe")
+	}
+
+	query.Filter.Resolver = func(columnName string) value.ValueType {
+		cols := tableMetadata.Schema.GetColumns()
+		for idx, _ := range cols {
+			col := cols[idx]
+
+			if col.ColumnName == columnName {
+				return col.ColumnType
+			}
+		}
+		return value.TypeInvalid
+	}
+
+	children := []PlanNode{
+		&FilterPlanNode{
+			PlanNodeBase: PlanNodeBase{
+				Type:     PlanNodeTypeFilter,
+				Database: db,
+				Children: []PlanNode{
+					&SeqScanPlanNode{
+						PlanNodeBase: PlanNodeBase{
+							Type:     PlanNodeTypeSeqScan,
+							Children: nil,
+							Database: db,
+						},
+						Query:         query,
+						TableMetadata: tableMetadata,
+						Cursor:        NewPagesCursorFromParts(tableMetadata.FileID, 0, 0),
+						CurrentPage:   nil,
+					},
+				},
+			},
+			FilterQuery:   query,
+			TableMetadata: tableMetadata,
+		},
+	}
+
+	// Assigning a @unique column means we have to look at the rest of the table
+	needsScan := false
+	for _, field := range query.Fields {
+		for _, col := range tableMetadata.Schema.GetColumns() {
+			if col.IsUnique && schema.ExtractColumnName(field.Name) == col.ColumnName {
+				needsScan = true
+			}
+		}
+	}
+
+	if needsScan {
+		children = append(children, &SeqScanPlanNode{
+			PlanNodeBase: PlanNodeBase{
+				Type:     PlanNodeTypeSeqScan,
+				Children: nil,
+				Database: db,
+			},
+			Query:         query,
+			TableMetadata: tableMetadata,
+			Cursor:        NewPagesCursorFromParts(tableMetadata.FileID, 0, 0),
+			CurrentPage:   nil,
+		})
+	}
+
+	return &UpdatePlanNode{
+		PlanNodeBase: PlanNodeBase{
+			Type:     PlanNodeTypeUpdate,
+			Database: db,
+			Children: children,
+		},
+		Query:          query,
+		TableMetadata:  tableMetadata,
+		NeedsScan:      needsScan,
+		TuplesToUpdate: nil,
+		Collected:      false,
+	}, nil
 }
 func DeletePlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
 	tableMetadata := db.Catalog.GetTableMetadata(query.QueryInstrName)
@@ -251,6 +469,108 @@ func CreatePlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
 	}, nil
 }
 
+func CreateIndexPlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
+	tableMetadata := db.Catalog.GetTableMetadata(query.QueryInstrName)
+	if tableMetadata == nil {
+		return nil, TableDoesNotExistError{table: query.QueryInstrName}
+	}
+
+	return &CreateIndexPlanNode{
+		PlanNodeBase: PlanNodeBase{
+			Type:     PlanNodeTypeCreate,
+			Children: nil,
+			Database: db,
+		},
+		Query:         query,
+		TableMetadata: tableMetadata,
+		Created:       false,
+	}, nil
+}
+
+func CreateSequencePlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
+	return &CreateSequencePlanNode{
+		PlanNodeBase: PlanNodeBase{
+			Type:     PlanNodeTypeCreate,
+			Children: nil,
+			Database: db,
+		},
+		Sequence: query.QueryInstrName,
+		Created:  false,
+	}, nil
+}
+
+func DropIndexPlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
+	return &DropIndexPlanNode{
+		PlanNodeBase: PlanNodeBase{
+			Type:     PlanNodeTypeDelete,
+			Children: nil,
+			Database: db,
+		},
+		Index:   query.QueryInstrName,
+		Dropped: false,
+	}, nil
+}
+
+func DropTablePlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
+	return &DropTablePlanNode{
+		PlanNodeBase: PlanNodeBase{
+			Type:     PlanNodeTypeDelete,
+			Children: nil,
+			Database: db,
+		},
+		Table:   query.QueryInstrName,
+		Dropped: false,
+	}, nil
+}
+
+func TruncatePlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
+	return &TruncatePlanNode{
+		PlanNodeBase: PlanNodeBase{
+			Type:     PlanNodeTypeDelete,
+			Children: nil,
+			Database: db,
+		},
+		Table:     query.QueryInstrName,
+		Truncated: false,
+	}, nil
+}
+
+func AlterTablePlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
+	return &AlterTablePlanNode{
+		PlanNodeBase: PlanNodeBase{
+			Type:     PlanNodeTypeUpdate,
+			Children: nil,
+			Database: db,
+		},
+		Query:   query,
+		Altered: false,
+	}, nil
+}
+
+func VacuumPlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
+	return &VacuumPlanNode{
+		PlanNodeBase: PlanNodeBase{
+			Type:     PlanNodeTypeVacuum,
+			Children: nil,
+			Database: db,
+		},
+		Table:    query.QueryInstrName,
+		Vacuumed: false,
+	}, nil
+}
+
+func TransactionPlanBuilder(query *query.Query, db *ElenaDB) (PlanNode, error) {
+	return &TransactionPlanNode{
+		PlanNodeBase: PlanNodeBase{
+			Type:     PlanNodeTypeTxn,
+			Children: nil,
+			Database: db,
+		},
+		Action: query.QueryType,
+		Done:   false,
+	}, nil
+}
+
 /* Plan errors */
 
 // UnknownPlanError is returned when the planner does not recognize the query type.
@@ -296,15 +616,36 @@ func OptimizeQueryPlan(inputPlan PlanNode) PlanNode {
 func MakeQueryPlan(inputQuery *query.Query, db *ElenaDB) (PlanNode, error) {
 	switch inputQuery.QueryType {
 	case query.QueryCreate: // creame
+		if inputQuery.QueryIndexInstr {
+			return CreateIndexPlanBuilder(inputQuery, db)
+		}
+		if inputQuery.QuerySequenceInstr {
+			return CreateSequencePlanBuilder(inputQuery, db)
+		}
 		return CreatePlanBuilder(inputQuery, db)
 	case query.QueryRetrieve: // dame
 		return SelectPlanBuilder(inputQuery, db)
 	case query.QueryInsert: // mete
 		return InsertPlanBuilder(inputQuery, db)
 	case query.QueryErase: // borra
+		if inputQuery.QueryIndexInstr {
+			return DropIndexPlanBuilder(inputQuery, db)
+		}
+		if inputQuery.QueryTableInstr {
+			return DropTablePlanBuilder(inputQuery, db)
+		}
 		return DeletePlanBuilder(inputQuery, db)
 	case query.QueryUpdate: // cambia
+		if inputQuery.QueryAlterInstr != "" {
+			return AlterTablePlanBuilder(inputQuery, db)
+		}
 		return UpdatePlanBuilder(inputQuery, db)
+	case query.QueryVacuum: // limpia
+		return VacuumPlanBuilder(inputQuery, db)
+	case query.QueryTruncate: // trunca
+		return TruncatePlanBuilder(inputQuery, db)
+	case query.QueryBegin, query.QueryCommit, query.QueryRollback: // empieza, confirma, deshaz
+		return TransactionPlanBuilder(inputQuery, db)
 	default:
 		return nil, UnknownPlanError{}
 	}
@@ -0,0 +1,191 @@
+package database
+
+import (
+	"bytes"
+	"fisi/elenadb/pkg/buffer"
+	"fisi/elenadb/pkg/catalog"
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/concurrency"
+	"fisi/elenadb/pkg/recovery"
+	"fisi/elenadb/pkg/storage/page"
+	"fisi/elenadb/pkg/utils"
+	"fmt"
+	"strings"
+)
+
+// Brings the tables back to the last committed state after a crash, ARIES style. The log only
+// has something else than a checkpoint if Elena didn't shut down cleanly. It goes in three
+// passes:
+//   - analysis: the transactions without a commit (or abort) in the log are the losers
+//   - redo: every change in the log is written again to its page, unless the page already has
+//     it (its PageLSN is not older), so the pages are left as they were at the crash
+//   - undo: the changes of the losers are undone, newest first. Each undo is logged as a
+//     compensation that points to the next record to undo, so a crash while undoing doesn't
+//     undo anything twice
+//
+// Indexes are not logged, so they have to be rebuilt after a recovery. Returns whether there
+// was anything to recover. It runs before the catalog is loaded, the files are found by the
+// names in the records.
+func (db *ElenaDB) recover() (bool, error) {
+	records, err := db.bufferPool.LogManager().ReadLogRecords()
+	if err != nil {
+		return false, err
+	}
+
+	// analysis
+	recordsByLSN := make(map[common.LSN_t]*recovery.LogRecord, len(records))
+	losers := make(map[common.TxnID_t]common.LSN_t)
+	for _, record := range records {
+		recordsByLSN[record.LSN] = record
+		switch record.Type {
+		case recovery.LogCheckpoint:
+		case recovery.LogCommit, recovery.LogAbort:
+			delete(losers, record.TxnID)
+		default:
+			losers[record.TxnID] = record.LSN
+		}
+	}
+	if len(records) == 0 || (len(records) == 1 && records[0].Type == recovery.LogCheckpoint) {
+		return false, nil
+	}
+	db.log.Boot("recovering from %d log records (%d transactions to undo)", len(records), len(losers))
+
+	// redo
+	for _, record := range records {
+		if !record.IsPageRecord() {
+			continue
+		}
+		if err := db.redo(record); err != nil {
+			return true, err
+		}
+	}
+
+	// undo
+	transactions := make(map[common.TxnID_t]*concurrency.Transaction, len(losers))
+	for txnId, lastLSN := range losers {
+		transactions[txnId] = concurrency.NewTransaction(txnId)
+		transactions[txnId].SetPrevLSN(lastLSN)
+	}
+	for len(losers) > 0 {
+		txnId, lsn := newestLoserRecord(losers)
+		record := recordsByLSN[lsn]
+		next := common.InvalidLSN
+		if record != nil {
+			next = record.PrevLSN
+			if record.Type == recovery.LogCompensation {
+				next = record.UndoNextLSN
+			} else if record.IsUndoable() {
+				if err := db.undo(transactions[txnId], record); err != nil {
+					return true, err
+				}
+			}
+		}
+		if next != common.InvalidLSN {
+			losers[txnId] = next
+			continue
+		}
+
+		txn := transactions[txnId]
+		if _, err := db.bufferPool.LogManager().AppendLogRecord(
+			recovery.NewTxnLogRecord(txn.GetTxnId(), txn.GetPrevLSN(), recovery.LogAbort),
+		); err != nil {
+			return true, err
+		}
+		delete(losers, txnId)
+	}
+	return true, nil
+}
+
+// The loser with the newest record left to undo
+func newestLoserRecord(losers map[common.TxnID_t]common.LSN_t) (common.TxnID_t, common.LSN_t) {
+	newestTxn, newest := common.InvalidTxnID, common.InvalidLSN
+	for txnId, lsn := range losers {
+		if lsn > newest {
+			newestTxn, newest = txnId, lsn
+		}
+	}
+	return newestTxn, newest
+}
+
+// Writes again the bytes changed by the record, if the page doesn't have them yet
+func (db *ElenaDB) redo(record *recovery.LogRecord) error {
+	guard, err := db.pageForRecovery(record)
+	if err != nil || guard == nil {
+		return err
+	}
+	defer guard.Drop()
+
+	slottedPage := page.NewSlottedPageFromRawPage(guard.Page())
+	if slottedPage.Header.PageLSN >= record.LSN {
+		return nil
+	}
+	copy(guard.DataMut()[record.Offset:], record.Redo)
+	slottedPage.SetPageLSN(record.LSN)
+	guard.Page().LSN = record.LSN
+	return nil
+}
+
+// Undoes a change of a transaction that didn't commit, and logs it as a compensation
+func (db *ElenaDB) undo(txn *concurrency.Transaction, record *recovery.LogRecord) error {
+	guard, err := db.pageForRecovery(record)
+	if err != nil {
+		return err
+	}
+	if guard == nil {
+		return fmt.Errorf("page %s of \"%s\" is gone, it can't be undone", record.PageID.ToString(), record.File)
+	}
+	defer guard.Drop()
+
+	_, _, err = db.undoOnPage(txn, guard, record)
+	return err
+}
+
+// Undoes the change of the record on its page, which must be write latched, and logs the
+// compensation. Returns the tuple the slot had before the undo and the one it has after (nil
+// if it has none), so the indexes can follow.
+func (db *ElenaDB) undoOnPage(
+	txn *concurrency.Transaction,
+	guard *buffer.WritePageGuard,
+	record *recovery.LogRecord,
+) (removed []byte, restored []byte, err error) {
+	before := bytes.Clone(guard.Data())
+	slottedPage := page.NewSlottedPageFromRawPage(guard.Page())
+	removed = slottedPage.RawTuple(record.Slot)
+	switch record.Type {
+	case recovery.LogInsert:
+		slottedPage.DeleteTuple(record.Slot)
+	case recovery.LogDelete, recovery.LogUpdate:
+		if err := slottedPage.RestoreTuple(record.Slot, record.Tuple); err != nil {
+			return nil, nil, err
+		}
+		restored = record.Tuple
+	}
+	return removed, restored, db.logCompensation(txn, guard, before, record)
+}
+
+// Returns the page of the record write latched, adding pages to its file if the page never
+// made it to disk. Returns nil if the file doesn't exist anymore.
+func (db *ElenaDB) pageForRecovery(record *recovery.LogRecord) (*buffer.WritePageGuard, error) {
+	fileId, aPageId := common.ParsePageID(record.PageID)
+	if !utils.FileExists(db.DbPath + record.File) {
+		return nil, nil
+	}
+	// The catalog isn't loaded yet, the buffer pool only needs the name of the file
+	if db.Catalog.FilenameFromFileId(fileId) == nil {
+		name := strings.TrimSuffix(record.File, ".table")
+		db.Catalog.RegisterTableMetadata(name, &catalog.TableMetadata{Name: name, FileID: fileId})
+	}
+
+	for db.bufferPool.PageCount(fileId) <= aPageId {
+		guard := db.bufferPool.NewPageWrite(fileId)
+		if guard == nil {
+			return nil, fmt.Errorf("unable to allocate a page for file %d", fileId)
+		}
+		guard.Drop()
+	}
+	guard := db.bufferPool.FetchPageWrite(record.PageID)
+	if guard == nil {
+		return nil, fmt.Errorf("page %s of \"%s\" not found", record.PageID.ToString(), record.File)
+	}
+	return guard, nil
+}
@@ -0,0 +1,287 @@
+package database
+
+import (
+	"bufio"
+	"fisi/elenadb/pkg/concurrency"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs a statement in a transaction that is never committed, as if Elena died right after it
+func execUncommitted(t *testing.T, db *ElenaDB, txn *concurrency.Transaction, input string) int {
+	t.Helper()
+	parsedQuery, err := db.sqlPipeline(input)
+	if err != nil {
+		t.Fatalf("%s: %v", input, err)
+	}
+	plan, err := MakeQueryPlan(parsedQuery, db)
+	if err != nil {
+		t.Fatalf("%s: %v", input, err)
+	}
+	plan = OptimizeQueryPlan(plan)
+	setTransaction(plan, txn)
+
+	count := 0
+	for {
+		tuple, err := plan.Next()
+		if err != nil {
+			t.Fatalf("%s: %v", input, err)
+		}
+		if tuple == nil {
+			return count
+		}
+		count++
+	}
+}
+
+func TestRecoveryRedoesCommittedStatements(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir, WithBufferPoolSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla alumnos { id int @id, nombre char(200), } pe")
+	execAll(t, db, "creame indice en alumnos (nombre) pe")
+	for i := 0; i < 100; i++ {
+		execAll(t, db, fmt.Sprintf("mete { nombre: \"alumno %d\" } en alumnos pe", i))
+	}
+	execAll(t, db, "borra de alumnos donde (id >= 20 y id < 40) pe")
+	execAll(t, db, "cambia en alumnos { nombre: \"otro nombre, bastante mas largo que el de antes\" } si (id >= 60) pe")
+
+	// Elena dies without a shutdown: the small pool wrote some of the pages, the rest are
+	// only in the log
+	db, err = StartElenaBusiness(dir, WithBufferPoolSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := execAll(t, db, "dame todo de alumnos pe"); n != 80 {
+		t.Fatalf("expected 80 rows after recovering, got %d", n)
+	}
+	if n := execAll(t, db, "dame todo de alumnos donde (nombre == \"otro nombre, bastante mas largo que el de antes\") pe"); n != 40 {
+		t.Fatalf("expected 40 updated rows after recovering, got %d", n)
+	}
+	assertNoDrift(t, db, "alumnos.id")
+	assertNoDrift(t, db, "alumnos.nombre")
+
+	// The identity was recovered too
+	execAll(t, db, "mete { nombre: \"nuevo\" } en alumnos pe")
+	if n := execAll(t, db, "dame todo de alumnos donde (id == 100) pe"); n != 1 {
+		t.Fatalf("expected the next id to be 100, got %d rows with it", n)
+	}
+}
+
+func TestRecoveryUndoesUncommittedStatements(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir, WithBufferPoolSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla alumnos { id int @id, nombre char(200), } pe")
+	execAll(t, db, "creame indice en alumnos (nombre) pe")
+	for i := 0; i < 50; i++ {
+		execAll(t, db, fmt.Sprintf("mete { nombre: \"alumno %d\" } en alumnos pe", i))
+	}
+
+	// The transaction never commits, but its pages (and the log before them) make it to disk.
+	// The longer names don't fit in place, so the updates move rows to other pages.
+	txn := db.txnManager.Begin()
+	if n := execUncommitted(t, db, txn, "borra de alumnos donde (id < 10) pe"); n != 10 {
+		t.Fatalf("expected 10 rows deleted, got %d", n)
+	}
+	if n := execUncommitted(t, db, txn, fmt.Sprintf("cambia en alumnos { nombre: \"%0150d\" } si (id >= 20 y id < 30) pe", 0)); n != 10 {
+		t.Fatalf("expected 10 rows updated, got %d", n)
+	}
+	for i := 0; i < 30; i++ {
+		execUncommitted(t, db, txn, fmt.Sprintf("mete { nombre: \"%0200d\" } en alumnos pe", i))
+	}
+	db.bufferPool.FlushEntirePool()
+
+	db, err = StartElenaBusiness(dir, WithBufferPoolSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := execAll(t, db, "dame todo de alumnos pe"); n != 50 {
+		t.Fatalf("expected the 50 committed rows after recovering, got %d", n)
+	}
+	for i := 0; i < 50; i++ {
+		if n := execAll(t, db, fmt.Sprintf("dame todo de alumnos donde (id == %d y nombre == \"alumno %d\") pe", i, i)); n != 1 {
+			t.Fatalf("expected row %d to be as it was committed, got %d rows", i, n)
+		}
+	}
+	assertNoDrift(t, db, "alumnos.id")
+	assertNoDrift(t, db, "alumnos.nombre")
+
+	// A crash after the recovery has nothing left to undo
+	db.RestInPeace()
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := execAll(t, db, "dame todo de alumnos pe"); n != 50 {
+		t.Fatalf("expected 50 rows after a restart, got %d", n)
+	}
+}
+
+func TestCheckpointsKeepUncommittedChangesUndoable(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir, WithBufferPoolSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla a { id int @id, nombre char(20), } pe")
+	execAll(t, db, "creame tabla b { id int @id, nombre char(20), } pe")
+	execAll(t, db, "mete { nombre: \"uno\" } en a pe")
+
+	txn := db.txnManager.Begin()
+	for i := 0; i < 5; i++ {
+		execUncommitted(t, db, txn, fmt.Sprintf("mete { nombre: \"fila %d\" } en b pe", i))
+	}
+
+	// Emptying the log now would leave nothing to undo the rows of txn with
+	execErr(t, db, "limpia tabla a pe")
+	execErr(t, db, "trunca tabla a pe")
+	execErr(t, db, "cambia tabla a agrega { edad int?, } pe")
+
+	// Elena dies with the rows of txn on disk
+	db.bufferPool.FlushEntirePool()
+	db, err = StartElenaBusiness(dir, WithBufferPoolSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := execAll(t, db, "dame todo de b pe"); n != 0 {
+		t.Fatalf("expected the uncommitted rows of b to be undone, got %d", n)
+	}
+	if n := execAll(t, db, "dame todo de a pe"); n != 1 {
+		t.Fatalf("expected the row of a, got %d", n)
+	}
+
+	// With nothing else running it checkpoints
+	execAll(t, db, "limpia tabla a pe")
+	db.RestInPeace()
+}
+
+// Statements of the workload killed by TestRecoveryAfterAKill: every row is inserted, and
+// every fourth insert deletes the row before it
+func killWorkload(statements int) ([]string, map[int32]bool) {
+	queries := []string{}
+	rows := map[int32]bool{}
+	for id := int32(0); len(queries) < statements; id++ {
+		queries = append(queries, fmt.Sprintf("mete { nombre: \"alumno %d\" } en alumnos pe", id))
+		rows[id] = true
+		if id%4 == 3 && len(queries) < statements {
+			queries = append(queries, fmt.Sprintf("borra de alumnos donde (id == %d) pe", id-1))
+			delete(rows, id-1)
+		}
+	}
+	return queries, rows
+}
+
+const killDirEnv = "ELENA_KILL_TEST_DIR"
+
+// Runs the workload in another process and kills it halfway, the rows that were committed
+// have to be there after the recovery, and nothing else
+func TestRecoveryAfterAKill(t *testing.T) {
+	if dir := os.Getenv(killDirEnv); dir != "" {
+		runKillWorkload(t, dir)
+		return
+	}
+
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRecoveryAfterAKill$")
+	cmd.Env = append(os.Environ(), killDirEnv+"="+dir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	committed := make(chan int)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if n, found := strings.CutPrefix(scanner.Text(), "committed "); found {
+				count, _ := strconv.Atoi(n)
+				committed <- count
+			}
+		}
+		close(committed)
+	}()
+
+	last := 0
+	timeout := time.After(2 * time.Minute)
+	for last < 300 {
+		select {
+		case count, ok := <-committed:
+			if !ok {
+				t.Fatalf("the workload stopped after %d statements", last)
+			}
+			last = count
+		case <-timeout:
+			cmd.Process.Kill()
+			t.Fatalf("the workload only committed %d statements", last)
+		}
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	for count := range committed {
+		last = count
+	}
+	cmd.Wait()
+
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil, "dame todo de alumnos pe", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := map[int32]bool{}
+	for result := range tuples {
+		if result.IsError() {
+			t.Fatal(result.Error)
+		}
+		rows[result.Value.Values[0].AsInt32()] = true
+	}
+
+	// The statement running when it was killed may have committed without saying so
+	_, expected := killWorkload(last)
+	_, expectedNext := killWorkload(last + 1)
+	if !sameRows(rows, expected) && !sameRows(rows, expectedNext) {
+		t.Fatalf("after %d committed statements, expected %d rows, got %d", last, len(expected), len(rows))
+	}
+	assertNoDrift(t, db, "alumnos.id")
+}
+
+func runKillWorkload(t *testing.T, dir string) {
+	db, err := StartElenaBusiness(dir, WithBufferPoolSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla alumnos { id int @id, nombre char(200), } pe")
+	queries, _ := killWorkload(100_000)
+	for i, query := range queries {
+		execAll(t, db, query)
+		fmt.Printf("committed %d\n", i+1)
+	}
+}
+
+func sameRows(a, b map[int32]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id := range a {
+		if !b[id] {
+			return false
+		}
+	}
+	return true
+}
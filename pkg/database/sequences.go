@@ -0,0 +1,216 @@
+package database
+
+import (
+	"fisi/elenadb/internal/query"
+	"fisi/elenadb/pkg/catalog"
+	"fisi/elenadb/pkg/catalog/column"
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/meta"
+	"fisi/elenadb/pkg/storage/table/value"
+	"fmt"
+)
+
+// Type of the elena_meta rows of the sequences
+const SEQUENCE_FILE_TYPE = "seq"
+
+// A sequence hands out the values 0, 1, 2... Each one is a row of elena_meta whose root is the
+// next value to hand out, and it's stored (and committed) before the value is handed out: a
+// value is never handed out twice, not even after a crash, but the ones handed out to rows
+// that are rolled back, or that never made it to disk, are skipped.
+//
+// Every table has one for its @id column, named <tabla>_<columna>_seq. Others are created by
+// "creame secuencia <nombre> pe", and used by "mete" as siguiente(<nombre>).
+//
+// elena_meta itself hands out its file ids from the header of its last page instead: it can't
+// insert the row of its own sequence without a file id.
+
+// Name of the sequence that hands out the identities of a table
+func identitySequenceName(table string, col string) string {
+	return fmt.Sprintf("%s_%s_seq", table, col)
+}
+
+// Adds the row of the sequence to elena_meta, starting from 0, and registers it in the catalog
+func (db *ElenaDB) createSequence(name string) (*catalog.SequenceMetadata, error) {
+	sql := fmt.Sprintf("creame secuencia %s pe", name)
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil,
+		fmt.Sprintf(
+			"mete { type: \"%s\", name: \"%s\", root: 0, sql: \"%s\" } en %s retornando { file_id } pe",
+			SEQUENCE_FILE_TYPE, name, sql, meta.ELENA_META_TABLE_NAME,
+		), false)
+	if err != nil {
+		return nil, err
+	}
+	var fileId int32
+	for result := range tuples {
+		if result.IsError() {
+			return nil, result.Error
+		}
+		fileId = result.Value.Values[0].AsInt32()
+	}
+
+	sequenceMetadata := &catalog.SequenceMetadata{
+		Name:      name,
+		FileID:    common.FileID_t(fileId),
+		Next:      0,
+		SqlCreate: sql,
+	}
+	db.Catalog.SequenceMetadataMap[name] = sequenceMetadata
+	return sequenceMetadata, nil
+}
+
+// Hands out the next value of the sequence. It runs a statement on elena_meta, so it can't be
+// called with a page latched
+func (db *ElenaDB) nextValue(name string) (int32, error) {
+	db.sequenceLatch.Lock()
+	defer db.sequenceLatch.Unlock()
+
+	sequenceMetadata := db.Catalog.SequenceMetadataMap[name]
+	if sequenceMetadata == nil {
+		return 0, SequenceDoesNotExistError{sequence: name}
+	}
+	next := sequenceMetadata.Next
+
+	// elena_meta statements run in transactions of their own, so it's on disk once it returns
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil,
+		fmt.Sprintf(
+			"cambia en %s { root: %d } si (file_id == %d) pe",
+			meta.ELENA_META_TABLE_NAME, next+1, sequenceMetadata.FileID,
+		), false)
+	if err != nil {
+		return 0, err
+	}
+	for result := range tuples {
+		if result.IsError() {
+			return 0, result.Error
+		}
+	}
+
+	sequenceMetadata.Next = next + 1
+	return next, nil
+}
+
+// Sequences of the @id columns of a table
+func (db *ElenaDB) identitySequences(tableMetadata *catalog.TableMetadata) []*catalog.SequenceMetadata {
+	sequences := []*catalog.SequenceMetadata{}
+	for _, col := range tableMetadata.Schema.GetColumns() {
+		if !col.IsIdentity {
+			continue
+		}
+		if sequenceMetadata := db.Catalog.SequenceMetadataMap[identitySequenceName(tableMetadata.Name, col.ColumnName)]; sequenceMetadata != nil {
+			sequences = append(sequences, sequenceMetadata)
+		}
+	}
+	return sequences
+}
+
+// Makes the sequence hand out 0 again
+func (db *ElenaDB) resetSequence(sequenceMetadata *catalog.SequenceMetadata) error {
+	db.sequenceLatch.Lock()
+	defer db.sequenceLatch.Unlock()
+
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil,
+		fmt.Sprintf(
+			"cambia en %s { root: 0 } si (file_id == %d) pe",
+			meta.ELENA_META_TABLE_NAME, sequenceMetadata.FileID,
+		), false)
+	if err != nil {
+		return err
+	}
+	for result := range tuples {
+		if result.IsError() {
+			return result.Error
+		}
+	}
+	sequenceMetadata.Next = 0
+	return nil
+}
+
+// Deletes the row of the sequence from elena_meta and forgets it
+func (db *ElenaDB) dropSequence(sequenceMetadata *catalog.SequenceMetadata) error {
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil,
+		fmt.Sprintf(
+			"borra de %s donde (file_id == %d) pe",
+			meta.ELENA_META_TABLE_NAME, sequenceMetadata.FileID,
+		), false)
+	if err != nil {
+		return err
+	}
+	for result := range tuples {
+		if result.IsError() {
+			return result.Error
+		}
+	}
+	delete(db.Catalog.SequenceMetadataMap, sequenceMetadata.Name)
+	return nil
+}
+
+// Gives the sequence another name, keeping the value it's at
+func (db *ElenaDB) renameSequence(sequenceMetadata *catalog.SequenceMetadata, name string) error {
+	sql := fmt.Sprintf("creame secuencia %s pe", name)
+	tuples, _, _, _, err := db.ExecuteThisBaby(nil,
+		fmt.Sprintf(
+			"cambia en %s { name: \"%s\", sql: \"%s\" } si (file_id == %d) pe",
+			meta.ELENA_META_TABLE_NAME, name, sql, sequenceMetadata.FileID,
+		), false)
+	if err != nil {
+		return err
+	}
+	for result := range tuples {
+		if result.IsError() {
+			return result.Error
+		}
+	}
+
+	delete(db.Catalog.SequenceMetadataMap, sequenceMetadata.Name)
+	sequenceMetadata.Name = name
+	sequenceMetadata.SqlCreate = sql
+	db.Catalog.SequenceMetadataMap[name] = sequenceMetadata
+	return nil
+}
+
+// Checks a siguiente(<secuencia>) given to a column in "mete". The value stays a
+// query.NextValue until the statement runs
+func (db *ElenaDB) bindNextValue(tableName string, col column.Column, field query.QueryField) (*query.QueryField, error) {
+	next := field.Value.(query.NextValue)
+	if db.Catalog.SequenceMetadataMap[next.Sequence] == nil {
+		return nil, SequenceDoesNotExistError{sequence: next.Sequence}
+	}
+	if col.ColumnType != value.TypeInt32 {
+		return nil, fmt.Errorf("column \"%s\" is not int, it can't take siguiente(%s)", col.ColumnName, next.Sequence)
+	}
+
+	return &query.QueryField{
+		Foreign:     col.IsForeign,
+		Name:        fmt.Sprintf("%s.%s", tableName, col.ColumnName),
+		Type:        col.ColumnType,
+		Length:      uint8(col.StorageSize),
+		Value:       next,
+		ForeignPath: "",
+		Nullable:    col.IsNullable,
+		Annotations: []string{},
+	}, nil
+}
+
+// Replaces the siguiente(<secuencia>) of the fields by the next values of their sequences
+func (db *ElenaDB) resolveNextValues(fields []query.QueryField) error {
+	for idx := range fields {
+		next, ok := fields[idx].Value.(query.NextValue)
+		if !ok {
+			continue
+		}
+		nextValue, err := db.nextValue(next.Sequence)
+		if err != nil {
+			return err
+		}
+		fields[idx].Value = nextValue
+	}
+	return nil
+}
+
+type SequenceDoesNotExistError struct {
+	sequence string
+}
+
+func (e SequenceDoesNotExistError) Error() string {
+	return fmt.Sprintf("sequence \"%s\" does not exist", e.sequence)
+}
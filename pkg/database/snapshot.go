@@ -0,0 +1,18 @@
+package database
+
+import (
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/concurrency"
+	"fisi/elenadb/pkg/storage/page"
+)
+
+// Rows of a heap page that the snapshot of the transaction has, by slot (nil if it has none).
+// p must be a copy taken while the page was latched, or the page itself if it still is.
+func (db *ElenaDB) visibleRows(txn *concurrency.Transaction, p *page.Page) [][]byte {
+	slottedPage := page.NewSlottedPageFromRawPage(p)
+	heap := make([][]byte, slottedPage.GetNSlots())
+	for slot := range heap {
+		heap[slot] = slottedPage.RawTuple(common.SlotNumber_t(slot))
+	}
+	return db.txnManager.GetVersionStore().VisibleRows(txn, p.PageId, heap)
+}
@@ -1 +1,122 @@
 package database
+
+import (
+	"bytes"
+	"fisi/elenadb/pkg/buffer"
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/concurrency"
+	"fisi/elenadb/pkg/recovery"
+	"fisi/elenadb/pkg/storage/page"
+	"fisi/elenadb/pkg/storage/table/tuple"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parses the value of the RID ghost column, which has the format "(file_id,actual_page_id,slot)"
+func parseRidGhostValue(rid string) (common.PageID_t, common.SlotNumber_t, error) {
+	if len(rid) < 2 {
+		return common.InvalidPageID, 0, fmt.Errorf("invalid RID format: %s", rid)
+	}
+	ridParts := strings.Split(rid[1:len(rid)-1], ",")
+	if len(ridParts) != 3 {
+		return common.InvalidPageID, 0, fmt.Errorf("invalid RID format: %s", rid)
+	}
+	fileId, errFile := strconv.Atoi(ridParts[0])
+	aPageId, errPage := strconv.Atoi(ridParts[1])
+	tupleSlot, errSlot := strconv.Atoi(ridParts[2])
+	if errFile != nil || errPage != nil || errSlot != nil {
+		return common.InvalidPageID, 0, fmt.Errorf("invalid RID format: %s", rid)
+	}
+
+	pageId := common.NewPageIdFromParts(common.FileID_t(fileId), common.APageID_t(aPageId))
+	return pageId, common.SlotNumber_t(tupleSlot), nil
+}
+
+// Appends an already built tuple to the table heap, in the first page with room for it. Used
+// when a tuple has to be moved somewhere else (i.e. it grew after a "cambia"), so identities
+// are never reassigned here.
+func (db *ElenaDB) appendTupleToHeap(txn *concurrency.Transaction, fileId common.FileID_t, t *tuple.Tuple) (common.PageID_t, common.SlotNumber_t, error) {
+	fsm := db.freeSpaceMap(fileId)
+	guard, slottedPage, err := db.pageWithSpaceFor(txn, fsm, fileId, t.Size, nil)
+	if err != nil {
+		return common.InvalidPageID, 0, err
+	}
+
+	before := bytes.Clone(guard.Data())
+	slot, err := slottedPage.AppendTuple(t)
+	if err == nil {
+		err = db.logPageChange(txn, recovery.LogInsert, guard, before, slot, t.AsRawData())
+	}
+	free := slottedPage.FreeBytes()
+	pageId := guard.PageId()
+	guard.Drop()
+	if err != nil {
+		return common.InvalidPageID, 0, err
+	}
+
+	db.updateFreeSpace(pageId, free)
+	return pageId, slot, nil
+}
+
+// Finds a page of the heap with room for a tuple of the given size and returns it write
+// latched. The free-space map is asked first, so the space left by deleted tuples is reused;
+// if no page has room the tuple goes to a new page at the end of the heap.
+//
+// last is the last page of the heap if the caller already has it ("mete" keeps it to hand out
+// the file ids of elena_meta), it's returned as is if the tuple goes there. Other pages are only latched after
+// it, they all come before it. fsm has to be taken before latching any page of the table. A
+// new page is logged in the transaction.
+func (db *ElenaDB) pageWithSpaceFor(txn *concurrency.Transaction, fsm *FreeSpaceMap, fileId common.FileID_t, tupleSize uint16, last *buffer.WritePageGuard) (*buffer.WritePageGuard, *page.SlottedPage, error) {
+	for {
+		aPageId, ok := fsm.FindPage(tupleSize)
+		if !ok {
+			break
+		}
+		pageId := common.NewPageIdFromParts(fileId, aPageId)
+		guard := last
+		if last == nil || last.PageId() != pageId {
+			guard = db.bufferPool.FetchPageWrite(pageId)
+			if guard == nil {
+				return nil, nil, fmt.Errorf("page %s not found", pageId.ToString())
+			}
+		}
+
+		slottedPage := page.NewSlottedPageFromRawPage(guard.Page())
+		if slottedPage.HasSpaceForThisTupleSize(tupleSize) {
+			return guard, slottedPage, nil
+		}
+		// Someone else took the space since the map was updated
+		fsm.Update(aPageId, slottedPage.FreeBytes())
+		if guard != last {
+			guard.Drop()
+		}
+	}
+
+	// "mete" reads the next file id of elena_meta from the last page, so the new page has to
+	// remember the last one handed out
+	lastInsertedId := int32(0)
+	if last != nil {
+		lastInsertedId = page.NewSlottedPageFromRawPage(last.Page()).Header.LastInsertedId
+	} else if pageCount := db.bufferPool.PageCount(fileId); pageCount > 0 {
+		lastGuard := db.bufferPool.FetchPageRead(common.NewPageIdFromParts(fileId, pageCount-1))
+		if lastGuard == nil {
+			return nil, nil, fmt.Errorf("unable to read the last page of file %d", fileId)
+		}
+		lastInsertedId = page.NewSlottedPageFromRawPage(lastGuard.Page()).Header.LastInsertedId
+		lastGuard.Drop()
+	}
+
+	guard := db.bufferPool.NewPageWrite(fileId)
+	if guard == nil {
+		return nil, nil, fmt.Errorf("unable to allocate a page for file %d", fileId)
+	}
+	before := bytes.Clone(guard.Data())
+	slottedPage := page.NewEmptySlottedPage(guard.Page())
+	slottedPage.SetLastInsertedId(lastInsertedId)
+	if err := db.logPageChange(txn, recovery.LogNewPage, guard, before, 0, nil); err != nil {
+		guard.Drop()
+		return nil, nil, err
+	}
+	return guard, slottedPage, nil
+}
@@ -0,0 +1,217 @@
+package database
+
+import (
+	"bytes"
+	"fisi/elenadb/internal/query"
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/concurrency"
+	"fisi/elenadb/pkg/meta"
+	"fisi/elenadb/pkg/recovery"
+	"fisi/elenadb/pkg/storage/page"
+	"fisi/elenadb/pkg/storage/table/tuple"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// A Session is a connection to Elena, i.e. the REPL or a client of a service. The transaction
+// it starts with "empieza" is its own: only the statements run with the session are part of it,
+// the ones of other sessions, or run without one (internal statements), go on in their own.
+type Session struct {
+	db *ElenaDB
+	// Transaction started by "empieza", nil if every statement runs in its own. The executor
+	// goroutine of a statement may clear it while the next one starts, see openTransaction
+	currentTxn *concurrency.Transaction
+	latch      sync.Mutex
+}
+
+// Opens a session, closed with Close. The ones still open are closed by RestInPeace
+func (db *ElenaDB) NewSession() *Session {
+	session := &Session{db: db}
+	db.sessionsLatch.Lock()
+	defer db.sessionsLatch.Unlock()
+	db.sessions[session] = struct{}{}
+	return session
+}
+
+// Closes the session. A transaction left open is rolled back, like if the connection was lost
+func (s *Session) Close() error {
+	s.db.sessionsLatch.Lock()
+	delete(s.db.sessions, s)
+	s.db.sessionsLatch.Unlock()
+
+	if s.openTransaction() == nil {
+		return nil
+	}
+	return s.rollbackTransaction()
+}
+
+// Returns the transaction a statement runs in. Outside of "empieza" ... "confirma" of its
+// session every statement is a transaction of its own (implicit), committed when it finishes,
+// or rolled back if it fails.
+//
+// Changes to elena_meta are never part of the open transaction: the catalog is updated by
+// statements run while another one is running (i.e. when a split moves the root of an index)
+// and those have to stay even if the transaction is rolled back. That's also why the
+// statements that create or drop files can't run inside a transaction.
+func (db *ElenaDB) statementTransaction(session *Session, parsedQuery *query.Query) (txn *concurrency.Transaction, implicit bool, err error) {
+	switch parsedQuery.QueryType {
+	case query.QueryBegin, query.QueryCommit, query.QueryRollback:
+		if session == nil {
+			return nil, false, fmt.Errorf("\"%s\" needs a session, without one every statement is a transaction of its own", parsedQuery.QueryType)
+		}
+		return db.txnManager.Begin(), true, nil
+	}
+
+	var currentTxn *concurrency.Transaction
+	if session != nil {
+		currentTxn = session.openTransaction()
+	}
+	if currentTxn == nil || parsedQuery.QueryInstrName == meta.ELENA_META_TABLE_NAME {
+		return db.txnManager.Begin(), true, nil
+	}
+
+	switch parsedQuery.QueryType {
+	case query.QueryCreate, query.QueryVacuum, query.QueryTruncate:
+		return nil, false, TransactionRunningError{statement: string(parsedQuery.QueryType)}
+	case query.QueryErase:
+		if parsedQuery.QueryIndexInstr {
+			return nil, false, TransactionRunningError{statement: "borra indice"}
+		}
+		if parsedQuery.QueryTableInstr {
+			return nil, false, TransactionRunningError{statement: "borra tabla"}
+		}
+	case query.QueryUpdate:
+		if parsedQuery.QueryAlterInstr != "" {
+			return nil, false, TransactionRunningError{statement: "cambia tabla"}
+		}
+	}
+	return currentTxn, false, nil
+}
+
+// Ends the transaction of a statement once its plan is done. An implicit transaction commits,
+// unless the statement failed. A failed statement rolls back the whole open transaction of its
+// session, the statements that go together can't be half done.
+func (db *ElenaDB) finishStatement(session *Session, txn *concurrency.Transaction, implicit bool, failed bool) error {
+	if !failed {
+		if implicit {
+			return db.txnManager.Commit(txn)
+		}
+		return nil
+	}
+
+	if !implicit {
+		db.log.Warn("rolling back transaction %d, one of its statements failed", txn.GetTxnId())
+		session.closeTransaction(txn)
+	}
+	return db.txnManager.Abort(txn)
+}
+
+// The transaction started by "empieza", nil if there is none. A statement runs its plan in
+// another goroutine, which closes the transaction if the statement fails, so currentTxn is only
+// used with the latch. The latch is never held while a transaction commits or aborts: undoing
+// a change may run statements on elena_meta.
+func (s *Session) openTransaction() *concurrency.Transaction {
+	s.latch.Lock()
+	defer s.latch.Unlock()
+	return s.currentTxn
+}
+
+// Forgets txn as the open transaction, unless another one took its place already
+func (s *Session) closeTransaction(txn *concurrency.Transaction) {
+	s.latch.Lock()
+	defer s.latch.Unlock()
+	if s.currentTxn == txn {
+		s.currentTxn = nil
+	}
+}
+
+// "empieza": the next statements of the session run in the same transaction, until "confirma"
+// or "deshaz"
+func (s *Session) beginTransaction() error {
+	s.latch.Lock()
+	defer s.latch.Unlock()
+	if s.currentTxn != nil {
+		return fmt.Errorf("transaction %d is already running, \"confirma\" or \"deshaz\" it first", s.currentTxn.GetTxnId())
+	}
+	s.currentTxn = s.db.txnManager.Begin()
+	s.db.log.Info("transaction %d started", s.currentTxn.GetTxnId())
+	return nil
+}
+
+// "confirma"
+func (s *Session) commitTransaction() error {
+	txn := s.openTransaction()
+	if txn == nil {
+		return fmt.Errorf("there is no transaction to commit, start one with \"empieza\"")
+	}
+	if err := s.db.txnManager.Commit(txn); err != nil {
+		return err
+	}
+	s.db.log.Info("transaction %d committed", txn.GetTxnId())
+	s.closeTransaction(txn)
+	return nil
+}
+
+// "deshaz"
+func (s *Session) rollbackTransaction() error {
+	s.latch.Lock()
+	txn := s.currentTxn
+	s.currentTxn = nil
+	s.latch.Unlock()
+	if txn == nil {
+		return fmt.Errorf("there is no transaction to roll back, start one with \"empieza\"")
+	}
+	if err := s.db.txnManager.Abort(txn); err != nil {
+		return err
+	}
+	s.db.log.Info("transaction %d rolled back", txn.GetTxnId())
+	return nil
+}
+
+// Undoes a change of a transaction that is rolled back while Elena runs. It's the same undo
+// recovery does, but the indexes and the free-space map of the table have to follow it.
+func (db *ElenaDB) rollbackRecord(txn *concurrency.Transaction, record *recovery.LogRecord) error {
+	guard := db.bufferPool.FetchPageWrite(record.PageID)
+	if guard == nil {
+		return fmt.Errorf("page %s not found", record.PageID.ToString())
+	}
+	removed, restored, err := db.undoOnPage(txn, guard, record)
+	free := page.NewSlottedPageFromRawPage(guard.Page()).FreeBytes()
+	guard.Drop()
+	if err != nil {
+		return err
+	}
+	db.updateFreeSpace(record.PageID, free)
+
+	tableMetadata := db.Catalog.GetTableMetadata(strings.TrimSuffix(record.File, ".table"))
+	if tableMetadata == nil {
+		return fmt.Errorf("table of file \"%s\" not found", record.File)
+	}
+	// The undo goes on even if a root of an index couldn't be stored, the catalog keeps the
+	// old one and the next change tries again
+	rid := common.NewRID(record.PageID, uint32(record.Slot))
+	if removed != nil {
+		removedTuple := tuple.NewFromRawData(&tableMetadata.Schema, bytes.NewReader(removed))
+		if err := db.deleteFromIndexes(tableMetadata, removedTuple.Values, rid); err != nil {
+			db.log.Error("%s", err.Error())
+		}
+	}
+	if restored != nil {
+		restoredTuple := tuple.NewFromRawData(&tableMetadata.Schema, bytes.NewReader(restored))
+		if err := db.insertIntoIndexes(tableMetadata, restoredTuple.Values, rid); err != nil {
+			db.log.Error("%s", err.Error())
+		}
+	}
+	return nil
+}
+
+// TransactionRunningError is returned for statements that can't be undone, while a
+// transaction is running
+type TransactionRunningError struct {
+	statement string
+}
+
+func (e TransactionRunningError) Error() string {
+	return fmt.Sprintf("\"%s\" can't run inside a transaction, \"confirma\" or \"deshaz\" it first", e.statement)
+}
@@ -0,0 +1,523 @@
+package database
+
+import (
+	"errors"
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/concurrency"
+	"fisi/elenadb/pkg/storage/page"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Runs a statement and returns its error, from when it's planned or while it runs
+func execResult(db *ElenaDB, input string) error {
+	return execResultIn(db, nil, input)
+}
+
+// Like execResult, with session
+func execResultIn(db *ElenaDB, session *Session, input string) error {
+	tuples, _, _, _, err := db.ExecuteThisBaby(session, input, false)
+	if err != nil {
+		return err
+	}
+	for result := range tuples {
+		if result.IsError() {
+			err = result.Error
+		}
+	}
+	return err
+}
+
+// Runs a statement that is expected to fail, when it's planned or while it runs
+func execErr(t *testing.T, db *ElenaDB, input string) error {
+	t.Helper()
+	return execErrIn(t, db, nil, input)
+}
+
+// Like execErr, with session
+func execErrIn(t *testing.T, db *ElenaDB, session *Session, input string) error {
+	t.Helper()
+	err := execResultIn(db, session, input)
+	if err == nil {
+		t.Fatalf("%s: expected an error", input)
+	}
+	return err
+}
+
+func TestTransactionCommitsTogether(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla cursos { id int @id, nombre char(50), } pe")
+	execAll(t, db, "creame tabla notas { id int @id, curso int, nota int, } pe")
+
+	session := db.NewSession()
+	execIn(t, db, session, "empieza pe")
+	execIn(t, db, session, "mete { nombre: \"bases de datos\" } en cursos pe")
+	for i := 0; i < 3; i++ {
+		execIn(t, db, session, fmt.Sprintf("mete { curso: 0, nota: %d } en notas pe", 15+i))
+	}
+	execIn(t, db, session, "confirma pe")
+
+	// Committed is on disk, even if Elena dies right after
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := execAll(t, db, "dame todo de cursos pe"); n != 1 {
+		t.Fatalf("expected 1 curso, got %d", n)
+	}
+	if n := execAll(t, db, "dame todo de notas donde (curso == 0) pe"); n != 3 {
+		t.Fatalf("expected 3 notas, got %d", n)
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir, WithBufferPoolSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla alumnos { id int @id, nombre char(200), } pe")
+	execAll(t, db, "creame indice en alumnos (nombre) pe")
+	for i := 0; i < 50; i++ {
+		execAll(t, db, fmt.Sprintf("mete { nombre: \"alumno %d\" } en alumnos pe", i))
+	}
+
+	// Enough rows to add pages and split the indexes, and updates that don't fit in place
+	session := db.NewSession()
+	execIn(t, db, session, "empieza pe")
+	for i := 0; i < 100; i++ {
+		execIn(t, db, session, fmt.Sprintf("mete { nombre: \"%0150d\" } en alumnos pe", i))
+	}
+	execIn(t, db, session, "borra de alumnos donde (id < 10) pe")
+	execIn(t, db, session, fmt.Sprintf("cambia en alumnos { nombre: \"%0100d\" } si (id >= 20 y id < 30) pe", 0))
+	execIn(t, db, session, "cambia en alumnos { nombre: \"otro\" } si (id >= 30 y id < 40) pe")
+	if n := execIn(t, db, session, "dame todo de alumnos pe"); n != 140 {
+		t.Fatalf("expected the transaction to see its own rows, got %d", n)
+	}
+	execIn(t, db, session, "deshaz pe")
+
+	assertCommittedAlumnos := func(db *ElenaDB) {
+		t.Helper()
+		if n := execAll(t, db, "dame todo de alumnos pe"); n != 50 {
+			t.Fatalf("expected the 50 committed rows, got %d", n)
+		}
+		for i := 0; i < 50; i++ {
+			if n := execAll(t, db, fmt.Sprintf("dame todo de alumnos donde (nombre == \"alumno %d\") pe", i)); n != 1 {
+				t.Fatalf("expected to find alumno %d by nombre, got %d rows", i, n)
+			}
+		}
+		assertNoDrift(t, db, "alumnos.id")
+		assertNoDrift(t, db, "alumnos.nombre")
+	}
+	assertCommittedAlumnos(db)
+
+	// The free-space map follows the pages the rollback changed
+	fileId := db.Catalog.GetTableMetadata("alumnos").FileID
+	fsm := db.freeSpaceMap(fileId)
+	for aPageId := common.APageID_t(0); aPageId < db.bufferPool.PageCount(fileId); aPageId++ {
+		guard := db.bufferPool.FetchPageRead(common.NewPageIdFromParts(fileId, aPageId))
+		free := page.NewSlottedPageFromRawPage(guard.Page()).FreeBytes()
+		guard.Drop()
+		if fsm.free[aPageId] != free {
+			t.Fatalf("expected page %d to have %d free bytes in the map, it has %d", aPageId, free, fsm.free[aPageId])
+		}
+	}
+
+	// The rollback is in the log, recovery has nothing left to undo
+	db, err = StartElenaBusiness(dir, WithBufferPoolSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCommittedAlumnos(db)
+}
+
+func TestFailedStatementRollsBackTheTransaction(t *testing.T) {
+	db, err := StartElenaBusiness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla usuarios { id int @id, correo char(50) @unique, } pe")
+	execAll(t, db, "mete { correo: \"elena@fisi.pe\" } en usuarios pe")
+
+	session := db.NewSession()
+	execIn(t, db, session, "empieza pe")
+	execIn(t, db, session, "mete { correo: \"eduardo@fisi.pe\" } en usuarios pe")
+	execErrIn(t, db, session, "mete { correo: \"elena@fisi.pe\" } en usuarios pe")
+	if n := execIn(t, db, session, "dame todo de usuarios pe"); n != 1 {
+		t.Fatalf("expected the whole transaction to be rolled back, got %d rows", n)
+	}
+	execErrIn(t, db, session, "confirma pe")
+	assertNoDrift(t, db, "usuarios.id")
+}
+
+// The executor goroutine of a failed statement closes the transaction while the caller may be
+// running the next statement already (go test -race)
+func TestFailedStatementClosesTheTransactionWhileTheNextOneStarts(t *testing.T) {
+	db, err := StartElenaBusiness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla usuarios { id int @id, correo char(50) @unique, } pe")
+	execAll(t, db, "mete { correo: \"elena@fisi.pe\" } en usuarios pe")
+
+	session := db.NewSession()
+	execIn(t, db, session, "empieza pe")
+	tuples, _, _, _, err := db.ExecuteThisBaby(session, "mete { correo: \"elena@fisi.pe\" } en usuarios pe", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := <-tuples; !result.IsError() {
+		t.Fatal("expected the duplicate to fail")
+	}
+	// It runs in the transaction or on its own, depending on whether it was closed already
+	execResultIn(db, session, "dame todo de usuarios pe")
+	for range tuples {
+	}
+
+	execErrIn(t, db, session, "confirma pe")
+	if n := execAll(t, db, "dame todo de usuarios pe"); n != 1 {
+		t.Fatalf("expected 1 row, got %d", n)
+	}
+}
+
+func TestTransactionStatements(t *testing.T) {
+	dir := t.TempDir()
+	db, err := StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, "creame tabla alumnos { id int @id, nombre char(50), } pe")
+
+	// Without a session every statement is a transaction of its own
+	execErr(t, db, "empieza pe")
+
+	session := db.NewSession()
+	execErrIn(t, db, session, "confirma pe")
+	execErrIn(t, db, session, "deshaz pe")
+
+	execIn(t, db, session, "empieza pe")
+	execErrIn(t, db, session, "empieza pe")
+	execIn(t, db, session, "mete { nombre: \"elena\" } en alumnos pe")
+
+	// Files are not part of transactions
+	for _, ddl := range []string{
+		"creame tabla cursos { id int @id, } pe",
+		"creame indice en alumnos (nombre) pe",
+		"borra indice alumnos.id pe",
+		"limpia tabla alumnos pe",
+	} {
+		execErrIn(t, db, session, ddl)
+	}
+
+	// The failed statements didn't touch the transaction
+	execIn(t, db, session, "confirma pe")
+	if n := execIn(t, db, session, "dame todo de alumnos pe"); n != 1 {
+		t.Fatalf("expected 1 row, got %d", n)
+	}
+
+	// A transaction left open is rolled back on shutdown
+	execIn(t, db, session, "empieza pe")
+	execIn(t, db, session, "mete { nombre: \"eduardo\" } en alumnos pe")
+	db.RestInPeace()
+	db, err = StartElenaBusiness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := execAll(t, db, "dame todo de alumnos pe"); n != 1 {
+		t.Fatalf("expected the open transaction to be rolled back, got %d rows", n)
+	}
+}
+
+// The statements run by other callers while a session has a transaction open (another session,
+// or none) are transactions of their own
+func TestSessionsHaveTheirOwnTransactions(t *testing.T) {
+	db, err := StartElenaBusiness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.RestInPeace)
+	execAll(t, db, "creame tabla alumnos { id int @id, nombre char(50), } pe")
+	repl, service := db.NewSession(), db.NewSession()
+
+	execIn(t, db, repl, "empieza pe")
+	execIn(t, db, repl, "mete { nombre: \"deshecho\" } en alumnos pe")
+	execIn(t, db, service, "mete { nombre: \"servicio\" } en alumnos pe")
+	execAll(t, db, "mete { nombre: \"sin sesion\" } en alumnos pe")
+	execErrIn(t, db, service, "confirma pe")
+	execIn(t, db, service, "empieza pe")
+	execIn(t, db, service, "mete { nombre: \"confirmado\" } en alumnos pe")
+	execIn(t, db, service, "confirma pe")
+	execIn(t, db, repl, "deshaz pe")
+
+	if n := execAll(t, db, "dame todo de alumnos pe"); n != 3 {
+		t.Fatalf("expected the 3 rows of the other callers, got %d", n)
+	}
+	if n := execAll(t, db, "dame todo de alumnos donde (nombre == \"deshecho\") pe"); n != 0 {
+		t.Fatalf("expected the row of the rolled back session to be gone, got %d", n)
+	}
+
+	// Closing a session rolls back the transaction it left open
+	execIn(t, db, repl, "empieza pe")
+	execIn(t, db, repl, "mete { nombre: \"perdido\" } en alumnos pe")
+	if err := repl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := execAll(t, db, "dame todo de alumnos pe"); n != 3 {
+		t.Fatalf("expected the open transaction of the closed session to be rolled back, got %d rows", n)
+	}
+}
+
+func TestDeadlockRollsBackTheYoungestTransaction(t *testing.T) {
+	interval := common.CycleDetectionInterval
+	common.CycleDetectionInterval = 10 * time.Millisecond
+	t.Cleanup(func() { common.CycleDetectionInterval = interval })
+	db, err := StartElenaBusiness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.RestInPeace)
+	execAll(t, db, "creame tabla alumnos { id int @id, nota int, } pe")
+	execAll(t, db, "creame tabla cursos { id int @id, nombre char(50), } pe")
+	execAll(t, db, "mete { nota: 10 } en alumnos pe")
+	alumnos := db.Catalog.GetTableMetadata("alumnos").FileID
+	cursos := db.Catalog.GetTableMetadata("cursos").FileID
+
+	// Another transaction, older than the one of the session, is writing cursos
+	other := db.txnManager.Begin()
+	if err := db.lockManager.LockTable(other, concurrency.LockExclusive, cursos); err != nil {
+		t.Fatal(err)
+	}
+
+	session := db.NewSession()
+	execIn(t, db, session, "empieza pe")
+	execIn(t, db, session, "cambia en alumnos { nota: 20 } si (id == 0) pe")
+	waiting := make(chan error, 1)
+	go func() {
+		tuples, _, _, _, err := db.ExecuteThisBaby(session, "borra de cursos donde (id == 0) pe", false)
+		for result := range tuples {
+			if result.IsError() && err == nil {
+				err = result.Error
+			}
+		}
+		waiting <- err
+	}()
+	select {
+	case err := <-waiting:
+		t.Fatalf("expected the session to wait for cursos, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Now each one waits for the other. The session is the youngest, so its transaction is
+	// rolled back and the other one gets alumnos
+	if err := db.lockManager.LockTable(other, concurrency.LockShared, alumnos); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-waiting:
+		if !errors.As(err, &concurrency.TransactionAbortedError{}) {
+			t.Fatalf("expected the session transaction to be aborted, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the deadlock to be broken")
+	}
+	if err := db.txnManager.Commit(other); err != nil {
+		t.Fatal(err)
+	}
+
+	execErrIn(t, db, session, "confirma pe")
+	if n := execAll(t, db, "dame todo de alumnos donde (nota == 10) pe"); n != 1 {
+		t.Fatalf("expected the update to be rolled back, got %d rows as they were", n)
+	}
+}
+
+func TestReadersSeeTheSnapshotOfTheirTransaction(t *testing.T) {
+	db, err := StartElenaBusiness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.RestInPeace)
+	execAll(t, db, "creame tabla alumnos { id int @id, nombre char(50), } pe")
+	execAll(t, db, "creame indice en alumnos (nombre) pe")
+	for i := 0; i < 3; i++ {
+		execAll(t, db, fmt.Sprintf("mete { nombre: \"alumno %d\" } en alumnos pe", i))
+	}
+
+	reader := db.txnManager.Begin()
+	execAll(t, db, "mete { nombre: \"alumno 3\" } en alumnos pe")
+	execAll(t, db, "borra de alumnos donde (id == 0) pe")
+	execAll(t, db, "cambia en alumnos { nombre: \"nuevo\" } si (id == 1) pe")
+	session := db.NewSession()
+	execIn(t, db, session, "empieza pe")
+	execIn(t, db, session, "mete { nombre: \"sin confirmar\" } en alumnos pe")
+
+	// The reader doesn't wait for the session, and sees the rows as they were when it began,
+	// through the heap and through the index
+	for input, expected := range map[string]int{
+		"dame todo de alumnos pe":                                3,
+		"dame todo de alumnos donde (id == 0) pe":                1,
+		"dame todo de alumnos donde (nombre == \"alumno 1\") pe": 1,
+		"dame todo de alumnos donde (nombre == \"nuevo\") pe":    0,
+		"dame todo de alumnos donde (nombre >= \"alumno\") pe":   3,
+	} {
+		if n := execUncommitted(t, db, reader, input); n != expected {
+			t.Fatalf("%s: expected %d rows in the snapshot, got %d", input, expected, n)
+		}
+	}
+	if mode, _ := reader.GetTableLockMode(db.Catalog.GetTableMetadata("alumnos").FileID); mode != concurrency.LockIntentionShared {
+		t.Fatalf("expected the reader to only lock the table in IS mode, got %s", mode.ToString())
+	}
+
+	// The session sees what was committed plus its own rows
+	if n := execIn(t, db, session, "dame todo de alumnos pe"); n != 4 {
+		t.Fatalf("expected 4 rows in the session, got %d", n)
+	}
+	execIn(t, db, session, "deshaz pe")
+	if err := db.txnManager.Commit(reader); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.txnManager.GetVersionStore().Len(); n != 0 {
+		t.Fatalf("expected the old versions to be garbage collected, %d rows still have them", n)
+	}
+}
+
+// Rows other transactions move or delete while an index scan is halfway are still returned
+// once, in the order of the keys they have in the snapshot
+func TestIndexScanKeepsItsSnapshotWhileOthersWrite(t *testing.T) {
+	for _, desc := range []bool{false, true} {
+		db, err := StartElenaBusiness(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		execAll(t, db, "creame tabla alumnos { id int @id, nombre char(50), } pe")
+		execAll(t, db, "creame indice en alumnos (nombre) pe")
+		for i := 0; i < 100; i++ {
+			execAll(t, db, fmt.Sprintf("mete { nombre: \"alumno %03d\" } en alumnos pe", i))
+		}
+
+		input, first, last, returned := "dame todo de alumnos ordenado por nombre pe", "aaa", "zzz", 5
+		if desc {
+			input, first, last, returned = "dame todo de alumnos ordenado por nombre desc pe", "zzz", "aaa", 95
+		}
+		reader := db.txnManager.Begin()
+		parsedQuery, err := db.sqlPipeline(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, err := MakeQueryPlan(parsedQuery, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan = OptimizeQueryPlan(plan)
+		setTransaction(plan, reader)
+
+		names := []string{}
+		next := func() bool {
+			row, err := plan.Next()
+			if err != nil {
+				t.Fatalf("%s: %v", input, err)
+			}
+			if row != nil {
+				names = append(names, row.Values[1].AsVarchar())
+			}
+			return row != nil
+		}
+		for i := 0; i < 10; i++ {
+			next()
+		}
+
+		// A row the scan didn't reach moves behind it, one it returned moves ahead of it, and
+		// one it didn't reach is deleted
+		execAll(t, db, fmt.Sprintf("cambia en alumnos { nombre: \"%s\" } si (id == 50) pe", first))
+		execAll(t, db, fmt.Sprintf("cambia en alumnos { nombre: \"%s\" } si (id == %d) pe", last, returned))
+		execAll(t, db, "borra de alumnos donde (id == 60) pe")
+		execAll(t, db, "mete { nombre: \"alumno 0555\" } en alumnos pe")
+		for next() {
+		}
+
+		if len(names) != 100 {
+			t.Fatalf("%s: expected the 100 rows of the snapshot, got %d", input, len(names))
+		}
+		for i, name := range names {
+			expected := i
+			if desc {
+				expected = 99 - i
+			}
+			if name != fmt.Sprintf("alumno %03d", expected) {
+				t.Fatalf("%s: expected \"alumno %03d\" at %d, got \"%s\"", input, expected, i, name)
+			}
+		}
+		if err := db.txnManager.Commit(reader); err != nil {
+			t.Fatal(err)
+		}
+		db.RestInPeace()
+	}
+}
+
+func TestWholeTableStatementsWaitForReaders(t *testing.T) {
+	db, err := StartElenaBusiness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.RestInPeace)
+	execAll(t, db, "creame tabla alumnos { id int @id, nombre char(50), } pe")
+	for i := 0; i < 300; i++ {
+		execAll(t, db, fmt.Sprintf("mete { nombre: \"alumno %d\" } en alumnos pe", i))
+	}
+
+	// The reader is still walking the index when the table is vacuumed, the pages it has
+	// pinned can't be discarded under it
+	reader := db.txnManager.Begin()
+	parsedQuery, err := db.sqlPipeline("dame todo de alumnos donde (id >= 0) pe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := MakeQueryPlan(parsedQuery, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan = OptimizeQueryPlan(plan)
+	setTransaction(plan, reader)
+	if first, err := plan.Next(); err != nil || first == nil {
+		t.Fatalf("expected a first row, got %v (%v)", first, err)
+	}
+
+	vacuumed := make(chan error)
+	go func() {
+		vacuumed <- execResult(db, "limpia tabla alumnos pe")
+	}()
+	select {
+	case err := <-vacuumed:
+		t.Fatalf("expected the vacuum to wait for the reader, it finished with %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	rows := 1
+	for {
+		tuple, err := plan.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tuple == nil {
+			break
+		}
+		rows++
+	}
+	if rows != 300 {
+		t.Fatalf("expected 300 rows, got %d", rows)
+	}
+	if err := db.txnManager.Commit(reader); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-vacuumed; err != nil {
+		t.Fatal(err)
+	}
+	assertNoDrift(t, db, "alumnos.id")
+	if n := execAll(t, db, "dame todo de alumnos donde (id >= 100 y id < 200) pe"); n != 100 {
+		t.Fatalf("expected 100 rows after vacuuming, got %d", n)
+	}
+}
@@ -0,0 +1,159 @@
+package database
+
+import (
+	"fisi/elenadb/pkg/catalog"
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/concurrency"
+	"fisi/elenadb/pkg/meta"
+	"fisi/elenadb/pkg/storage/page"
+	"fisi/elenadb/pkg/storage/table/tuple"
+	"fmt"
+	"os"
+)
+
+// What "limpia tabla" did to a table
+type VacuumStats struct {
+	Table       string
+	Rows        int
+	PagesBefore common.APageID_t
+	PagesAfter  common.APageID_t
+}
+
+func (s *VacuumStats) ToString() string {
+	return fmt.Sprintf("%s: %d row(s), %d -> %d page(s)", s.Table, s.Rows, s.PagesBefore, s.PagesAfter)
+}
+
+// Rewrites the heap of a table into a new file with only its live tuples, packed one after
+// the other, and puts it in place of the old one. The indexes of the table are rebuilt
+// against the new RIDs.
+//
+// The new file is written next to the old one and renamed over it, which is atomic: elena_meta
+// keeps pointing to "<table>.table" and finds either the old heap or the new one, never half
+// of it. The indexes are rebuilt after that; if Elena dies before they are done, CheckIndex
+// with repair fixes them. Nothing else may use the database while it's being vacuumed, the log
+// is emptied first.
+func (db *ElenaDB) Vacuum(table string) (*VacuumStats, error) {
+	return db.vacuum(nil, table)
+}
+
+// Vacuums a table in txn, the transaction of a "limpia tabla"
+func (db *ElenaDB) vacuum(txn *concurrency.Transaction, table string) (*VacuumStats, error) {
+	tableMetadata := db.Catalog.GetTableMetadata(table)
+	if tableMetadata == nil || table == meta.ELENA_META_TABLE_NAME {
+		return nil, TableDoesNotExistError{table: table}
+	}
+
+	// The rows move to other slots, their versions would be left behind
+	db.txnManager.GarbageCollect()
+	if len(db.txnManager.GetVersionStore().TableVersions(tableMetadata.FileID)) > 0 {
+		return nil, fmt.Errorf("running transactions still see old versions of the rows of \"%s\", try again once they end", table)
+	}
+
+	// The log can't have changes to the old heap when the new one takes its place, redo would
+	// write them over it
+	if err := db.checkpoint(txn); err != nil {
+		return nil, err
+	}
+
+	stats, err := db.copyHeap(tableMetadata, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.replaceHeap(tableMetadata); err != nil {
+		return nil, err
+	}
+
+	for _, indexMetadata := range db.Catalog.GetTableIndexes(table) {
+		if err := db.rebuildIndex(tableMetadata, indexMetadata); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// Path of the file a table is rewritten to, before it's renamed over the heap
+func (db *ElenaDB) newHeapPath(table string) string {
+	return db.DbPath + table + ".table.vacuum"
+}
+
+// Copies the live tuples of the table to "<table>.table.vacuum", which is on disk once it
+// returns. If convert is given, the tuples are copied as it returns them (i.e. with other
+// columns)
+func (db *ElenaDB) copyHeap(tableMetadata *catalog.TableMetadata, convert func(*tuple.Tuple) *tuple.Tuple) (stats *VacuumStats, err error) {
+	fileId := tableMetadata.FileID
+	newHeapPath := db.newHeapPath(tableMetadata.Name)
+
+	file, err := os.Create(newHeapPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(newHeapPath)
+		}
+	}()
+
+	stats = &VacuumStats{
+		Table:       tableMetadata.Name,
+		PagesBefore: db.bufferPool.PageCount(fileId),
+	}
+	newPage := page.NewSelfContainedSlottedPage()
+	writePage := func() error {
+		_, err := file.Write(newPage.AsRawPageData())
+		stats.PagesAfter++
+		return err
+	}
+
+	// The pages are read through the buffer pool, so the changes that aren't on disk yet
+	// make it to the new heap too
+	lastInsertedId := int32(0)
+	for aPageId := common.APageID_t(0); aPageId < stats.PagesBefore; aPageId++ {
+		guard := db.bufferPool.FetchPageRead(common.NewPageIdFromParts(fileId, aPageId))
+		if guard == nil {
+			return nil, fmt.Errorf("unable to read page %d of table \"%s\"", aPageId, tableMetadata.Name)
+		}
+		slottedPage := page.NewSlottedPageFromRawPage(guard.Page())
+		lastInsertedId = slottedPage.Header.LastInsertedId
+
+		for slot := uint16(0); slot < slottedPage.GetNSlots(); slot++ {
+			t := slottedPage.ReadTuple(&tableMetadata.Schema, common.SlotNumber_t(slot))
+			if t == nil {
+				continue
+			}
+			if convert != nil {
+				t = convert(t)
+			}
+			if !newPage.HasSpaceForThisTupleSize(t.Size) {
+				if err := writePage(); err != nil {
+					guard.Drop()
+					return nil, err
+				}
+				newPage = page.NewSelfContainedSlottedPage()
+			}
+			if _, err := newPage.AppendTuple(t); err != nil {
+				guard.Drop()
+				return nil, err
+			}
+			stats.Rows++
+		}
+		guard.Drop()
+	}
+
+	// The last page is written even if it's empty, with the header of the old last page
+	newPage.SetLastInsertedId(lastInsertedId)
+	if err := writePage(); err != nil {
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Renames the file written by copyHeap over the heap of the table
+func (db *ElenaDB) replaceHeap(tableMetadata *catalog.TableMetadata) error {
+	// The pages of the old heap must not be written over the new one
+	db.discardHeapPages(tableMetadata)
+	return os.Rename(db.newHeapPath(tableMetadata.Name), db.DbPath+tableMetadata.Name+".table")
+}
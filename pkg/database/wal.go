@@ -0,0 +1,119 @@
+package database
+
+import (
+	"fisi/elenadb/pkg/buffer"
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/concurrency"
+	"fisi/elenadb/pkg/recovery"
+	"fisi/elenadb/pkg/storage/page"
+	"fmt"
+)
+
+// Every node of the plan runs in the transaction of the statement: the scans lock what they
+// read in it, and the nodes that write to a heap lock and log their changes in it
+func setTransaction(plan PlanNode, txn *concurrency.Transaction) {
+	node, ok := plan.(interface{ base() *PlanNodeBase })
+	if !ok {
+		return
+	}
+	node.base().Txn = txn
+	for _, child := range node.base().Children {
+		setTransaction(child, txn)
+	}
+}
+
+// Logs a change just made to a heap page, which must still be write latched. before is a
+// copy of the page from before the change: the record keeps only the bytes that changed,
+// which is what redo writes back. slot and tuple are what undo needs (see LogRecord).
+//
+// The row the change replaced is kept as a version, for the transactions whose snapshot
+// doesn't have the change (see concurrency.VersionStore).
+func (db *ElenaDB) logPageChange(
+	txn *concurrency.Transaction,
+	recordType recovery.LogRecordType,
+	guard *buffer.WritePageGuard,
+	before []byte,
+	slot common.SlotNumber_t,
+	tuple []byte,
+) error {
+	switch recordType {
+	case recovery.LogInsert:
+		db.txnManager.GetVersionStore().Write(txn, *common.NewRID(guard.PageId(), uint32(slot)), nil, false)
+	case recovery.LogUpdate, recovery.LogDelete:
+		deleted := recordType == recovery.LogDelete
+		db.txnManager.GetVersionStore().Write(txn, *common.NewRID(guard.PageId(), uint32(slot)), tuple, deleted)
+	}
+
+	record := recovery.NewTxnLogRecord(txn.GetTxnId(), txn.GetPrevLSN(), recordType)
+	record.Slot = slot
+	record.Tuple = tuple
+	return db.appendPageRecord(txn, record, guard, before)
+}
+
+// Logs the undo of a record, made to a page that is still write latched
+func (db *ElenaDB) logCompensation(
+	txn *concurrency.Transaction,
+	guard *buffer.WritePageGuard,
+	before []byte,
+	undone *recovery.LogRecord,
+) error {
+	record := recovery.NewTxnLogRecord(txn.GetTxnId(), txn.GetPrevLSN(), recovery.LogCompensation)
+	record.Slot = undone.Slot
+	record.UndoNextLSN = undone.PrevLSN
+	return db.appendPageRecord(txn, record, guard, before)
+}
+
+func (db *ElenaDB) appendPageRecord(
+	txn *concurrency.Transaction,
+	record *recovery.LogRecord,
+	guard *buffer.WritePageGuard,
+	before []byte,
+) error {
+	pageId := guard.PageId()
+	filename := db.Catalog.FilenameFromFileId(pageId.GetFileId())
+	if filename == nil {
+		return fmt.Errorf("unknown file %d", pageId.GetFileId())
+	}
+
+	after := guard.Data()
+	start, end := changedBytes(before, after)
+	record.PageID = pageId
+	record.File = *filename
+	record.Offset = uint16(start)
+	record.Redo = append([]byte{}, after[start:end]...)
+
+	lsn, err := db.bufferPool.LogManager().AppendLogRecord(record)
+	if err != nil {
+		return err
+	}
+	txn.SetPrevLSN(lsn)
+	txn.AppendWriteRecord(record)
+	page.NewSlottedPageFromRawPage(guard.Page()).SetPageLSN(lsn)
+	guard.Page().LSN = lsn
+	guard.MarkDirty()
+	return nil
+}
+
+// Returns the range of bytes that differ between both versions of a page, empty if they are
+// the same
+func changedBytes(before, after []byte) (int, int) {
+	start := 0
+	for start < len(after) && before[start] == after[start] {
+		start++
+	}
+	end := len(after)
+	for end > start && before[end-1] == after[end-1] {
+		end--
+	}
+	return start, end
+}
+
+// Writes every dirty page to disk and empties the log, so a crash from here on has nothing
+// to recover from before this point. Fails if a transaction other than txn (nil for none) is
+// running: its uncommitted changes would stay on disk with no log to undo them.
+func (db *ElenaDB) checkpoint(txn *concurrency.Transaction) error {
+	return db.txnManager.RunAlone(txn, func() error {
+		db.bufferPool.FlushEntirePool()
+		return db.bufferPool.LogManager().Checkpoint()
+	})
+}
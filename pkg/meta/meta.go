@@ -21,6 +21,12 @@ import (
 const ELENA_META_TABLE_NAME = "elena_meta"
 const ELENA_META_TABLE_FILE = "elena_meta.table"
 
+// Write-ahead log of the database, see recovery.LogManager
+const ELENA_WAL_FILE = "elena.wal"
+
+// Header page of the database, with the page count of each file (see buffer/page_counts.go)
+const ELENA_PAGES_FILE = "elena.pages"
+
 var ElenaMetaSchema = schema.NewSchema([]column.Column{
 	{ColumnName: "file_id", ColumnType: value.TypeInt32, IsUnique: true, IsIdentity: true},
 	{ColumnName: "type", ColumnType: value.TypeVarChar, StorageSize: 5},
@@ -0,0 +1,169 @@
+package recovery
+
+import (
+	"fisi/elenadb/pkg/common"
+	storage_disk "fisi/elenadb/pkg/storage/disk"
+	"sync"
+)
+
+// LogManager appends records to the write-ahead log. Records are kept in a buffer and only
+// written (and synced) when someone needs them on disk: a page about to be written by the
+// buffer pool (WAL before data), a commit, or a full buffer.
+//
+// LSNs are a sequence that never goes back, not offsets in the file: pages keep the LSN of
+// their last change, and the log is truncated on checkpoints.
+type LogManager struct {
+	latch       sync.Mutex
+	diskManager *storage_disk.DiskManager
+	// Serialized records not written to disk yet
+	buffer []byte
+	// Whether the end of the log was read from disk, so nextLSN is right
+	opened        bool
+	nextLSN       common.LSN_t
+	persistentLSN common.LSN_t
+	log           *common.Logger
+}
+
+func NewLogManager(diskManager *storage_disk.DiskManager) *LogManager {
+	return &LogManager{
+		diskManager:   diskManager,
+		buffer:        make([]byte, 0, common.LogBufferSize),
+		nextLSN:       1,
+		persistentLSN: common.InvalidLSN,
+		log:           common.NewLogger('📜'),
+	}
+}
+
+// Gives the record the next LSN and adds it to the log. It's not on disk until Flush.
+func (lm *LogManager) AppendLogRecord(record *LogRecord) (common.LSN_t, error) {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	if err := lm.openUnlocked(); err != nil {
+		return common.InvalidLSN, err
+	}
+
+	record.LSN = lm.nextLSN
+	data := record.Serialize()
+	if len(lm.buffer)+len(data) > common.LogBufferSize {
+		if err := lm.flushUnlocked(); err != nil {
+			return common.InvalidLSN, err
+		}
+	}
+	lm.nextLSN++
+	lm.buffer = append(lm.buffer, data...)
+	lm.log.Debug("append %s", record.ToString())
+	return record.LSN, nil
+}
+
+// Makes sure that every record up to lsn is on disk. InvalidLSN is a no-op
+func (lm *LogManager) Flush(lsn common.LSN_t) error {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	if lsn == common.InvalidLSN || lsn <= lm.persistentLSN {
+		return nil
+	}
+	return lm.flushUnlocked()
+}
+
+// Last LSN that is on disk
+func (lm *LogManager) PersistentLSN() common.LSN_t {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	return lm.persistentLSN
+}
+
+func (lm *LogManager) flushUnlocked() error {
+	if len(lm.buffer) == 0 {
+		return nil
+	}
+	if err := lm.diskManager.WriteLog(lm.buffer); err != nil {
+		return err
+	}
+	lm.buffer = lm.buffer[:0]
+	lm.persistentLSN = lm.nextLSN - 1
+	return nil
+}
+
+// Reads every record in the log file. A torn record at the end (Elena died while writing it)
+// is cut from the file, together with anything after it.
+func (lm *LogManager) ReadLogRecords() ([]*LogRecord, error) {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	if err := lm.flushUnlocked(); err != nil {
+		return nil, err
+	}
+	return lm.readUnlocked()
+}
+
+func (lm *LogManager) readUnlocked() ([]*LogRecord, error) {
+	records := []*LogRecord{}
+	chunk := make([]byte, common.LogBufferSize)
+	pending := []byte{}
+	offset := int64(0)
+	for {
+		n, err := lm.diskManager.ReadLog(chunk, offset+int64(len(pending)))
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, chunk[:n]...)
+
+		for {
+			record, size, ok := DeserializeLogRecord(pending)
+			if !ok {
+				break
+			}
+			records = append(records, record)
+			pending = pending[size:]
+			offset += int64(size)
+		}
+		if n < len(chunk) {
+			break
+		}
+	}
+
+	if len(pending) > 0 {
+		lm.log.Warn("dropping %d bytes of a torn record at the end of the log", len(pending))
+		if err := lm.diskManager.TruncateLog(offset); err != nil {
+			return nil, err
+		}
+	}
+
+	lm.opened = true
+	if len(records) > 0 {
+		last := records[len(records)-1].LSN
+		lm.nextLSN = last + 1
+		lm.persistentLSN = last
+	}
+	return records, nil
+}
+
+// The next LSN comes after the last record on disk, so the log has to be read once before
+// appending to it
+func (lm *LogManager) openUnlocked() error {
+	if lm.opened {
+		return nil
+	}
+	_, err := lm.readUnlocked()
+	return err
+}
+
+// Empties the log, leaving only a checkpoint record that keeps the LSN sequence going. The
+// caller must have written every dirty page to disk and there must be no transaction running,
+// the records still in the buffer are dropped.
+func (lm *LogManager) Checkpoint() error {
+	lm.latch.Lock()
+	defer lm.latch.Unlock()
+	if err := lm.openUnlocked(); err != nil {
+		return err
+	}
+
+	record := NewTxnLogRecord(common.InvalidTxnID, common.InvalidLSN, LogCheckpoint)
+	record.LSN = lm.nextLSN
+	if err := lm.diskManager.ResetLog(record.Serialize()); err != nil {
+		return err
+	}
+	lm.nextLSN++
+	lm.buffer = lm.buffer[:0]
+	lm.persistentLSN = record.LSN
+	return nil
+}
@@ -0,0 +1,143 @@
+package recovery_test
+
+import (
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/meta"
+	"fisi/elenadb/pkg/recovery"
+	storage_disk "fisi/elenadb/pkg/storage/disk"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLogManager(t *testing.T, dir string) (*recovery.LogManager, *storage_disk.DiskManager) {
+	common.GloablDbDir = dir
+	dm, err := storage_disk.NewDiskManager(dir)
+	assert.Nil(t, err)
+	t.Cleanup(dm.ShutDown)
+	return recovery.NewLogManager(dm), dm
+}
+
+func pageRecord(txnId common.TxnID_t, prevLSN common.LSN_t) *recovery.LogRecord {
+	record := recovery.NewTxnLogRecord(txnId, prevLSN, recovery.LogUpdate)
+	record.PageID = common.NewPageIdFromParts(2, 3)
+	record.File = "alumnos.table"
+	record.Slot = 7
+	record.Offset = 120
+	record.Redo = []byte("nuevo")
+	record.Tuple = []byte("viejo")
+	return record
+}
+
+func TestLogRecordRoundTrip(t *testing.T) {
+	record := pageRecord(42, 9)
+	record.LSN = 10
+	record.UndoNextLSN = 4
+
+	data := record.Serialize()
+	read, size, ok := recovery.DeserializeLogRecord(data)
+	assert.True(t, ok)
+	assert.Equal(t, len(data), size)
+	assert.Equal(t, record, read)
+
+	// a record missing its last byte, or with a flipped one, is not a record
+	_, _, ok = recovery.DeserializeLogRecord(data[:len(data)-1])
+	assert.False(t, ok)
+	data[len(data)-3] ^= 0xff
+	_, _, ok = recovery.DeserializeLogRecord(data)
+	assert.False(t, ok)
+}
+
+func TestLogManagerReadsWhatWasFlushed(t *testing.T) {
+	dir := t.TempDir()
+	lm, _ := newLogManager(t, dir)
+
+	first, err := lm.AppendLogRecord(pageRecord(1, common.InvalidLSN))
+	assert.Nil(t, err)
+	second, err := lm.AppendLogRecord(recovery.NewTxnLogRecord(1, first, recovery.LogCommit))
+	assert.Nil(t, err)
+	assert.Equal(t, first+1, second)
+	assert.Equal(t, common.InvalidLSN, lm.PersistentLSN())
+
+	// only what was flushed survives
+	assert.Nil(t, lm.Flush(second))
+	assert.Equal(t, second, lm.PersistentLSN())
+	_, err = lm.AppendLogRecord(pageRecord(2, common.InvalidLSN))
+	assert.Nil(t, err)
+
+	reopened, _ := newLogManager(t, dir)
+	records, err := reopened.ReadLogRecords()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, first, records[0].LSN)
+	assert.Equal(t, recovery.LogCommit, records[1].Type)
+
+	// and the LSNs go on from the last one on disk
+	third, err := reopened.AppendLogRecord(pageRecord(3, common.InvalidLSN))
+	assert.Nil(t, err)
+	assert.Equal(t, second+1, third)
+}
+
+func TestLogManagerDropsATornRecord(t *testing.T) {
+	dir := t.TempDir()
+	lm, _ := newLogManager(t, dir)
+	lsn, err := lm.AppendLogRecord(pageRecord(1, common.InvalidLSN))
+	assert.Nil(t, err)
+	assert.Nil(t, lm.Flush(lsn))
+
+	// Elena died halfway through writing the next record
+	walPath := filepath.Join(dir, meta.ELENA_WAL_FILE)
+	info, err := os.Stat(walPath)
+	assert.Nil(t, err)
+	torn := pageRecord(1, lsn)
+	torn.LSN = lsn + 1
+	data := torn.Serialize()
+	file, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write(data[:len(data)/2])
+	assert.Nil(t, err)
+	file.Close()
+
+	reopened, _ := newLogManager(t, dir)
+	records, err := reopened.ReadLogRecords()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	truncated, err := os.Stat(walPath)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size(), truncated.Size())
+
+	// new records go where the torn one was
+	next, err := reopened.AppendLogRecord(recovery.NewTxnLogRecord(1, lsn, recovery.LogCommit))
+	assert.Nil(t, err)
+	assert.Nil(t, reopened.Flush(next))
+	records, err = reopened.ReadLogRecords()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, next, records[1].LSN)
+}
+
+func TestCheckpointKeepsTheLSNsGoing(t *testing.T) {
+	dir := t.TempDir()
+	lm, _ := newLogManager(t, dir)
+	last := common.InvalidLSN
+	for i := 0; i < 50; i++ {
+		lsn, err := lm.AppendLogRecord(pageRecord(common.TxnID_t(i), common.InvalidLSN))
+		assert.Nil(t, err)
+		last = lsn
+	}
+	assert.Nil(t, lm.Flush(last))
+	assert.Nil(t, lm.Checkpoint())
+
+	reopened, _ := newLogManager(t, dir)
+	records, err := reopened.ReadLogRecords()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, recovery.LogCheckpoint, records[0].Type)
+	assert.Equal(t, last+1, records[0].LSN)
+
+	lsn, err := reopened.AppendLogRecord(pageRecord(99, common.InvalidLSN))
+	assert.Nil(t, err)
+	assert.Equal(t, last+2, lsn)
+}
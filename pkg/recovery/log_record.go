@@ -0,0 +1,187 @@
+package recovery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fisi/elenadb/pkg/common"
+	"fmt"
+	"hash/crc32"
+)
+
+type LogRecordType uint8
+
+const (
+	LogInvalid LogRecordType = iota
+	// A tuple was stored in a slot of a heap page
+	LogInsert
+	// The tuple of a slot was deleted
+	LogDelete
+	// The tuple of a slot was overwritten in place
+	LogUpdate
+	// A page was added at the end of a heap
+	LogNewPage
+	// The last identity handed out by a heap changed
+	LogIdentity
+	// Compensation (CLR): the undo of an earlier record. It's only redone, never undone
+	LogCompensation
+	LogCommit
+	LogAbort
+	// Everything before it is on disk. It's the first record after the log is truncated
+	LogCheckpoint
+)
+
+func (t LogRecordType) ToString() string {
+	switch t {
+	case LogInsert:
+		return "INSERT"
+	case LogDelete:
+		return "DELETE"
+	case LogUpdate:
+		return "UPDATE"
+	case LogNewPage:
+		return "NEWPAGE"
+	case LogIdentity:
+		return "IDENTITY"
+	case LogCompensation:
+		return "CLR"
+	case LogCommit:
+		return "COMMIT"
+	case LogAbort:
+		return "ABORT"
+	case LogCheckpoint:
+		return "CHECKPOINT"
+	default:
+		return "INVALID"
+	}
+}
+
+// LogRecord is an entry of the write-ahead log. Changes to pages are logged physiologically:
+// they are redone by writing back the bytes they changed (Redo, from Offset), whatever the
+// page had, and undone logically from the tuple they touched (Tuple, in Slot), so an undo
+// doesn't depend on where the other tuples of the page moved since.
+//
+// On disk a record is:
+// ------------------------------------------------------------------------------------------
+// | Size(4) | CRC(4) | LSN(4) | PrevLSN(4) | TxnID(8) | Type(1) | PageID(4) | Slot(2) |
+// | UndoNextLSN(4) | Offset(2) | len(2) Redo | len(2) Tuple | len(1) File |
+// ------------------------------------------------------------------------------------------
+// The CRC covers everything after it, so a record torn by a crash is found and dropped.
+type LogRecord struct {
+	LSN common.LSN_t
+	// Previous record of the same transaction, InvalidLSN if it's the first one
+	PrevLSN common.LSN_t
+	TxnID   common.TxnID_t
+	Type    LogRecordType
+	PageID  common.PageID_t
+	// File of the page, so recovery can find it before the catalog is loaded
+	File string
+	Slot common.SlotNumber_t
+	// Bytes of the page written by the change, starting at Offset
+	Offset uint16
+	Redo   []byte
+	// Tuple inserted in the slot, or the one that was there before a delete or update
+	Tuple []byte
+	// Only for compensations: the next record of the transaction left to undo
+	UndoNextLSN common.LSN_t
+}
+
+const logRecordHeaderSize = 8
+
+func NewTxnLogRecord(txnId common.TxnID_t, prevLSN common.LSN_t, recordType LogRecordType) *LogRecord {
+	return &LogRecord{
+		LSN:         common.InvalidLSN,
+		PrevLSN:     prevLSN,
+		TxnID:       txnId,
+		Type:        recordType,
+		PageID:      common.InvalidPageID,
+		UndoNextLSN: common.InvalidLSN,
+	}
+}
+
+// Whether the record changes a page
+func (r *LogRecord) IsPageRecord() bool {
+	return r.PageID != common.InvalidPageID
+}
+
+// Whether undoing the transaction has to do something about this record
+func (r *LogRecord) IsUndoable() bool {
+	return r.Type == LogInsert || r.Type == LogDelete || r.Type == LogUpdate
+}
+
+func (r *LogRecord) ToString() string {
+	if !r.IsPageRecord() {
+		return fmt.Sprintf("%d: %s txn=%d prev=%d", r.LSN, r.Type.ToString(), r.TxnID, r.PrevLSN)
+	}
+	return fmt.Sprintf(
+		"%d: %s txn=%d prev=%d page=%s slot=%d redo=%d@%d tuple=%d",
+		r.LSN, r.Type.ToString(), r.TxnID, r.PrevLSN, r.PageID.ToString(), r.Slot, len(r.Redo), r.Offset, len(r.Tuple),
+	)
+}
+
+func (r *LogRecord) Serialize() []byte {
+	data := make([]byte, logRecordHeaderSize, logRecordHeaderSize+39+len(r.Redo)+len(r.Tuple)+len(r.File))
+	data = binary.LittleEndian.AppendUint32(data, uint32(r.LSN))
+	data = binary.LittleEndian.AppendUint32(data, uint32(r.PrevLSN))
+	data = binary.LittleEndian.AppendUint64(data, uint64(r.TxnID))
+	data = append(data, byte(r.Type))
+	data = binary.LittleEndian.AppendUint32(data, uint32(r.PageID))
+	data = binary.LittleEndian.AppendUint16(data, uint16(r.Slot))
+	data = binary.LittleEndian.AppendUint32(data, uint32(r.UndoNextLSN))
+	data = binary.LittleEndian.AppendUint16(data, r.Offset)
+	data = binary.LittleEndian.AppendUint16(data, uint16(len(r.Redo)))
+	data = append(data, r.Redo...)
+	data = binary.LittleEndian.AppendUint16(data, uint16(len(r.Tuple)))
+	data = append(data, r.Tuple...)
+	data = append(data, byte(len(r.File)))
+	data = append(data, r.File...)
+
+	binary.LittleEndian.PutUint32(data[0:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(data[4:], crc32.ChecksumIEEE(data[logRecordHeaderSize:]))
+	return data
+}
+
+// Reads the record at the start of data and returns how many bytes it takes. ok is false if
+// data doesn't start with a whole, valid record (i.e. the end of the log, or a torn write).
+func DeserializeLogRecord(data []byte) (record *LogRecord, size int, ok bool) {
+	if len(data) < logRecordHeaderSize {
+		return nil, 0, false
+	}
+	size = int(binary.LittleEndian.Uint32(data[0:]))
+	if size < logRecordHeaderSize || size > len(data) {
+		return nil, 0, false
+	}
+	if crc32.ChecksumIEEE(data[logRecordHeaderSize:size]) != binary.LittleEndian.Uint32(data[4:]) {
+		return nil, 0, false
+	}
+
+	r := &recordReader{data: data[logRecordHeaderSize:size]}
+	record = &LogRecord{
+		LSN:         common.LSN_t(r.uint32()),
+		PrevLSN:     common.LSN_t(r.uint32()),
+		TxnID:       common.TxnID_t(r.uint64()),
+		Type:        LogRecordType(r.bytes(1)[0]),
+		PageID:      common.PageID_t(r.uint32()),
+		Slot:        common.SlotNumber_t(r.uint16()),
+		UndoNextLSN: common.LSN_t(r.uint32()),
+		Offset:      r.uint16(),
+	}
+	record.Redo = bytes.Clone(r.bytes(int(r.uint16())))
+	record.Tuple = bytes.Clone(r.bytes(int(r.uint16())))
+	record.File = string(r.bytes(int(r.bytes(1)[0])))
+	return record, size, true
+}
+
+type recordReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *recordReader) bytes(n int) []byte {
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *recordReader) uint16() uint16 { return binary.LittleEndian.Uint16(r.bytes(2)) }
+func (r *recordReader) uint32() uint32 { return binary.LittleEndian.Uint32(r.bytes(4)) }
+func (r *recordReader) uint64() uint64 { return binary.LittleEndian.Uint64(r.bytes(8)) }
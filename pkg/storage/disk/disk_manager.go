@@ -14,7 +14,8 @@ package storage_disk
 
 import (
 	"fisi/elenadb/pkg/common"
-	"fmt"
+	"fisi/elenadb/pkg/meta"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
@@ -42,6 +43,7 @@ type DiskManager struct {
 func NewDiskManager(dbDir string) (*DiskManager, error) {
 	dm := &DiskManager{
 		dbDir:     dbDir,
+		logName:   meta.ELENA_WAL_FILE,
 		flushLogF: make(chan struct{}),
 		latch:     sync.RWMutex{},
 		logLatch:  sync.RWMutex{},
@@ -58,7 +60,10 @@ func (dm *DiskManager) ShutDown() {
 	dm.logLatch.Lock()
 	defer dm.latch.Unlock()
 	defer dm.logLatch.Unlock()
-	// TODO: gracefully close the file resources
+	if dm.logFile != nil {
+		dm.logFile.Close()
+		dm.logFile = nil
+	}
 }
 
 // WritePage: writes a page to the database file.
@@ -105,30 +110,99 @@ func (dm *DiskManager) ReadPage(pageID common.PageID_t, filename string) ([]byte
 	return pageData, err
 }
 
-// WriteLog: flushes the entire log buffer into disk.
+// WriteLog: appends log data to the end of the log file and forces it to disk.
 // @param logData: raw log data
-func (dm *DiskManager) WriteLog(format string, a ...any) {
+func (dm *DiskManager) WriteLog(logData []byte) error {
 	dm.logLatch.Lock()
 	defer dm.logLatch.Unlock()
-	_, err := dm.logFile.Write([]byte(fmt.Sprintf(format, a...)))
-	if err != nil {
-		panic(err)
+	if err := dm.openLogUnlocked(); err != nil {
+		return err
+	}
+	if _, err := dm.logFile.Write(logData); err != nil {
+		return err
+	}
+	if err := dm.logFile.Sync(); err != nil {
+		return err
 	}
+	atomic.AddInt32(&dm.numFlushes, 1)
+	return nil
 }
 
-// ReadLog reads a log entry from the log file.
+// ReadLog reads a part of the log file.
 // @param logData output buffer
-// @param size size of the log entry
-// @param offset offset of the log entry in the file
-// @return true if the read was successful, false otherwise
-func (dm *DiskManager) ReadLog(logData []byte, size, offset int) (bool, error) {
-	dm.logLatch.RLock()
-	defer dm.logLatch.RUnlock()
-	_, err := dm.logFile.ReadAt(logData, int64(offset))
+// @param offset offset of the log data in the file
+// @return how many bytes were read, less than len(logData) at the end of the file
+func (dm *DiskManager) ReadLog(logData []byte, offset int64) (int, error) {
+	dm.logLatch.Lock()
+	defer dm.logLatch.Unlock()
+	if err := dm.openLogUnlocked(); err != nil {
+		return 0, err
+	}
+	n, err := dm.logFile.ReadAt(logData, offset)
+	if err == io.EOF {
+		return n, nil
+	}
+	return n, err
+}
+
+// TruncateLog: cuts the log file to the given size, 0 to empty it.
+// @param size: new size of the log file
+func (dm *DiskManager) TruncateLog(size int64) error {
+	dm.logLatch.Lock()
+	defer dm.logLatch.Unlock()
+	if err := dm.openLogUnlocked(); err != nil {
+		return err
+	}
+	if err := dm.logFile.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := dm.logFile.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	return dm.logFile.Sync()
+}
+
+// ResetLog: replaces the whole log file with the given data. The data is written over the
+// start of the file before cutting the rest, so the file is never left empty.
+// @param logData: raw log data
+func (dm *DiskManager) ResetLog(logData []byte) error {
+	dm.logLatch.Lock()
+	defer dm.logLatch.Unlock()
+	if err := dm.openLogUnlocked(); err != nil {
+		return err
+	}
+	if _, err := dm.logFile.WriteAt(logData, 0); err != nil {
+		return err
+	}
+	if err := dm.logFile.Truncate(int64(len(logData))); err != nil {
+		return err
+	}
+	if _, err := dm.logFile.Seek(int64(len(logData)), io.SeekStart); err != nil {
+		return err
+	}
+	if err := dm.logFile.Sync(); err != nil {
+		return err
+	}
+	atomic.AddInt32(&dm.numFlushes, 1)
+	return nil
+}
+
+// The log file is opened (or created) the first time it's used, so a disk manager can be
+// created before its directory exists
+func (dm *DiskManager) openLogUnlocked() error {
+	if dm.logFile != nil {
+		return nil
+	}
+	logFile, err := os.OpenFile(filepath.Join(dm.dbDir, dm.logName), os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		return false, err
+		return err
+	}
+	if _, err := logFile.Seek(0, io.SeekEnd); err != nil {
+		logFile.Close()
+		return err
 	}
-	return true, nil
+	dm.logFile = logFile
+	return nil
 }
 
 // ✅ GetFileSize: gets the size of the specified file.
@@ -1,188 +1,361 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fisi/elenadb/pkg/buffer"
+	"fisi/elenadb/pkg/catalog/schema"
 	"fisi/elenadb/pkg/common"
 	"fisi/elenadb/pkg/storage/page"
 	"fmt"
+	"runtime"
+	"sync"
 	// "fmt"
 )
 
-const numberNodes = 500
-
-// BPTree es la estructura principal del B+ Tree
+// BPTree es la estructura principal del B+ Tree.
+//
+// Se puede usar desde varias goroutines a la vez. Cada página tiene su latch y las operaciones
+// bajan desde la raíz con latch crabbing: toman el latch del hijo antes de soltar el del padre.
+// Las lecturas sueltan al padre apenas tienen al hijo. Las escrituras se quedan con los
+// ancestros mientras el nodo en el que están no sea seguro, es decir mientras se pueda dividir
+// (Insert) o quedar con muy pocas claves (Delete), porque entonces el cambio sube hasta ellos.
 type BPTree struct {
 	bufferPoolManager *buffer.BufferPoolManager
 	fileId            common.FileID_t
-	RootPageID        common.PageID_t
+	// RootPageID solo cambia con rootLatch tomado en escritura
+	RootPageID common.PageID_t
+	rootLatch  sync.RWMutex
+	comparator *KeyComparator
+	// Las entradas del árbol son la clave seguida del RID
+	entrySize int
+
+	// Máximo de claves por nodo, lo que entra en una página según el ancho de la clave
+	maxLeafKeys     int
+	maxInternalKeys int
+	// Mínimo de claves por nodo (salvo la raíz), con menos se redistribuye o se fusiona
+	minLeafKeys     int
+	minInternalKeys int
+
+	// Páginas que quedaron sin uso al fusionar nodos, newNode las usa antes de agrandar el
+	// archivo
+	freeLatch sync.Mutex
+	freePages []common.PageID_t
+}
+
+// NewBPTree crea una nueva instancia del B+ Tree, con claves de las columnas de keySchema
+func NewBPTree(bufferPoolManager *buffer.BufferPoolManager, catalog common.FileID_t, keySchema *schema.Schema) (*BPTree, error) {
+	comparator, err := NewKeyComparator(keySchema)
+	if err != nil {
+		return nil, err
+	}
+	rootPage := createEmptyPage(bufferPoolManager, catalog, comparator.KeySize()+ridSize)
+
+	return newBPTree(bufferPoolManager, catalog, rootPage.PageID, comparator), nil
+}
+
+// OpenBPTree abre un B+ Tree que ya existe en el archivo, a partir de su página raíz
+// y del esquema de sus claves (ambos guardados en elena_meta)
+func OpenBPTree(bufferPoolManager *buffer.BufferPoolManager, fileId common.FileID_t, root common.PageID_t, keySchema *schema.Schema) (*BPTree, error) {
+	comparator, err := NewKeyComparator(keySchema)
+	if err != nil {
+		return nil, err
+	}
+	tree := newBPTree(bufferPoolManager, fileId, root, comparator)
+
+	guard := bufferPoolManager.FetchPageRead(root)
+	if guard == nil {
+		return nil, fmt.Errorf("root page %s of the B+ tree is missing", root.ToString())
+	}
+	defer guard.Drop()
+	rootPage, err := page.BTreePageFromRawData(guard.Data())
+	if err != nil {
+		return nil, err
+	}
+	if rootPage.KeySize != tree.entrySize {
+		return nil, fmt.Errorf("B+ tree entries are %d bytes wide, but the key schema needs %d", rootPage.KeySize, tree.entrySize)
+	}
+	if err := tree.findFreePages(); err != nil {
+		return nil, err
+	}
+	return tree, nil
 }
 
-// NewBPTree crea una nueva instancia del B+ Tree
-func NewBPTree(bufferPoolManager *buffer.BufferPoolManager, catalog common.FileID_t) *BPTree {
-	rootPage := createEmptyPage(bufferPoolManager, catalog)
+// findFreePages recorre las páginas del archivo para juntar las que quedaron libres. Las
+// páginas libres no están enlazadas entre sí, solo se reconocen por su tipo.
+func (tree *BPTree) findFreePages() error {
+	count := tree.bufferPoolManager.PageCount(tree.fileId)
+	for i := common.APageID_t(0); i < count; i++ {
+		pageID := common.NewPageIdFromParts(tree.fileId, i)
+		guard := tree.bufferPoolManager.FetchPageRead(pageID)
+		if guard == nil {
+			return fmt.Errorf("page %s of the B+ tree is missing", pageID.ToString())
+		}
+		bTreePage, err := page.BTreePageFromRawData(guard.Data())
+		guard.Drop()
+		if err != nil {
+			return err
+		}
+		if bTreePage.PageType == page.FreePage {
+			tree.freePages = append(tree.freePages, pageID)
+		}
+	}
+	return nil
+}
 
+// takeFreePage toma una página libre, con su latch de escritura, para un nodo nuevo. Se salta
+// las que alguien más tiene fijadas: un IndexIterator que estaba en una hoja cuando se fusionó
+// la sigue teniendo hasta que baja de nuevo desde la raíz. Retorna nil si no hay ninguna.
+func (tree *BPTree) takeFreePage() *buffer.WritePageGuard {
+	tree.freeLatch.Lock()
+	defer tree.freeLatch.Unlock()
+	for i := len(tree.freePages) - 1; i >= 0; i-- {
+		pinned := tree.fetchBasic(tree.freePages[i])
+		guard, ok := pinned.TryUpgradeWrite()
+		if !ok {
+			pinned.Drop()
+			continue
+		}
+		if guard.Page().PinCount.Load() > 1 {
+			guard.Drop()
+			continue
+		}
+		tree.freePages = append(tree.freePages[:i], tree.freePages[i+1:]...)
+		return guard
+	}
+	return nil
+}
+
+// addFreePages agrega páginas que ya nadie tiene tomadas a las libres del árbol
+func (tree *BPTree) addFreePages(pageIDs []common.PageID_t) {
+	tree.freeLatch.Lock()
+	defer tree.freeLatch.Unlock()
+	tree.freePages = append(tree.freePages, pageIDs...)
+}
+
+// FreePageCount retorna cuántas páginas libres tiene el árbol para reusar
+func (tree *BPTree) FreePageCount() int {
+	tree.freeLatch.Lock()
+	defer tree.freeLatch.Unlock()
+	return len(tree.freePages)
+}
+
+func newBPTree(bufferPoolManager *buffer.BufferPoolManager, fileId common.FileID_t, root common.PageID_t, comparator *KeyComparator) *BPTree {
+	entrySize := comparator.KeySize() + ridSize
+	maxLeafKeys := page.BTreeLeafMaxKeys(entrySize)
+	maxInternalKeys := page.BTreeInternalMaxKeys(entrySize)
 	return &BPTree{
 		bufferPoolManager: bufferPoolManager,
-		fileId:            catalog,
-		RootPageID:        rootPage.PageID,
+		fileId:            fileId,
+		RootPageID:        root,
+		comparator:        comparator,
+		entrySize:         entrySize,
+		maxLeafKeys:       maxLeafKeys,
+		maxInternalKeys:   maxInternalKeys,
+		minLeafKeys:       maxLeafKeys / 2,
+		minInternalKeys:   maxInternalKeys / 2,
 	}
 }
 
+// KeySchema retorna las columnas que forman las claves del árbol
+func (tree *BPTree) KeySchema() *schema.Schema {
+	return tree.comparator.KeySchema()
+}
+
+// Root retorna la página raíz, que cambia cuando el árbol crece o pierde un nivel
+func (tree *BPTree) Root() common.PageID_t {
+	tree.rootLatch.RLock()
+	defer tree.rootLatch.RUnlock()
+	return tree.RootPageID
+}
+
 // createEmptyPage crea una nueva página vacía y la retorna
-func createEmptyPage(bufferPoolManager *buffer.BufferPoolManager, catalog common.FileID_t) *page.BTreePage {
-	p := bufferPoolManager.NewPage(catalog)
-	if p == nil {
+func createEmptyPage(bufferPoolManager *buffer.BufferPoolManager, catalog common.FileID_t, keySize int) *page.BTreePage {
+	guard := bufferPoolManager.NewPageWrite(catalog)
+	if guard == nil {
 		panic("No se pudo crear una nueva página")
 	}
-	bTreePage := page.NewBTreePage(p.PageId, page.LeafPage)
-	data, err := bTreePage.Serialize()
-	if err != nil {
-		panic(fmt.Sprintf("Error serializing BTreePage: %v", err))
-	}
-	copy(p.Data, data)
-	bufferPoolManager.WriteDataToPageAndPin(p.PageId, data)
-	bufferPoolManager.UnpinPage(p.PageId, true)
+	defer guard.Drop()
+	bTreePage := page.NewBTreePage(guard.PageId(), page.LeafPage, keySize)
+	writeNode(guard, bTreePage)
 	return bTreePage
 }
 
-// getPage obtiene una página del Buffer Pool Manager y la convierte a BTreePage
-func (tree *BPTree) getPage(pageID common.PageID_t) *page.BTreePage {
-	p := tree.bufferPoolManager.FetchPage(pageID)
-	if p == nil {
-		return nil
+// fetchBasic fija la página en el Buffer Pool Manager, sin tomar su latch
+func (tree *BPTree) fetchBasic(pageID common.PageID_t) *buffer.BasicPageGuard {
+	guard := tree.bufferPoolManager.FetchPageBasic(pageID)
+	if guard == nil {
+		panic(fmt.Sprintf("No se pudo obtener la página %s", pageID.ToString()))
 	}
-	bTreePage, err := page.BTreePageFromRawData(p.Data)
+	return guard
+}
+
+// fetchRead fija la página y espera su latch de lectura
+func (tree *BPTree) fetchRead(pageID common.PageID_t) *buffer.ReadPageGuard {
+	return tree.fetchBasic(pageID).UpgradeRead()
+}
+
+// readNode convierte a BTreePage los datos de una página de la que se tiene el latch
+func readNode(data []byte) *page.BTreePage {
+	bTreePage, err := page.BTreePageFromRawData(data)
 	if err != nil {
-		fmt.Printf("Error converting Page to BTreePage: %v", p.Data)
 		panic(fmt.Sprintf("Error converting Page to BTreePage: %v", err))
 	}
-	tree.bufferPoolManager.UnpinPage(p.PageId, false)
 	return bTreePage
 }
 
-// createPage crea una nueva página usando el Buffer Pool Manager y la convierte a BTreePage
-func (tree *BPTree) createPage(pageType page.BTreePageType) *page.BTreePage {
-	p := tree.bufferPoolManager.NewPage(tree.fileId)
-	if p == nil {
-		return nil
-	}
-	bTreePage := page.NewBTreePage(p.PageId, pageType)
-	data, err := bTreePage.Serialize()
+// writeNode guarda el nodo en su página, que queda sucia
+func writeNode(guard *buffer.WritePageGuard, node *page.BTreePage) {
+	data, err := node.Serialize()
 	if err != nil {
 		panic(fmt.Sprintf("Error serializing BTreePage: %v", err))
 	}
-	copy(p.Data, data)
-	return bTreePage
+	copy(guard.DataMut(), data)
 }
 
-// Insert inserta una clave-valor en el B+ Tree
-func (tree *BPTree) Insert(key int, value uint64) {
-	if tree.RootPageID == common.InvalidPageID {
-		newPage := tree.createPage(page.LeafPage)
-		if newPage == nil {
-			panic("(1) No se pudo crear una nueva página")
-		}
-		tree.RootPageID = newPage.PageID
-		tree.initializeRootPage(newPage, key, value)
-	} else {
-		tree.insertIntoNode(tree.RootPageID, key, value)
+// getPage lee una página del árbol tal como está, sin quedarse con ella
+func (tree *BPTree) getPage(pageID common.PageID_t) *page.BTreePage {
+	guard := tree.fetchRead(pageID)
+	defer guard.Drop()
+	return readNode(guard.Data())
+}
+
+// entry arma la entrada del árbol para una clave (codificada) y su RID
+func (tree *BPTree) entry(key []byte, value uint64) []byte {
+	data := make([]byte, len(key)+ridSize)
+	copy(data, key)
+	binary.BigEndian.PutUint64(data[len(key):], value)
+	return data
+}
+
+// compare ordena entradas y claves del árbol: primero por las columnas que ambas tienen y, si
+// las dos traen el RID, por el RID. Una clave sin RID es igual a todas sus entradas.
+func (tree *BPTree) compare(a, b []byte) int {
+	if cmp := tree.comparator.Compare(a, b); cmp != 0 {
+		return cmp
 	}
-	// fmt.Printf("Terminó la inserción de %v\n\n", key)
+	size := tree.comparator.KeySize()
+	if len(a) < size+ridSize || len(b) < size+ridSize {
+		return 0
+	}
+	return bytes.Compare(a[size:size+ridSize], b[size:size+ridSize])
 }
 
-// initializeRootPage inicializa la página raíz
-func (tree *BPTree) initializeRootPage(rootPage *page.BTreePage, key int, value uint64) {
-	rootPage.Keys = append(rootPage.Keys, key)
-	rootPage.Values = append(rootPage.Values, value)
-	data, _ := rootPage.Serialize()
-	tree.bufferPoolManager.WriteDataToPageAndPin(rootPage.PageID, data)
-	tree.bufferPoolManager.UnpinPage(rootPage.PageID, true)
-	tree.bufferPoolManager.UnpinPage(rootPage.PageID, true)
+// safeForInsert dice si el nodo tiene lugar para una clave más sin dividirse
+func (tree *BPTree) safeForInsert(n *latchedNode) bool {
+	if n.node.PageType == page.LeafPage {
+		return len(n.node.Keys) < tree.maxLeafKeys
+	}
+	return len(n.node.Keys) < tree.maxInternalKeys
 }
 
-// insertIntoNode inserta una clave-valor en un nodo dado
-func (tree *BPTree) insertIntoNode(pageID common.PageID_t, key int, value uint64) {
-	nodePage := tree.getPage(pageID)
-	if nodePage == nil {
-		panic("No se pudo obtener la página del nodo")
+// safeForDelete dice si el nodo puede perder una clave sin quedar con menos del mínimo. La raíz
+// no tiene mínimo, pero si es interna y se queda sin claves el árbol pierde un nivel.
+func (tree *BPTree) safeForDelete(n *latchedNode) bool {
+	if n.isRoot {
+		return n.node.PageType == page.LeafPage || len(n.node.Keys) > 1
 	}
+	if n.node.PageType == page.LeafPage {
+		return len(n.node.Keys) > tree.minLeafKeys
+	}
+	return len(n.node.Keys) > tree.minInternalKeys
+}
 
-	// fmt.Printf("Looking at the node: %v\n", nodePage)
-	if nodePage.PageType == page.InternalPage {
-		// fmt.Print("Looking for the correct node to append....\n")
-		childIndex := tree.findIndex(nodePage.Keys, key)
-		childPageID := nodePage.Children[childIndex]
-		tree.bufferPoolManager.UnpinPage(nodePage.PageID, false)
-		tree.insertIntoNode(childPageID, key, value)
-		return
+// Insert inserta una clave-valor en el B+ Tree. La clave debe tener todas las columnas.
+func (tree *BPTree) Insert(indexKey IndexKey, value uint64) {
+	entry := tree.entry(tree.encodeFullKey(indexKey), value)
+	for !tree.insert(entry, value) {
+		// Otra escritura estaba usando una hoja vecina, se intenta de nuevo desde la raíz
+		runtime.Gosched()
 	}
+}
 
-	if len(nodePage.Keys) < numberNodes {
-		tree.insertIntoLeaf(nodePage, key, value)
-	} else {
-		// fmt.Print("Overflow....\n")
-		tree.splitNode(nodePage, key, value)
+func (tree *BPTree) encodeFullKey(indexKey IndexKey) []byte {
+	if len(indexKey) != tree.KeySchema().GetColumnCount() {
+		panic(fmt.Sprintf("La clave %s no tiene todas las columnas del índice", indexKey.ToString()))
 	}
+	return tree.comparator.Encode(indexKey)
+}
+
+// insert hace un intento de Insert. Es false si no pudo tomar una hoja vecina, sin haber
+// cambiado nada.
+func (tree *BPTree) insert(entry []byte, value uint64) bool {
+	ctx := tree.newWriteContext()
+	defer ctx.releaseAll()
+
+	n := ctx.push(tree.RootPageID)
+	for {
+		if tree.safeForInsert(n) {
+			ctx.releaseAncestors()
+		}
+		if n.node.PageType == page.LeafPage {
+			break
+		}
+		n = ctx.push(n.node.Children[tree.findUpperIndex(n.node.Keys, entry)])
+	}
+
+	if len(n.node.Keys) < tree.maxLeafKeys {
+		tree.insertIntoLeaf(n, entry, value)
+		return true
+	}
+
+	// La hoja se divide y la que le sigue va a apuntar hacia atrás a la nueva
+	var next *latchedNode
+	if n.node.NextLeaf != common.InvalidPageID {
+		var ok bool
+		if next, ok = ctx.tryLatch(n.node.NextLeaf); !ok {
+			return false
+		}
+	}
+	tree.splitLeaf(ctx, entry, value, next)
+	return true
 }
 
 // insertIntoLeaf inserta una clave-valor en una página hoja
-func (tree *BPTree) insertIntoLeaf(nodePage *page.BTreePage, key int, value uint64) {
-	index := tree.findIndex(nodePage.Keys, key)
-	nodePage.Keys = append(nodePage.Keys[:index], append([]int{key}, nodePage.Keys[index:]...)...)
+func (tree *BPTree) insertIntoLeaf(leaf *latchedNode, entry []byte, value uint64) {
+	nodePage := leaf.node
+	index := tree.findIndex(nodePage.Keys, entry)
+	nodePage.Keys = append(nodePage.Keys[:index], append([][]byte{entry}, nodePage.Keys[index:]...)...)
 	nodePage.Values = append(nodePage.Values[:index], append([]uint64{value}, nodePage.Values[index:]...)...)
-	data, err := nodePage.Serialize()
-	if err != nil {
-		panic(fmt.Sprintf("Error serializing BTreePage: %v", err))
-	}
-	// fmt.Printf("Inserting to leaf.......\n")
-	// fmt.Printf("Node: %v\n", nodePage)
-	tree.bufferPoolManager.WriteDataToPageAndPin(nodePage.PageID, data)
-	tree.bufferPoolManager.UnpinPage(nodePage.PageID, true)
-	tree.bufferPoolManager.UnpinPage(nodePage.PageID, true)
+	leaf.dirty = true
 }
 
-// splitNode maneja el desbordamiento de un nodo
-func (tree *BPTree) splitNode(nodePage *page.BTreePage, key int, value uint64) {
-	newPage := tree.createPage(nodePage.PageType)
-	if newPage == nil {
-		panic("(2) No se pudo crear una nueva página")
-	}
+// splitLeaf maneja el desbordamiento de la hoja al final del camino
+func (tree *BPTree) splitLeaf(ctx *writeContext, entry []byte, value uint64, next *latchedNode) {
+	level := len(ctx.path) - 1
+	leaf := ctx.path[level]
+	nodePage := leaf.node
+	newLeaf := ctx.newNode(page.LeafPage)
+	newPage := newLeaf.node
 
-	index := tree.findIndex(nodePage.Keys, key)
-	allKeys := append(nodePage.Keys[:index], append([]int{key}, nodePage.Keys[index:]...)...)
+	index := tree.findIndex(nodePage.Keys, entry)
+	allKeys := append(nodePage.Keys[:index], append([][]byte{entry}, nodePage.Keys[index:]...)...)
 	allValues := append(nodePage.Values[:index], append([]uint64{value}, nodePage.Values[index:]...)...)
 	midIndex := len(allKeys) / 2
 
 	newPage.Keys = append(newPage.Keys, allKeys[midIndex:]...)
 	newPage.Values = append(newPage.Values, allValues[midIndex:]...)
-	// newPage.Children = append(newPage.Children, nodePage.PageID)
-
 	nodePage.Keys = allKeys[:midIndex]
 	nodePage.Values = allValues[:midIndex]
-	nodePage.Children = append(nodePage.Children, newPage.PageID)
-
-	// fmt.Printf("Splitting.......\n")
-	// fmt.Printf("newpage: %v - nodepage: %v\n", newPage, nodePage)
-
-	data1, _ := nodePage.Serialize()
-	data2, _ := newPage.Serialize()
 
-	tree.updateParentNode(nodePage, newPage, newPage.Keys[0])
+	// La nueva hoja queda entre nodePage y la hoja que le seguía
+	newPage.PrevLeaf = nodePage.PageID
+	newPage.NextLeaf = nodePage.NextLeaf
+	nodePage.NextLeaf = newPage.PageID
+	if next != nil {
+		next.node.PrevLeaf = newPage.PageID
+		next.dirty = true
+	}
+	leaf.dirty = true
 
-	tree.bufferPoolManager.WriteDataToPageAndPin(nodePage.PageID, data1)
-	tree.bufferPoolManager.WriteDataToPageAndPin(newPage.PageID, data2)
-	tree.bufferPoolManager.UnpinPage(nodePage.PageID, true)
-	tree.bufferPoolManager.UnpinPage(newPage.PageID, true)
-	tree.bufferPoolManager.UnpinPage(nodePage.PageID, true)
-	tree.bufferPoolManager.UnpinPage(newPage.PageID, true)
+	tree.insertIntoParent(ctx, level, newLeaf, newPage.Keys[0])
 }
 
-// splitInternal divide el parent y ahonda el arbol un nivel más
-func (tree *BPTree) splitInternal(oldNode *page.BTreePage) {
-	newInternalPage := tree.createPage(page.InternalPage)
-	if newInternalPage == nil {
-		panic("Failed to create a new internal page")
-	}
+// splitInternal divide el nodo interno ctx.path[level] y sube la clave del medio al padre
+func (tree *BPTree) splitInternal(ctx *writeContext, level int) {
+	oldNode := ctx.path[level].node
+	newInternal := ctx.newNode(page.InternalPage)
+	newInternalPage := newInternal.node
 
 	midIndex := len(oldNode.Keys) / 2
 
@@ -196,168 +369,314 @@ func (tree *BPTree) splitInternal(oldNode *page.BTreePage) {
 	// Update the old node to keep keys and children up to but not including the middle index
 	oldNode.Keys = oldNode.Keys[:midIndex]
 	oldNode.Children = oldNode.Children[:midIndex+1]
+	ctx.path[level].dirty = true
 
-	// fmt.Printf("Splitting internal node.......\n")
-	// fmt.Printf("newInternalPage: %v\n", newInternalPage)
-	// fmt.Printf("oldNode: %v\n", oldNode)
+	// Update the parent node after splitting
+	tree.insertIntoParent(ctx, level, newInternal, promotedKey)
+}
 
-	// Serialize and write data to pages
-	data1, _ := oldNode.Serialize()
-	data2, _ := newInternalPage.Serialize()
+// insertIntoParent agrega newNode (y su clave) al padre de ctx.path[level] después de una
+// división. El padre está en el camino porque el nodo que se dividió no era seguro.
+func (tree *BPTree) insertIntoParent(ctx *writeContext, level int, newNode *latchedNode, promotedKey []byte) {
+	oldNode := ctx.path[level]
+	if level == 0 {
+		if !oldNode.isRoot {
+			panic(fmt.Sprintf("La página %s se dividió sin tener a su padre", oldNode.node.PageID.ToString()))
+		}
 
-	tree.bufferPoolManager.WriteDataToPageAndPin(oldNode.PageID, data1)
-	tree.bufferPoolManager.WriteDataToPageAndPin(newInternalPage.PageID, data2)
+		// El árbol crece un nivel
+		newRoot := ctx.newNode(page.InternalPage)
+		newRoot.node.Keys = append(newRoot.node.Keys, promotedKey)
+		newRoot.node.Children = append(newRoot.node.Children, oldNode.node.PageID, newNode.node.PageID)
+		tree.RootPageID = newRoot.node.PageID
+		return
+	}
 
-	tree.bufferPoolManager.UnpinPage(oldNode.PageID, true)
-	tree.bufferPoolManager.UnpinPage(newInternalPage.PageID, true)
-	tree.bufferPoolManager.UnpinPage(oldNode.PageID, true)
-	tree.bufferPoolManager.UnpinPage(newInternalPage.PageID, true)
+	parent := ctx.path[level-1]
+	parentPage := parent.node
+	index := childIndexOf(parentPage, oldNode.node.PageID)
 
-	// Update the parent node after splitting
-	tree.updateParentNode(oldNode, newInternalPage, promotedKey)
+	parentPage.Keys = append(parentPage.Keys[:index], append([][]byte{promotedKey}, parentPage.Keys[index:]...)...)
+	parentPage.Children = append(parentPage.Children[:index+1], append([]common.PageID_t{newNode.node.PageID}, parentPage.Children[index+1:]...)...)
+	parent.dirty = true
+
+	if len(parentPage.Keys) > tree.maxInternalKeys {
+		tree.splitInternal(ctx, level-1)
+	}
 }
 
-// updateParentNode actualiza el nodo padre después de una división
-func (tree *BPTree) updateParentNode(oldNode *page.BTreePage, newNode *page.BTreePage, promotedKey int) {
-	// promotedKey := newNode.Keys[0]
-	// fmt.Printf("PROMOTED KEY: %v", promotedKey)
-	if oldNode.PageID == tree.RootPageID {
-		newRootPage := tree.createPage(page.InternalPage)
-		if newRootPage == nil {
-			panic("(3) No se pudo crear una nueva página raíz")
+// childIndexOf retorna la posición de childID entre los hijos de parent
+func childIndexOf(parent *page.BTreePage, childID common.PageID_t) int {
+	for index, id := range parent.Children {
+		if id == childID {
+			return index
 		}
+	}
+	panic(fmt.Sprintf("La página %s no está entre los hijos de su padre %s", childID.ToString(), parent.PageID.ToString()))
+}
 
-		newRootPage.Keys = append(newRootPage.Keys, promotedKey)
-		// newRootPage.Values = append(newRootPage.Values, oldNode.Values...)
-		newRootPage.Children = append(newRootPage.Children, oldNode.PageID, newNode.PageID)
-
-		// fmt.Printf("TESTING THIS: %v", len(newRootPage.Keys))
-		if len(newRootPage.Keys) > numberNodes {
-			tree.splitInternal(newRootPage)
-		}
+// Search busca una clave en el B+ Tree. Si es un prefijo, retorna la primera que empiece así.
+func (tree *BPTree) Search(indexKey IndexKey) (uint64, bool) {
+	iterator := NewIndexIterator(tree)
+	defer iterator.Close()
+	iterator.Seek(indexKey)
+	key, value, ok := iterator.Next()
+	if !ok || tree.Compare(key, indexKey) != 0 {
+		return 0, false
+	}
+	return value, true
+}
 
-		// fmt.Printf("newrootpage: %v\n", newRootPage)
+// findLeaf baja hasta la primera hoja que puede tener la clave. Si la clave se repite se va
+// por la izquierda, las demás están en las hojas que le siguen.
+func (tree *BPTree) findLeaf(key []byte) *buffer.ReadPageGuard {
+	return tree.descend(key, tree.findIndex)
+}
 
-		tree.RootPageID = newRootPage.PageID
-		data, err := newRootPage.Serialize()
-		if err != nil {
-			panic(fmt.Sprintf("Error serializing BTreePage: %v", err))
-		}
-		tree.bufferPoolManager.WriteDataToPageAndPin(newRootPage.PageID, data)
-		tree.bufferPoolManager.UnpinPage(newRootPage.PageID, true)
-		// tree.bufferPoolManager.UnpinPage(newRootPage.PageID, true)
-	} else {
-		parentPageID := tree.findParent(oldNode.PageID)
-		parentPage := tree.getPage(parentPageID)
-		// fmt.Printf("IDK why is this working:")
-		index := tree.findIndex(parentPage.Keys, promotedKey)
+// findLastLeaf baja hasta la última hoja que puede tener la clave, la que la sigue ya solo
+// tiene claves mayores
+func (tree *BPTree) findLastLeaf(key []byte) *buffer.ReadPageGuard {
+	return tree.descend(key, tree.findUpperIndex)
+}
 
-		parentPage.Keys = append(parentPage.Keys[:index], append([]int{promotedKey}, parentPage.Keys[index:]...)...)
-		parentPage.Children = append(parentPage.Children[:index+1], append([]common.PageID_t{newNode.PageID}, parentPage.Children[index+1:]...)...)
+// descend baja con latches de lectura hasta una hoja, eligiendo en cada nodo el hijo con
+// childIndex. Retorna la hoja con su latch de lectura tomado.
+func (tree *BPTree) descend(key []byte, childIndex func(keys [][]byte, key []byte) int) *buffer.ReadPageGuard {
+	tree.rootLatch.RLock()
+	guard := tree.fetchRead(tree.RootPageID)
+	tree.rootLatch.RUnlock()
 
-		// fmt.Printf("TESTING THIS IN A PARENT NOT A ROOT: %v", len(parentPage.Keys))
-		if len(parentPage.Keys) > numberNodes {
-			tree.splitInternal(parentPage)
+	for {
+		nodePage := readNode(guard.Data())
+		if nodePage.PageType == page.LeafPage {
+			return guard
 		}
+		child := tree.fetchRead(nodePage.Children[childIndex(nodePage.Keys, key)])
+		guard.Drop()
+		guard = child
+	}
+}
 
-		data, err := parentPage.Serialize()
-		if err != nil {
-			panic(fmt.Sprintf("Error serializing BTreePage: %v", err))
+// Delete quita el par clave-valor del B+ Tree. Retorna false si no lo encontró. La clave
+// debe tener todas las columnas.
+// Si la hoja queda con muy pocas claves le pide prestado a un hermano o se fusiona con él.
+func (tree *BPTree) Delete(indexKey IndexKey, value uint64) bool {
+	entry := tree.entry(tree.encodeFullKey(indexKey), value)
+	for {
+		if deleted, done := tree.delete(entry); done {
+			return deleted
 		}
-		// fmt.Printf("newpage: %v %v\n", parentPage.Keys, parentPage.Children)
+		runtime.Gosched()
+	}
+}
+
+// delete hace un intento de Delete. done es false si no pudo tomar un hermano o una hoja
+// vecina, sin haber cambiado nada.
+func (tree *BPTree) delete(entry []byte) (deleted bool, done bool) {
+	ctx := tree.newWriteContext()
+	defer ctx.releaseAll()
 
-		// JEJEJEJEJEJEJJEEJJEJEJEJEJEJEJJEJEJEJEJEJEJEJEJEJJEJEJEJEJEJEJEJEJEJJEJEJEJEJEJEJEJJEJEJEJEJEJJEJEJEJEJJEJEJE
-		if len(parentPage.Keys) > numberNodes {
-			tree.splitNode(parentPage, parentPage.Keys[len(parentPage.Keys)/2], 0) // No value needed for internal split
+	n := ctx.push(tree.RootPageID)
+	for {
+		if tree.safeForDelete(n) {
+			ctx.releaseAncestors()
 		}
+		if n.node.PageType == page.LeafPage {
+			break
+		}
+		n = ctx.push(n.node.Children[tree.findUpperIndex(n.node.Keys, entry)])
+	}
 
-		tree.bufferPoolManager.WriteDataToPageAndPin(parentPage.PageID, data)
-		tree.bufferPoolManager.UnpinPage(parentPage.PageID, true)
-		tree.bufferPoolManager.UnpinPage(parentPage.PageID, true)
+	leafPage := n.node
+	i := tree.findIndex(leafPage.Keys, entry)
+	if i == len(leafPage.Keys) || tree.compare(leafPage.Keys[i], entry) != 0 {
+		return false, true
 	}
+	if !tree.safeForDelete(n) && !tree.latchNeighbours(ctx) {
+		return false, false
+	}
+
+	leafPage.Keys = append(leafPage.Keys[:i], leafPage.Keys[i+1:]...)
+	leafPage.Values = append(leafPage.Values[:i], leafPage.Values[i+1:]...)
+	n.dirty = true
+	tree.rebalance(ctx, len(ctx.path)-1)
+	return true, true
 }
 
-// findParent encuentra el ID de la página padre de un nodo dado
-func (tree *BPTree) findParent(childPageID common.PageID_t) common.PageID_t {
-	return tree.searchParent(tree.RootPageID, childPageID)
+// latchNeighbours toma todo lo que puede necesitar rebalance antes de que se cambie algo: los
+// hermanos de cada nodo del camino que puede quedar con muy pocas claves, y las hojas que
+// siguen a la hoja y a su hermana derecha, cuyo enlace hacia atrás cambia si una desaparece
+// en una fusión. Es false si alguna estaba tomada.
+func (tree *BPTree) latchNeighbours(ctx *writeContext) bool {
+	// Todos los nodos del camino menos el primero son inseguros, si no ya se habrían soltado
+	// sus ancestros
+	for level := len(ctx.path) - 1; level > 0; level-- {
+		parentPage := ctx.path[level-1].node
+		index := childIndexOf(parentPage, ctx.path[level].node.PageID)
+		if index > 0 {
+			if _, ok := ctx.tryLatch(parentPage.Children[index-1]); !ok {
+				return false
+			}
+		}
+		if index < len(parentPage.Children)-1 {
+			if _, ok := ctx.tryLatch(parentPage.Children[index+1]); !ok {
+				return false
+			}
+		}
+	}
+
+	leaf := ctx.path[len(ctx.path)-1].node
+	for pageID, i := leaf.NextLeaf, 0; pageID != common.InvalidPageID && i < 2; i++ {
+		next, ok := ctx.tryLatch(pageID)
+		if !ok {
+			return false
+		}
+		pageID = next.node.NextLeaf
+	}
+	return true
 }
 
-// searchParent busca recursivamente el nodo padre de un nodo dado
-func (tree *BPTree) searchParent(currentPageID, targetPageID common.PageID_t) common.PageID_t {
-	currentPage := tree.getPage(currentPageID)
-	if currentPage == nil {
-		return common.InvalidPageID
+// rebalance arregla el nodo ctx.path[level] si quedó con menos claves del mínimo después de
+// un borrado. Sus hermanos ya los tomó latchNeighbours.
+func (tree *BPTree) rebalance(ctx *writeContext, level int) {
+	n := ctx.path[level]
+	node := n.node
+	if n.isRoot {
+		// La raíz puede quedar casi vacía, pero si es interna y le queda un solo hijo, ese
+		// hijo pasa a ser la raíz
+		if node.PageType == page.InternalPage && len(node.Keys) == 0 && len(node.Children) == 1 {
+			tree.RootPageID = node.Children[0]
+			ctx.free(n)
+		}
+		return
 	}
 
-	if currentPage.PageType == page.LeafPage {
-		return common.InvalidPageID
+	minKeys := tree.minLeafKeys
+	if node.PageType == page.InternalPage {
+		minKeys = tree.minInternalKeys
 	}
+	if len(node.Keys) >= minKeys {
+		return
+	}
+
+	parent := ctx.path[level-1]
+	index := childIndexOf(parent.node, node.PageID)
 
-	for _, childID := range currentPage.Children {
-		if childID == targetPageID {
-			return currentPageID
+	// Primero intentamos pedir prestado a un hermano que tenga claves de sobra
+	var left, right *latchedNode
+	if index > 0 {
+		left = ctx.nodes[parent.node.Children[index-1]]
+		if len(left.node.Keys) > minKeys {
+			tree.borrowFromLeft(n, left, parent, index)
+			return
 		}
-		childPage := tree.getPage(childID)
-		if childPage != nil && childPage.PageType == page.InternalPage {
-			parentID := tree.searchParent(childID, targetPageID)
-			if parentID != common.InvalidPageID {
-				return parentID
-			}
+	}
+	if index < len(parent.node.Children)-1 {
+		right = ctx.nodes[parent.node.Children[index+1]]
+		if len(right.node.Keys) > minKeys {
+			tree.borrowFromRight(n, right, parent, index)
+			return
 		}
 	}
-	return common.InvalidPageID
-}
 
-// Search busca una clave en el B+ Tree
-func (tree *BPTree) Search(key int) (uint64, bool) {
-	return tree.searchNode(tree.RootPageID, key)
+	// Si ninguno puede, nos fusionamos con uno de ellos y el padre pierde una clave
+	if left != nil {
+		tree.merge(ctx, left, n, parent, index-1)
+	} else {
+		tree.merge(ctx, n, right, parent, index)
+	}
+	tree.rebalance(ctx, level-1)
 }
 
-// searchNode busca una clave en un nodo específico del árbol B+
-func (tree *BPTree) searchNode(pageID common.PageID_t, key int) (uint64, bool) {
-	nodePage := tree.getPage(pageID)
-	if nodePage == nil {
-		return 0, false
+// borrowFromLeft pasa la última clave del hermano izquierdo al inicio de node
+func (tree *BPTree) borrowFromLeft(n, l, p *latchedNode, index int) {
+	node, left, parent := n.node, l.node, p.node
+	last := len(left.Keys) - 1
+	if node.PageType == page.LeafPage {
+		node.Keys = append([][]byte{left.Keys[last]}, node.Keys...)
+		node.Values = append([]uint64{left.Values[last]}, node.Values...)
+		left.Keys = left.Keys[:last]
+		left.Values = left.Values[:last]
+		parent.Keys[index-1] = node.Keys[0]
+	} else {
+		// En los nodos internos la clave del padre baja y la del hermano sube
+		movedChild := left.Children[last+1]
+		node.Keys = append([][]byte{parent.Keys[index-1]}, node.Keys...)
+		node.Children = append([]common.PageID_t{movedChild}, node.Children...)
+		parent.Keys[index-1] = left.Keys[last]
+		left.Keys = left.Keys[:last]
+		left.Children = left.Children[:last+1]
 	}
+	n.dirty, l.dirty, p.dirty = true, true, true
+}
 
-	// Iterar sobre las claves del nodo para encontrar el índice adecuado
-	index := 0
-	for ; index < len(nodePage.Keys); index++ {
-		if key <= nodePage.Keys[index] {
-			break
-		}
+// borrowFromRight pasa la primera clave del hermano derecho al final de node
+func (tree *BPTree) borrowFromRight(n, r, p *latchedNode, index int) {
+	node, right, parent := n.node, r.node, p.node
+	if node.PageType == page.LeafPage {
+		node.Keys = append(node.Keys, right.Keys[0])
+		node.Values = append(node.Values, right.Values[0])
+		right.Keys = right.Keys[1:]
+		right.Values = right.Values[1:]
+		parent.Keys[index] = right.Keys[0]
+	} else {
+		movedChild := right.Children[0]
+		node.Keys = append(node.Keys, parent.Keys[index])
+		node.Children = append(node.Children, movedChild)
+		parent.Keys[index] = right.Keys[0]
+		right.Keys = right.Keys[1:]
+		right.Children = right.Children[1:]
 	}
+	n.dirty, r.dirty, p.dirty = true, true, true
+}
 
-	// fmt.Printf("Looking in the node %v at index %v\n\n", nodePage, index)
-
-	// Verificar si estamos en una hoja y si la clave está presente
-	if nodePage.PageType == page.LeafPage {
-		// fmt.Printf("index: %v, nodePageKeys: %v\n", index, nodePage.Keys)
-		if index < len(nodePage.Keys) && nodePage.Keys[index] == key {
-			return nodePage.Values[index], true
+// merge junta right dentro de left, que son hijos consecutivos de parent separados por
+// parent.Keys[sepIndex]. La página de right queda libre para un nodo nuevo; si un
+// IndexIterator todavía está en ella, al volver a leerla baja de nuevo desde la raíz.
+func (tree *BPTree) merge(ctx *writeContext, l, r, p *latchedNode, sepIndex int) {
+	left, right, parent := l.node, r.node, p.node
+	if left.PageType == page.LeafPage {
+		left.Keys = append(left.Keys, right.Keys...)
+		left.Values = append(left.Values, right.Values...)
+		left.NextLeaf = right.NextLeaf
+		if left.NextLeaf != common.InvalidPageID {
+			next := ctx.nodes[left.NextLeaf]
+			next.node.PrevLeaf = left.PageID
+			next.dirty = true
 		}
-		return 0, false
+	} else {
+		left.Keys = append(append(left.Keys, parent.Keys[sepIndex]), right.Keys...)
+		left.Children = append(left.Children, right.Children...)
 	}
 
-	// Si la clave está en una página interna (nodo interno), debemos ajustar el índice
-	if index < len(nodePage.Keys) && nodePage.Keys[index] == key {
-		// La clave está en el nodo interno, pero necesitamos encontrar su posición real en la página hoja
-		index++ // Avanzamos al siguiente índice para ir al hijo correcto
-	}
+	ctx.free(r)
 
-	// Recursivamente buscar en el hijo correspondiente
-	childPageID := nodePage.Children[index]
-	tree.bufferPoolManager.UnpinPage(pageID, false)
-	return tree.searchNode(childPageID, key)
+	parent.Keys = append(parent.Keys[:sepIndex], parent.Keys[sepIndex+1:]...)
+	parent.Children = append(parent.Children[:sepIndex+1], parent.Children[sepIndex+2:]...)
+	l.dirty, r.dirty, p.dirty = true, true, true
 }
 
 // findIndex encuentra el índice donde debería estar la clave en un slice ordenado de claves
-func (tree *BPTree) findIndex(keys []int, key int) int {
+func (tree *BPTree) findIndex(keys [][]byte, key []byte) int {
 	// Búsqueda binaria
 	low, high := 0, len(keys)
 	for low < high {
 		mid := low + (high-low)/2
-		if keys[mid] < key {
+		if tree.compare(keys[mid], key) < 0 {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+	return low
+}
+
+// findUpperIndex encuentra el índice de la primera clave mayor a la dada
+func (tree *BPTree) findUpperIndex(keys [][]byte, key []byte) int {
+	low, high := 0, len(keys)
+	for low < high {
+		mid := low + (high-low)/2
+		if tree.compare(keys[mid], key) <= 0 {
 			low = mid + 1
 		} else {
 			high = mid
@@ -366,16 +685,22 @@ func (tree *BPTree) findIndex(keys []int, key int) int {
 	return low
 }
 
+// Compare ordena dos claves (o prefijos) como lo hace el árbol
+func (tree *BPTree) Compare(a, b IndexKey) int {
+	return tree.comparator.Compare(tree.comparator.Encode(a), tree.comparator.Encode(b))
+}
+
 // PrintTree imprime el árbol B+ a través de un recorrido BFS
 func (tree *BPTree) PrintTree() {
 	// fmt.Println("Printing B+ Tree:")
 
-	if tree.RootPageID == common.InvalidPageID {
+	root := tree.Root()
+	if root == common.InvalidPageID {
 		// fmt.Println("Empty tree")
 		return
 	}
 
-	queue := []common.PageID_t{tree.RootPageID}
+	queue := []common.PageID_t{root}
 	levelSizes := []int{1}
 
 	for len(queue) > 0 {
@@ -397,8 +722,6 @@ func (tree *BPTree) PrintTree() {
 			if nodePage.PageType == page.InternalPage {
 				nextLevel = append(nextLevel, nodePage.Children...)
 			}
-
-			tree.bufferPoolManager.UnpinPage(nodePage.PageID, false)
 		}
 
 		if len(nextLevel) > 0 {
@@ -408,67 +731,23 @@ func (tree *BPTree) PrintTree() {
 	}
 }
 
-// RangeSearch busca un rango de claves en el B+ Tree
-func (tree *BPTree) RangeSearch(startKey int, endKey int, currentPageID common.PageID_t) ([]int, []uint64) {
-	var keys []int
+// RangeSearch busca las claves entre startKey y endKey (ambas incluidas) en el B+ Tree.
+// Los extremos pueden ser prefijos, y una clave vacía deja ese lado del rango abierto.
+// Junta todo en memoria, para recorrer un rango de a pocos está IndexIterator.
+func (tree *BPTree) RangeSearch(startKey IndexKey, endKey IndexKey) ([]IndexKey, []uint64) {
+	var keys []IndexKey
 	var values []uint64
-	found := false
 
-	// Find the starting node
-	// currentPageID := tree.RootPageID
+	iterator := NewIndexIterator(tree)
+	defer iterator.Close()
+	iterator.Seek(startKey)
 	for {
-		nodePage := tree.getPage(currentPageID)
-		if nodePage == nil {
-			fmt.Printf("No hay page, %v", currentPageID)
-			return nil, nil
-		}
-
-		if nodePage.PageType == page.LeafPage {
-			// Add all keys and values in range
-			for i, key := range nodePage.Keys {
-				if key >= startKey && key < endKey {
-					// fmt.Printf("Appending keys and values..... %v - %v\n", key, nodePage.Values[i])
-					keys = append(keys, key)
-					values = append(values, nodePage.Values[i])
-				} else if key == endKey {
-					keys = append(keys, key)
-					values = append(values, nodePage.Values[i])
-					found = true
-					break
-				}
-			}
-
-			if found {
-				// fmt.Printf("FOUND IS TRUE\n")
-				tree.bufferPoolManager.UnpinPage(nodePage.PageID, false)
-				break
-			}
-			// Move to the next leaf node
-			if len(nodePage.Children) != 0 {
-				// fmt.Printf("Going to next leaf node.... %v\n", nodePage.Children[0])
-				currentPageID = nodePage.Children[0]
-				tree.bufferPoolManager.UnpinPage(nodePage.PageID, false)
-			} else {
-				tree.bufferPoolManager.UnpinPage(nodePage.PageID, false)
-				break
-			}
-		} else {
-			// Find the appropriate child node
-			// fmt.Printf("Looking for the appropiate child node....\n")
-			index := 0
-			for index < len(nodePage.Keys) && startKey > nodePage.Keys[index] {
-				index++
-			}
-			if index < len(nodePage.Keys) && startKey <= nodePage.Keys[index] {
-				// fmt.Printf("Looking in: %v\n", nodePage.Children[index])
-				currentPageID = nodePage.Children[index]
-			} else {
-				// fmt.Printf("Looking in: %v\n", nodePage.Children[len(nodePage.Children)-1])
-				currentPageID = nodePage.Children[len(nodePage.Children)-1]
-			}
-			tree.bufferPoolManager.UnpinPage(nodePage.PageID, false)
+		key, value, ok := iterator.Next()
+		if !ok || tree.Compare(key, endKey) > 0 {
+			break
 		}
+		keys = append(keys, key)
+		values = append(values, value)
 	}
-
 	return keys, values
 }
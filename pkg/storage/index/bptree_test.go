@@ -3,13 +3,35 @@ package storage
 import (
 	"fisi/elenadb/pkg/buffer"
 	"fisi/elenadb/pkg/catalog"
+	"fisi/elenadb/pkg/catalog/column"
+	"fisi/elenadb/pkg/catalog/schema"
 	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/storage/page"
+	"fisi/elenadb/pkg/storage/table/value"
 	"fmt"
+	"math/rand"
 	"os"
+	"sync"
 	"testing"
 	"time"
 )
 
+// Casi todas las pruebas usan claves de una sola columna int
+var intKeySchema = schema.NewSchema([]column.Column{column.NewColumn(value.TypeInt32, "key")})
+
+func intKey(key int) IndexKey {
+	return IndexKey{*value.NewInt32Value(int32(key))}
+}
+
+func newIntBPTree(t *testing.T, bpm *buffer.BufferPoolManager, fileId common.FileID_t) *BPTree {
+	t.Helper()
+	bptree, err := NewBPTree(bpm, fileId, intKeySchema)
+	if err != nil {
+		t.Fatalf("No se pudo crear el B+ Tree: %s", err)
+	}
+	return bptree
+}
+
 func TestRangeSearch(t *testing.T) {
 	// Inicializa el DiskManager
 	db_dir := "db.elena/"
@@ -26,17 +48,17 @@ func TestRangeSearch(t *testing.T) {
 	catalogFileId := common.FileID_t(0)
 
 	// Inicializa el B+ Tree con el Buffer Pool Manager
-	bptree := NewBPTree(bpm, catalogFileId)
+	bptree := newIntBPTree(t, bpm, catalogFileId)
 
 	const large = 60000
 	key := 1
 	for ; key < large; key++ {
-		bptree.Insert(key, uint64(key))
+		bptree.Insert(intKey(key), uint64(key))
 		// bptree.PrintTree()
 	}
 
 	// bptree.PrintTree()
-	keys, values := bptree.RangeSearch(2576, 2576, 0)
+	keys, values := bptree.RangeSearch(intKey(2576), intKey(2576))
 
 	fmt.Printf("Keys: %v", keys)
 	fmt.Printf("Values: %v", values)
@@ -47,7 +69,9 @@ func TestIntegrationWithBufferpool(t *testing.T) {
 	// Inicializa el DiskManager
 	db_dir := "db.elena/"
 	common.GloablDbDir = db_dir
-	buffer_pool_size := 3
+	// Una inserción que divide hasta la raíz tiene fijadas a la vez su camino (3 niveles), la
+	// hoja siguiente y las 3 páginas nuevas
+	buffer_pool_size := 8
 	k := 5
 
 	os.MkdirAll(db_dir, os.ModePerm)
@@ -58,12 +82,12 @@ func TestIntegrationWithBufferpool(t *testing.T) {
 	catalogFileId := common.FileID_t(0)
 
 	// Inicializa el B+ Tree con el Buffer Pool Manager
-	bptree := NewBPTree(bpm, catalogFileId)
+	bptree := newIntBPTree(t, bpm, catalogFileId)
 
 	const large = 60000
 	key := 1
 	for ; key < large; key++ {
-		bptree.Insert(key, uint64(key))
+		bptree.Insert(intKey(key), uint64(key))
 		// bptree.PrintTree()
 	}
 	// bufferPoolManager.FlushEntirePool()
@@ -71,7 +95,7 @@ func TestIntegrationWithBufferpool(t *testing.T) {
 	// Verifica que las claves y valores se hayan insertado correctamente
 	keyIterator := 1
 	for ; keyIterator < large; keyIterator++ {
-		value, found := bptree.Search(keyIterator)
+		value, found := bptree.Search(intKey(keyIterator))
 		if !found {
 			t.Errorf("Clave %d no encontrada en el B+ Tree", keyIterator)
 		}
@@ -101,19 +125,19 @@ func TestEmpiricalAnalysis(t *testing.T) {
 	fmt.Println("Data Size,Insert Time (ms),Search Time (ms),Range Search Time (ms)")
 
 	for _, size := range dataSizes {
-		bptree := NewBPTree(bpm, catalogFileId)
+		bptree := newIntBPTree(t, bpm, catalogFileId)
 
 		// Measure insert time
 		startInsert := time.Now()
 		for i := 1; i <= size; i++ {
-			bptree.Insert(i, uint64(i))
+			bptree.Insert(intKey(i), uint64(i))
 		}
 		insertTime := time.Since(startInsert)
 
 		// Measure search time
 		startSearch := time.Now()
 		for i := 1; i <= size; i++ {
-			_, found := bptree.Search(i)
+			_, found := bptree.Search(intKey(i))
 			if !found {
 				t.Errorf("Key %d not found in B+ Tree", i)
 			}
@@ -124,7 +148,7 @@ func TestEmpiricalAnalysis(t *testing.T) {
 		startRangeSearch := time.Now()
 		lowerBound := 1
 		upperBound := size
-		keys, _ := bptree.RangeSearch(lowerBound, upperBound, bptree.RootPageID)
+		keys, _ := bptree.RangeSearch(intKey(lowerBound), intKey(upperBound))
 		rangeSearchTime := time.Since(startRangeSearch)
 
 		if len(keys) != upperBound-lowerBound+1 {
@@ -138,3 +162,699 @@ func TestEmpiricalAnalysis(t *testing.T) {
 			float64(rangeSearchTime.Milliseconds()))
 	}
 }
+
+func TestDelete(t *testing.T) {
+	db_dir := "db.elena/"
+	common.GloablDbDir = db_dir
+	buffer_pool_size := 50
+	k := 5
+
+	os.MkdirAll(db_dir, os.ModePerm)
+	os.Create(db_dir + "elena_meta.table")
+	defer os.RemoveAll(db_dir)
+
+	bpm := buffer.NewBufferPoolManager(db_dir, uint32(buffer_pool_size), k, catalog.EmptyCatalog())
+	bptree := newIntBPTree(t, bpm, common.FileID_t(0))
+
+	const large = 2000
+	for key := 1; key <= large; key++ {
+		bptree.Insert(intKey(key), uint64(key))
+	}
+
+	// Borramos las claves pares
+	for key := 2; key <= large; key += 2 {
+		if !bptree.Delete(intKey(key), uint64(key)) {
+			t.Fatalf("Clave %d no pudo ser borrada", key)
+		}
+	}
+
+	if bptree.Delete(intKey(2), 2) {
+		t.Fatalf("Clave 2 fue borrada dos veces")
+	}
+	if bptree.Delete(intKey(3), 4) {
+		t.Fatalf("Clave 3 fue borrada con un valor que no le corresponde")
+	}
+
+	for key := 1; key <= large; key++ {
+		_, found := bptree.Search(intKey(key))
+		if found != (key%2 == 1) {
+			t.Errorf("Clave %d: se esperaba found=%v", key, key%2 == 1)
+		}
+	}
+
+	keys, _ := bptree.RangeSearch(intKey(1), intKey(large))
+	if len(keys) != large/2 {
+		t.Errorf("RangeSearch retornó %d claves, se esperaban %d", len(keys), large/2)
+	}
+}
+
+// checkTree revisa que las claves de cada hijo estén entre las de su padre, que las hojas estén
+// todas en el último nivel, que los nodos (salvo la raíz) no tengan menos claves del mínimo y
+// que las hojas, encadenadas en ambos sentidos, tengan las entradas en orden.
+// Retorna la cantidad de claves y de niveles del árbol.
+func checkTree(t *testing.T, bptree *BPTree) (int, int) {
+	t.Helper()
+
+	// Cada nodo se revisa con el rango de entradas que le deja su padre: [low, high)
+	type bounded struct {
+		pageID    common.PageID_t
+		low, high []byte
+	}
+
+	var firstLeaf common.PageID_t = common.InvalidPageID
+	levels := 0
+	queue := []bounded{{pageID: bptree.RootPageID}}
+	for len(queue) > 0 {
+		levels++
+		var next []bounded
+		for _, item := range queue {
+			node := bptree.getPage(item.pageID)
+			if item.pageID != bptree.RootPageID {
+				minKeys := bptree.minLeafKeys
+				if node.PageType == page.InternalPage {
+					minKeys = bptree.minInternalKeys
+				}
+				if len(node.Keys) < minKeys {
+					t.Fatalf("La página %s tiene %d claves, el mínimo es %d", item.pageID.ToString(), len(node.Keys), minKeys)
+				}
+			}
+			for _, key := range node.Keys {
+				if (item.low != nil && bptree.compare(key, item.low) < 0) || (item.high != nil && bptree.compare(key, item.high) >= 0) {
+					t.Fatalf("La página %s tiene la clave %s fuera del rango de su padre",
+						item.pageID.ToString(), bptree.comparator.Decode(key).ToString())
+				}
+			}
+			if node.PageType == page.LeafPage {
+				if len(next) > 0 {
+					t.Fatalf("La hoja %s no está en el último nivel", item.pageID.ToString())
+				}
+				if firstLeaf == common.InvalidPageID {
+					firstLeaf = item.pageID
+				}
+				continue
+			}
+			for i, childID := range node.Children {
+				child := bounded{pageID: childID, low: item.low, high: item.high}
+				if i > 0 {
+					child.low = node.Keys[i-1]
+				}
+				if i < len(node.Keys) {
+					child.high = node.Keys[i]
+				}
+				next = append(next, child)
+			}
+		}
+		queue = next
+	}
+
+	count := 0
+	var lastKey []byte
+	prevLeaf := common.InvalidPageID
+	for pageID := firstLeaf; pageID != common.InvalidPageID; {
+		leaf := bptree.getPage(pageID)
+		if leaf.PrevLeaf != prevLeaf {
+			t.Fatalf("La hoja %s apunta hacia atrás a %s, se esperaba %s", pageID.ToString(), leaf.PrevLeaf.ToString(), prevLeaf.ToString())
+		}
+		prevLeaf = pageID
+		for _, key := range leaf.Keys {
+			if lastKey != nil && bptree.compare(key, lastKey) <= 0 {
+				t.Fatalf("Las hojas no están en orden: %s después de %s",
+					bptree.comparator.Decode(key).ToString(), bptree.comparator.Decode(lastKey).ToString())
+			}
+			lastKey = key
+			count++
+		}
+		pageID = leaf.NextLeaf
+	}
+	return count, levels
+}
+
+func TestSiblingLinks(t *testing.T) {
+	db_dir := "db.elena/"
+	common.GloablDbDir = db_dir
+	buffer_pool_size := 50
+	k := 5
+
+	os.MkdirAll(db_dir, os.ModePerm)
+	os.Create(db_dir + "elena_meta.table")
+	defer os.RemoveAll(db_dir)
+
+	bpm := buffer.NewBufferPoolManager(db_dir, uint32(buffer_pool_size), k, catalog.EmptyCatalog())
+	bptree := newIntBPTree(t, bpm, common.FileID_t(0))
+
+	// Suficientes claves, en desorden y repetidas, para tener tres niveles
+	const large = 100000
+	for i := 0; i < large; i++ {
+		bptree.Insert(intKey((i*7919)%(large/2)), uint64(i))
+	}
+
+	count, levels := checkTree(t, bptree)
+	if levels < 3 {
+		t.Fatalf("Se esperaban al menos 3 niveles, hay %d", levels)
+	}
+	if count != large {
+		t.Fatalf("Las hojas encadenadas tienen %d claves, se esperaban %d", count, large)
+	}
+}
+
+// Inserta y borra al azar, comparando el árbol contra un map. Las claves llevan una columna de
+// relleno para que entren pocas por página y el árbol tenga varios niveles con pocas claves.
+func TestRandomizedDeleteAgainstMap(t *testing.T) {
+	db_dir := "db.elena/"
+	common.GloablDbDir = db_dir
+	buffer_pool_size := 50
+	k := 5
+
+	os.MkdirAll(db_dir, os.ModePerm)
+	os.Create(db_dir + "elena_meta.table")
+	defer os.RemoveAll(db_dir)
+
+	bpm := buffer.NewBufferPoolManager(db_dir, uint32(buffer_pool_size), k, catalog.EmptyCatalog())
+	keySchema := schema.NewSchema([]column.Column{
+		column.NewColumn(value.TypeInt32, "key"),
+		column.NewSizedColumn(value.TypeVarChar, "relleno", 255),
+	})
+	bptree, err := NewBPTree(bpm, common.FileID_t(0), keySchema)
+	if err != nil {
+		t.Fatalf("No se pudo crear el B+ Tree: %s", err)
+	}
+	wideKey := func(key int) IndexKey {
+		return IndexKey{*value.NewInt32Value(int32(key)), *value.NewVarCharValue("", 255)}
+	}
+
+	const keyRange = 1500
+	rng := rand.New(rand.NewSource(42))
+	// clave -> valores, las claves se repiten como en un índice no único
+	oracle := make(map[int]map[uint64]bool)
+	size := 0
+	nextValue := uint64(0)
+
+	checkAgainstOracle := func() int {
+		count, levels := checkTree(t, bptree)
+		if count != size {
+			t.Fatalf("El árbol tiene %d claves, el map tiene %d", count, size)
+		}
+		keys, values := bptree.RangeSearch(IndexKey{}, IndexKey{})
+		if len(keys) != size {
+			t.Fatalf("RangeSearch retornó %d claves, se esperaban %d", len(keys), size)
+		}
+		for i := range keys {
+			if !oracle[int(keys[i][0].AsInt32())][values[i]] {
+				t.Fatalf("El árbol tiene (%s, %d) que no está en el map", keys[i].ToString(), values[i])
+			}
+		}
+		for key := 0; key < keyRange; key++ {
+			_, found := bptree.Search(intKey(key))
+			if found != (len(oracle[key]) > 0) {
+				t.Fatalf("Search(%d) = %v, se esperaba %v", key, found, len(oracle[key]) > 0)
+			}
+		}
+		return levels
+	}
+
+	// Crece hasta cuatro niveles (así también se fusionan nodos internos), se encoge, vuelve a
+	// crecer y se vacía por completo
+	var grownPages common.APageID_t
+	for round, target := range []int{3000, 150, 2000, 0} {
+		for size != target {
+			if size < target && rng.Intn(4) != 0 || size == 0 {
+				key := rng.Intn(keyRange)
+				nextValue++
+				bptree.Insert(wideKey(key), nextValue)
+				if oracle[key] == nil {
+					oracle[key] = make(map[uint64]bool)
+				}
+				oracle[key][nextValue] = true
+				size++
+				continue
+			}
+
+			key := rng.Intn(keyRange)
+			if len(oracle[key]) == 0 {
+				if bptree.Delete(wideKey(key), 0) {
+					t.Fatalf("Se borró la clave %d que no existe", key)
+				}
+				continue
+			}
+			for value := range oracle[key] {
+				if !bptree.Delete(wideKey(key), value) {
+					t.Fatalf("No se pudo borrar (%d, %d)", key, value)
+				}
+				if bptree.Delete(wideKey(key), value) {
+					t.Fatalf("(%d, %d) se borró dos veces", key, value)
+				}
+				delete(oracle[key], value)
+				size--
+				break
+			}
+		}
+		levels := checkAgainstOracle()
+		switch round {
+		case 0:
+			if levels < 4 {
+				t.Fatalf("Se esperaban al menos 4 niveles, hay %d", levels)
+			}
+			grownPages = bpm.PageCount(common.FileID_t(0))
+		case 1:
+			if bptree.FreePageCount() == 0 {
+				t.Fatalf("Al encogerse el árbol no quedaron páginas libres")
+			}
+		case 2:
+			// Con menos claves que en la ronda 0, los nodos nuevos usan las páginas libres
+			if pages := bpm.PageCount(common.FileID_t(0)); pages != grownPages {
+				t.Fatalf("El archivo pasó de %d a %d páginas, no se usaron las libres", grownPages, pages)
+			}
+		}
+		t.Logf("ronda %d: %d claves, %d niveles", round, size, levels)
+	}
+
+	// Al vaciarse, la raíz colapsó hasta volver a ser una hoja y las demás páginas quedaron
+	// libres, también al volver a abrir el árbol
+	root := bptree.getPage(bptree.RootPageID)
+	if root.PageType != page.LeafPage || len(root.Keys) != 0 {
+		t.Fatalf("Se esperaba una raíz hoja vacía, hay %v", root)
+	}
+	pages := int(bpm.PageCount(common.FileID_t(0)))
+	if free := bptree.FreePageCount(); free != pages-1 {
+		t.Fatalf("Hay %d páginas libres de %d, se esperaban todas menos la raíz", free, pages)
+	}
+	reopened, err := OpenBPTree(bpm, common.FileID_t(0), bptree.RootPageID, keySchema)
+	if err != nil {
+		t.Fatalf("No se pudo abrir el B+ Tree: %s", err)
+	}
+	if free := reopened.FreePageCount(); free != pages-1 {
+		t.Fatalf("Al abrir el árbol hay %d páginas libres, se esperaban %d", free, pages-1)
+	}
+}
+
+func TestCompositeKeys(t *testing.T) {
+	db_dir := "db.elena/"
+	common.GloablDbDir = db_dir
+	buffer_pool_size := 50
+	k := 5
+
+	os.MkdirAll(db_dir, os.ModePerm)
+	os.Create(db_dir + "elena_meta.table")
+	defer os.RemoveAll(db_dir)
+
+	bpm := buffer.NewBufferPoolManager(db_dir, uint32(buffer_pool_size), k, catalog.EmptyCatalog())
+	keySchema := schema.NewSchema([]column.Column{
+		column.NewSizedColumn(value.TypeVarChar, "codigo", 8),
+		column.NewColumn(value.TypeInt32, "anio"),
+	})
+	bptree, err := NewBPTree(bpm, common.FileID_t(0), keySchema)
+	if err != nil {
+		t.Fatalf("No se pudo crear el B+ Tree: %s", err)
+	}
+	key := func(codigo string, anio int) IndexKey {
+		return IndexKey{*value.NewVarCharValue(codigo, 8), *value.NewInt32Value(int32(anio))}
+	}
+
+	// 500 códigos con 6 años cada uno, insertados en desorden
+	const large = 3000
+	for i := 0; i < large; i++ {
+		j := (i * 7919) % large
+		bptree.Insert(key(fmt.Sprintf("c%04d", j/6), 2000+j%6), uint64(j))
+	}
+	count, _ := checkTree(t, bptree)
+	if count != large {
+		t.Fatalf("El árbol tiene %d claves, se esperaban %d", count, large)
+	}
+
+	// Se ordena por código y después por año
+	keys, values := bptree.RangeSearch(IndexKey{}, IndexKey{})
+	if len(keys) != large {
+		t.Fatalf("RangeSearch retornó %d claves, se esperaban %d", len(keys), large)
+	}
+	for i := range keys {
+		if values[i] != uint64(i) {
+			t.Fatalf("La clave %s tiene el valor %d, se esperaba %d", keys[i].ToString(), values[i], i)
+		}
+	}
+
+	// Un prefijo trae todos los años del código
+	keys, _ = bptree.RangeSearch(IndexKey{*value.NewVarCharValue("c0042", 8)}, IndexKey{*value.NewVarCharValue("c0042", 8)})
+	if len(keys) != 6 {
+		t.Fatalf("El prefijo c0042 trajo %d claves, se esperaban 6", len(keys))
+	}
+	for i, found := range keys {
+		if found.ToString() != key("c0042", 2000+i).ToString() {
+			t.Fatalf("Se esperaba %s, se obtuvo %s", key("c0042", 2000+i).ToString(), found.ToString())
+		}
+	}
+
+	// Rango entre dos claves completas
+	keys, _ = bptree.RangeSearch(key("c0010", 2003), key("c0011", 2001))
+	if len(keys) != 5 {
+		t.Fatalf("El rango trajo %d claves, se esperaban 5", len(keys))
+	}
+
+	if value, found := bptree.Search(key("c0100", 2004)); !found || value != 604 {
+		t.Fatalf("Search(c0100, 2004) = %d, %v", value, found)
+	}
+	if !bptree.Delete(key("c0100", 2004), 604) {
+		t.Fatalf("No se pudo borrar (c0100, 2004)")
+	}
+	if _, found := bptree.Search(key("c0100", 2004)); found {
+		t.Fatalf("(c0100, 2004) sigue en el árbol")
+	}
+
+	// Se vuelve a abrir con el mismo esquema, uno de otro ancho no sirve
+	reopened, err := OpenBPTree(bpm, common.FileID_t(0), bptree.RootPageID, keySchema)
+	if err != nil {
+		t.Fatalf("No se pudo abrir el B+ Tree: %s", err)
+	}
+	if value, found := reopened.Search(key("c0499", 2005)); !found || value != large-1 {
+		t.Fatalf("Search(c0499, 2005) = %d, %v", value, found)
+	}
+	if _, err := OpenBPTree(bpm, common.FileID_t(0), bptree.RootPageID, intKeySchema); err == nil {
+		t.Fatalf("Se abrió el B+ Tree con claves de otro ancho")
+	}
+}
+
+func TestFloatAndBoolKeys(t *testing.T) {
+	db_dir := "db.elena/"
+	common.GloablDbDir = db_dir
+	buffer_pool_size := 50
+	k := 5
+
+	os.MkdirAll(db_dir, os.ModePerm)
+	os.Create(db_dir + "elena_meta.table")
+	defer os.RemoveAll(db_dir)
+
+	bpm := buffer.NewBufferPoolManager(db_dir, uint32(buffer_pool_size), k, catalog.EmptyCatalog())
+	keySchema := schema.NewSchema([]column.Column{
+		column.NewColumn(value.TypeBoolean, "activo"),
+		column.NewColumn(value.TypeFloat32, "nota"),
+	})
+	bptree, err := NewBPTree(bpm, common.FileID_t(0), keySchema)
+	if err != nil {
+		t.Fatalf("No se pudo crear el B+ Tree: %s", err)
+	}
+
+	notas := []float32{12.5, -3.25, 0, 20, -0.5, 7.75}
+	for i, nota := range notas {
+		bptree.Insert(IndexKey{*value.NewBooleanValue(i%2 == 0), *value.NewFloat32Value(nota)}, uint64(i))
+	}
+
+	keys, _ := bptree.RangeSearch(IndexKey{}, IndexKey{})
+	expected := "(false, -3.25) (false, 7.75) (false, 20) (true, -0.5) (true, 0) (true, 12.5) "
+	got := ""
+	for _, key := range keys {
+		got += key.ToString() + " "
+	}
+	if got != expected {
+		t.Fatalf("Se esperaba %s, se obtuvo %s", expected, got)
+	}
+
+	// Las notas de 0 a 15 de los activos
+	keys, _ = bptree.RangeSearch(
+		IndexKey{*value.NewBooleanValue(true), *value.NewFloat32Value(0)},
+		IndexKey{*value.NewBooleanValue(true), *value.NewFloat32Value(15)},
+	)
+	if len(keys) != 2 {
+		t.Fatalf("El rango trajo %d claves, se esperaban 2", len(keys))
+	}
+
+	// Una clave que no entra con otras BTREE_MIN_FAN_OUT en una página no se puede indexar
+	wide := schema.NewSchema([]column.Column{
+		column.NewSizedColumn(value.TypeVarChar, "a", 255),
+		column.NewSizedColumn(value.TypeVarChar, "b", 255),
+		column.NewSizedColumn(value.TypeVarChar, "c", 255),
+		column.NewSizedColumn(value.TypeVarChar, "d", 255),
+	})
+	if _, err := NewBPTree(bpm, common.FileID_t(0), wide); err == nil {
+		t.Fatalf("Se creó un B+ Tree con claves de %d bytes", 4*256)
+	}
+}
+
+// Recorre el árbol con el iterador en ambos sentidos. El pool es chico a propósito: si el
+// iterador dejara fijadas las hojas por las que pasa, se quedaría sin frames.
+func TestIndexIterator(t *testing.T) {
+	db_dir := "db.elena/"
+	common.GloablDbDir = db_dir
+	buffer_pool_size := 10
+	k := 5
+
+	os.MkdirAll(db_dir, os.ModePerm)
+	os.Create(db_dir + "elena_meta.table")
+	defer os.RemoveAll(db_dir)
+
+	bpm := buffer.NewBufferPoolManager(db_dir, uint32(buffer_pool_size), k, catalog.EmptyCatalog())
+	bptree := newIntBPTree(t, bpm, common.FileID_t(0))
+
+	// Solo las claves pares, para buscar también las que no están
+	const large = 20000
+	for i := 0; i < large; i += 2 {
+		bptree.Insert(intKey(i), uint64(i))
+	}
+	checkTree(t, bptree)
+
+	it := NewIndexIterator(bptree)
+	defer it.Close()
+
+	// De principio a fin y de vuelta
+	for round := 0; round < 3; round++ {
+		it.Seek(IndexKey{})
+		expected := 0
+		for key, value, ok := it.Next(); ok; key, value, ok = it.Next() {
+			if int(key[0].AsInt32()) != expected || value != uint64(expected) {
+				t.Fatalf("Next retornó %s (%d), se esperaba %d", key.ToString(), value, expected)
+			}
+			expected += 2
+		}
+		if expected != large {
+			t.Fatalf("Next terminó en %d, se esperaba %d", expected, large)
+		}
+
+		for key, _, ok := it.Prev(); ok; key, _, ok = it.Prev() {
+			expected -= 2
+			if int(key[0].AsInt32()) != expected {
+				t.Fatalf("Prev retornó %s, se esperaba %d", key.ToString(), expected)
+			}
+		}
+		if expected != 0 {
+			t.Fatalf("Prev terminó en %d, se esperaba 0", expected)
+		}
+	}
+
+	// Seek queda antes de la primera clave >= a la buscada, SeekAfter después de la última <=
+	it.Seek(intKey(1001))
+	if key, _, _ := it.Next(); key[0].AsInt32() != 1002 {
+		t.Fatalf("Seek(1001) y Next retornó %s, se esperaba 1002", key.ToString())
+	}
+	if key, _, _ := it.Prev(); key[0].AsInt32() != 1002 {
+		t.Fatalf("Next y Prev retornó %s, se esperaba 1002", key.ToString())
+	}
+	if key, _, _ := it.Prev(); key[0].AsInt32() != 1000 {
+		t.Fatalf("Prev retornó %s, se esperaba 1000", key.ToString())
+	}
+
+	it.SeekAfter(intKey(1001))
+	if key, _, _ := it.Prev(); key[0].AsInt32() != 1000 {
+		t.Fatalf("SeekAfter(1001) y Prev retornó %s, se esperaba 1000", key.ToString())
+	}
+	it.SeekAfter(intKey(1000))
+	if key, _, _ := it.Prev(); key[0].AsInt32() != 1000 {
+		t.Fatalf("SeekAfter(1000) y Prev retornó %s, se esperaba 1000", key.ToString())
+	}
+
+	it.SeekAfter(IndexKey{})
+	if key, _, _ := it.Prev(); key[0].AsInt32() != large-2 {
+		t.Fatalf("SeekAfter() y Prev retornó %s, se esperaba %d", key.ToString(), large-2)
+	}
+	if _, _, ok := it.Next(); !ok {
+		t.Fatalf("Después de Prev debería quedar la última clave")
+	}
+	if _, _, ok := it.Next(); ok {
+		t.Fatalf("Next después del final retornó una clave")
+	}
+
+	it.Seek(intKey(large))
+	if _, _, ok := it.Next(); ok {
+		t.Fatalf("Seek después de la última clave y Next retornó una clave")
+	}
+	it.Seek(intKey(-1))
+	if _, _, ok := it.Prev(); ok {
+		t.Fatalf("Seek antes de la primera clave y Prev retornó una clave")
+	}
+
+	// Las hojas que quedan vacías o se juntan al borrar no cortan el recorrido
+	for i := 0; i < large; i += 4 {
+		bptree.Delete(intKey(i), uint64(i))
+	}
+	checkTree(t, bptree)
+	it.Seek(IndexKey{})
+	expected := 2
+	for key, _, ok := it.Next(); ok; key, _, ok = it.Next() {
+		if int(key[0].AsInt32()) != expected {
+			t.Fatalf("Next retornó %s después de borrar, se esperaba %d", key.ToString(), expected)
+		}
+		expected += 4
+	}
+	if expected != large+2 {
+		t.Fatalf("Next terminó en %d después de borrar, se esperaba %d", expected, large+2)
+	}
+
+	// Si la hoja del iterador se fusiona y queda libre, el iterador baja de nuevo desde la
+	// raíz. Mientras la tenga fijada, la página no se usa para los nodos nuevos.
+	it.Seek(intKey(10002))
+	it.Next()
+	leafID := it.leaf.PageID
+	for i := 2; i < 15000; i += 4 {
+		bptree.Delete(intKey(i), uint64(i))
+	}
+	if freed := bptree.getPage(leafID); freed.PageType != page.FreePage {
+		t.Fatalf("La hoja %s del iterador no quedó libre", leafID.ToString())
+	}
+	for i := large; i < 2*large; i++ {
+		bptree.Insert(intKey(i), uint64(i))
+	}
+	checkTree(t, bptree)
+	if freed := bptree.getPage(leafID); freed.PageType != page.FreePage {
+		t.Fatalf("La hoja %s se volvió a usar mientras el iterador estaba en ella", leafID.ToString())
+	}
+	// Lo que quedaba de la hoja ya estaba leído, después sigue la primera clave que no se borró
+	last := int32(10002)
+	for key, _, ok := it.Next(); ok; key, _, ok = it.Next() {
+		if key[0].AsInt32() <= last {
+			t.Fatalf("Next retornó %s después de %d", key.ToString(), last)
+		}
+		if last = key[0].AsInt32(); last > 15000 {
+			break
+		}
+	}
+	if last != 15002 {
+		t.Fatalf("Next retornó %d después de fusionar su hoja, se esperaba 15002", last)
+	}
+}
+
+// Varias goroutines insertan, borran y buscan a la vez en el mismo árbol. Pensada para
+// correr con -race: go test -race -run TestConcurrentAccess ./pkg/storage/index
+func TestConcurrentAccess(t *testing.T) {
+	db_dir := "db.elena/"
+	common.GloablDbDir = db_dir
+	// Todo el árbol entra en memoria. Si no, con un solo CPU los lectores y el hilo del disco
+	// se pasan el turno entre ellos y las demás goroutines casi no corren
+	buffer_pool_size := 1000
+	k := 5
+
+	os.MkdirAll(db_dir, os.ModePerm)
+	os.Create(db_dir + "elena_meta.table")
+	defer os.RemoveAll(db_dir)
+
+	// Claves anchas para que entren pocas por página y el árbol tenga tres niveles
+	bpm := buffer.NewBufferPoolManager(db_dir, uint32(buffer_pool_size), k, catalog.EmptyCatalog())
+	keySchema := schema.NewSchema([]column.Column{column.NewSizedColumn(value.TypeVarChar, "codigo", 200)})
+	bptree, err := NewBPTree(bpm, common.FileID_t(0), keySchema)
+	if err != nil {
+		t.Fatalf("No se pudo crear el B+ Tree: %s", err)
+	}
+	key := func(k int) IndexKey {
+		return IndexKey{*value.NewVarCharValue(fmt.Sprintf("%06d", k), 200)}
+	}
+
+	// Las claves pares se quedan todo el tiempo, las impares se borran mientras tanto
+	const initial = 3000
+	for i := 0; i < initial; i++ {
+		bptree.Insert(key(i), uint64(i))
+	}
+
+	const writers = 4
+	const perWriter = 1000
+	const readers = 4
+	var wg sync.WaitGroup
+	errs := make(chan string, writers+readers+1)
+	done := make(chan struct{})
+
+	// Los escritores se intercalan, así compiten por las mismas hojas
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				k := initial + i*writers + w
+				bptree.Insert(key(k), uint64(k))
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < initial; i += 2 {
+			if !bptree.Delete(key(i), uint64(i)) {
+				errs <- fmt.Sprintf("no se pudo borrar %d", i)
+				return
+			}
+		}
+	}()
+
+	var readersWg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		readersWg.Add(1)
+		go func(r int) {
+			defer readersWg.Done()
+			rng := rand.New(rand.NewSource(int64(r)))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				k := rng.Intn(initial/2) * 2
+				if value, found := bptree.Search(key(k)); !found || value != uint64(k) {
+					errs <- fmt.Sprintf("Search(%d) = (%d, %v) mientras se escribía", k, value, found)
+					return
+				}
+
+				// Un rango en orden, hacia adelante o hacia atrás, donde ninguna clave se repite
+				it := NewIndexIterator(bptree)
+				var last IndexKey
+				var count int
+				next := it.Next
+				if r%2 == 0 {
+					it.Seek(key(k))
+				} else {
+					it.SeekAfter(key(k + 200))
+					next = it.Prev
+				}
+				for entry, _, ok := next(); ok && count < 100; entry, _, ok = next() {
+					if last != nil && (r%2 == 0) == (bptree.Compare(entry, last) <= 0) {
+						errs <- fmt.Sprintf("el iterador retornó %s después de %s", entry.ToString(), last.ToString())
+						it.Close()
+						return
+					}
+					last = entry
+					count++
+				}
+				it.Close()
+			}
+		}(r)
+	}
+
+	wg.Wait()
+	close(done)
+	readersWg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if t.Failed() {
+		return
+	}
+
+	count, levels := checkTree(t, bptree)
+	if levels < 3 {
+		t.Fatalf("Se esperaban al menos 3 niveles, hay %d", levels)
+	}
+	if expected := initial/2 + writers*perWriter; count != expected {
+		t.Fatalf("El árbol tiene %d claves, se esperaban %d", count, expected)
+	}
+	for k := 0; k < initial+writers*perWriter; k++ {
+		_, found := bptree.Search(key(k))
+		if found != (k >= initial || k%2 == 0) {
+			t.Fatalf("Search(%d) = %v después de escribir", k, found)
+		}
+	}
+}
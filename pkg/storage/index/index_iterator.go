@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"fisi/elenadb/pkg/buffer"
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/storage/page"
+	"runtime"
+)
+
+// IndexIterator recorre las entradas del B+ Tree en orden, hacia adelante o hacia atrás, de
+// hoja en hoja siguiendo los enlaces entre hermanas. Tiene fijada (pin) en el Buffer Pool
+// Manager solo la hoja en la que está, hasta pasar a otra o hasta Close.
+//
+// Como un cursor, el iterador está entre dos entradas: Next retorna la de la derecha y avanza,
+// Prev retorna la de la izquierda y retrocede. La hoja se lee (con su latch) al llegar a ella y
+// el latch se suelta enseguida, así que entre llamadas no bloquea a nadie. Lo que cambie en la
+// hoja después de leerla no se ve, pero el iterador recuerda la última entrada que retornó y,
+// al terminar la hoja, la vuelve a leer y sigue desde ahí: las entradas que se mueven de hoja
+// mientras tanto no se pierden ni se repiten.
+type IndexIterator struct {
+	tree *BPTree
+	leaf *page.BTreePage
+	// mantiene fijada la página de leaf
+	pin *buffer.BasicPageGuard
+	// posición entre las claves de la hoja, de 0 a len(leaf.Keys)
+	pos int
+	// dónde está el cursor aunque la hoja cambie: justo antes de las entradas iguales a
+	// boundary, o justo después si afterBoundary
+	boundary      []byte
+	afterBoundary bool
+}
+
+// NewIndexIterator crea un iterador sin posición, hay que llamar a Seek o SeekAfter antes
+// de recorrer
+func NewIndexIterator(tree *BPTree) *IndexIterator {
+	return &IndexIterator{tree: tree}
+}
+
+// Seek deja el iterador justo antes de la primera entrada mayor o igual a la clave. Con una
+// clave vacía queda al principio del árbol.
+func (it *IndexIterator) Seek(indexKey IndexKey) {
+	key := it.tree.comparator.Encode(indexKey)
+	it.setLeaf(it.tree.findLeaf(key), key, false)
+}
+
+// SeekAfter deja el iterador justo después de la última entrada menor o igual a la clave, para
+// recorrer hacia atrás con Prev. Con una clave vacía queda al final del árbol.
+func (it *IndexIterator) SeekAfter(indexKey IndexKey) {
+	key := it.tree.comparator.Encode(indexKey)
+	it.setLeaf(it.tree.findLastLeaf(key), key, true)
+}
+
+// Next retorna la siguiente entrada y avanza. Es false cuando ya no hay más.
+func (it *IndexIterator) Next() (IndexKey, uint64, bool) {
+	if it.leaf == nil {
+		return nil, 0, false
+	}
+	for it.pos >= len(it.leaf.Keys) {
+		if !it.forward() {
+			return nil, 0, false
+		}
+	}
+
+	key, value := it.entry(it.pos)
+	it.boundary, it.afterBoundary = it.leaf.Keys[it.pos], true
+	it.pos++
+	return key, value, true
+}
+
+// Prev retorna la entrada anterior y retrocede. Es false cuando ya no hay más.
+func (it *IndexIterator) Prev() (IndexKey, uint64, bool) {
+	if it.leaf == nil {
+		return nil, 0, false
+	}
+	for it.pos <= 0 {
+		if !it.backward() {
+			return nil, 0, false
+		}
+	}
+
+	it.pos--
+	key, value := it.entry(it.pos)
+	it.boundary, it.afterBoundary = it.leaf.Keys[it.pos], false
+	return key, value, true
+}
+
+// Close suelta la hoja en la que está el iterador. Se puede volver a usar con Seek.
+func (it *IndexIterator) Close() {
+	if it.pin != nil {
+		it.pin.Drop()
+		it.pin = nil
+	}
+	it.leaf = nil
+}
+
+func (it *IndexIterator) entry(pos int) (IndexKey, uint64) {
+	return it.tree.comparator.Decode(it.leaf.Keys[pos]), it.leaf.Values[pos]
+}
+
+// setLeaf pone el iterador en una hoja de la que se tiene el latch, soltando la anterior. La
+// hoja queda leída y fijada, y su latch se suelta.
+func (it *IndexIterator) setLeaf(guard *buffer.ReadPageGuard, boundary []byte, afterBoundary bool) {
+	it.Close()
+	leaf := readNode(guard.Data())
+	it.pin = it.tree.fetchBasic(guard.PageId())
+	guard.Drop()
+	it.leaf = leaf
+	it.boundary, it.afterBoundary = boundary, afterBoundary
+	it.pos = it.cursor(leaf.Keys)
+}
+
+// cursor retorna la posición del iterador entre las claves de una hoja
+func (it *IndexIterator) cursor(keys [][]byte) int {
+	if it.afterBoundary {
+		return it.tree.findUpperIndex(keys, it.boundary)
+	}
+	return it.tree.findIndex(keys, it.boundary)
+}
+
+// reread vuelve a leer la hoja actual, que pudo recibir entradas de una hermana después de
+// leerla. Retorna también la página, con su latch de lectura tomado.
+//
+// Si la hoja se fusionó con su hermana quedó libre, y sus enlaces ya no sirven: el iterador
+// baja de nuevo desde la raíz hasta la hoja donde está ahora el cursor. Mientras lo tenga
+// fijada, la página libre no se vuelve a usar para otro nodo.
+func (it *IndexIterator) reread() (*buffer.ReadPageGuard, *page.BTreePage) {
+	guard := it.tree.fetchRead(it.leaf.PageID)
+	leaf := readNode(guard.Data())
+	if leaf.PageType != page.FreePage {
+		return guard, leaf
+	}
+	guard.Drop()
+
+	key := it.boundary
+	if it.afterBoundary {
+		guard = it.tree.findLastLeaf(key)
+	} else {
+		guard = it.tree.findLeaf(key)
+	}
+	it.setLeaf(guard, key, it.afterBoundary)
+	return it.reread()
+}
+
+// forward se mueve hacia adelante cuando se terminó la hoja. Es false si ya no hay más.
+func (it *IndexIterator) forward() bool {
+	guard, leaf := it.reread()
+	if pos := it.cursor(leaf.Keys); pos < len(leaf.Keys) || leaf.NextLeaf == common.InvalidPageID {
+		guard.Drop()
+		it.leaf, it.pos = leaf, pos
+		return pos < len(leaf.Keys)
+	}
+
+	// Se toma la siguiente antes de soltar esta, así ninguna entrada pasa de una a la otra en
+	// el medio. Las escrituras nunca esperan un latch de costado, no hay deadlock.
+	next := it.tree.fetchRead(leaf.NextLeaf)
+	guard.Drop()
+	it.setLeaf(next, it.boundary, it.afterBoundary)
+	return true
+}
+
+// backward se mueve hacia atrás cuando se llegó al inicio de la hoja. Es false si ya no hay
+// más.
+func (it *IndexIterator) backward() bool {
+	for {
+		guard, leaf := it.reread()
+		if pos := it.cursor(leaf.Keys); pos > 0 || leaf.PrevLeaf == common.InvalidPageID {
+			guard.Drop()
+			it.leaf, it.pos = leaf, pos
+			return pos > 0
+		}
+
+		// Hacia atrás no se espera: otro iterador puede estar esperando esta hoja desde la
+		// anterior. Si está ocupada se suelta todo y se reintenta.
+		pinned := it.tree.fetchBasic(leaf.PrevLeaf)
+		prev, ok := pinned.TryUpgradeRead()
+		if !ok {
+			pinned.Drop()
+			guard.Drop()
+			runtime.Gosched()
+			continue
+		}
+		guard.Drop()
+		it.setLeaf(prev, it.boundary, it.afterBoundary)
+		return true
+	}
+}
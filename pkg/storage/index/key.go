@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"fisi/elenadb/pkg/catalog/column"
+	"fisi/elenadb/pkg/catalog/schema"
+	"fisi/elenadb/pkg/storage/page"
+	"fisi/elenadb/pkg/storage/table/value"
+	"fmt"
+	"strings"
+)
+
+// IndexKey es una clave del índice: los valores de las columnas indexadas, en orden.
+// Una clave con menos columnas que el esquema es un prefijo y compara igual a todas las
+// claves que empiezan con esos valores (así se busca por las primeras columnas).
+type IndexKey []value.Value
+
+func (key IndexKey) ToString() string {
+	values := make([]string, len(key))
+	for i := range key {
+		values[i] = key[i].FormatAsString()
+	}
+	return "(" + strings.Join(values, ", ") + ")"
+}
+
+// En el árbol cada clave va seguida del RID de su tupla (8 bytes, big endian para que se ordene
+// byte a byte). Así no hay dos entradas iguales aunque se repita la clave, y una escritura baja
+// directo a la única hoja donde está o debe estar su entrada.
+const ridSize = 8
+
+// KeyComparator sabe guardar y ordenar las claves de un índice a partir del esquema de sus
+// columnas. En las páginas cada columna ocupa siempre el mismo ancho, así todas las claves
+// miden KeySize bytes. Cada columna empieza con un byte que dice si es NULL (0) o no (1),
+// los NULL dejan el resto de la columna en ceros:
+//
+//	int, float: 1 + 4 bytes | bool: 1 + 1 byte | char(n): 1 + [len(u8)][n bytes, rellenado con ceros]
+type KeyComparator struct {
+	keySchema *schema.Schema
+	widths    []int
+	keySize   int
+}
+
+// NewKeyComparator arma el comparador para las columnas del esquema. Falla si la clave (con su
+// RID) no entra en una página junto a otras BTREE_MIN_FAN_OUT claves.
+func NewKeyComparator(keySchema *schema.Schema) (*KeyComparator, error) {
+	if keySchema.IsEmpty() {
+		return nil, fmt.Errorf("an index key needs at least one column")
+	}
+
+	comparator := &KeyComparator{keySchema: keySchema}
+	for _, col := range keySchema.GetColumns() {
+		width, err := columnWidth(col)
+		if err != nil {
+			return nil, err
+		}
+		comparator.widths = append(comparator.widths, width)
+		comparator.keySize += width
+	}
+
+	if comparator.keySize+ridSize > page.BTREE_MAX_KEY_SIZE {
+		return nil, fmt.Errorf("index key is %d bytes wide, at most %d are allowed", comparator.keySize, page.BTREE_MAX_KEY_SIZE-ridSize)
+	}
+	return comparator, nil
+}
+
+// El ancho de la columna con su byte de NULL
+func columnWidth(col column.Column) (int, error) {
+	switch col.ColumnType {
+	case value.TypeInt32, value.TypeFloat32, value.TypeBoolean:
+		return 1 + int(col.ColumnType.TypeSize()), nil
+	case value.TypeVarChar:
+		return 1 + int(col.StorageSize) + 1, nil
+	default:
+		return 0, fmt.Errorf("column \"%s\" of type %s can't be indexed", col.ColumnName, col.ColumnType)
+	}
+}
+
+func (c *KeyComparator) KeySize() int {
+	return c.keySize
+}
+
+func (c *KeyComparator) KeySchema() *schema.Schema {
+	return c.keySchema
+}
+
+// Encode pasa la clave a su forma en la página. Si es un prefijo, solo ocupa el ancho de sus
+// columnas. Los char más largos que la columna se cortan, como al guardarlos en la tabla.
+func (c *KeyComparator) Encode(key IndexKey) []byte {
+	if len(key) > len(c.widths) {
+		panic(fmt.Sprintf("key %s has more columns than the index", key.ToString()))
+	}
+
+	size := 0
+	for i := range key {
+		size += c.widths[i]
+	}
+
+	data := make([]byte, size)
+	offset := 0
+	for i, v := range key {
+		col := c.keySchema.GetColumn(i)
+		if v.Type != col.ColumnType {
+			panic(fmt.Sprintf("key column \"%s\" is %s, got a %s", col.ColumnName, col.ColumnType, v.Type))
+		}
+		if !v.IsNull() {
+			data[offset] = 1
+			copy(data[offset+1:offset+c.widths[i]], v.Data)
+			if v.Type == value.TypeVarChar && len(v.Data) > c.widths[i]-1 {
+				data[offset+1] = byte(c.widths[i] - 2)
+			}
+		}
+		offset += c.widths[i]
+	}
+	return data
+}
+
+// Decode es la inversa de Encode
+func (c *KeyComparator) Decode(data []byte) IndexKey {
+	key := IndexKey{}
+	offset := 0
+	for i, width := range c.widths {
+		if offset+width > len(data) {
+			break
+		}
+		key = append(key, c.column(i, data[offset:offset+width]))
+		offset += width
+	}
+	return key
+}
+
+// column retorna el valor de la columna i de la clave, sin copiar los bytes
+func (c *KeyComparator) column(i int, data []byte) value.Value {
+	colType := c.keySchema.GetColumn(i).ColumnType
+	if data[0] == 0 {
+		return *value.NewNullValue(colType)
+	}
+	data = data[1:]
+	if colType == value.TypeVarChar {
+		return value.Value{Type: colType, Data: data[:data[0]+1]}
+	}
+	return value.Value{Type: colType, Data: data}
+}
+
+// Compare ordena dos claves codificadas columna por columna, como en un diccionario: -1 si
+// a < b, 0 si son iguales y 1 si a > b. Solo se comparan las columnas que ambas tienen,
+// por eso un prefijo es igual a las claves que empiezan con él.
+func (c *KeyComparator) Compare(a, b []byte) int {
+	offset := 0
+	for i, width := range c.widths {
+		if offset+width > len(a) || offset+width > len(b) {
+			return 0
+		}
+		va := c.column(i, a[offset:offset+width])
+		vb := c.column(i, b[offset:offset+width])
+		if cmp := value.Compare(&va, &vb); cmp != 0 {
+			return cmp
+		}
+		offset += width
+	}
+	return 0
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"fisi/elenadb/pkg/buffer"
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/storage/page"
+)
+
+// latchedNode es un nodo que una escritura tiene tomado con el WritePageGuard de su página
+// (fijada en el Buffer Pool Manager y con el latch de escritura). Los cambios se hacen sobre
+// node y se copian a la página al soltarla.
+type latchedNode struct {
+	guard *buffer.WritePageGuard
+	node  *page.BTreePage
+	// era la raíz al tomarlo, y lo sigue siendo mientras se tenga su latch
+	isRoot bool
+	dirty  bool
+}
+
+// writeContext lleva lo que tiene tomado una escritura (Insert o Delete).
+//
+// path es el camino desde el ancestro más alto que todavía tiene hasta el nodo en el que está,
+// cada nodo es el padre del siguiente. Bajando se espera el latch de cada hijo; cuando un nodo
+// es seguro se sueltan los de arriba. Lo demás que se necesite (hermanos, hojas vecinas) se
+// toma solo si está libre, con tryLatch, así una escritura nunca espera un latch fuera del
+// orden de la raíz a las hojas y no hay deadlocks.
+type writeContext struct {
+	tree        *BPTree
+	rootLatched bool
+	path        []*latchedNode
+	nodes       map[common.PageID_t]*latchedNode
+	// páginas que la escritura dejó libres, pasan al árbol al soltarlas
+	freed []common.PageID_t
+}
+
+// newWriteContext empieza una escritura con el latch de la raíz del árbol tomado
+func (tree *BPTree) newWriteContext() *writeContext {
+	tree.rootLatch.Lock()
+	return &writeContext{
+		tree:        tree,
+		rootLatched: true,
+		path:        []*latchedNode{},
+		nodes:       map[common.PageID_t]*latchedNode{},
+	}
+}
+
+// push baja a la página pageID, esperando su latch, y la agrega al camino
+func (ctx *writeContext) push(pageID common.PageID_t) *latchedNode {
+	guard := ctx.tree.fetchBasic(pageID).UpgradeWrite()
+	n := &latchedNode{
+		guard:  guard,
+		node:   readNode(guard.Data()),
+		isRoot: len(ctx.path) == 0 && ctx.rootLatched,
+	}
+	ctx.nodes[pageID] = n
+	ctx.path = append(ctx.path, n)
+	return n
+}
+
+// releaseAncestors suelta todo lo que está encima del último nodo del camino, que es seguro:
+// lo que cambie debajo de él ya no sube más arriba
+func (ctx *writeContext) releaseAncestors() {
+	if ctx.rootLatched {
+		ctx.tree.rootLatch.Unlock()
+		ctx.rootLatched = false
+	}
+	last := len(ctx.path) - 1
+	for _, n := range ctx.path[:last] {
+		ctx.release(n)
+	}
+	ctx.path = ctx.path[last:]
+}
+
+// tryLatch toma una página fuera del camino solo si nadie la está usando. Si retorna false la
+// escritura tiene que soltar todo y empezar de nuevo, por eso se llama antes de cambiar nada.
+func (ctx *writeContext) tryLatch(pageID common.PageID_t) (*latchedNode, bool) {
+	if n, ok := ctx.nodes[pageID]; ok {
+		return n, true
+	}
+	pinned := ctx.tree.fetchBasic(pageID)
+	guard, ok := pinned.TryUpgradeWrite()
+	if !ok {
+		pinned.Drop()
+		return nil, false
+	}
+	n := &latchedNode{guard: guard, node: readNode(guard.Data())}
+	ctx.nodes[pageID] = n
+	return n, true
+}
+
+// newNode crea un nodo en una página libre, o en una nueva si no hay. Nadie más lo ve hasta
+// que se enlace en el árbol.
+func (ctx *writeContext) newNode(pageType page.BTreePageType) *latchedNode {
+	guard := ctx.tree.takeFreePage()
+	if guard == nil {
+		guard = ctx.tree.bufferPoolManager.NewPageWrite(ctx.tree.fileId)
+	}
+	if guard == nil {
+		panic("No se pudo crear una nueva página")
+	}
+	n := &latchedNode{
+		guard: guard,
+		node:  page.NewBTreePage(guard.PageId(), pageType, ctx.tree.entrySize),
+		dirty: true,
+	}
+	ctx.nodes[guard.PageId()] = n
+	return n
+}
+
+// free deja libre la página de un nodo que salió del árbol. Otras escrituras recién la pueden
+// usar cuando esta la suelta.
+func (ctx *writeContext) free(n *latchedNode) {
+	n.node = page.NewBTreePage(n.node.PageID, page.FreePage, ctx.tree.entrySize)
+	n.dirty = true
+	ctx.freed = append(ctx.freed, n.node.PageID)
+}
+
+// release escribe el nodo en su página si cambió, y la suelta
+func (ctx *writeContext) release(n *latchedNode) {
+	if n.dirty {
+		writeNode(n.guard, n.node)
+	}
+	delete(ctx.nodes, n.guard.PageId())
+	n.guard.Drop()
+}
+
+// releaseAll suelta todo lo que la escritura tiene tomado
+func (ctx *writeContext) releaseAll() {
+	for _, n := range ctx.nodes {
+		ctx.release(n)
+	}
+	ctx.path = nil
+	if len(ctx.freed) > 0 {
+		ctx.tree.addFreePages(ctx.freed)
+		ctx.freed = nil
+	}
+	if ctx.rootLatched {
+		ctx.tree.rootLatch.Unlock()
+		ctx.rootLatched = false
+	}
+}
@@ -1,9 +1,9 @@
 package page
 
 import (
-	"bytes"
-	"encoding/gob"
+	"encoding/binary"
 	"fisi/elenadb/pkg/common"
+	"fmt"
 )
 
 // BTreePageType define el tipo de página del B+ Tree
@@ -12,51 +12,225 @@ type BTreePageType int
 const (
 	InternalPage BTreePageType = iota
 	LeafPage
+	// FreePage es una página que el árbol dejó sin uso y que puede volver a usar
+	FreePage
 )
 
+// Cada nodo del B+ Tree ocupa exactamente una página: un HEADER fijo y luego arreglos contiguos
+// -----------------------------------------------------------------------------------------------
+// | Version(1) | PageType(1) | NumKeys(2) | KeySize(2) | PageID(4) | PrevLeaf(4) | NextLeaf(4) | ... |
+// -----------------------------------------------------------------------------------------------
+//
+// Hojas:    | HEADER | Keys (KeySize * NumKeys) | Values (8 * NumKeys) |
+// Internas: | HEADER | Keys (KeySize * NumKeys) | Children (4 * (NumKeys + 1)) |
+// Libres:   | HEADER |, sin claves
+//
+// Aquí las claves son opacas: todas las claves del árbol miden KeySize bytes y el árbol sabe
+// cómo compararlas. Las hojas están enlazadas con sus hermanas en ambos sentidos, para
+// recorrerlas en orden hacia adelante o hacia atrás. Todos los números van en little endian.
+// PrevLeaf y NextLeaf son InvalidPageID cuando no hay hermana.
+//
+// No hay enlace al padre: el árbol encuentra los padres de un nodo al bajar desde la raíz, así
+// que los escritores solo toman latches de la raíz hacia las hojas.
+const BTREE_PAGE_VERSION = 4
+const BTREE_PAGE_HEADER_SIZE = 18
+const BTREE_VALUE_SIZE = 8
+const BTREE_CHILD_SIZE = 4
+
+// Cada nodo debe poder tener al menos esta cantidad de claves, para que siempre se pueda
+// partir en dos mitades que luego se puedan volver a unir. Esto limita el tamaño de una clave.
+const BTREE_MIN_FAN_OUT = 4
+const BTREE_MAX_KEY_SIZE = (common.ElenaPageSize-BTREE_PAGE_HEADER_SIZE)/BTREE_MIN_FAN_OUT - BTREE_VALUE_SIZE
+
+// Fan-out del árbol: cuántas claves caben como máximo en una página, según el tipo de nodo
+func BTreeLeafMaxKeys(keySize int) int {
+	return (common.ElenaPageSize - BTREE_PAGE_HEADER_SIZE) / (keySize + BTREE_VALUE_SIZE)
+}
+
+func BTreeInternalMaxKeys(keySize int) int {
+	return (common.ElenaPageSize - BTREE_PAGE_HEADER_SIZE - BTREE_CHILD_SIZE) / (keySize + BTREE_CHILD_SIZE)
+}
+
 // BTreePage representa una página en el B+ Tree
 type BTreePage struct {
 	PageID   common.PageID_t
 	PageType BTreePageType
-	Keys     []int
+	PrevLeaf common.PageID_t
+	NextLeaf common.PageID_t
+	KeySize  int
+	Keys     [][]byte
 	Values   []uint64
 	Children []common.PageID_t
 }
 
 // NewBTreePage crea una nueva página del B+ Tree
-func NewBTreePage(pageID common.PageID_t, pageType BTreePageType) *BTreePage {
+func NewBTreePage(pageID common.PageID_t, pageType BTreePageType, keySize int) *BTreePage {
 	return &BTreePage{
 		PageID:   pageID,
 		PageType: pageType,
-		Keys:     []int{},
+		PrevLeaf: common.InvalidPageID,
+		NextLeaf: common.InvalidPageID,
+		KeySize:  keySize,
+		Keys:     [][]byte{},
 		Values:   []uint64{},
 		Children: []common.PageID_t{},
 	}
 }
 
-// Serialize serializa una BTreePage a un slice de bytes
+// MaxKeys retorna cuántas claves caben como máximo en esta página
+func (p *BTreePage) MaxKeys() int {
+	if p.PageType == LeafPage {
+		return BTreeLeafMaxKeys(p.KeySize)
+	}
+	return BTreeInternalMaxKeys(p.KeySize)
+}
+
+// Serialize serializa una BTreePage a un slice de bytes del tamaño de una página
 func (p *BTreePage) Serialize() ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(p)
-	if err != nil {
-		return nil, err
+	if p.KeySize <= 0 || p.KeySize > BTREE_MAX_KEY_SIZE {
+		return nil, fmt.Errorf("btree page %s: invalid key size %d", p.PageID.ToString(), p.KeySize)
+	}
+	numKeys := len(p.Keys)
+	if numKeys > p.MaxKeys() {
+		return nil, BTreePageOverflow{PageID: p.PageID, NumKeys: numKeys, MaxKeys: p.MaxKeys()}
+	}
+
+	data := make([]byte, common.ElenaPageSize)
+	data[0] = BTREE_PAGE_VERSION
+	data[1] = byte(p.PageType)
+	binary.LittleEndian.PutUint16(data[2:], uint16(numKeys))
+	binary.LittleEndian.PutUint16(data[4:], uint16(p.KeySize))
+	binary.LittleEndian.PutUint32(data[6:], uint32(p.PageID))
+	binary.LittleEndian.PutUint32(data[10:], uint32(p.PrevLeaf))
+	binary.LittleEndian.PutUint32(data[14:], uint32(p.NextLeaf))
+
+	offset := BTREE_PAGE_HEADER_SIZE
+	for _, key := range p.Keys {
+		if len(key) != p.KeySize {
+			return nil, fmt.Errorf("btree page %s: key of %d bytes, expected %d", p.PageID.ToString(), len(key), p.KeySize)
+		}
+		copy(data[offset:], key)
+		offset += p.KeySize
+	}
+
+	if p.PageType == FreePage {
+		if numKeys != 0 {
+			return nil, fmt.Errorf("btree page %s: free page with %d keys", p.PageID.ToString(), numKeys)
+		}
+		return data, nil
+	}
+	if p.PageType == LeafPage {
+		if len(p.Values) != numKeys {
+			return nil, fmt.Errorf("btree page %s: %d keys but %d values", p.PageID.ToString(), numKeys, len(p.Values))
+		}
+		for _, value := range p.Values {
+			binary.LittleEndian.PutUint64(data[offset:], value)
+			offset += BTREE_VALUE_SIZE
+		}
+		return data, nil
 	}
-	return buf.Bytes(), nil
+
+	// Una página interna recién creada todavía no tiene hijos
+	if len(p.Children) == 0 && numKeys == 0 {
+		return data, nil
+	}
+	if len(p.Children) != numKeys+1 {
+		return nil, fmt.Errorf("btree page %s: %d keys but %d children", p.PageID.ToString(), numKeys, len(p.Children))
+	}
+	for _, child := range p.Children {
+		binary.LittleEndian.PutUint32(data[offset:], uint32(child))
+		offset += BTREE_CHILD_SIZE
+	}
+	return data, nil
 }
 
 // Deserialize deserializa un slice de bytes a una BTreePage
 func Deserialize(data []byte) (*BTreePage, error) {
-	var p BTreePage
-	buf := bytes.NewBuffer(data)
-	dec := gob.NewDecoder(buf)
-	err := dec.Decode(&p)
-	if err != nil {
-		return nil, err
+	if len(data) < BTREE_PAGE_HEADER_SIZE {
+		return nil, fmt.Errorf("btree page too short: %d bytes", len(data))
+	}
+	if data[0] != BTREE_PAGE_VERSION {
+		return nil, fmt.Errorf("unsupported btree page version %d", data[0])
+	}
+
+	p := &BTreePage{
+		PageType: BTreePageType(data[1]),
+		KeySize:  int(binary.LittleEndian.Uint16(data[4:])),
+		PageID:   common.PageID_t(binary.LittleEndian.Uint32(data[6:])),
+		PrevLeaf: common.PageID_t(binary.LittleEndian.Uint32(data[10:])),
+		NextLeaf: common.PageID_t(binary.LittleEndian.Uint32(data[14:])),
+		Values:   []uint64{},
+		Children: []common.PageID_t{},
+	}
+	if p.PageType != LeafPage && p.PageType != InternalPage && p.PageType != FreePage {
+		return nil, fmt.Errorf("btree page %s: unknown page type %d", p.PageID.ToString(), data[1])
+	}
+	if p.KeySize <= 0 || p.KeySize > BTREE_MAX_KEY_SIZE {
+		return nil, fmt.Errorf("btree page %s: invalid key size %d", p.PageID.ToString(), p.KeySize)
+	}
+
+	numKeys := int(binary.LittleEndian.Uint16(data[2:]))
+	if p.PageType == FreePage {
+		if numKeys != 0 {
+			return nil, fmt.Errorf("btree page %s: free page with %d keys", p.PageID.ToString(), numKeys)
+		}
+		p.Keys = [][]byte{}
+		return p, nil
+	}
+	if numKeys > p.MaxKeys() {
+		return nil, BTreePageOverflow{PageID: p.PageID, NumKeys: numKeys, MaxKeys: p.MaxKeys()}
+	}
+
+	// Las claves se copian: data suele ser un frame del buffer pool, que se puede reutilizar
+	// apenas se suelta la página
+	offset := BTREE_PAGE_HEADER_SIZE
+	keys := make([]byte, numKeys*p.KeySize)
+	copy(keys, data[offset:])
+	p.Keys = make([][]byte, numKeys)
+	for i := range p.Keys {
+		p.Keys[i] = keys[i*p.KeySize : (i+1)*p.KeySize : (i+1)*p.KeySize]
+	}
+	offset += len(keys)
+
+	if p.PageType == LeafPage {
+		p.Values = make([]uint64, numKeys)
+		for i := range p.Values {
+			p.Values[i] = binary.LittleEndian.Uint64(data[offset:])
+			offset += BTREE_VALUE_SIZE
+		}
+		return p, nil
+	}
+
+	if numKeys == 0 {
+		return p, nil
 	}
-	return &p, nil
+	p.Children = make([]common.PageID_t, numKeys+1)
+	for i := range p.Children {
+		p.Children[i] = common.PageID_t(binary.LittleEndian.Uint32(data[offset:]))
+		offset += BTREE_CHILD_SIZE
+	}
+	return p, nil
 }
 
 func BTreePageFromRawData(rawData []byte) (*BTreePage, error) {
 	return Deserialize(rawData)
 }
+
+// ============ Errores ============
+
+// BTreePageOverflow es el error de un nodo con más claves de las que caben en una página
+type BTreePageOverflow struct {
+	PageID  common.PageID_t
+	NumKeys int
+	MaxKeys int
+}
+
+func (e BTreePageOverflow) Error() string {
+	return fmt.Sprintf("btree page %s overflows: %d keys, at most %d fit in a page", e.PageID.ToString(), e.NumKeys, e.MaxKeys)
+}
+
+// para saber si el error es de tipo BTreePageOverflow
+func IsBTreePageOverflow(err error) bool {
+	_, ok := err.(BTreePageOverflow)
+	return ok
+}
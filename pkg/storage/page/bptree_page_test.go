@@ -0,0 +1,112 @@
+package page_test
+
+import (
+	"encoding/binary"
+	"fisi/elenadb/pkg/common"
+	"fisi/elenadb/pkg/storage/page"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Keys are opaque for the page, these tests just use 4 byte integers
+func key(k uint32) []byte {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, k)
+	return data
+}
+
+func TestBTreePageRoundTrip(t *testing.T) {
+	leaf := page.NewBTreePage(common.NewPageIdFromParts(3, 7), page.LeafPage, 4)
+	leaf.PrevLeaf = common.NewPageIdFromParts(3, 5)
+	leaf.NextLeaf = common.NewPageIdFromParts(3, 8)
+	leaf.Keys = [][]byte{key(0), key(1), key(42), key(math.MaxUint32)}
+	leaf.Values = []uint64{1, 2, 3, math.MaxUint64}
+
+	data, err := leaf.Serialize()
+	assert.Nil(t, err)
+	assert.Equal(t, common.ElenaPageSize, len(data))
+
+	read, err := page.BTreePageFromRawData(data)
+	assert.Nil(t, err)
+	assert.Equal(t, leaf, read)
+
+	// The keys read don't share memory with the raw page
+	data[page.BTREE_PAGE_HEADER_SIZE] = 0xff
+	assert.Equal(t, key(0), read.Keys[0])
+
+	internal := page.NewBTreePage(common.NewPageIdFromParts(3, 1), page.InternalPage, 4)
+	internal.Keys = [][]byte{key(10), key(20)}
+	internal.Children = []common.PageID_t{
+		common.NewPageIdFromParts(3, 2),
+		common.NewPageIdFromParts(3, 7),
+		common.NewPageIdFromParts(3, 9),
+	}
+
+	data, err = internal.Serialize()
+	assert.Nil(t, err)
+	read, err = page.BTreePageFromRawData(data)
+	assert.Nil(t, err)
+	assert.Equal(t, internal, read)
+
+	free := page.NewBTreePage(common.NewPageIdFromParts(3, 9), page.FreePage, 4)
+	data, err = free.Serialize()
+	assert.Nil(t, err)
+	read, err = page.BTreePageFromRawData(data)
+	assert.Nil(t, err)
+	assert.Equal(t, free, read)
+}
+
+func TestBTreePageFanOutFitsInAPage(t *testing.T) {
+	for _, keySize := range []int{4, 9, 256, page.BTREE_MAX_KEY_SIZE} {
+		maxLeafKeys := page.BTreeLeafMaxKeys(keySize)
+		maxInternalKeys := page.BTreeInternalMaxKeys(keySize)
+		assert.GreaterOrEqual(t, maxLeafKeys, page.BTREE_MIN_FAN_OUT)
+		assert.GreaterOrEqual(t, maxInternalKeys, page.BTREE_MIN_FAN_OUT)
+
+		leaf := page.NewBTreePage(0, page.LeafPage, keySize)
+		for i := 0; i < maxLeafKeys; i++ {
+			leaf.Keys = append(leaf.Keys, make([]byte, keySize))
+			leaf.Values = append(leaf.Values, uint64(i))
+		}
+		_, err := leaf.Serialize()
+		assert.Nil(t, err)
+
+		leaf.Keys = append(leaf.Keys, make([]byte, keySize))
+		leaf.Values = append(leaf.Values, 0)
+		_, err = leaf.Serialize()
+		assert.True(t, page.IsBTreePageOverflow(err))
+
+		internal := page.NewBTreePage(0, page.InternalPage, keySize)
+		internal.Children = append(internal.Children, 0)
+		for i := 0; i < maxInternalKeys; i++ {
+			internal.Keys = append(internal.Keys, make([]byte, keySize))
+			internal.Children = append(internal.Children, common.PageID_t(i+1))
+		}
+		_, err = internal.Serialize()
+		assert.Nil(t, err)
+
+		internal.Keys = append(internal.Keys, make([]byte, keySize))
+		internal.Children = append(internal.Children, 0)
+		_, err = internal.Serialize()
+		assert.True(t, page.IsBTreePageOverflow(err))
+	}
+}
+
+func TestBTreePageRejectsBadKeys(t *testing.T) {
+	leaf := page.NewBTreePage(0, page.LeafPage, 4)
+	leaf.Keys = [][]byte{key(1), {1, 2}}
+	leaf.Values = []uint64{1, 2}
+	_, err := leaf.Serialize()
+	assert.NotNil(t, err)
+
+	_, err = page.NewBTreePage(0, page.LeafPage, page.BTREE_MAX_KEY_SIZE+1).Serialize()
+	assert.NotNil(t, err)
+}
+
+func TestBTreePageRejectsUnknownVersion(t *testing.T) {
+	// A zeroed page was never written as a B+ tree node
+	_, err := page.BTreePageFromRawData(make([]byte, common.ElenaPageSize))
+	assert.NotNil(t, err)
+}
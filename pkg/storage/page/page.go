@@ -14,7 +14,10 @@ type Page struct {
 	PinCount atomic.Int32 // number of workers que usan la page. WHEN DO U PIN? when a worker thread is using it during a query
 	IsDirty  bool
 	Data     []byte
-	Latch    sync.RWMutex // TODO: implement read and write guards for pages
+	Latch    sync.RWMutex // taken through the page guards of the buffer pool (see buffer/page_guard.go)
+	// LSN of the last logged change to the page while it's in memory. The log has to be on
+	// disk up to it before the page is written (see recovery.LogManager)
+	LSN common.LSN_t
 }
 
 func NewPage(pageId common.PageID_t, pinCount int32) *Page {
@@ -24,6 +27,7 @@ func NewPage(pageId common.PageID_t, pinCount int32) *Page {
 		IsDirty:  false,
 		Data:     make([]byte, common.ElenaPageSize),
 		Latch:    sync.RWMutex{},
+		LSN:      common.InvalidLSN,
 	}
 	p.PinCount.Store(pinCount)
 	return p
@@ -36,6 +40,7 @@ func NewPageWithData(pageId common.PageID_t, data []byte, pinCount int32) *Page
 		IsDirty:  false,
 		Data:     data,
 		Latch:    sync.RWMutex{},
+		LSN:      common.InvalidLSN,
 	}
 	p.PinCount.Store(pinCount)
 	return p
@@ -48,4 +53,5 @@ func (p *Page) ResetMemory() {
 	p.Data = make([]byte, common.ElenaPageSize)
 	p.IsDirty = false
 	p.PinCount.Store(0)
+	p.LSN = common.InvalidLSN
 }
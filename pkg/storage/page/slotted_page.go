@@ -11,18 +11,19 @@ import (
 
 // A table is made up of Data Pages, which is a combination of HEADER, SLOTS and INSERTED TUPLES
 // -------------------------------------------------------------------
-// |  HEADER (8 bytes)  |  SLOTS  |  ..........  |  INSERTED TUPLES  |
+// |  HEADER (16 bytes) |  SLOTS  |  ..........  |  INSERTED TUPLES  |
 // -------------------------------------------------------------------
 //                                               ^
 // ________________ LastUsedOffset ______________|
 //
 
-const SLOTTED_PAGE_HEADER_SIZE = 12
+const SLOTTED_PAGE_HEADER_SIZE = 16
 const SLOT_SIZE = 4
 
 // Page header format:
 // -------------------------------------------------------------------------
 // | NumTuples(2) | NumDeletedTuples(2) | FreeSpace(2) | LastUsedOffset(2) |
+// | LastInsertedId(4) | PageLSN(4) |
 // -------------------------------------------------------------------------
 type SlottedPageHeader struct {
 	NumTuples      uint16              // 2 bytes
@@ -30,6 +31,7 @@ type SlottedPageHeader struct {
 	FreeSpace      uint16              // 2 bytes
 	LastUsedOffset common.SlotOffset_t // 2 bytes
 	LastInsertedId int32               // 4 bytes
+	PageLSN        common.LSN_t        // 4 bytes, LSN of the last change written to the page
 }
 
 // Just a wrapper type for Pages
@@ -123,26 +125,99 @@ func (sp *SlottedPage) SetLastInsertedId(lastInsertedId int32) {
 	copy(sp.PageData[8:], (*(*[4]byte)(unsafe.Pointer(&lastInsertedId)))[:])
 }
 
+func (sp *SlottedPage) SetPageLSN(lsn common.LSN_t) {
+	sp.Header.PageLSN = lsn
+	copy(sp.PageData[12:], (*(*[4]byte)(unsafe.Pointer(&lsn)))[:])
+}
+
+// Whether the page can take a tuple of this size, compacting it if needed. A new slot is only
+// needed if there's no deleted one to reuse.
 func (sp *SlottedPage) HasSpaceForThisTupleSize(size uint16) bool {
-	return sp.Header.FreeSpace >= size+SLOT_SIZE
+	return sp.FreeBytes() >= spaceNeededFor(size, sp.GetSlotsArray())
 }
 
-func (sp *SlottedPage) AppendTuple(t *tuple.Tuple) error {
-	if sp.Header.FreeSpace < t.Size {
-		return NoSpaceLeft{
-			FreeSpace: sp.Header.FreeSpace,
-			TupleSize: t.Size,
-		}
+// Free bytes of the page, counting the ones left behind by deleted (or shrunk) tuples. Those
+// are only usable after compacting the page, AppendTuple does it when it needs them.
+func (sp *SlottedPage) FreeBytes() uint16 {
+	usedBytes := uint16(common.ElenaPageSize-SLOTTED_PAGE_HEADER_SIZE) - uint16(sp.Header.LastUsedOffset)
+	for _, s := range sp.GetSlotsArray() {
+		usedBytes -= s.Length
 	}
+	return sp.Header.FreeSpace + usedBytes
+}
 
+// Stores the tuple in the page and returns its slot. The slot of a deleted tuple is reused if
+// there's one. If the free space is scattered between the tuples, the page is compacted first.
+func (sp *SlottedPage) AppendTuple(t *tuple.Tuple) (common.SlotNumber_t, error) {
 	slots := sp.GetSlotsArray()
-	slots = append(slots, SlotData{
+	needed := spaceNeededFor(t.Size, slots)
+	if sp.Header.FreeSpace < needed {
+		if sp.FreeBytes() < needed {
+			return 0, NoSpaceLeft{
+				FreeSpace: sp.FreeBytes(),
+				TupleSize: t.Size,
+			}
+		}
+		sp.Compact()
+		slots = sp.GetSlotsArray()
+	}
+
+	slot := firstDeletedSlot(slots)
+	newSlot := SlotData{
 		Offset: sp.Header.LastUsedOffset - common.SlotOffset_t(t.Size),
 		Length: t.Size,
-	})
+	}
+	if int(slot) < len(slots) {
+		slots[slot] = newSlot
+	} else {
+		slots = append(slots, newSlot)
+	}
 	sp.SetSlotsArray(slots)
 	copy(sp.PageData[SLOTTED_PAGE_HEADER_SIZE+int(sp.Header.LastUsedOffset):], t.AsRawData())
-	return nil
+	return slot, nil
+}
+
+// Compact moves the tuples together to the end of the page, so the bytes of deleted (or shrunk)
+// tuples join the free space. Tuples keep their slots, so their RIDs don't change. Slots of
+// deleted tuples are kept too, AppendTuple reuses them.
+func (sp *SlottedPage) Compact() {
+	slots := sp.GetSlotsArray()
+	// Tuples can move over each other, so they are copied from the page as it was
+	oldData := bytes.Clone(sp.PageData)
+
+	offset := common.SlotOffset_t(common.ElenaPageSize - SLOTTED_PAGE_HEADER_SIZE)
+	for i := range slots {
+		if slots[i].IsDeleted() {
+			slots[i].Offset = 0
+			continue
+		}
+		offset -= common.SlotOffset_t(slots[i].Length)
+		oldStart := SLOTTED_PAGE_HEADER_SIZE + int(slots[i].Offset)
+		copy(
+			sp.PageData[SLOTTED_PAGE_HEADER_SIZE+int(offset):],
+			oldData[oldStart:oldStart+int(slots[i].Length)],
+		)
+		slots[i].Offset = offset
+	}
+	sp.SetSlotsArray(slots)
+}
+
+// Bytes a tuple of this size takes, with its slot if it can't reuse one
+func spaceNeededFor(size uint16, slots []SlotData) uint16 {
+	if int(firstDeletedSlot(slots)) < len(slots) {
+		return size
+	}
+	return size + SLOT_SIZE
+}
+
+// Returns the first slot of a deleted tuple, or len(slots) if there's none
+func firstDeletedSlot(slots []SlotData) common.SlotNumber_t {
+	for i := range slots {
+		if slots[i].IsDeleted() {
+			return common.SlotNumber_t(i)
+		}
+	}
+	return common.SlotNumber_t(len(slots))
 }
 
 func (sp *SlottedPage) GetSlotsArray() []SlotData {
@@ -206,6 +281,74 @@ func (sp *SlottedPage) DeleteTuple(slot common.SlotNumber_t) bool {
 	return false
 }
 
+// Overwrites the tuple stored at the given slot. The new tuple is written in place, so it
+// must fit in the bytes the slot already owns; the leftover bytes (if any) are just lost.
+// Returns NoSpaceLeft if the new tuple is bigger than the old one, so the caller can
+// delete it and append it somewhere else.
+func (sp *SlottedPage) UpdateTuple(slot common.SlotNumber_t, t *tuple.Tuple) error {
+	slots := sp.GetSlotsArray()
+	if int(slot) >= len(slots) || slots[slot].IsDeleted() {
+		return fmt.Errorf("slot %d does not hold a tuple", slot)
+	}
+
+	if t.Size > slots[slot].Length {
+		return NoSpaceLeft{
+			FreeSpace: slots[slot].Length,
+			TupleSize: t.Size,
+		}
+	}
+
+	slots[slot].Length = t.Size
+	sp.SetSlotsArray(slots)
+	copy(sp.PageData[SLOTTED_PAGE_HEADER_SIZE+int(slots[slot].Offset):], t.AsRawData())
+	return nil
+}
+
+// Returns the bytes of the tuple stored at the given slot, nil if the slot has no tuple
+func (sp *SlottedPage) RawTuple(slot common.SlotNumber_t) []byte {
+	slots := sp.GetSlotsArray()
+	if int(slot) >= len(slots) || slots[slot].IsDeleted() {
+		return nil
+	}
+	start := SLOTTED_PAGE_HEADER_SIZE + int(slots[slot].Offset)
+	return bytes.Clone(sp.PageData[start : start+int(slots[slot].Length)])
+}
+
+// Puts the bytes of a tuple back in the given slot, replacing whatever tuple it has. Used to
+// undo a delete or an update, so the slot must exist. The page is compacted if the bytes only
+// fit that way.
+func (sp *SlottedPage) RestoreTuple(slot common.SlotNumber_t, data []byte) error {
+	slots := sp.GetSlotsArray()
+	if int(slot) >= len(slots) {
+		return fmt.Errorf("slot %d does not exist", slot)
+	}
+	size := uint16(len(data))
+	// The bytes of the tuple being replaced are free too
+	if sp.FreeBytes()+slots[slot].Length < size {
+		return NoSpaceLeft{
+			FreeSpace: sp.FreeBytes() + slots[slot].Length,
+			TupleSize: size,
+		}
+	}
+	if !slots[slot].IsDeleted() {
+		slots[slot].Length = 0
+		sp.SetSlotsArray(slots)
+	}
+
+	if sp.Header.FreeSpace < size {
+		sp.Compact()
+		slots = sp.GetSlotsArray()
+	}
+
+	slots[slot] = SlotData{
+		Offset: sp.Header.LastUsedOffset - common.SlotOffset_t(size),
+		Length: size,
+	}
+	sp.SetSlotsArray(slots)
+	copy(sp.PageData[SLOTTED_PAGE_HEADER_SIZE+int(sp.Header.LastUsedOffset):], data)
+	return nil
+}
+
 func (sp *SlottedPage) MostRecentTuple() *tuple.Tuple {
 	slots := sp.GetSlotsArray()
 	if len(slots) == 0 {
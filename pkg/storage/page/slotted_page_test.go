@@ -61,7 +61,8 @@ func TestSlottedPages(t *testing.T) {
 		column.NewColumn(value.TypeFloat32, "some_float"),
 		column.NewSizedColumn(value.TypeVarChar, "some_varchar", 6),
 	})
-	assert.Nil(t, sp.AppendTuple(tpl2))
+	_, err := sp.AppendTuple(tpl2)
+	assert.Nil(t, err)
 
 	// Check if tuple 0 is still valid!
 	assert.Equal(t, tpl, sp.ReadTuple(sch, 0))
@@ -92,7 +93,7 @@ func TestSlottedPageFlooding(t *testing.T) {
 
 	// Simulate pushing 10000 tuples
 	for i := uint16(0); i < 1000; i++ {
-		err := sp.AppendTuple(tpl)
+		_, err := sp.AppendTuple(tpl)
 		expectedFreeSize, safe := utils.SafeSubtractUint16(
 			common.ElenaPageSize,
 			page.SLOTTED_PAGE_HEADER_SIZE+(i+1)*appendedTupleSize,
@@ -123,3 +124,143 @@ func TestSlottedPageFlooding(t *testing.T) {
 	// Deleting all tuples shouldn't free any space
 	assert.Equal(t, sp.Header.FreeSpace, freeSpaceWhenFulled)
 }
+
+func TestSlottedPageFreeBytes(t *testing.T) {
+	tpl := tuple.NewFromValues([]value.Value{
+		*value.NewInt32Value(69),
+		*value.NewVarCharValue("elena", 5),
+	})
+	sp := page.NewSelfContainedSlottedPage()
+	assert.Equal(t, sp.Header.FreeSpace, sp.FreeBytes())
+
+	for i := 0; i < 3; i++ {
+		_, err := sp.AppendTuple(tpl)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, sp.Header.FreeSpace, sp.FreeBytes())
+	freeSpace := sp.Header.FreeSpace
+
+	// The bytes of a deleted tuple are free, but not in one piece with the rest
+	sp.DeleteTuple(1)
+	assert.Equal(t, freeSpace, sp.Header.FreeSpace)
+	assert.Equal(t, freeSpace+tpl.Size, sp.FreeBytes())
+
+	// The same goes for the bytes a tuple doesn't use anymore after shrinking
+	shorter := tuple.NewFromValues([]value.Value{
+		*value.NewInt32Value(69),
+		*value.NewVarCharValue("ele", 5),
+	})
+	assert.Nil(t, sp.UpdateTuple(0, shorter))
+	assert.Equal(t, freeSpace+tpl.Size+tpl.Size-shorter.Size, sp.FreeBytes())
+}
+
+func TestSlottedPageCompaction(t *testing.T) {
+	sch := schema.NewSchema([]column.Column{
+		column.NewColumn(value.TypeInt32, "some_int"),
+		column.NewSizedColumn(value.TypeVarChar, "some_varchar", 100),
+	})
+	newTuple := func(i int32, text string) *tuple.Tuple {
+		return tuple.NewFromValues([]value.Value{
+			*value.NewInt32Value(i),
+			*value.NewVarCharValue(text, 100),
+		})
+	}
+
+	sp := page.NewSelfContainedSlottedPage()
+	tuples := []*tuple.Tuple{}
+	for i := int32(0); ; i++ {
+		tpl := newTuple(i, "elena")
+		if !sp.HasSpaceForThisTupleSize(tpl.Size) {
+			break
+		}
+		slot, err := sp.AppendTuple(tpl)
+		assert.Nil(t, err)
+		assert.Equal(t, common.SlotNumber_t(i), slot)
+		tuples = append(tuples, tpl)
+	}
+	_, err := sp.AppendTuple(newTuple(0, "elena"))
+	assert.True(t, page.IsNoSpaceLeft(err))
+
+	// Scenario: compacting moves the live tuples together, without changing their slots
+	sp.DeleteTuple(1)
+	sp.DeleteTuple(3)
+	assert.Nil(t, sp.UpdateTuple(4, newTuple(4, "e")))
+	tuples[4] = newTuple(4, "e")
+	freeBytes := sp.FreeBytes()
+	sp.Compact()
+	assert.Equal(t, freeBytes, sp.Header.FreeSpace)
+	assert.Equal(t, freeBytes, sp.FreeBytes())
+	assert.Equal(t, uint16(2), sp.Header.NumDeleted)
+	for i, tpl := range tuples {
+		if i == 1 || i == 3 {
+			assert.Nil(t, sp.ReadTuple(sch, common.SlotNumber_t(i)))
+		} else {
+			assert.Equal(t, tpl, sp.ReadTuple(sch, common.SlotNumber_t(i)))
+		}
+	}
+
+	// Scenario: new tuples take the slots of the deleted ones first
+	slot, err := sp.AppendTuple(newTuple(100, "reused"))
+	assert.Nil(t, err)
+	assert.Equal(t, common.SlotNumber_t(1), slot)
+	assert.Equal(t, newTuple(100, "reused"), sp.ReadTuple(sch, 1))
+
+	// Scenario: a full page with a deleted tuple is compacted when a tuple needs its bytes
+	sp = page.NewSelfContainedSlottedPage()
+	for sp.HasSpaceForThisTupleSize(newTuple(0, "elena").Size) {
+		_, err := sp.AppendTuple(newTuple(0, "elena"))
+		assert.Nil(t, err)
+	}
+	sp.DeleteTuple(0)
+	sp.DeleteTuple(1)
+	bigger := newTuple(1, "elena elena")
+	assert.True(t, sp.HasSpaceForThisTupleSize(bigger.Size))
+	slot, err = sp.AppendTuple(bigger)
+	assert.Nil(t, err)
+	assert.Equal(t, common.SlotNumber_t(0), slot)
+	assert.Equal(t, bigger, sp.ReadTuple(sch, 0))
+	assert.Nil(t, sp.ReadTuple(sch, 1))
+	assert.Equal(t, newTuple(0, "elena"), sp.ReadTuple(sch, 2))
+}
+
+func TestSlottedPageRestoreTuple(t *testing.T) {
+	sch := schema.NewSchema([]column.Column{
+		column.NewColumn(value.TypeInt32, "some_int"),
+		column.NewSizedColumn(value.TypeVarChar, "some_varchar", 100),
+	})
+	newTuple := func(i int32, text string) *tuple.Tuple {
+		return tuple.NewFromValues([]value.Value{
+			*value.NewInt32Value(i),
+			*value.NewVarCharValue(text, 100),
+		})
+	}
+
+	sp := page.NewSelfContainedSlottedPage()
+	for sp.HasSpaceForThisTupleSize(newTuple(0, "elena").Size) {
+		_, err := sp.AppendTuple(newTuple(0, "elena"))
+		assert.Nil(t, err)
+	}
+
+	// Scenario: a deleted tuple comes back to its slot
+	old := sp.RawTuple(2)
+	sp.DeleteTuple(2)
+	assert.Nil(t, sp.RawTuple(2))
+	assert.Nil(t, sp.RestoreTuple(2, old))
+	assert.Equal(t, newTuple(0, "elena"), sp.ReadTuple(sch, 2))
+	assert.Equal(t, uint16(0), sp.Header.NumDeleted)
+
+	// Scenario: an updated tuple gets its old bytes back, even if they are bigger. The full
+	// page is compacted to make room with the bytes the update left behind.
+	old = sp.RawTuple(5)
+	assert.Nil(t, sp.UpdateTuple(5, newTuple(5, "e")))
+	assert.Nil(t, sp.RestoreTuple(5, old))
+	assert.Equal(t, newTuple(0, "elena"), sp.ReadTuple(sch, 5))
+	for i := 0; i < int(sp.GetNSlots()); i++ {
+		assert.Equal(t, newTuple(0, "elena"), sp.ReadTuple(sch, common.SlotNumber_t(i)))
+	}
+
+	// Scenario: there's no room for the old tuple
+	assert.True(t, page.IsNoSpaceLeft(sp.RestoreTuple(0, make([]byte, 200))))
+	assert.Equal(t, newTuple(0, "elena"), sp.ReadTuple(sch, 0))
+	assert.NotNil(t, sp.RestoreTuple(common.SlotNumber_t(sp.GetNSlots()), old))
+}
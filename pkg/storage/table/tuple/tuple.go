@@ -32,16 +32,26 @@ func New(values []value.Value, RowId common.RID) *Tuple {
 }
 
 // FLAG_ALGORITMO: data serialization
+// Tuples are encoded as: [null bitmap][values], where the bitmap has a bit per column (the
+// first column is the lowest bit of the first byte) and NULLs take no bytes in the values
 func (t *Tuple) AsRawData() []byte {
 	bytesitos := make([]byte, t.Size)
-	offset := 0
-	for _, val := range t.Values {
+	offset := nullBitmapSize(len(t.Values))
+	for idx, val := range t.Values {
+		if val.IsNull() {
+			bytesitos[idx/8] |= 1 << (idx % 8)
+			continue
+		}
 		copy(bytesitos[offset:], val.Data)
 		offset += len(val.Data)
 	}
 	return bytesitos
 }
 
+func nullBitmapSize(columns int) int {
+	return (columns + 7) / 8
+}
+
 func NewFromValues(values []value.Value) *Tuple {
 	return &Tuple{
 		Values: values,
@@ -52,9 +62,15 @@ func NewFromValues(values []value.Value) *Tuple {
 
 func NewFromRawData(schema *schema.Schema, reader *bytes.Reader) *Tuple {
 	values := make([]value.Value, schema.GetColumnCount())
+	nulls := make([]byte, nullBitmapSize(len(values)))
+	debugutils.NotErr(reader.Read(nulls))
 
 	for idx, col := range schema.GetColumns() {
 		var val value.Value
+		if nulls[idx/8]&(1<<(idx%8)) != 0 {
+			values[idx] = *value.NewNullValue(col.ColumnType)
+			continue
+		}
 		switch col.ColumnType {
 		case value.TypeBoolean:
 			b := make([]byte, 1)
@@ -100,7 +116,7 @@ func Empty() *Tuple {
 }
 
 func calculateValuesSize(values []value.Value) uint16 {
-	s := uint16(0)
+	s := uint16(nullBitmapSize(len(values)))
 	for _, v := range values {
 		s += uint16(len(v.Data))
 	}
@@ -117,14 +133,16 @@ func (t *Tuple) PrintAsRow(rowSchema *schema.Schema) {
 		var formattedValue string
 
 		// TODO: scape characters?
-		switch val.Type {
-		case value.TypeInt32:
+		switch {
+		case val.IsNull():
+			formattedValue = val.FormatAsString()
+		case val.Type == value.TypeInt32:
 			formattedValue = fmt.Sprintf("%d", val.AsInt32())
-		case value.TypeFloat32:
+		case val.Type == value.TypeFloat32:
 			formattedValue = fmt.Sprintf("%f", val.AsFloat32())
-		case value.TypeVarChar:
+		case val.Type == value.TypeVarChar:
 			formattedValue = val.AsVarchar()
-		case value.TypeBoolean:
+		case val.Type == value.TypeBoolean:
 			formattedValue = fmt.Sprintf("%t", val.AsBoolean())
 		default:
 			panic(fmt.Sprintf("Unknown type: '%s'", string(val.Type)))
@@ -179,6 +197,7 @@ func (t *Tuple) PrintAsRow(rowSchema *schema.Schema) {
 	}
 }
 
-func (t *Tuple) IsNull() bool {
-	return false
+// Whether the value of the column is NULL
+func (t *Tuple) IsNull(idx int) bool {
+	return t.Values[idx].IsNull()
 }
@@ -1,13 +1,26 @@
 package tuple
 
+import "fisi/elenadb/pkg/common"
+
+// TupleMeta says who wrote a version of a tuple, so a transaction can tell if it's in its
+// snapshot (see concurrency.VersionStore). Versions are only kept in memory, the heap pages
+// don't store it.
 type TupleMeta struct {
-	timestamp int64
-	isDeleted bool
+	// Commit timestamp of the transaction that wrote the version. While that transaction is
+	// running it's its id instead, and ids are never below common.TXNStartID
+	Timestamp common.Timestamp_t
+	// The version is the tuple being deleted (or not inserted yet)
+	IsDeleted bool
 }
 
 func EmptyTupleMeta() *TupleMeta {
 	return &TupleMeta{
-		timestamp: -1,
-		isDeleted: false,
+		Timestamp: 0,
+		IsDeleted: false,
 	}
 }
+
+// Whether the transaction that wrote the version is still running
+func (meta *TupleMeta) IsUncommitted() bool {
+	return meta.Timestamp >= common.Timestamp_t(common.TXNStartID)
+}
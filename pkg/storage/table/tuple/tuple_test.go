@@ -8,6 +8,7 @@ import (
 	"fisi/elenadb/pkg/common"
 	"fisi/elenadb/pkg/storage/table/tuple"
 	"fisi/elenadb/pkg/storage/table/value"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -46,27 +47,30 @@ func TestTupleAsRawData(t *testing.T) {
 
 	rawData := tp.AsRawData()
 
-	assert.Equal(t, 1+4+1+5+1+10, len(rawData))
+	assert.Equal(t, 1+1+4+1+5+1+10, len(rawData))
+
+	// check for the null bitmap, no column is null
+	assert.Equal(t, byte(0), rawData[0])
 
 	// check for the boolean
-	assert.Equal(t, byte(1), rawData[0])
+	assert.Equal(t, byte(1), rawData[1])
 
 	// check for the integer
-	decodedI32 := int32(binary.LittleEndian.Uint32(rawData[1:5]))
+	decodedI32 := int32(binary.LittleEndian.Uint32(rawData[2:6]))
 	assert.Equal(t, int32(69), decodedI32)
 
 	// check for the string
-	decodedString := string(rawData[6:11])
+	decodedString := string(rawData[7:12])
 	assert.Equal(t, "elena", decodedString)
 
 	// check for the varchar length
-	assert.Equal(t, byte(5), rawData[5])
+	assert.Equal(t, byte(5), rawData[6])
 
 	// check for the second varchar length
-	assert.Equal(t, byte(10), rawData[11])
+	assert.Equal(t, byte(10), rawData[12])
 
 	// check for the second varchar
-	decodedString2 := string(rawData[1+4+1+5+1:])
+	decodedString2 := string(rawData[1+1+4+1+5+1:])
 	assert.Equal(t, "elena_over", decodedString2)
 }
 
@@ -94,7 +98,36 @@ func TestTupleRawDataParsingUsingSchemas(t *testing.T) {
 	assert.Equal(t, tp.Size, tp2.Size)
 	assert.Equal(t, tp.RowId, tp2.RowId) // both invalid
 	assert.Equal(t, tp.AsRawData(), tp2.AsRawData())
-	assert.Equal(t, tp.IsNull(), tp2.IsNull())
+	assert.Equal(t, tp.IsNull(0), tp2.IsNull(0))
+	assert.Equal(t, tp.Values, tp2.Values)
 	assert.Equal(t, tp.Values, tp2.Values)
+}
+
+func TestTupleNullBitmap(t *testing.T) {
+	columns := make([]column.Column, 0, 9)
+	values := make([]value.Value, 0, 9)
+	for i := 0; i < 9; i++ {
+		columns = append(columns, column.NewColumn(value.TypeInt32, fmt.Sprintf("col_%d", i)))
+		if i == 1 || i == 8 {
+			values = append(values, *value.NewNullValue(value.TypeInt32))
+		} else {
+			values = append(values, *value.NewInt32Value(int32(i)))
+		}
+	}
+	tp := tuple.NewFromValues(values)
+
+	// NULLs only take their bit, and 9 columns need 2 bytes of bitmap
+	rawData := tp.AsRawData()
+	assert.Equal(t, 2+7*4, len(rawData))
+	assert.Equal(t, []byte{0b10, 0b1}, rawData[:2])
+	assert.Equal(t, int32(0), int32(binary.LittleEndian.Uint32(rawData[2:6])))
+	assert.Equal(t, int32(2), int32(binary.LittleEndian.Uint32(rawData[6:10])))
+
+	tp2 := tuple.NewFromRawData(schema.NewSchema(columns), bytes.NewReader(rawData))
+	assert.Equal(t, tp.Size, tp2.Size)
 	assert.Equal(t, tp.Values, tp2.Values)
+	assert.True(t, tp2.IsNull(1))
+	assert.True(t, tp2.IsNull(8))
+	assert.False(t, tp2.IsNull(0))
+	assert.Equal(t, "nulo", tp2.Values[8].FormatAsString())
 }
@@ -0,0 +1,49 @@
+package value
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Compare orders two values of the same type: -1 if a < b, 0 if they are equal and 1 if
+// a > b. Varchars are compared byte by byte (like Go strings) and false goes before true.
+// NULLs go before everything else and are equal to each other, so they can be sorted and
+// indexed. Filters don't use this for NULLs, for them a comparison with NULL is unknown.
+func Compare(a, b *Value) int {
+	if a.Type != b.Type {
+		panic(fmt.Sprintf("unreachable: comparing a %s with a %s", a.Type, b.Type))
+	}
+	if a.Null || b.Null {
+		return compareOrdered(nullRank(a), nullRank(b))
+	}
+
+	switch a.Type {
+	case TypeInt32:
+		return compareOrdered(a.AsInt32(), b.AsInt32())
+	case TypeFloat32:
+		return compareOrdered(a.AsFloat32(), b.AsFloat32())
+	case TypeVarChar:
+		return bytes.Compare(a.Data[1:a.Data[0]+1], b.Data[1:b.Data[0]+1])
+	case TypeBoolean:
+		return compareOrdered(a.Data[0], b.Data[0])
+	default:
+		panic("unreachable: unknown type")
+	}
+}
+
+func nullRank(v *Value) uint8 {
+	if v.Null {
+		return 0
+	}
+	return 1
+}
+
+func compareOrdered[T int32 | float32 | uint8](a, b T) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
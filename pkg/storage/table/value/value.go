@@ -20,6 +20,8 @@ const (
 type Value struct {
 	Type ValueType
 	Data []byte
+	// SQL NULL: the value has a type but no data, it's stored in the null bitmap of the tuple
+	Null bool
 }
 
 func NewValueTypeFromUserType(typeName string) ValueType {
@@ -96,6 +98,15 @@ func NewBooleanValue(data bool) *Value {
 }
 
 
+// A NULL of the type, printed as "nulo"
+func NewNullValue(type_id ValueType) *Value {
+	return &Value{
+		Type: type_id,
+		Data: nil,
+		Null: true,
+	}
+}
+
 // varchars are encoded as: [len(u8)][data(len)]
 func NewVarCharValue(data string, maxBytes int) *Value {
 	if maxBytes > 255 {
@@ -109,6 +120,10 @@ func NewVarCharValue(data string, maxBytes int) *Value {
 	return NewValue(TypeVarChar, buf)
 }
 
+func (v *Value) IsNull() bool {
+	return v.Null
+}
+
 func (v *ValueType) AsString() string {
 	return string(*v)
 }
@@ -134,6 +149,9 @@ func (v *Value) SizeOnDisk() uint16 {
 }
 
 func (v *Value) FormatAsString() string {
+	if v.Null {
+		return "nulo"
+	}
 	switch v.Type {
 	case TypeBoolean:
 		return strconv.FormatBool(v.AsBoolean())